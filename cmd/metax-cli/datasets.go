@@ -66,7 +66,10 @@ func runDatasets(url string, args []string) error {
 	fmt.Println("querying metax datasets endpoint")
 	svc := metax.NewMetaxService(METAX_HOST, metax.WithCredentials(os.Getenv("APP_METAX_API_USER"), os.Getenv("APP_METAX_API_PASS")))
 	// 053bffbcc41edad4853bea91fc42ea18
-	response, err := svc.Datasets(metax.WithOwner(owner.String()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	response, err := svc.Datasets(ctx, metax.WithOwner(owner.String()))
 	if err != nil {
 		return err
 	}
@@ -84,7 +87,7 @@ func runDatasets(url string, args []string) error {
 		}
 	}
 
-	streamResponse, err := svc.ReadStream(metax.WithOwner(owner.String()))
+	streamResponse, err := svc.ReadStream(ctx, metax.WithOwner(owner.String()))
 	if err != nil {
 		return err
 	}
@@ -101,9 +104,6 @@ func runDatasets(url string, args []string) error {
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
 	total, c, errc, err := svc.ReadStreamChannel(ctx, metax.WithOwner(owner.String()))
 	if err != nil {
 		return err
@@ -1,7 +1,7 @@
 package main
 
 import (
-	//"context"
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -67,15 +67,16 @@ func runFetch(url string, args []string) error {
 	if err != nil {
 		return err
 	}
-	//fmt.Println(db.Version())
+	ctx := context.Background()
+	//fmt.Println(db.Version(ctx))
 
 	if identity != "" && !owner.IsSet() {
-		uid, err = db.GetUidForIdentity(service, identity)
+		uid, err = db.GetUidForIdentity(ctx, service, identity)
 		if err != nil {
 			return err
 		}
 	} else if identity == "" && owner.IsSet() {
-		identity, err = db.GetIdentityForUid(service, owner.Get())
+		identity, err = db.GetIdentityForUid(ctx, service, owner.Get())
 		if err != nil {
 			return err
 		}
@@ -85,7 +86,7 @@ func runFetch(url string, args []string) error {
 
 	api := metax.NewMetaxService(METAX_HOST, metax.WithCredentials(os.Getenv("APP_METAX_API_USER"), os.Getenv("APP_METAX_API_PASS")))
 
-	err = shared.FetchSince(api, db, Logger, uid, identity, sinceHeader)
+	err = shared.FetchSince(ctx, api, db, Logger, uid, identity, sinceHeader)
 	if err != nil {
 		return err
 	}
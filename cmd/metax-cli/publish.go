@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -72,7 +73,7 @@ func runPublish(url string, args []string) error {
 		Projects: projects,
 		Identity: userIdentity,
 	}
-	vId, nId, qId, err := shared.Publish(api, db, id, owner)
+	vId, nId, qId, err := shared.Publish(context.Background(), api, db, id, owner)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "type: %T\n", err)
 		if apiErr, ok := err.(*metax.ApiError); ok {
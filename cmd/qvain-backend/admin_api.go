@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/internal/shared"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+
+	"github.com/francoispqt/gojay"
+	"github.com/rs/zerolog"
+	"github.com/wvh/uuid"
+)
+
+// AdminApi provides administrative operations such as importing the datasets of an organisation from Metax.
+type AdminApi struct {
+	db       *psql.DB
+	metax    *metax.MetaxService
+	logger   zerolog.Logger
+	identity string
+	apiKey   string
+
+	// state of the running or last import; only one import runs at a time
+	mu        sync.Mutex
+	importing bool
+	org       string
+	project   string
+	outcome   *psql.SyncOutcome
+}
+
+// NewAdminApi creates a new AdminApi.
+func NewAdminApi(db *psql.DB, metax *metax.MetaxService, logger zerolog.Logger, apiKey string) *AdminApi {
+	return &AdminApi{
+		db:       db,
+		metax:    metax,
+		logger:   logger,
+		identity: DefaultIdentity,
+		apiKey:   apiKey,
+	}
+}
+
+func (api *AdminApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if api.apiKey == "" {
+		loggedJSONError(w, http.StatusText(http.StatusForbidden), http.StatusForbidden, &api.logger).Msg("missing api key")
+		return
+	}
+
+	key := r.Header.Get("x-api-key")
+	if key != api.apiKey {
+		loggedJSONError(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized, &api.logger).Msg("invalid api key")
+		return
+	}
+
+	head := ShiftUrlWithTrailing(r)
+	api.logger.Debug().Str("head", head).Str("path", r.URL.Path).Str("method", r.Method).Msg("admin")
+
+	if head == "sync" {
+		switch r.Method {
+		case http.MethodGet:
+			api.importStatus(w, r)
+		case http.MethodPost:
+			api.startImport(w, r)
+		case http.MethodOptions:
+			apiWriteOptions(w, "GET, POST, OPTIONS")
+		default:
+			loggedJSONError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed, &api.logger).Str("head", head).Str("path", r.URL.Path).Str("method", r.Method).Msg("admin")
+		}
+		return
+	}
+
+	loggedJSONError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound, &api.logger).Msg("admin")
+}
+
+// startImport starts importing the datasets of an organisation or IDA project from Metax in the background.
+// New datasets are assigned owners from their editor metadata, the optional JSON object in the request body mapping
+// metadata provider users to Qvain uids, the users' identities, or the fallback owner given as query parameter.
+func (api *AdminApi) startImport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	org, project := query.Get("org"), query.Get("project")
+	if org == "" && project == "" {
+		loggedJSONError(w, "either org or project is required", http.StatusBadRequest, &api.logger).Msg("missing import parameter")
+		return
+	}
+
+	params := []metax.DatasetOption{metax.WithOrganisation(org), metax.WithProject(project)}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			loggedJSONError(w, "invalid since parameter", http.StatusBadRequest, &api.logger).Err(err).Msg("invalid import parameter")
+			return
+		}
+		params = append(params, metax.Since(t))
+	}
+
+	var fallback uuid.UUID
+	if owner := query.Get("owner"); owner != "" {
+		var err error
+		if fallback, err = uuid.FromString(owner); err != nil {
+			loggedJSONError(w, "invalid owner parameter", http.StatusBadRequest, &api.logger).Err(err).Msg("invalid import parameter")
+			return
+		}
+	}
+
+	var mapping map[string]uuid.UUID
+	if r.ContentLength != 0 {
+		var err error
+		if mapping, err = shared.ReadOwnerMapping(r.Body); err != nil {
+			loggedJSONError(w, "invalid owner mapping", http.StatusBadRequest, &api.logger).Err(err).Msg("invalid owner mapping")
+			return
+		}
+	}
+
+	api.mu.Lock()
+	if api.importing {
+		api.mu.Unlock()
+		loggedJSONError(w, "import already in progress", http.StatusConflict, &api.logger).Msg("import already in progress")
+		return
+	}
+	api.importing = true
+	api.org, api.project = org, project
+	api.outcome = nil
+	api.mu.Unlock()
+
+	go func() {
+		logger := api.logger.With().Str("org", org).Str("project", project).Logger()
+		mapper := shared.NewOwnerMapper(api.db, api.identity, mapping, fallback)
+		outcome, err := shared.Import(context.Background(), api.metax, api.db, logger, mapper.Owner, params...)
+		if err != nil {
+			logger.Warn().Err(err).Msg("import failed")
+		}
+
+		api.mu.Lock()
+		api.importing = false
+		api.outcome = outcome
+		api.mu.Unlock()
+	}()
+
+	apiWriteHeaders(w)
+	w.WriteHeader(http.StatusAccepted)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	enc.AddIntKey("status", http.StatusAccepted)
+	enc.AddStringKey("msg", "import started")
+	enc.AppendByte('}')
+	enc.Write()
+}
+
+// importStatus returns the state of the running or last import since the service started.
+func (api *AdminApi) importStatus(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	importing, org, project, outcome := api.importing, api.org, api.project, api.outcome
+	api.mu.Unlock()
+
+	if !importing && outcome == nil {
+		loggedJSONError(w, "no import has been run", http.StatusNotFound, &api.logger).Msg("no import")
+		return
+	}
+
+	apiWriteHeaders(w)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	enc.AddBoolKey("running", importing)
+	enc.AddStringKeyOmitEmpty("org", org)
+	enc.AddStringKeyOmitEmpty("project", project)
+	if outcome != nil {
+		enc.AddTimeKey("run", &outcome.Run, time.RFC3339)
+		enc.AddBoolKey("success", outcome.Success)
+		enc.AddIntKey("written", outcome.Written)
+		enc.AddIntKey("skipped", outcome.Skipped)
+		enc.AddIntKey("deleted", outcome.Deleted)
+		enc.AddIntKey("failed", outcome.Failed)
+		enc.AddIntKey("conflicts", outcome.Conflicts)
+		enc.AddSliceStringKey("errors", outcome.Errors)
+	}
+	enc.AppendByte('}')
+	enc.Write()
+}
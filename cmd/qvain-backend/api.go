@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"expvar"
 	"net/http"
+	"time"
 
+	"github.com/CSCfi/qvain-api/internal/refdata"
+	"github.com/CSCfi/qvain-api/internal/shared"
 	"github.com/CSCfi/qvain-api/pkg/metax"
 	"github.com/rs/zerolog"
 )
 
+// metaxNegotiateTimeout limits how long start-up waits for the Metax API version check.
+const metaxNegotiateTimeout = 10 * time.Second
+
 // Root configures a http.Handler for routing HTTP requests to the root URL.
-func Root(config *Config) http.Handler {
+// The returned stop function stops background services such as the sync scheduler; call it after the server has shut down.
+func Root(config *Config) (http.Handler, func()) {
 	apis := NewApis(config)
 	apiHandler := http.Handler(apis)
 	if config.LogRequests {
@@ -26,7 +34,7 @@ func Root(config *Config) http.Handler {
 		default:
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		}
-	})
+	}), apis.Stop
 }
 
 // Apis holds configured API endpoints.
@@ -40,6 +48,11 @@ type Apis struct {
 	proxy    *ApiProxy
 	lookup   *LookupApi
 	stats    *StatsApi
+	admin    *AdminApi
+	refdata  *RefdataApi
+
+	// stopSync stops the sync scheduler, if it's running
+	stopSync func()
 }
 
 // NewApis constructs a collection of APIs with a given configuration.
@@ -49,33 +62,103 @@ func NewApis(config *Config) *Apis {
 		logger: config.NewLogger("apis"),
 	}
 
-	metax := metax.NewMetaxService(config.MetaxApiHost,
+	metaxHost, metaxUrl := config.MetaxApiHost, "https://"+config.MetaxApiHost+"/rest/"
+	metaxVersion := metax.ApiV1
+	if config.metaxVersion == "2" {
+		metaxVersion = metax.ApiV2
+	}
+	metaxOptions := []metax.MetaxOption{
 		metax.WithCredentials(config.metaxApiUser, config.metaxApiPass),
-		metax.WithInsecureCertificates(config.DevMode))
+		metax.WithInsecureCertificates(config.DevMode),
+		metax.WithLogger(config.NewLogger("metax")),
+		metax.WithApiVersion(metaxVersion),
+	}
+
+	// in development mode, optionally use an in-memory fake Metax that only speaks API v1
+	fakeMetax := false
+	if config.DevMode && config.metaxFake {
+		host, url, options, err := startFakeMetax(config.metaxFakeSeed, apis.logger)
+		if err != nil {
+			apis.logger.Error().Err(err).Str("host", metaxHost).Msg("can't use fake Metax, using real one")
+		} else {
+			metaxHost, metaxUrl, fakeMetax = host, url, true
+			metaxOptions = append(metaxOptions, options...)
+		}
+	}
+
+	metaxService := metax.NewMetaxService(metaxHost, metaxOptions...)
+	if config.metaxVersion == "auto" && !fakeMetax {
+		ctx, cancel := context.WithTimeout(context.Background(), metaxNegotiateTimeout)
+		if _, err := metaxService.NegotiateVersion(ctx); err != nil {
+			apis.logger.Warn().Err(err).Msg("can't negotiate Metax API version, using v1")
+		}
+		cancel()
+	}
 
-	apis.datasets = NewDatasetApi(config.db, config.sessions, metax, config.NewLogger("datasets"))
+	var logoutRedirect string
+	if provider := config.defaultOidcProvider(); provider != nil {
+		logoutRedirect = provider.LogoutUrl()
+	}
+
+	apis.datasets = NewDatasetApi(config.db, config.sessions, metaxService, config.NewLogger("datasets"))
+	if config.metaxDrafts {
+		if metaxService.Version() == metax.ApiV2 {
+			apis.datasets.SetMetaxDrafts(true)
+		} else {
+			apis.logger.Warn().Msg("Metax drafts require Metax API v2, saving drafts locally only")
+		}
+	}
+	apis.auth = NewAuthApi(config, makeOnFairdataLogin(metaxService, config.db, config.NewLogger("sync")), config.NewLogger("auth"))
 	apis.sessions = NewSessionApi(
 		config.sessions,
 		config.NewLogger("sessions"),
-		config.oidcProviderUrl+config.oidcLogoutPath,
+		logoutRedirect,
+		apis.auth.LogoutUrl,
 	)
-	apis.auth = NewAuthApi(config, makeOnFairdataLogin(metax, config.db, config.NewLogger("sync")), config.NewLogger("auth"))
 	apis.proxy = NewApiProxy(
-		"https://"+config.MetaxApiHost+"/rest/",
+		metaxUrl,
 		config.metaxApiUser,
 		config.metaxApiPass,
 		config.sessions,
 		config.NewLogger("proxy"),
 		config.DevMode,
 	)
+	if config.syncInterval > 0 {
+		apis.stopSync = shared.NewSyncScheduler(metaxService, config.db, config.NewLogger("sync"), DefaultIdentity,
+			shared.WithSyncInterval(config.syncInterval),
+			shared.WithSyncWorkers(config.syncWorkers),
+			shared.WithSyncRate(config.syncRate),
+		).Start()
+	}
 	apis.lookup = NewLookupApi(config.db, config.NewLogger("lookup"), config.qvainLookupApiKey)
 	apis.stats = NewStatsApi(config.db, config.NewLogger("stats"), config.qvainStatsApiKey)
+	apis.admin = NewAdminApi(config.db, metaxService, config.NewLogger("admin"), config.qvainAdminApiKey)
+
+	var refdataCache *refdata.Cache
+	if config.refdataUrl != "" {
+		refdataCache = refdata.NewElasticCache(config.refdataUrl, config.NewLogger("refdata"))
+		refdataCache.Start(config.refdataRefresh)
+		apis.datasets.SetRefdata(refdataCache, config.refdataFillLabels)
+	}
+	apis.refdata = NewRefdataApi(refdataCache, config.NewLogger("refdata"))
 
 	return apis
 }
 
+// Stop stops background services; it waits for running syncs to finish.
+func (apis *Apis) Stop() {
+	if apis.stopSync != nil {
+		apis.stopSync()
+	}
+}
+
 // ServeHTTP is a http.Handler that delegates to the requested API endpoint.
+// The request context gets a deadline, so handlers stop working on requests the client can no longer receive.
 func (apis *Apis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), RequestTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
 	head := ShiftUrlWithTrailing(r)
 	apis.logger.Debug().Str("head", head).Str("path", r.URL.Path).Msg("apis")
 
@@ -98,6 +181,12 @@ func (apis *Apis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "stats/":
 		statsC.Add(1)
 		apis.stats.ServeHTTP(w, r)
+	case "admin/":
+		adminC.Add(1)
+		apis.admin.ServeHTTP(w, r)
+	case "refdata/":
+		refdataC.Add(1)
+		apis.refdata.ServeHTTP(w, r)
 	case "version":
 		versionC.Add(1)
 		ifGet(w, r, apiVersion)
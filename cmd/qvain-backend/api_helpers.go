@@ -159,6 +159,8 @@ func dbError(w http.ResponseWriter, err error, logger *zerolog.Logger) *zerolog.
 		return loggedJSONError(w, "resource not found", http.StatusNotFound, logger)
 	case psql.ErrNotOwner:
 		return loggedJSONError(w, "not resource owner", http.StatusForbidden, logger)
+	case psql.ErrConflict:
+		return loggedJSONError(w, "conflicting resources", http.StatusConflict, logger)
 	case psql.ErrInvalidJson:
 		return loggedJSONError(w, "invalid input", http.StatusBadRequest, logger)
 	// connection
@@ -2,58 +2,108 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	//"github.com/CSCfi/qvain-api/internal/jwt"
 	"github.com/CSCfi/qvain-api/internal/oidc"
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/internal/sessions"
 	//"github.com/CSCfi/qvain-api/orcid"
 
 	"github.com/francoispqt/gojay"
 	"github.com/rs/zerolog"
+	"github.com/wvh/uuid"
 )
 
+const (
+	// linkCookieName is the name of the cookie that marks an OIDC login as an account linking request.
+	linkCookieName = "link"
+
+	// linkModeLink links an identity, refusing to merge users that both own datasets.
+	linkModeLink = "link"
+
+	// linkModeMerge links an identity, merging users even if both own datasets.
+	linkModeMerge = "merge"
+)
+
+// authProvider holds the OIDC client and handlers for one configured identity provider.
+type authProvider struct {
+	config           *oidcProviderConfig
+	client           *oidc.OidcClient
+	authorizeHandler http.Handler
+	callbackHandler  http.Handler
+}
+
 // AuthApi holds authentication handlers configured for this application.
 type AuthApi struct {
-	oidc struct {
-		client           *oidc.OidcClient
-		authorizeHandler http.Handler
-		callbackHandler  http.Handler
-	}
+	// providers in configuration order; the first one is the default
+	providers []*authProvider
+	byName    map[string]*authProvider
+
+	sessions *sessions.Manager
+	db       *psql.DB
+
 	ServeHTTP http.HandlerFunc
 	logger    zerolog.Logger
 }
 
 // NewAuthApi sets up external authentication services such as OpenID Connect endpoints.
 //
-// TODO: Too hard-coded: right now the OIDC configuration is flat; perhaps come up with better,
-// more dynamic config that allows more than one provider.
+// Each configured provider is served at /api/auth/{provider}/login and /api/auth/{provider}/cb;
+// the default (first) provider is also available at /api/auth/login and /api/auth/cb.
+// Logged in users can link identities from other providers at /api/auth/{provider}/link.
+// IdP-initiated logout is taken at /api/auth/{provider}/backchannel-logout and /api/auth/{provider}/frontchannel-logout.
+// Providers that fail to initialise are logged and skipped.
 func NewAuthApi(config *Config, onLogin loginHook, logger zerolog.Logger) *AuthApi {
 	api := AuthApi{
-		logger: logger,
-	}
-
-	// main OIDC client
-	oidcLogger := config.NewLogger("oidc").With().Str("idp", config.oidcProviderName).Logger()
-	oidcClient, err := oidc.NewOidcClient(
-		config.oidcProviderName,
-		config.oidcClientID,
-		config.oidcClientSecret,
-		"https://"+config.Hostname+config.DevPort+"/api/auth/cb",
-		config.oidcProviderUrl,
-		"/login",
-		oidc.WithAllowDevLogin(config.DevMode),
-		oidc.WithSkipExpiryCheck(config.DevMode),
-	)
-	if err != nil {
-		logger.Error().Err(err).Str("idp", config.oidcProviderName).Msg("oidc configuration failed")
+		byName:   make(map[string]*authProvider),
+		sessions: config.sessions,
+		db:       config.db,
+		logger:   logger,
+	}
+
+	for i := range config.oidcProviders {
+		pc := &config.oidcProviders[i]
+
+		oidcLogger := config.NewLogger("oidc").With().Str("idp", pc.name).Logger()
+		oidcClient, err := oidc.NewOidcClient(
+			pc.name,
+			pc.clientID,
+			pc.clientSecret,
+			"https://"+config.Hostname+config.DevPort+pc.CallbackPath(),
+			pc.url,
+			"/login",
+			oidc.WithAllowDevLogin(config.DevMode),
+			oidc.WithSkipExpiryCheck(config.DevMode),
+		)
+		if err != nil {
+			logger.Error().Err(err).Str("idp", pc.name).Msg("oidc configuration failed")
+			continue
+		}
+
+		if pc.postLogoutRedirect == "" {
+			pc.postLogoutRedirect = "https://" + config.Hostname + config.DevPort + "/"
+		}
+
+		oidcClient.SetLogger(oidcLogger)
+		oidcClient.OnLogout = MakeLogoutHandler(config.sessions, config.Logger, pc.name)
+		oidcClient.OnLogin = MakeSessionHandler(config.sessions, config.db, onLogin, config.Logger, pc.name, pc.service, pc.claimsMapping)
+
+		provider := &authProvider{
+			config:           pc,
+			client:           oidcClient,
+			authorizeHandler: oidcClient.Auth(),
+			callbackHandler:  oidcClient.Callback(),
+		}
+		api.providers = append(api.providers, provider)
+		api.byName[pc.name] = provider
+	}
+
+	if len(api.providers) < 1 {
 		api.ServeHTTP = func(w http.ResponseWriter, r *http.Request) {
-			loggedJSONError(w, "no authentication endpoints configured", http.StatusNotFound, &logger).Err(err).Str("idp", config.oidcProviderName).Msg("oidc configuration failed")
+			loggedJSONError(w, "no authentication endpoints configured", http.StatusNotFound, &logger).Int("configured", len(config.oidcProviders)).Msg("no oidc providers available")
 		}
 	} else {
-		oidcClient.SetLogger(oidcLogger)
-		oidcClient.OnLogin = MakeSessionHandlerForFairdata(config.sessions, config.db, onLogin, config.Logger, config.oidcProviderName)
-		api.oidc.client = oidcClient
-		api.oidc.authorizeHandler = oidcClient.Auth()
-		api.oidc.callbackHandler = oidcClient.Callback()
 		api.ServeHTTP = api.authHandler
 	}
 	return &api
@@ -69,14 +119,40 @@ func (api *AuthApi) authHandler(w http.ResponseWriter, r *http.Request) {
 	case "":
 		ifGet(w, r, api.listProviders)
 		return
-	case "login":
-		api.oidc.authorizeHandler.ServeHTTP(w, r)
+	case "login", "cb":
+		// legacy endpoints for the default provider
+		api.providerHandler(w, r, api.providers[0], head)
 		return
-	case "cb":
-		api.oidc.callbackHandler.ServeHTTP(w, r)
+	case "identities", "identities/":
+		api.identitiesHandler(w, r)
 		return
 	}
-	loggedJSONError(w, "unknown authentication method", http.StatusNotFound, &api.logger).Msg("Error in authHandler")
+
+	if HasSubroutes(head) {
+		if provider, ok := api.byName[GetStringParam(head)]; ok {
+			api.providerHandler(w, r, provider, ShiftUrlWithTrailing(r))
+			return
+		}
+	}
+	loggedJSONError(w, "unknown authentication method", http.StatusNotFound, &api.logger).Str("head", head).Msg("Error in authHandler")
+}
+
+// providerHandler dispatches a request to the login or callback handler of a provider.
+func (api *AuthApi) providerHandler(w http.ResponseWriter, r *http.Request, provider *authProvider, op string) {
+	switch op {
+	case "login":
+		provider.authorizeHandler.ServeHTTP(w, r)
+	case "cb":
+		provider.callbackHandler.ServeHTTP(w, r)
+	case "link":
+		api.startLink(w, r, provider)
+	case "backchannel-logout":
+		provider.client.BackChannelLogout().ServeHTTP(w, r)
+	case "frontchannel-logout":
+		provider.client.FrontChannelLogout().ServeHTTP(w, r)
+	default:
+		loggedJSONError(w, "unknown authentication method", http.StatusNotFound, &api.logger).Str("idp", provider.config.name).Str("op", op).Msg("Error in authHandler")
+	}
 }
 
 // listProviders lists configured providers at the auth endpoint.
@@ -89,10 +165,151 @@ func (api *AuthApi) listProviders(w http.ResponseWriter, r *http.Request) {
 	enc.AppendByte('{')
 	enc.StringKey("api", "auth")
 	enc.ArrayKey("IdPs", gojay.EncodeArrayFunc(func(enc *gojay.Encoder) {
-		for _, provider := range []string{api.oidc.client.Name} {
-			enc.AddString(provider)
+		for _, provider := range api.providers {
+			enc.AddString(provider.client.Name)
+		}
+	}))
+	enc.ArrayKey("providers", gojay.EncodeArrayFunc(func(enc *gojay.Encoder) {
+		for i, provider := range api.providers {
+			enc.AddObject(gojay.EncodeObjectFunc(func(enc *gojay.Encoder) {
+				enc.StringKey("name", provider.config.name)
+				enc.StringKey("login", "/api/auth/"+provider.config.name+"/login")
+				enc.BoolKey("default", i == 0)
+			}))
 		}
 	}))
 	enc.AppendByte('}')
 	enc.Write()
 }
+
+// LogoutUrl returns the RP-initiated logout url at the IdP the session was created by,
+// or an empty string if the session has no IdP login or the IdP doesn't support it.
+func (api *AuthApi) LogoutUrl(session *sessions.Session) string {
+	idp := session.Idp()
+	if idp == nil {
+		return ""
+	}
+	provider, ok := api.byName[idp.Provider]
+	if !ok {
+		return ""
+	}
+	return provider.client.EndSessionUrl(idp.IDToken, provider.config.postLogoutRedirect)
+}
+
+// startLink starts an OIDC login that links the new identity to the currently logged in user.
+// With the query parameter `merge=1`, the user confirms that an existing user with datasets may be merged into the current one.
+func (api *AuthApi) startLink(w http.ResponseWriter, r *http.Request, provider *authProvider) {
+	if r.Method != http.MethodGet {
+		jsonError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := api.sessions.UserSessionFromRequest(r); err != nil {
+		sessionError(w, err, &api.logger).Err(err).Str("idp", provider.config.name).Msg("link requires a session")
+		return
+	}
+
+	mode := linkModeLink
+	if r.URL.Query().Get("merge") != "" {
+		mode = linkModeMerge
+	}
+	setLinkCookie(w, mode)
+
+	provider.authorizeHandler.ServeHTTP(w, r)
+}
+
+// identitiesHandler lists (GET /identities) or unlinks (DELETE /identities/{svc}) the external identities of the current user.
+func (api *AuthApi) identitiesHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := api.sessions.UserSessionFromRequest(r)
+	if err != nil {
+		sessionError(w, err, &api.logger).Err(err).Msg("no session from request")
+		return
+	}
+	user := session.User
+
+	svc := ShiftUrlWithTrailing(r)
+	if svc == "" {
+		if checkMethod(w, r, http.MethodGet) {
+			api.listIdentities(w, r, user.Uid)
+		}
+		return
+	}
+
+	if !checkMethod(w, r, http.MethodDelete) {
+		return
+	}
+	svc = GetStringParam(svc)
+
+	// don't allow pulling the rug from under the current session
+	if svc == user.Service {
+		loggedJSONError(w, "can't unlink the identity of the current session", http.StatusConflict, &api.logger).Str("uid", user.Uid.String()).Str("svc", svc).Msg("unlink refused")
+		return
+	}
+
+	if err := api.db.UnlinkIdentity(r.Context(), user.Uid, svc); err != nil {
+		dbError(w, err, &api.logger).Err(err).Str("uid", user.Uid.String()).Str("svc", svc).Msg("unlink failed")
+		return
+	}
+	api.logger.Info().Str("uid", user.Uid.String()).Str("svc", svc).Msg("unlinked identity")
+
+	apiWriteHeaders(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listIdentities writes the external identities of a user as a JSON object of service to identity.
+func (api *AuthApi) listIdentities(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+	extids, err := api.db.GetIdentities(r.Context(), uid)
+	if err != nil {
+		dbError(w, err, &api.logger).Err(err).Str("uid", uid.String()).Msg("can't get identities")
+		return
+	}
+
+	apiWriteHeaders(w)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	for svc, id := range extids {
+		enc.AddStringKey(svc, id)
+	}
+	enc.AppendByte('}')
+	enc.Write()
+}
+
+// setLinkCookie marks the following OIDC login as an account linking request.
+func setLinkCookie(w http.ResponseWriter, mode string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     linkCookieName,
+		Value:    mode,
+		Path:     oidc.DefaultCookiePath,
+		Expires:  time.Now().Add(oidc.DefaultLoginTimeout * time.Second),
+		MaxAge:   oidc.DefaultLoginTimeout,
+		Secure:   true,
+		HttpOnly: true,
+	})
+}
+
+// getLinkCookie returns the link mode if the current OIDC login is an account linking request.
+func getLinkCookie(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(linkCookieName)
+	if err != nil {
+		return "", false
+	}
+	if cookie.Value != linkModeLink && cookie.Value != linkModeMerge {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// deleteLinkCookie removes the account linking marker.
+func deleteLinkCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     linkCookieName,
+		Value:    "",
+		Path:     oidc.DefaultCookiePath,
+		MaxAge:   -1,
+		Expires:  time.Unix(0, 0),
+		Secure:   true,
+		HttpOnly: true,
+	})
+}
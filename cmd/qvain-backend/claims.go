@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/CSCfi/qvain-api/internal/oidc"
+	"github.com/CSCfi/qvain-api/pkg/models"
+
+	gooidc "github.com/coreos/go-oidc"
+	"github.com/rs/zerolog"
+)
+
+// subjectClaim is the claim holding the token subject.
+const subjectClaim = "sub"
+
+var (
+	// FairdataTokenProjectPrefixes are used to identify IDA projects from group_names field
+	FairdataTokenProjectPrefixes = []string{"fairdata:IDA01:", "IDA01:"}
+
+	// fairdataClaimsMapping maps token fields specific to the Fairdata authentication proxy.
+	fairdataClaimsMapping = claimsMapping{
+		Identity:        []string{"CSCUserName", subjectClaim},
+		Name:            "name",
+		GivenName:       "given_name",
+		FamilyName:      "family_name",
+		Email:           "email",
+		Organisation:    "schacHomeOrganization",
+		Projects:        "group_names",
+		ProjectPrefixes: FairdataTokenProjectPrefixes,
+		Required: []requiredClaim{
+			// the old proxy didn't send CSCUserName; the subject ends with @fairdataid there
+			{Claim: "CSCUserName", Error: "missingcsc", StrictOnly: true, UnlessSubjectSuffix: "@fairdataid"},
+			{Claim: "schacHomeOrganization", Error: "missingorg"},
+		},
+	}
+
+	// genericClaimsMapping maps standard OpenID Connect claims; the token subject is used as identity.
+	genericClaimsMapping = claimsMapping{
+		Identity:     []string{subjectClaim},
+		Name:         "name",
+		GivenName:    "given_name",
+		FamilyName:   "family_name",
+		Email:        "email",
+		Organisation: "schacHomeOrganization",
+	}
+
+	// builtinClaimsMappings can be selected by name in the provider configuration.
+	builtinClaimsMappings = map[string]*claimsMapping{
+		ClaimsFairdata: &fairdataClaimsMapping,
+		ClaimsGeneric:  &genericClaimsMapping,
+	}
+
+	errMissingIdentity = errors.New("no identity claim in token")
+)
+
+// claimsMapping declares which token claims become which user fields.
+// It can be loaded from a JSON file with the same field names as the json tags below.
+type claimsMapping struct {
+	// Identity lists the claims to try, in order, for the user identity; the first non-empty one is used.
+	Identity []string `json:"identity"`
+
+	// Name is the display name claim; GivenName and FamilyName, if present in the token, are preferred over it.
+	Name       string `json:"name"`
+	GivenName  string `json:"given_name"`
+	FamilyName string `json:"family_name"`
+
+	Email        string `json:"email"`
+	Organisation string `json:"organisation"`
+
+	// Projects is the claim holding the user's groups, either as list or space-separated string.
+	Projects string `json:"projects"`
+
+	// ProjectPrefixes, if set, only keeps projects with one of these prefixes and strips the prefix.
+	ProjectPrefixes []string `json:"project_prefixes"`
+
+	// Required lists claims that must be present for the login to succeed.
+	Required []requiredClaim `json:"required"`
+}
+
+// requiredClaim is a rule for a claim that must be present in the token.
+type requiredClaim struct {
+	Claim string `json:"claim"`
+
+	// Error is the flag sent to the frontend when the claim is missing; defaults to `missingclaim`.
+	Error string `json:"error"`
+
+	// StrictOnly rules are not enforced in development mode.
+	StrictOnly bool `json:"strict_only"`
+
+	// UnlessSubjectSuffix skips the rule for token subjects with this suffix.
+	UnlessSubjectSuffix string `json:"unless_subject_suffix"`
+}
+
+// loadClaimsMapping returns a built-in mapping by name, or reads a mapping from a JSON file if the argument looks like a path.
+func loadClaimsMapping(nameOrPath string) (*claimsMapping, error) {
+	if mapping, ok := builtinClaimsMappings[nameOrPath]; ok {
+		return mapping, nil
+	}
+	if !strings.ContainsRune(nameOrPath, os.PathSeparator) && !strings.HasSuffix(nameOrPath, ".json") {
+		return nil, fmt.Errorf("unknown claims mapping %q", nameOrPath)
+	}
+
+	f, err := os.Open(nameOrPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mapping := new(claimsMapping)
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(mapping); err != nil {
+		return nil, fmt.Errorf("claims mapping %s: %s", nameOrPath, err)
+	}
+	if len(mapping.Identity) < 1 {
+		return nil, fmt.Errorf("claims mapping %s: no identity claims", nameOrPath)
+	}
+	for _, rule := range mapping.Required {
+		if rule.Claim == "" {
+			return nil, fmt.Errorf("claims mapping %s: required rule without claim", nameOrPath)
+		}
+	}
+	return mapping, nil
+}
+
+// Mapper returns a claimsMapper for ID tokens using this mapping.
+// If strict is false, required claim rules marked as StrictOnly are not enforced.
+func (mapping *claimsMapping) Mapper(strict bool, logger zerolog.Logger) claimsMapper {
+	return func(idToken *gooidc.IDToken) (*models.User, error) {
+		var claims map[string]interface{}
+		if err := idToken.Claims(&claims); err != nil {
+			logger.Warn().Err(err).Msg("failed to get token claims")
+			return nil, err
+		}
+
+		user, err := mapping.mapClaims(idToken.Subject, claims, strict)
+		if err == nil && len(user.Projects) > 0 {
+			logger.Debug().Strs("projects", user.Projects).Msg("projects in token")
+		}
+		return user, err
+	}
+}
+
+// mapClaims creates a user from decoded token claims.
+func (mapping *claimsMapping) mapClaims(subject string, claims map[string]interface{}, strict bool) (*models.User, error) {
+	get := func(claim string) string {
+		if claim == subjectClaim {
+			return subject
+		}
+		return claimString(claims, claim)
+	}
+
+	for _, rule := range mapping.Required {
+		if get(rule.Claim) != "" || (rule.StrictOnly && !strict) {
+			continue
+		}
+		if rule.UnlessSubjectSuffix != "" && strings.HasSuffix(subject, rule.UnlessSubjectSuffix) {
+			continue
+		}
+		return nil, requiredClaimError(rule.Error)
+	}
+
+	user := &models.User{
+		Name:         fullName(get(mapping.Name), get(mapping.GivenName), get(mapping.FamilyName)),
+		Email:        get(mapping.Email),
+		Organisation: get(mapping.Organisation),
+	}
+	for _, claim := range mapping.Identity {
+		if user.Identity = get(claim); user.Identity != "" {
+			break
+		}
+	}
+	if user.Identity == "" {
+		return nil, errMissingIdentity
+	}
+
+	if mapping.Projects != "" {
+		projects := claimStrings(claims, mapping.Projects)
+		if len(mapping.ProjectPrefixes) > 0 {
+			projects = filterOnAndTrimPrefix(projects, mapping.ProjectPrefixes...)
+		}
+		if len(projects) > 0 {
+			user.Projects = projects
+		}
+	}
+	return user, nil
+}
+
+// requiredClaimError returns the error for a missing required claim; the well-known flags keep their own errors.
+func requiredClaimError(flag string) error {
+	switch flag {
+	case "missingcsc":
+		return oidc.ErrMissingCSCUserName
+	case "missingorg":
+		return oidc.ErrMissingOrganization
+	case "":
+		return oidc.NewFrontendError("missingclaim")
+	}
+	return oidc.NewFrontendError(flag)
+}
+
+// claimString returns a claim as string, or an empty string if it is missing or not a string.
+func claimString(claims map[string]interface{}, claim string) string {
+	if claim == "" {
+		return ""
+	}
+	s, _ := claims[claim].(string)
+	return s
+}
+
+// claimStrings returns a claim that is either a list of strings or a space-separated string.
+func claimStrings(claims map[string]interface{}, claim string) []string {
+	switch v := claims[claim].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
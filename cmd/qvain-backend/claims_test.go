@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/CSCfi/qvain-api/internal/oidc"
+	"github.com/CSCfi/qvain-api/pkg/models"
+)
+
+func TestMapClaims(t *testing.T) {
+	fairdataToken := map[string]interface{}{
+		"CSCUserName":           "jdoe",
+		"given_name":            "John",
+		"family_name":           "Doe",
+		"name":                  "Johnny",
+		"email":                 "jdoe@example.com",
+		"schacHomeOrganization": "example.com",
+		"group_names":           []interface{}{"fairdata:IDA01:project1", "IDA01:project2", "fairdata:other"},
+	}
+	without := func(claims map[string]interface{}, keys ...string) map[string]interface{} {
+		out := make(map[string]interface{}, len(claims))
+		for k, v := range claims {
+			out[k] = v
+		}
+		for _, k := range keys {
+			delete(out, k)
+		}
+		return out
+	}
+
+	var tests = []struct {
+		name    string
+		mapping *claimsMapping
+		subject string
+		claims  map[string]interface{}
+		strict  bool
+		user    *models.User
+		err     error
+	}{
+		{
+			name:    "fairdata",
+			mapping: &fairdataClaimsMapping,
+			subject: "abc123",
+			claims:  fairdataToken,
+			strict:  true,
+			user: &models.User{
+				Identity:     "jdoe",
+				Name:         "John Doe",
+				Email:        "jdoe@example.com",
+				Organisation: "example.com",
+				Projects:     []string{"project1", "project2"},
+			},
+		},
+		{
+			name:    "fairdata without csc user name",
+			mapping: &fairdataClaimsMapping,
+			subject: "abc123",
+			claims:  without(fairdataToken, "CSCUserName"),
+			strict:  true,
+			err:     oidc.ErrMissingCSCUserName,
+		},
+		{
+			name:    "fairdata without csc user name in dev mode",
+			mapping: &fairdataClaimsMapping,
+			subject: "abc123",
+			claims:  without(fairdataToken, "CSCUserName", "group_names"),
+			user: &models.User{
+				Identity:     "abc123",
+				Name:         "John Doe",
+				Email:        "jdoe@example.com",
+				Organisation: "example.com",
+			},
+		},
+		{
+			name:    "fairdata old proxy",
+			mapping: &fairdataClaimsMapping,
+			subject: "jdoe@fairdataid",
+			claims:  without(fairdataToken, "CSCUserName", "given_name", "family_name", "group_names"),
+			strict:  true,
+			user: &models.User{
+				Identity:     "jdoe@fairdataid",
+				Name:         "Johnny",
+				Email:        "jdoe@example.com",
+				Organisation: "example.com",
+			},
+		},
+		{
+			name:    "fairdata without organisation",
+			mapping: &fairdataClaimsMapping,
+			subject: "abc123",
+			claims:  without(fairdataToken, "schacHomeOrganization"),
+			strict:  true,
+			err:     oidc.ErrMissingOrganization,
+		},
+		{
+			name:    "generic",
+			mapping: &genericClaimsMapping,
+			subject: "abc123",
+			claims:  map[string]interface{}{"name": "Jane Doe", "email": "jane@example.com"},
+			strict:  true,
+			user:    &models.User{Identity: "abc123", Name: "Jane Doe", Email: "jane@example.com"},
+		},
+		{
+			name: "custom",
+			mapping: &claimsMapping{
+				Identity:     []string{"preferred_username"},
+				Name:         "name",
+				Organisation: "org",
+				Projects:     "groups",
+				Required:     []requiredClaim{{Claim: "org", Error: "missinghome"}},
+			},
+			subject: "abc123",
+			claims:  map[string]interface{}{"preferred_username": "jane", "org": "example.org", "groups": "a b"},
+			user:    &models.User{Identity: "jane", Organisation: "example.org", Projects: []string{"a", "b"}},
+		},
+		{
+			name: "custom missing required claim",
+			mapping: &claimsMapping{
+				Identity: []string{"preferred_username"},
+				Required: []requiredClaim{{Claim: "org", Error: "missinghome"}},
+			},
+			subject: "abc123",
+			claims:  map[string]interface{}{"preferred_username": "jane"},
+			err:     oidc.NewFrontendError("missinghome"),
+		},
+		{
+			name:    "custom missing identity",
+			mapping: &claimsMapping{Identity: []string{"preferred_username"}},
+			subject: "abc123",
+			claims:  map[string]interface{}{},
+			err:     errMissingIdentity,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := test.mapping.mapClaims(test.subject, test.claims, test.strict)
+			if !reflect.DeepEqual(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if !reflect.DeepEqual(user, test.user) {
+				t.Errorf("expected user %+v, got %+v", test.user, user)
+			}
+		})
+	}
+}
+
+func TestLoadClaimsMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qvain-claims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	good := write("good.json", `{
+		"identity": ["uid", "sub"],
+		"name": "displayName",
+		"projects": "memberOf",
+		"project_prefixes": ["proj:"],
+		"required": [{"claim": "uid", "error": "missinguid", "strict_only": true}]
+	}`)
+
+	mapping, err := loadClaimsMapping(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &claimsMapping{
+		Identity:        []string{"uid", "sub"},
+		Name:            "displayName",
+		Projects:        "memberOf",
+		ProjectPrefixes: []string{"proj:"},
+		Required:        []requiredClaim{{Claim: "uid", Error: "missinguid", StrictOnly: true}},
+	}
+	if !reflect.DeepEqual(mapping, expected) {
+		t.Errorf("expected %+v, got %+v", expected, mapping)
+	}
+
+	if mapping, err := loadClaimsMapping(ClaimsGeneric); err != nil || mapping != &genericClaimsMapping {
+		t.Errorf("expected built-in generic mapping, got %v (err: %v)", mapping, err)
+	}
+
+	for _, nameOrPath := range []string{
+		"unknown",
+		filepath.Join(dir, "missing.json"),
+		write("unknown-field.json", `{"identity": ["sub"], "nmae": "name"}`),
+		write("no-identity.json", `{"name": "name"}`),
+		write("bad-rule.json", `{"identity": ["sub"], "required": [{"error": "x"}]}`),
+	} {
+		if _, err := loadClaimsMapping(nameOrPath); err == nil {
+			t.Errorf("%s: expected error, got nil", nameOrPath)
+		}
+	}
+}
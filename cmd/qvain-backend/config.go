@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/rs/zerolog"
 
 	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/internal/refdata"
 	"github.com/CSCfi/qvain-api/internal/secmsg"
 	"github.com/CSCfi/qvain-api/internal/sessions"
+	"github.com/CSCfi/qvain-api/internal/shared"
 	"github.com/CSCfi/qvain-api/pkg/env"
 	"github.com/CSCfi/qvain-api/pkg/models"
 )
@@ -35,18 +40,34 @@ type Config struct {
 	MetaxApiHost string
 	metaxApiUser string
 	metaxApiPass string
+	metaxVersion string
+	metaxDrafts  bool
+
+	// development settings
+	metaxFake     bool
+	metaxFakeSeed string
+
+	// background sync settings
+	syncInterval time.Duration
+	syncWorkers  int
+	syncRate     time.Duration
+
+	// reference data settings
+	refdataUrl        string
+	refdataRefresh    time.Duration
+	refdataFillLabels bool
 
 	// session settings
-	tokenKey         []byte
-	oidcProviderName string
-	oidcProviderUrl  string
-	oidcClientID     string
-	oidcClientSecret string
-	oidcLogoutPath   string
+	tokenKey      []byte
+	oidcProviders []oidcProviderConfig
 
 	// stats api settings
 	qvainStatsApiKey  string
 	qvainLookupApiKey string
+	qvainAdminApiKey  string
+
+	// database settings
+	dbMigrate bool
 
 	// configured service instances
 	db        *psql.DB
@@ -69,6 +90,47 @@ func ConfigFromEnv() (*Config, error) {
 		return nil, fmt.Errorf("invalid token key: %s", err)
 	}
 
+	// get identity providers
+	providers, err := oidcProvidersFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("invalid oidc configuration: %s", err)
+	}
+
+	// get Metax API version: 1, 2 or auto to negotiate at start-up
+	metaxVersion := env.GetDefault("APP_METAX_API_VERSION", "1")
+	switch metaxVersion {
+	case "1", "2", "auto":
+	default:
+		return nil, fmt.Errorf("invalid Metax API version: %q", metaxVersion)
+	}
+
+	// get reference data source; defaults to the Elastic Search instance of the Metax host
+	refdataUrl := env.Get("APP_REFDATA_URL")
+	if refdataUrl == "" && env.Get("APP_METAX_API_HOST") != "" {
+		refdataUrl = "https://" + env.Get("APP_METAX_API_HOST") + "/es/"
+	}
+	refdataRefresh := refdata.DefaultRefreshInterval
+	if env.Get("APP_REFDATA_REFRESH") != "" {
+		if refdataRefresh, err = time.ParseDuration(env.Get("APP_REFDATA_REFRESH")); err != nil || refdataRefresh <= 0 {
+			return nil, fmt.Errorf("invalid reference data refresh interval: %q", env.Get("APP_REFDATA_REFRESH"))
+		}
+	}
+
+	// get background sync settings; sync is disabled without an interval
+	var syncInterval, syncRate time.Duration
+	if env.Get("APP_SYNC_INTERVAL") != "" {
+		if syncInterval, err = time.ParseDuration(env.Get("APP_SYNC_INTERVAL")); err != nil || syncInterval < 0 {
+			return nil, fmt.Errorf("invalid sync interval: %q", env.Get("APP_SYNC_INTERVAL"))
+		}
+	}
+	syncWorkers, err := strconv.Atoi(env.GetDefault("APP_SYNC_WORKERS", strconv.Itoa(shared.DefaultSyncWorkers)))
+	if err != nil || syncWorkers < 1 {
+		return nil, fmt.Errorf("invalid number of sync workers: %q", env.Get("APP_SYNC_WORKERS"))
+	}
+	if syncRate, err = time.ParseDuration(env.GetDefault("APP_SYNC_RATE", shared.DefaultSyncRate.String())); err != nil || syncRate < 0 {
+		return nil, fmt.Errorf("invalid sync rate: %q", env.Get("APP_SYNC_RATE"))
+	}
+
 	if *appDevMode {
 		*appDebug = true
 		*forceHttpOnly = true
@@ -87,7 +149,7 @@ func ConfigFromEnv() (*Config, error) {
 	return &Config{
 		Hostname:          hostname,
 		Port:              *appHttpPort,
-		DevPort:           env.GetDefault("APP_DEV_PORT",""),
+		DevPort:           env.GetDefault("APP_DEV_PORT", ""),
 		Standalone:        env.GetBool("APP_HTTP_STANDALONE"),
 		ForceHttpOnly:     *forceHttpOnly,
 		Debug:             *appDebug,
@@ -97,16 +159,24 @@ func ConfigFromEnv() (*Config, error) {
 		Logger:            createAppLogger(ServiceName, *appDebug, *disableLogging),
 		UseHttpErrors:     env.GetBool("APP_HTTP_ERRORS"),
 		tokenKey:          key,
-		oidcProviderName:  env.Get("APP_OIDC_PROVIDER_NAME"),
-		oidcProviderUrl:   env.Get("APP_OIDC_PROVIDER_URL"),
-		oidcClientID:      env.Get("APP_OIDC_CLIENT_ID"),
-		oidcClientSecret:  env.Get("APP_OIDC_CLIENT_SECRET"),
-		oidcLogoutPath:    env.GetDefault("APP_OIDC_LOGOUT_PATH","/idp/profile/Logout"),
+		oidcProviders:     providers,
 		MetaxApiHost:      env.Get("APP_METAX_API_HOST"),
 		metaxApiUser:      env.Get("APP_METAX_API_USER"),
 		metaxApiPass:      env.Get("APP_METAX_API_PASS"),
+		metaxVersion:      metaxVersion,
+		metaxDrafts:       env.GetBool("APP_METAX_DRAFTS"),
+		metaxFake:         env.GetBool("APP_METAX_FAKE"),
+		metaxFakeSeed:     env.Get("APP_METAX_FAKE_SEED"),
+		syncInterval:      syncInterval,
+		syncWorkers:       syncWorkers,
+		syncRate:          syncRate,
+		refdataUrl:        refdataUrl,
+		refdataRefresh:    refdataRefresh,
+		refdataFillLabels: env.GetBool("APP_REFDATA_FILL_LABELS"),
 		qvainStatsApiKey:  env.Get("APP_QVAIN_STATS_API_KEY"),
 		qvainLookupApiKey: env.Get("APP_QVAIN_LOOKUP_API_KEY"),
+		qvainAdminApiKey:  env.Get("APP_QVAIN_ADMIN_API_KEY"),
+		dbMigrate:         env.GetBool("APP_DB_MIGRATE"),
 	}, nil
 }
 
@@ -124,6 +194,18 @@ func (config *Config) initDB(logger zerolog.Logger) (err error) {
 	return err
 }
 
+// migrateDB applies pending schema migrations to the database.
+func (config *Config) migrateDB(logger zerolog.Logger) error {
+	applied, err := config.db.MigrateUp(context.Background(), 0)
+	if err != nil {
+		return err
+	}
+	for _, migration := range applied {
+		logger.Info().Int("version", migration.Version).Str("name", migration.Name).Msg("applied schema migration")
+	}
+	return nil
+}
+
 // initSessions initialises the session manager.
 func (config *Config) initSessions() error {
 	config.sessions = sessions.NewManager(sessions.WithRequireCSCUserName(!config.DevMode))
@@ -140,6 +222,15 @@ func (config *Config) initMessenger() (err error) {
 // TODO: worth putting it here?
 //func (config *Config) NewMetaxService() *metax.MetaxService {}
 
+// defaultOidcProvider returns the first configured identity provider, or nil if there are none.
+// The default provider is served at the legacy /api/auth/login and /api/auth/cb endpoints.
+func (config *Config) defaultOidcProvider() *oidcProviderConfig {
+	if len(config.oidcProviders) < 1 {
+		return nil
+	}
+	return &config.oidcProviders[0]
+}
+
 // getHostname gets the HTTP hostname from the environment or os, and returns an error on failure.
 // The hostname is used as vhost in http and in token audience checks, so it is important to get this right.
 func getHostname() (string, error) {
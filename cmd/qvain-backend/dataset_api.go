@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/CSCfi/qvain-api/internal/psql"
 	"github.com/CSCfi/qvain-api/internal/sessions"
@@ -27,7 +30,10 @@ type DatasetApi struct {
 	metax    *metax.MetaxService
 	logger   zerolog.Logger
 
-	identity string
+	identity    string
+	refdata     metax.Refdata
+	fillLabels  bool
+	metaxDrafts bool
 }
 
 func NewDatasetApi(db *psql.DB, sessions *sessions.Manager, metax *metax.MetaxService, logger zerolog.Logger) *DatasetApi {
@@ -46,6 +52,55 @@ func (api *DatasetApi) SetIdentity(identity string) {
 	api.identity = identity
 }
 
+// SetRefdata enables checking reference data identifiers on save, optionally filling in missing labels.
+// It is not safe to call this method after instantiation.
+func (api *DatasetApi) SetRefdata(refdata metax.Refdata, fillLabels bool) {
+	api.refdata = refdata
+	api.fillLabels = fillLabels
+}
+
+// SetMetaxDrafts enables saving unpublished datasets as drafts in Metax.
+// It is not safe to call this method after instantiation.
+func (api *DatasetApi) SetMetaxDrafts(enabled bool) {
+	api.metaxDrafts = enabled
+}
+
+// saveDraft saves an unpublished dataset as Metax draft if enabled; it writes an error response and returns false if that fails.
+// The dataset has already been saved in Qvain, so saving it again retries the draft; the Location header of the error
+// response points to the dataset.
+func (api *DatasetApi) saveDraft(w http.ResponseWriter, r *http.Request, owner *models.User, id uuid.UUID) bool {
+	if !api.metaxDrafts {
+		return true
+	}
+	if _, err := shared.SaveDraft(r.Context(), api.metax, api.db, id, owner); err != nil {
+		if r.Method == http.MethodPost {
+			w.Header().Set("Location", r.RequestURI+id.String())
+		}
+		api.handleDatasetError(w, owner.Uid, id, err, "saving Metax draft failed")
+		return false
+	}
+	return true
+}
+
+// validateRefdata checks reference data identifiers in a Metax dataset if enabled; it writes an error response and returns false if they are invalid.
+func (api *DatasetApi) validateRefdata(w http.ResponseWriter, dataset *metax.MetaxDataset) bool {
+	if api.refdata == nil {
+		return true
+	}
+
+	err := dataset.ValidateRefdata(api.refdata, api.fillLabels)
+	if err == nil {
+		return true
+	}
+	if refdataErr, ok := err.(*metax.RefdataError); ok {
+		api.logger.Debug().Err(err).Str("dataset", dataset.Id.String()).Msg("invalid reference data")
+		jsonErrorWithPayload(w, err.Error(), "refdata", refdataErr.Payload(), http.StatusBadRequest)
+		return false
+	}
+	loggedJSONError(w, err.Error(), http.StatusInternalServerError, &api.logger).Err(err).Msg("reference data validation failed")
+	return false
+}
+
 func (api *DatasetApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// authenticated api
 	session, err := api.sessions.SessionFromRequest(r)
@@ -76,6 +131,12 @@ func (api *DatasetApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// sync status and trigger
+	if head == "sync" {
+		api.sync(w, r, user)
+		return
+	}
+
 	// dataset uuid
 	id, err := GetUuidParam(head)
 	if err != nil {
@@ -92,8 +153,12 @@ func (api *DatasetApi) ListDatasets(w http.ResponseWriter, r *http.Request, user
 	case "":
 	case "fetch":
 		api.logger.Debug().Str("op", "fetch").Msg("datasets")
-		err := shared.Fetch(api.metax, api.db, api.logger, user.Uid, user.Identity)
-		if err != nil {
+		err := shared.Fetch(r.Context(), api.metax, api.db, api.logger, user.Uid, user.Identity)
+		if err == shared.ErrSyncInProgress || err == psql.ErrTooManySyncs {
+			// the user still gets the datasets, just without the latest changes from Metax
+			api.logger.Info().Err(err).Str("uid", user.Uid.String()).Msg("skipped sync before listing datasets")
+			w.Header().Set("X-Sync-Skipped", err.Error())
+		} else if err != nil {
 			// TODO: handle mixed error
 			loggedJSONError(w, err.Error(), http.StatusBadRequest, &api.logger).Err(err).Msg("Listing dataset failed")
 			//dbError(w, err)
@@ -101,13 +166,13 @@ func (api *DatasetApi) ListDatasets(w http.ResponseWriter, r *http.Request, user
 		}
 	case "fetchall":
 		api.logger.Debug().Str("op", "fetchall").Msg("datasets")
-		shared.FetchAll(api.metax, api.db, api.logger, user.Uid, user.Identity)
+		shared.FetchAll(r.Context(), api.metax, api.db, api.logger, user.Uid, user.Identity)
 	default:
 		loggedJSONError(w, "invalid parameter", http.StatusBadRequest, &api.logger).Msg("Unhandled parameter")
 		return
 	}
 
-	jsondata, err := api.db.ViewDatasetsByOwner(user.Uid)
+	jsondata, err := api.db.ViewDatasetsByOwner(r.Context(), user.Uid)
 	if err != nil {
 		dbError(w, err, &api.logger).Err(err).Str("uid", user.Uid.String()).Msg("ViewDatasetsByOwner failed")
 		return
@@ -159,6 +224,15 @@ func (api *DatasetApi) Dataset(w http.ResponseWriter, r *http.Request, user *mod
 			api.ListVersions(w, r, user.Uid, id)
 		}
 		return
+	case "versions/":
+		if ShiftUrl(r) != "graph" {
+			loggedJSONError(w, "invalid dataset operation", http.StatusNotFound, &api.logger).Msg("Unhandled dataset operation")
+			return
+		}
+		if checkMethod(w, r, http.MethodGet) {
+			api.versionGraph(w, r, user.Uid, id)
+		}
+		return
 	case "publish":
 		if checkMethod(w, r, http.MethodPost) {
 			api.publishDataset(w, r, user, id)
@@ -174,6 +248,24 @@ func (api *DatasetApi) Dataset(w http.ResponseWriter, r *http.Request, user *mod
 			api.refreshDatasetDirectoryContent(w, r, user, id)
 		}
 		return
+	case "fix_deprecated":
+		if checkMethod(w, r, http.MethodPost) {
+			api.fixDeprecated(w, r, user, id)
+		}
+		return
+	case "new_version":
+		if checkMethod(w, r, http.MethodPost) {
+			api.createNewVersion(w, r, user, id)
+		}
+		return
+	case "conflict":
+		api.conflict(w, r, user, id)
+		return
+	case "diff":
+		if checkMethod(w, r, http.MethodGet) {
+			api.diffDataset(w, r, user.Uid, id)
+		}
+		return
 	default:
 		loggedJSONError(w, "invalid dataset operation", http.StatusNotFound, &api.logger).Msg("Unhandled dataset operation")
 		return
@@ -190,7 +282,7 @@ func (api *DatasetApi) getDataset(w http.ResponseWriter, r *http.Request, owner
 		return
 	}
 
-	res, err := api.db.ViewDatasetWithOwner(id, owner, api.identity)
+	res, err := api.db.ViewDatasetWithOwner(r.Context(), id, owner, api.identity)
 	if err != nil {
 		dbError(w, err, &api.logger).Err(err).Str("dataset", id.String()).Str("user", owner.String()).Msg("retrieval of dataset failed")
 		return
@@ -240,13 +332,19 @@ func (api *DatasetApi) createDataset(w http.ResponseWriter, r *http.Request, cre
 			loggedJSONError(w, err.Error(), http.StatusBadRequest, &api.logger).Err(err).Msg("Dataset validation failed")
 			return
 		}
+		if !api.validateRefdata(w, metaxDataset) {
+			return
+		}
 	}
 
-	err = api.db.Create(typed.Unwrap())
+	err = api.db.Create(r.Context(), typed.Unwrap())
 	if err != nil {
 		dbError(w, err, &api.logger).Err(err).Msg("Creation of dataset failed")
 		return
 	}
+	if !api.saveDraft(w, r, creator, typed.Unwrap().Id) {
+		return
+	}
 
 	api.Created(w, r, typed.Unwrap().Id)
 }
@@ -286,7 +384,7 @@ func (api *DatasetApi) updateDataset(w http.ResponseWriter, r *http.Request, own
 	api.logger.Debug().Str("owner", owner.Uid.String()).Msg("owner")
 
 	// perform checks on the updated dataset before saving it
-	dataset, err := api.db.GetWithOwner(id, owner.Uid)
+	dataset, err := api.db.GetWithOwner(r.Context(), id, owner.Uid)
 	if err != nil {
 		dbError(w, err, &api.logger).Err(err).Str("Dataset id", id.String()).Str("Owner Uid", owner.Uid.String()).Msg("Update dataset failed")
 		return
@@ -302,31 +400,56 @@ func (api *DatasetApi) updateDataset(w http.ResponseWriter, r *http.Request, own
 			loggedJSONError(w, err.Error(), http.StatusBadRequest, &api.logger).Err(err).Msg("Updated dataset validation failed")
 			return
 		}
+		if !api.validateRefdata(w, &metax.MetaxDataset{Dataset: updated}) {
+			return
+		}
 	}
 
-	err = api.db.SmartUpdateWithOwner(id, typed.Unwrap().Blob(), owner.Uid)
+	err = api.db.SmartUpdateWithOwner(r.Context(), id, typed.Unwrap().Blob(), owner.Uid)
 	if err != nil {
 		dbError(w, err, &api.logger).Err(err).Str("dataset", id.String()).Str("user", owner.Uid.String()).Msg("SmartUpdateWithOwner failed")
 		return
 	}
+	if !dataset.Published && !api.saveDraft(w, r, owner, id) {
+		return
+	}
 
 	api.Created(w, r, typed.Unwrap().Id)
 }
 
 func (api *DatasetApi) handlePublishError(w http.ResponseWriter, ownerId uuid.UUID, id uuid.UUID, err error) {
+	if err == shared.ErrSyncConflict {
+		loggedJSONError(w, err.Error(), http.StatusConflict, &api.logger).Str("dataset", id.String()).Str("owner", ownerId.String()).Msg("publish failed")
+		return
+	}
+	if err == shared.ErrNoFileChanges {
+		loggedJSONError(w, err.Error(), http.StatusBadRequest, &api.logger).Str("dataset", id.String()).Str("owner", ownerId.String()).Msg("publish failed")
+		return
+	}
+	if err == metax.ErrNewVersionRequired {
+		loggedJSONError(w, err.Error()+": create one with POST /api/datasets/"+id.String()+"/new_version", http.StatusConflict, &api.logger).
+			Str("dataset", id.String()).Str("owner", ownerId.String()).Msg("publish failed")
+		return
+	}
+
+	api.handleDatasetError(w, ownerId, id, err, "publish failed")
+}
+
+// handleDatasetError writes and logs an error from an operation on a dataset that can fail in Metax or in the database.
+func (api *DatasetApi) handleDatasetError(w http.ResponseWriter, ownerId uuid.UUID, id uuid.UUID, err error, msg string) {
 	switch t := err.(type) {
 	case *metax.ApiError:
-		api.logger.Warn().Err(err).Str("dataset", id.String()).Str("owner", ownerId.String()).Str("origin", "api").Msg("publish failed")
+		api.logger.Warn().Err(err).Str("dataset", id.String()).Str("owner", ownerId.String()).Str("origin", "api").Msg(msg)
 		jsonErrorWithPayload(w, t.Error(), "metax", t.OriginalError(), convertExternalStatusCode(t.StatusCode()))
 	case *psql.DatabaseError:
-		dbError(w, err, &api.logger).Err(err).Str("dataset", id.String()).Str("owner", ownerId.String()).Str("origin", "database").Msg("publish failed")
+		dbError(w, err, &api.logger).Err(err).Str("dataset", id.String()).Str("owner", ownerId.String()).Str("origin", "database").Msg(msg)
 	default:
-		loggedJSONError(w, err.Error(), http.StatusInternalServerError, &api.logger).Err(err).Str("dataset", id.String()).Str("owner", ownerId.String()).Str("origin", "other").Msg("publish failed")
+		loggedJSONError(w, err.Error(), http.StatusInternalServerError, &api.logger).Err(err).Str("dataset", id.String()).Str("owner", ownerId.String()).Str("origin", "other").Msg(msg)
 	}
 }
 
 func (api *DatasetApi) publishDataset(w http.ResponseWriter, r *http.Request, owner *models.User, id uuid.UUID) {
-	vId, nId, qId, err := shared.Publish(api.metax, api.db, id, owner)
+	vId, nId, qId, err := shared.Publish(r.Context(), api.metax, api.db, id, owner)
 	if err != nil {
 		api.handlePublishError(w, owner.Uid, id, err)
 		return
@@ -336,20 +459,21 @@ func (api *DatasetApi) publishDataset(w http.ResponseWriter, r *http.Request, ow
 }
 
 func (api *DatasetApi) deleteDataset(w http.ResponseWriter, r *http.Request, owner uuid.UUID, id uuid.UUID) {
-	dataset, err := api.db.GetWithOwner(id, owner)
+	dataset, err := api.db.GetWithOwner(r.Context(), id, owner)
 	if err != nil {
 		dbError(w, err, &api.logger).Err(err).Str("dataset", id.String()).Str("user", owner.String()).Msg("deletion of dataset failed")
 		return
 	}
 
-	if dataset.Published {
-		err := shared.UnpublishAndDelete(api.metax, api.db, id, owner)
+	// Metax drafts are deleted from Metax like published datasets
+	if dataset.Published || metax.IsDraft(dataset.Blob()) {
+		err := shared.UnpublishAndDelete(r.Context(), api.metax, api.db, id, owner)
 		if err != nil {
 			api.handlePublishError(w, owner, id, err)
 			return
 		}
 	} else {
-		err = api.db.Delete(id, &owner)
+		err = api.db.Delete(r.Context(), id, &owner)
 		if err != nil {
 			dbError(w, err, &api.logger).Err(err).Str("dataset", id.String()).Str("user", owner.String()).Msg("deletion of dataset failed")
 			return
@@ -369,7 +493,7 @@ func (api *DatasetApi) changeDatasetCumulativeState(w http.ResponseWriter, r *ht
 		return
 	}
 
-	nextVersionQvainId, err := shared.ChangeDatasetCumulativeState(api.metax, api.db, &api.logger, owner, id, cumulativeState)
+	nextVersionQvainId, err := shared.ChangeDatasetCumulativeState(r.Context(), api.metax, api.db, &api.logger, owner, id, cumulativeState)
 	if err != nil {
 		switch t := err.(type) {
 		case *metax.ApiError:
@@ -408,7 +532,7 @@ func (api *DatasetApi) refreshDatasetDirectoryContent(w http.ResponseWriter, r *
 		return
 	}
 
-	nextVersionQvainId, err := shared.RefreshDatasetDirectoryContent(api.metax, api.db, &api.logger, owner, id, directoryIdentifier)
+	nextVersionQvainId, err := shared.RefreshDatasetDirectoryContent(r.Context(), api.metax, api.db, &api.logger, owner, id, directoryIdentifier)
 	if err != nil {
 		switch t := err.(type) {
 		case *metax.ApiError:
@@ -440,9 +564,242 @@ func (api *DatasetApi) refreshDatasetDirectoryContent(w http.ResponseWriter, r *
 
 }
 
+func (api *DatasetApi) fixDeprecated(w http.ResponseWriter, r *http.Request, owner *models.User, id uuid.UUID) {
+	newExtid, newId, err := shared.FixDeprecated(r.Context(), api.metax, api.db, id, owner)
+	if err != nil {
+		if err == shared.ErrNotPublished || err == shared.ErrNotDeprecated {
+			loggedJSONError(w, err.Error(), http.StatusBadRequest, &api.logger).
+				Str("owner", owner.Uid.String()).Str("dataset", id.String()).Msg("fixing deprecated dataset failed")
+			return
+		}
+		api.handlePublishError(w, owner.Uid, id, err)
+		return
+	}
+
+	apiWriteHeaders(w)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	enc.AddIntKey("status", http.StatusOK)
+	enc.AddStringKey("msg", "deprecated dataset fixed")
+	enc.AddStringKey("id", id.String())
+	if newId != nil {
+		enc.AddStringKey("new_id", newId.String())
+	}
+	enc.AddStringKey("new_extid", newExtid)
+	enc.AppendByte('}')
+	enc.Write()
+}
+
+// createNewVersion creates a local draft for a new version of a published dataset; publishing the draft creates the version in Metax.
+func (api *DatasetApi) createNewVersion(w http.ResponseWriter, r *http.Request, owner *models.User, id uuid.UUID) {
+	draftId, err := shared.CreateNewVersion(r.Context(), api.db, id, owner)
+	if err != nil {
+		if err == shared.ErrNotPublished || err == shared.ErrNotLatestVersion {
+			loggedJSONError(w, err.Error(), http.StatusBadRequest, &api.logger).
+				Str("owner", owner.Uid.String()).Str("dataset", id.String()).Msg("creating new version failed")
+			return
+		}
+		dbError(w, err, &api.logger).Err(err).Str("owner", owner.Uid.String()).Str("dataset", id.String()).Msg("creating new version failed")
+		return
+	}
+
+	apiWriteHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	enc.AddIntKey("status", http.StatusCreated)
+	enc.AddStringKey("msg", "new version draft created")
+	enc.AddStringKey("id", draftId.String())
+	enc.AddStringKey("based_on", id.String())
+	enc.AppendByte('}')
+	enc.Write()
+}
+
+// sync returns the outcome of the user's last sync from Metax (GET) or starts a new sync in the background (POST).
+func (api *DatasetApi) sync(w http.ResponseWriter, r *http.Request, user *models.User) {
+	switch r.Method {
+	case http.MethodGet:
+		api.syncStatus(w, r, user)
+	case http.MethodPost:
+		api.startSync(w, r, user)
+	case http.MethodOptions:
+		apiWriteOptions(w, "GET, POST, OPTIONS")
+	default:
+		loggedJSONError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed, &api.logger).Msg("Unhandled request method")
+	}
+}
+
+// syncStatus writes the outcome of the user's last sync.
+func (api *DatasetApi) syncStatus(w http.ResponseWriter, r *http.Request, user *models.User) {
+	outcome, err := api.db.GetSyncOutcome(r.Context(), user.Uid)
+	if err != nil {
+		dbError(w, err, &api.logger).Err(err).Str("uid", user.Uid.String()).Msg("error getting sync outcome")
+		return
+	}
+
+	apiWriteHeaders(w)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	enc.AddTimeKey("run", &outcome.Run, time.RFC3339)
+	if !outcome.Last.IsZero() {
+		enc.AddTimeKey("last_success", &outcome.Last, time.RFC3339)
+	}
+	enc.AddBoolKey("success", outcome.Success)
+	enc.AddIntKey("written", outcome.Written)
+	enc.AddIntKey("skipped", outcome.Skipped)
+	enc.AddIntKey("deleted", outcome.Deleted)
+	enc.AddIntKey("failed", outcome.Failed)
+	enc.AddIntKey("conflicts", outcome.Conflicts)
+	enc.AddSliceStringKey("errors", outcome.Errors)
+	if !outcome.Started.IsZero() {
+		// a sync that is running or was interrupted and will be resumed
+		enc.AddObjectKey("unfinished", gojay.EncodeObjectFunc(func(enc *gojay.Encoder) {
+			enc.AddTimeKey("started", &outcome.Started, time.RFC3339)
+			enc.AddIntKey("progress", outcome.Progress)
+		}))
+	}
+	enc.AppendByte('}')
+	enc.Write()
+}
+
+// startSync starts syncing the user's datasets from Metax in the background, unless a sync is already running.
+// The outcome can be retrieved with syncStatus when it's done.
+func (api *DatasetApi) startSync(w http.ResponseWriter, r *http.Request, user *models.User) {
+	lock, ok, err := api.db.TryLockSync(r.Context(), user.Uid)
+	if err == psql.ErrTooManySyncs {
+		loggedJSONError(w, "too many syncs running", http.StatusServiceUnavailable, &api.logger).Str("uid", user.Uid.String()).Msg("too many syncs running")
+		return
+	}
+	if err != nil {
+		dbError(w, err, &api.logger).Err(err).Str("uid", user.Uid.String()).Msg("can't lock user for sync")
+		return
+	}
+	if !ok {
+		loggedJSONError(w, "sync already in progress", http.StatusConflict, &api.logger).Str("uid", user.Uid.String()).Msg("sync already in progress")
+		return
+	}
+
+	// the sync outlives the request
+	go func() {
+		defer lock.Unlock()
+		if err := shared.FetchLocked(context.Background(), api.metax, api.db, lock, api.logger, user.Uid, user.Identity); err != nil {
+			api.logger.Warn().Err(err).Str("uid", user.Uid.String()).Msg("sync failed")
+		}
+	}()
+
+	apiWriteHeaders(w)
+	w.WriteHeader(http.StatusAccepted)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	enc.AddIntKey("status", http.StatusAccepted)
+	enc.AddStringKey("msg", "sync started")
+	enc.AppendByte('}')
+	enc.Write()
+}
+
+// conflict shows (GET) or resolves (POST) the sync conflict between local changes to a dataset and its upstream version.
+func (api *DatasetApi) conflict(w http.ResponseWriter, r *http.Request, owner *models.User, id uuid.UUID) {
+	switch r.Method {
+	case http.MethodGet:
+		api.getConflict(w, r, owner, id)
+	case http.MethodPost:
+		api.resolveConflict(w, r, owner, id)
+	case http.MethodOptions:
+		apiWriteOptions(w, "GET, POST, OPTIONS")
+	default:
+		loggedJSONError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed, &api.logger).Msg("Unhandled request method")
+	}
+}
+
+// getConflict writes the fields that differ between the local and upstream versions of a dataset in conflict.
+func (api *DatasetApi) getConflict(w http.ResponseWriter, r *http.Request, owner *models.User, id uuid.UUID) {
+	conflict, diffs, err := shared.GetConflict(r.Context(), api.db, id, owner.Uid)
+	if err != nil {
+		if _, ok := err.(*psql.DatabaseError); ok {
+			dbError(w, err, &api.logger).Err(err).Str("owner", owner.Uid.String()).Str("dataset", id.String()).Msg("getting conflict failed")
+			return
+		}
+		loggedJSONError(w, err.Error(), http.StatusInternalServerError, &api.logger).
+			Err(err).Str("owner", owner.Uid.String()).Str("dataset", id.String()).Msg("getting conflict failed")
+		return
+	}
+
+	apiWriteHeaders(w)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	enc.AddStringKey("id", id.String())
+	enc.AddTimeKey("detected", &conflict.Detected, time.RFC3339)
+	enc.AddArrayKey("changes", gojay.EncodeArrayFunc(func(enc *gojay.Encoder) {
+		for _, diff := range diffs {
+			local, upstream := gojay.EmbeddedJSON(diff.Old), gojay.EmbeddedJSON(diff.New)
+			enc.AddObject(gojay.EncodeObjectFunc(func(enc *gojay.Encoder) {
+				enc.AddStringKey("path", diff.Path)
+				enc.AddEmbeddedJSONKeyOmitEmpty("local", &local)
+				enc.AddEmbeddedJSONKeyOmitEmpty("upstream", &upstream)
+			}))
+		}
+	}))
+	enc.AppendByte('}')
+	enc.Write()
+}
+
+// conflictResolution is the request body for resolving a conflict.
+type conflictResolution struct {
+	Resolution     string   `json:"resolution"`
+	UpstreamFields []string `json:"upstream_fields"`
+}
+
+// resolveConflict resolves a sync conflict by keeping the local changes, taking the upstream version, or merging the two.
+func (api *DatasetApi) resolveConflict(w http.ResponseWriter, r *http.Request, owner *models.User, id uuid.UUID) {
+	var req conflictResolution
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		loggedJSONError(w, "invalid conflict resolution", http.StatusBadRequest, &api.logger).
+			Err(err).Str("owner", owner.Uid.String()).Str("dataset", id.String()).Msg("resolving conflict failed")
+		return
+	}
+
+	err := shared.ResolveConflict(r.Context(), api.db, id, owner.Uid, req.Resolution, req.UpstreamFields)
+	if err != nil {
+		switch err.(type) {
+		case *psql.DatabaseError:
+			dbError(w, err, &api.logger).Err(err).Str("owner", owner.Uid.String()).Str("dataset", id.String()).Msg("resolving conflict failed")
+		default:
+			status := http.StatusInternalServerError
+			if err == shared.ErrInvalidResolution || err == shared.ErrFieldNotInConflict {
+				status = http.StatusBadRequest
+			}
+			loggedJSONError(w, err.Error(), status, &api.logger).
+				Err(err).Str("owner", owner.Uid.String()).Str("dataset", id.String()).Msg("resolving conflict failed")
+		}
+		return
+	}
+
+	apiWriteHeaders(w)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	enc.AddIntKey("status", http.StatusOK)
+	enc.AddStringKey("msg", "conflict resolved")
+	enc.AddStringKey("id", id.String())
+	enc.AddStringKey("resolution", req.Resolution)
+	enc.AppendByte('}')
+	enc.Write()
+}
+
 // ListVersions lists an array of existing versions for a given dataset and owner.
 func (api *DatasetApi) ListVersions(w http.ResponseWriter, r *http.Request, user uuid.UUID, id uuid.UUID) {
-	jsondata, err := api.db.ViewVersions(user, id)
+	jsondata, err := api.db.ViewVersions(r.Context(), user, id)
 	if err != nil {
 		dbError(w, err, &api.logger).Err(err).Str("uid", user.String()).Str("dataset", id.String()).Msg("error getting versions")
 		return
@@ -452,6 +809,116 @@ func (api *DatasetApi) ListVersions(w http.ResponseWriter, r *http.Request, user
 	w.Write(jsondata)
 }
 
+// versionGraph writes all versions of a dataset with their Qvain ids and links to the previous and next versions.
+// With the fetch query parameter, versions that don't exist locally are synced from Metax.
+func (api *DatasetApi) versionGraph(w http.ResponseWriter, r *http.Request, user uuid.UUID, id uuid.UUID) {
+	parser := NewQueryParser(r.URL.Query())
+	fetch := parser.Flag("fetch")
+	if invalid := parser.Validate(); len(invalid) > 0 {
+		loggedJSONError(w, "invalid values: "+strings.Join(invalid, ","), http.StatusBadRequest, &api.logger).Msg("invalid version graph parameter")
+		return
+	}
+
+	versions, err := shared.VersionGraph(r.Context(), api.metax, api.db, api.logger, user, id, fetch)
+	if err != nil {
+		api.handleDatasetError(w, user, id, err, "getting version graph failed")
+		return
+	}
+
+	apiWriteHeaders(w)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	enc.AddStringKey("id", id.String())
+	enc.AddArrayKey("versions", gojay.EncodeArrayFunc(func(enc *gojay.Encoder) {
+		for i := range versions {
+			version := &versions[i]
+			enc.AddObject(gojay.EncodeObjectFunc(func(enc *gojay.Encoder) {
+				enc.AddStringKey("identifier", version.Identifier)
+				enc.AddStringKeyOmitEmpty("preferred_identifier", version.PreferredIdentifier)
+				if version.Id != nil {
+					enc.AddStringKey("qvain_id", version.Id.String())
+				}
+				enc.AddBoolKey("local", version.Id != nil)
+				enc.AddBoolKey("current", version.Id != nil && *version.Id == id)
+				enc.AddBoolKey("removed", version.Removed)
+				if !version.Published.IsZero() {
+					enc.AddTimeKey("published", &version.Published, time.RFC3339)
+				}
+				enc.AddStringKeyOmitEmpty("previous_dataset_version", version.Previous)
+				enc.AddStringKeyOmitEmpty("next_dataset_version", version.Next)
+			}))
+		}
+	}))
+	enc.AppendByte('}')
+	enc.Write()
+}
+
+// diffDataset writes the differences in the research dataset compared to another dataset given in the against query parameter,
+// either as Qvain id or Metax identifier. Fields are listed with their old and new values, and lists such as files and actors
+// with the items added, removed or changed.
+func (api *DatasetApi) diffDataset(w http.ResponseWriter, r *http.Request, user uuid.UUID, id uuid.UUID) {
+	against := r.URL.Query().Get("against")
+	if against == "" {
+		loggedJSONError(w, "missing against parameter", http.StatusBadRequest, &api.logger).Str("dataset", id.String()).Msg("diff failed")
+		return
+	}
+
+	diff, err := shared.DiffDataset(r.Context(), api.metax, api.db, user, id, against)
+	if err != nil {
+		if err == shared.ErrNotVersion {
+			loggedJSONError(w, err.Error(), http.StatusNotFound, &api.logger).Str("dataset", id.String()).Str("against", against).Msg("diff failed")
+			return
+		}
+		api.handleDatasetError(w, user, id, err, "diff failed")
+		return
+	}
+
+	encodeChanges := func(enc *gojay.Encoder, key string, diffs []metax.FieldDiff) {
+		enc.AddArrayKey(key, gojay.EncodeArrayFunc(func(enc *gojay.Encoder) {
+			for _, diff := range diffs {
+				oldVal, newVal := gojay.EmbeddedJSON(diff.Old), gojay.EmbeddedJSON(diff.New)
+				enc.AddObject(gojay.EncodeObjectFunc(func(enc *gojay.Encoder) {
+					enc.AddStringKey("path", diff.Path)
+					enc.AddEmbeddedJSONKeyOmitEmpty("old", &oldVal)
+					enc.AddEmbeddedJSONKeyOmitEmpty("new", &newVal)
+				}))
+			}
+		}))
+	}
+	encodeItems := func(enc *gojay.Encoder, key string, items []json.RawMessage) {
+		enc.AddArrayKey(key, gojay.EncodeArrayFunc(func(enc *gojay.Encoder) {
+			for _, item := range items {
+				embedded := gojay.EmbeddedJSON(item)
+				enc.AddEmbeddedJSON(&embedded)
+			}
+		}))
+	}
+
+	apiWriteHeaders(w)
+	enc := gojay.BorrowEncoder(w)
+	defer enc.Release()
+
+	enc.AppendByte('{')
+	enc.AddStringKey("id", id.String())
+	enc.AddStringKey("against", against)
+	encodeChanges(enc, "fields", diff.Fields)
+	enc.AddArrayKey("lists", gojay.EncodeArrayFunc(func(enc *gojay.Encoder) {
+		for _, list := range diff.Lists {
+			list := list
+			enc.AddObject(gojay.EncodeObjectFunc(func(enc *gojay.Encoder) {
+				enc.AddStringKey("path", list.Path)
+				encodeItems(enc, "added", list.Added)
+				encodeItems(enc, "removed", list.Removed)
+				encodeChanges(enc, "changed", list.Changed)
+			}))
+		}
+	}))
+	enc.AppendByte('}')
+	enc.Write()
+}
+
 // redirectToNew redirects to the location of a newly created (POST) or updated (PUT) resource.
 // Note that http.Redirect() will write and send the headers, so set ours before.
 func (api *DatasetApi) redirectToNew(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
@@ -82,9 +82,9 @@ func (api *LookupApi) Dataset(w http.ResponseWriter, r *http.Request) {
 			loggedJSONError(w, "invalid dataset id", http.StatusBadRequest, &api.logger).Str("qvain_id", qvainId).Msg("invalid dataset id")
 			return
 		}
-		res, err = api.db.ViewDatasetInfoByIdentifier("id", qvainId)
+		res, err = api.db.ViewDatasetInfoByIdentifier(r.Context(), "id", qvainId)
 	} else if metaxId != "" {
-		res, err = api.db.ViewDatasetInfoByIdentifier("identifier", metaxId)
+		res, err = api.db.ViewDatasetInfoByIdentifier(r.Context(), "identifier", metaxId)
 	}
 	if err != nil {
 		dbError(w, err, &api.logger).Msg("error retrieving dataset info")
@@ -2,10 +2,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/CSCfi/qvain-api/internal/version"
@@ -24,6 +27,13 @@ const (
 	HttpWriteTimeout = 25 * time.Second
 	HttpIdleTimeout  = 120 * time.Second
 
+	// RequestTimeout is the deadline for handling an API request, after which database queries are cancelled.
+	// The response can't be written after the write timeout anyway.
+	RequestTimeout = HttpWriteTimeout
+
+	// ShutdownTimeout is how long a graceful shutdown waits for open requests before closing their connections.
+	ShutdownTimeout = 30 * time.Second
+
 	// additional info message when Go web server returns
 	strHttpServerPanic = "http server crashed"
 )
@@ -75,6 +85,15 @@ func main() {
 	err = config.initDB(config.NewLogger("psql"))
 	if err != nil {
 		logger.Error().Err(err).Msg("daba baad")
+	} else {
+		publishDBMetrics(config.db)
+	}
+
+	// apply schema migrations if enabled; don't serve requests against an outdated schema
+	if err == nil && config.dbMigrate {
+		if err = config.migrateDB(config.NewLogger("migrate")); err != nil {
+			logger.Fatal().Err(err).Msg("schema migration failed")
+		}
 	}
 
 	// initialise session manager
@@ -90,8 +109,9 @@ func main() {
 	}
 
 	// default server, without TLSConfig
+	handler, stop := Root(config)
 	srv := &http.Server{
-		Handler:           Root(config),
+		Handler:           handler,
 		ReadTimeout:       HttpReadTimeout,
 		ReadHeaderTimeout: HttpReadTimeout,
 		WriteTimeout:      HttpWriteTimeout,
@@ -130,5 +150,27 @@ func main() {
 		Bool("debug", config.Debug).
 		Bool("dev", config.DevMode).
 		Msg("starting http server")
-	logger.Fatal().Err(srv.ListenAndServe()).Msg(strHttpServerPanic)
+
+	// shut down gracefully on SIGINT and SIGTERM: finish open requests, then stop background services
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		logger.Info().Str("signal", sig.String()).Msg("shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Error().Err(err).Msg("http server shutdown failed")
+		}
+		stop()
+		close(stopped)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Fatal().Err(err).Msg(strHttpServerPanic)
+	}
+	<-stopped
+	logger.Info().Msg("stopped")
 }
@@ -24,7 +24,7 @@ func TestCommonHandlers(t *testing.T) {
 		panic(err)
 	}
 
-	mux := Root(&Config{
+	mux, _ := Root(&Config{
 		tokenKey: key,
 	})
 
@@ -0,0 +1,35 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"os"
+
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/metax/metaxtest"
+	"github.com/rs/zerolog"
+)
+
+// startFakeMetax starts an in-memory fake Metax that only speaks API v1, seeded with the datasets in the given file if any.
+// It returns the host and REST API URL of the fake, and the client options needed to talk to it.
+func startFakeMetax(seed string, logger zerolog.Logger) (string, string, []metax.MetaxOption, error) {
+	fake := metaxtest.NewServer()
+	if seed != "" {
+		if err := loadFakeMetax(fake, seed); err != nil {
+			logger.Error().Err(err).Str("file", seed).Msg("can't load fake Metax datasets")
+		}
+	}
+	logger.Info().Str("url", fake.URL).Int("datasets", fake.Len()).Msg("using fake Metax")
+	return fake.Host(), fake.URL + "/rest/", append(fake.Options(), metax.WithApiVersion(metax.ApiV1)), nil
+}
+
+// loadFakeMetax seeds the fake Metax server with the datasets in a JSON array file.
+func loadFakeMetax(fake *metaxtest.Server, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fake.Load(f)
+}
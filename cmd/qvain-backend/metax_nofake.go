@@ -0,0 +1,16 @@
+//go:build !dev
+// +build !dev
+
+package main
+
+import (
+	"errors"
+
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/rs/zerolog"
+)
+
+// startFakeMetax fails in release builds; the fake Metax is only compiled in with the dev build tag.
+func startFakeMetax(seed string, logger zerolog.Logger) (string, string, []metax.MetaxOption, error) {
+	return "", "", nil, errors.New("fake Metax not available, build with -tags dev")
+}
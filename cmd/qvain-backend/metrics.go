@@ -5,6 +5,8 @@ import (
 	"os"
 	"runtime"
 	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
 )
 
 var (
@@ -15,11 +17,14 @@ var (
 	proxyC    expvar.Int
 	lookupC   expvar.Int
 	statsC    expvar.Int
+	adminC    expvar.Int
+	refdataC  expvar.Int
 	versionC  expvar.Int
 
 	// map containers
 	metricsState = expvar.NewMap("app.state")
 	metricsApis  = expvar.NewMap("app.apis")
+	metricsDB    = expvar.NewMap("app.db")
 
 	// startup time
 	startupTime = time.Now()
@@ -58,6 +63,18 @@ func getNumCgoCall() interface{} {
 	return runtime.NumCgoCall()
 }
 
+// publishDBMetrics exports the connection pool statistics of the database; wait times are in milliseconds.
+func publishDBMetrics(db *psql.DB) {
+	metricsDB.Set("acquired", expvar.Func(func() interface{} { return db.Stats().AcquiredConns }))
+	metricsDB.Set("idle", expvar.Func(func() interface{} { return db.Stats().IdleConns }))
+	metricsDB.Set("total", expvar.Func(func() interface{} { return db.Stats().TotalConns }))
+	metricsDB.Set("max", expvar.Func(func() interface{} { return db.Stats().MaxConns }))
+	metricsDB.Set("acquires", expvar.Func(func() interface{} { return db.Stats().AcquireCount }))
+	metricsDB.Set("empty_acquires", expvar.Func(func() interface{} { return db.Stats().EmptyAcquireCount }))
+	metricsDB.Set("canceled_acquires", expvar.Func(func() interface{} { return db.Stats().CanceledAcquireCount }))
+	metricsDB.Set("wait", expvar.Func(func() interface{} { return db.Stats().AcquireDuration / time.Millisecond }))
+}
+
 func init() {
 	metricsApis.Set("datasets", &datasetsC)
 	metricsApis.Set("sessions", &sessionsC)
@@ -65,6 +82,8 @@ func init() {
 	metricsApis.Set("proxy", &proxyC)
 	metricsApis.Set("lookup", &lookupC)
 	metricsApis.Set("stats", &statsC)
+	metricsApis.Set("admin", &adminC)
+	metricsApis.Set("refdata", &refdataC)
 	metricsApis.Set("version", &versionC)
 
 	startupVar.Set(startupTime.UTC().Format(time.RFC3339))
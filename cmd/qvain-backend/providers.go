@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CSCfi/qvain-api/pkg/env"
+)
+
+const (
+	// DefaultOidcLogoutPath is the logout path at the IdP if none is configured.
+	DefaultOidcLogoutPath = "/idp/profile/Logout"
+
+	// ClaimsFairdata maps claims from the Fairdata authentication proxy (CSCUserName, group_names, ...).
+	ClaimsFairdata = "fairdata"
+
+	// ClaimsGeneric maps standard OpenID Connect claims (sub, name, email).
+	ClaimsGeneric = "generic"
+)
+
+// oidcProviderConfig holds the configuration for one OpenID Connect identity provider.
+type oidcProviderConfig struct {
+	// name is the short, url-safe name used in the /api/auth/{name}/ routes.
+	name string
+
+	// service is the key the identity is stored under in identities.extids; defaults to the provider name.
+	service string
+
+	// claims selects how token claims are mapped to a user: a built-in mapping name or the path to a JSON mapping file.
+	claims        string
+	claimsMapping *claimsMapping
+
+	url          string
+	clientID     string
+	clientSecret string
+	logoutPath   string
+
+	// postLogoutRedirect is where the IdP sends the user after RP-initiated logout; defaults to the application root.
+	postLogoutRedirect string
+
+	// callbackPath is the redirect path registered at the IdP; defaults to /api/auth/{name}/cb.
+	callbackPath string
+}
+
+// CallbackPath returns the path the IdP redirects to after login.
+func (p *oidcProviderConfig) CallbackPath() string {
+	if p.callbackPath != "" {
+		return p.callbackPath
+	}
+	return "/api/auth/" + p.name + "/cb"
+}
+
+// LogoutUrl returns the url the frontend should redirect to after logout.
+func (p *oidcProviderConfig) LogoutUrl() string {
+	if p.url == "" {
+		return ""
+	}
+	return p.url + p.logoutPath
+}
+
+// oidcProvidersFromEnv reads the identity provider configuration from the environment.
+//
+// Providers are listed by name in APP_OIDC_PROVIDERS, separated by commas; each provider is then
+// configured with variables of the form APP_OIDC_{NAME}_{SETTING}, for example:
+//
+//	APP_OIDC_PROVIDERS=csc,haka
+//	APP_OIDC_CSC_PROVIDER_URL=https://...
+//	APP_OIDC_CSC_CLIENT_ID=...
+//
+// If APP_OIDC_PROVIDERS is not set, a single provider is read from the flat APP_OIDC_* variables.
+func oidcProvidersFromEnv() ([]oidcProviderConfig, error) {
+	names := env.Get("APP_OIDC_PROVIDERS")
+	if names == "" {
+		return legacyOidcProviderFromEnv()
+	}
+
+	var (
+		providers []oidcProviderConfig
+		err       error
+	)
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !isValidProviderName(name) {
+			return nil, fmt.Errorf("invalid provider name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate provider %q", name)
+		}
+		seen[name] = true
+
+		prefix := "APP_OIDC_" + strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_"
+		provider := oidcProviderConfig{
+			name:         name,
+			service:      env.GetDefault(prefix+"SERVICE", name),
+			claims:       env.GetDefault(prefix+"CLAIMS", ClaimsFairdata),
+			url:          env.Get(prefix + "PROVIDER_URL"),
+			clientID:     env.Get(prefix + "CLIENT_ID"),
+			clientSecret: env.Get(prefix + "CLIENT_SECRET"),
+			logoutPath:   env.GetDefault(prefix+"LOGOUT_PATH", DefaultOidcLogoutPath),
+
+			postLogoutRedirect: env.Get(prefix + "POST_LOGOUT_REDIRECT"),
+		}
+		if provider.url == "" {
+			return nil, fmt.Errorf("provider %q: missing %sPROVIDER_URL", name, prefix)
+		}
+		if provider.claimsMapping, err = loadClaimsMapping(provider.claims); err != nil {
+			return nil, fmt.Errorf("provider %q: %s", name, err)
+		}
+		providers = append(providers, provider)
+	}
+
+	return providers, nil
+}
+
+// legacyOidcProviderFromEnv reads a single provider from the flat APP_OIDC_* variables; it maps Fairdata claims by default.
+func legacyOidcProviderFromEnv() ([]oidcProviderConfig, error) {
+	url := env.Get("APP_OIDC_PROVIDER_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	claims := env.GetDefault("APP_OIDC_CLAIMS", ClaimsFairdata)
+	mapping, err := loadClaimsMapping(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	// the provider name has always been used as identity service key, so it's kept as configured
+	name := env.GetDefault("APP_OIDC_PROVIDER_NAME", DefaultIdentity)
+	if !isValidProviderName(strings.ToLower(name)) {
+		return nil, fmt.Errorf("invalid provider name %q", name)
+	}
+	return []oidcProviderConfig{{
+		name:          name,
+		service:       name,
+		claims:        claims,
+		claimsMapping: mapping,
+		url:           url,
+		clientID:      env.Get("APP_OIDC_CLIENT_ID"),
+		clientSecret:  env.Get("APP_OIDC_CLIENT_SECRET"),
+		logoutPath:    env.GetDefault("APP_OIDC_LOGOUT_PATH", DefaultOidcLogoutPath),
+
+		postLogoutRedirect: env.Get("APP_OIDC_POST_LOGOUT_REDIRECT"),
+
+		// keep the redirect url already registered at the IdP
+		callbackPath: "/api/auth/cb",
+	}}, nil
+}
+
+// isValidProviderName checks that a provider name can be used as url path segment and in environment variable names.
+func isValidProviderName(name string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	// don't shadow the legacy endpoints
+	return name != "login" && name != "cb" && name != "identities"
+}
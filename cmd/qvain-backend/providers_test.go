@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func setEnv(t *testing.T, vars map[string]string) func() {
+	for k, v := range vars {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for k := range vars {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestOidcProvidersFromEnv(t *testing.T) {
+	t.Run("legacy", func(t *testing.T) {
+		defer setEnv(t, map[string]string{
+			"APP_OIDC_PROVIDER_NAME": "fairdata",
+			"APP_OIDC_PROVIDER_URL":  "https://idp.example.com",
+			"APP_OIDC_CLIENT_ID":     "client",
+		})()
+
+		providers, err := oidcProvidersFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(providers) != 1 {
+			t.Fatalf("expected 1 provider, got %d", len(providers))
+		}
+		if providers[0].name != "fairdata" || providers[0].service != "fairdata" || providers[0].claims != ClaimsFairdata {
+			t.Errorf("unexpected provider: %+v", providers[0])
+		}
+		if providers[0].LogoutUrl() != "https://idp.example.com"+DefaultOidcLogoutPath {
+			t.Errorf("unexpected logout url: %s", providers[0].LogoutUrl())
+		}
+		if providers[0].CallbackPath() != "/api/auth/cb" {
+			t.Errorf("unexpected callback path: %s", providers[0].CallbackPath())
+		}
+	})
+
+	t.Run("legacy name kept", func(t *testing.T) {
+		defer setEnv(t, map[string]string{
+			"APP_OIDC_PROVIDER_NAME": "FairData",
+			"APP_OIDC_PROVIDER_URL":  "https://idp.example.com",
+		})()
+
+		providers, err := oidcProvidersFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(providers) != 1 || providers[0].service != "FairData" {
+			t.Errorf("expected the configured name as service key, got %+v", providers)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		providers, err := oidcProvidersFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(providers) != 0 {
+			t.Errorf("expected no providers, got %d", len(providers))
+		}
+	})
+
+	t.Run("multiple", func(t *testing.T) {
+		defer setEnv(t, map[string]string{
+			"APP_OIDC_PROVIDERS":              "csc, Haka,test-idp",
+			"APP_OIDC_CSC_PROVIDER_URL":       "https://csc.example.com",
+			"APP_OIDC_CSC_SERVICE":            "fairdata",
+			"APP_OIDC_HAKA_PROVIDER_URL":      "https://haka.example.com",
+			"APP_OIDC_HAKA_SERVICE":           "fairdata",
+			"APP_OIDC_TEST_IDP_PROVIDER_URL":  "http://localhost:9000",
+			"APP_OIDC_TEST_IDP_CLAIMS":        "generic",
+			"APP_OIDC_TEST_IDP_LOGOUT_PATH":   "/logout",
+			"APP_OIDC_TEST_IDP_CLIENT_SECRET": "secret",
+		})()
+
+		providers, err := oidcProvidersFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(providers) != 3 {
+			t.Fatalf("expected 3 providers, got %d", len(providers))
+		}
+
+		expected := []struct {
+			name, service, claims string
+		}{
+			{"csc", "fairdata", ClaimsFairdata},
+			{"haka", "fairdata", ClaimsFairdata},
+			{"test-idp", "test-idp", ClaimsGeneric},
+		}
+		for i, exp := range expected {
+			p := providers[i]
+			if p.name != exp.name || p.service != exp.service || p.claims != exp.claims {
+				t.Errorf("provider %d: expected %+v, got %+v", i, exp, p)
+			}
+		}
+		if providers[2].clientSecret != "secret" || providers[2].LogoutUrl() != "http://localhost:9000/logout" {
+			t.Errorf("unexpected provider settings: %+v", providers[2])
+		}
+		if providers[2].CallbackPath() != "/api/auth/test-idp/cb" {
+			t.Errorf("unexpected callback path: %s", providers[2].CallbackPath())
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name string
+			vars map[string]string
+		}{
+			{"missing url", map[string]string{"APP_OIDC_PROVIDERS": "csc"}},
+			{"invalid name", map[string]string{"APP_OIDC_PROVIDERS": "c/s/c"}},
+			{"reserved name", map[string]string{"APP_OIDC_PROVIDERS": "login", "APP_OIDC_LOGIN_PROVIDER_URL": "x"}},
+			{"invalid legacy name", map[string]string{"APP_OIDC_PROVIDER_NAME": "fair data", "APP_OIDC_PROVIDER_URL": "x"}},
+			{"duplicate", map[string]string{"APP_OIDC_PROVIDERS": "csc,csc", "APP_OIDC_CSC_PROVIDER_URL": "x"}},
+			{"unknown claims", map[string]string{"APP_OIDC_PROVIDERS": "csc", "APP_OIDC_CSC_PROVIDER_URL": "x", "APP_OIDC_CSC_CLAIMS": "foo"}},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				defer setEnv(t, test.vars)()
+				if _, err := oidcProvidersFromEnv(); err == nil {
+					t.Error("expected error, got nil")
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/CSCfi/qvain-api/internal/refdata"
+	"github.com/rs/zerolog"
+)
+
+// maxRefdataLimit caps the number of reference data items returned in one response.
+const maxRefdataLimit = 500
+
+// RefdataApi serves cached Metax reference data.
+type RefdataApi struct {
+	cache  *refdata.Cache
+	logger zerolog.Logger
+}
+
+// NewRefdataApi sets up a reference data API.
+func NewRefdataApi(cache *refdata.Cache, logger zerolog.Logger) *RefdataApi {
+	return &RefdataApi{
+		cache:  cache,
+		logger: logger,
+	}
+}
+
+// ServeHTTP handles requests for reference data of a given type, e.g. `/api/refdata/language?q=fin&limit=10`.
+func (api *RefdataApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	typ := ShiftUrlWithTrailing(r)
+	api.logger.Debug().Str("head", typ).Str("path", r.URL.Path).Str("method", r.Method).Msg("refdata")
+
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	if typ == "" || r.URL.Path != "" {
+		loggedJSONError(w, "reference data type required", http.StatusNotFound, &api.logger).Str("path", r.URL.Path).Msg("refdata")
+		return
+	}
+
+	if api.cache == nil {
+		loggedJSONError(w, "reference data not configured", http.StatusServiceUnavailable, &api.logger).Msg("refdata")
+		return
+	}
+
+	limit := refdata.DefaultLimit
+	if param := r.URL.Query().Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 || limit > maxRefdataLimit {
+			loggedJSONError(w, "invalid limit", http.StatusBadRequest, &api.logger).Str("limit", param).Msg("refdata")
+			return
+		}
+	}
+
+	items, err := api.cache.Search(typ, r.URL.Query().Get("q"), limit)
+	switch err {
+	case nil:
+	case refdata.ErrUnknownType:
+		loggedJSONError(w, "unknown reference data type", http.StatusNotFound, &api.logger).Str("type", typ).Msg("refdata")
+		return
+	case refdata.ErrNotLoaded:
+		loggedJSONError(w, "reference data not available", http.StatusServiceUnavailable, &api.logger).Str("type", typ).Msg("refdata")
+		return
+	default:
+		loggedJSONError(w, "reference data error", http.StatusInternalServerError, &api.logger).Err(err).Msg("refdata")
+		return
+	}
+
+	apiWriteHeaders(w)
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		api.logger.Error().Err(err).Msg("failed to encode reference data")
+	}
+}
@@ -13,14 +13,19 @@ type SessionApi struct {
 	sessions       *sessions.Manager
 	logger         zerolog.Logger
 	logoutRedirect string // redirect after logout
+
+	// logoutUrl returns a session specific logout redirect, such as the IdP's end session url, or an empty string
+	logoutUrl func(*sessions.Session) string
 }
 
 // NewSessionApi creates a new SessionApi.
-func NewSessionApi(sessions *sessions.Manager, logger zerolog.Logger, logoutRedirect string) *SessionApi {
+// The optional logoutUrl function takes precedence over the static logoutRedirect if it returns a url for the session.
+func NewSessionApi(sessions *sessions.Manager, logger zerolog.Logger, logoutRedirect string, logoutUrl func(*sessions.Session) string) *SessionApi {
 	return &SessionApi{
 		sessions:       sessions,
 		logger:         logger,
 		logoutRedirect: logoutRedirect,
+		logoutUrl:      logoutUrl,
 	}
 }
 
@@ -45,9 +50,16 @@ func (api *SessionApi) Current(w http.ResponseWriter, r *http.Request) {
 
 // Logout deletes the current user session and returns a json response.
 func (api *SessionApi) Logout(w http.ResponseWriter, r *http.Request) {
+	redirect := api.logoutRedirect
+
 	// If there is no session cookie or destroying session fails, assume
 	// it was already deleted and report successful logout.
 	if sid, err := sessions.GetSessionCookie(r); err == nil {
+		if session, err := api.sessions.Get(sid); err == nil && api.logoutUrl != nil {
+			if url := api.logoutUrl(session); url != "" {
+				redirect = url
+			}
+		}
 		api.sessions.DestroyWithCookie(w, sid)
 	}
 
@@ -59,7 +71,7 @@ func (api *SessionApi) Logout(w http.ResponseWriter, r *http.Request) {
 
 	enc.AppendByte('{')
 	enc.AddStringKey("msg", "User logged out succesfully")
-	enc.AddStringKey("redirect", api.logoutRedirect)
+	enc.AddStringKey("redirect", redirect)
 	enc.AppendByte('}')
 	enc.Write()
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -13,81 +14,56 @@ import (
 
 	gooidc "github.com/coreos/go-oidc"
 	"github.com/rs/zerolog"
+	"github.com/wvh/uuid"
 	"golang.org/x/oauth2"
 )
 
-var (
-	// FairdataTokenProjectPrefixes are used to identify IDA projects from group_names field
-	FairdataTokenProjectPrefixes = []string{"fairdata:IDA01:", "IDA01:"}
-)
+// claimsMapper extracts the user identity and profile from an ID token.
+// The returned user has no Uid or Service set; those are filled in by the session handler.
+type claimsMapper func(idToken *gooidc.IDToken) (*models.User, error)
+
+// MakeSessionHandler is a callback function for the OIDC callback handler to glue token data and our own database to create a user session.
+// The claims mapping declares how token claims become user fields; required claim rules marked as strict-only are enforced
+// if the session manager requires a CSC user name, i.e. outside development mode.
+func MakeSessionHandler(mgr *sessions.Manager, db *psql.DB, onLogin loginHook, logger zerolog.Logger, provider string, svc string, mapping *claimsMapping) func(http.ResponseWriter, *http.Request, *oauth2.Token, *gooidc.IDToken) error {
+	return makeSessionHandler(mgr, db, onLogin, logger, provider, svc, mapping.Mapper(mgr.RequireCSCUserName, logger))
+}
 
-// MakeSessionHandlerForFairdata is a callback function for the OIDC callback handler to glue token data and our own database to create a user session.
-// This particular version handles token fields specific to the Fairdata authentication proxy; see also generic version above.
-func MakeSessionHandlerForFairdata(mgr *sessions.Manager, db *psql.DB, onLogin loginHook, logger zerolog.Logger, svc string) func(http.ResponseWriter, *http.Request, *oauth2.Token, *gooidc.IDToken) error {
+// makeSessionHandler creates the OIDC login callback for a provider.
+//
+// If the login was started as an account linking request, the identity is linked to the user of the current session
+// instead of creating a new session; see linkIdentity.
+func makeSessionHandler(mgr *sessions.Manager, db *psql.DB, onLogin loginHook, logger zerolog.Logger, provider string, svc string, mapClaims claimsMapper) func(http.ResponseWriter, *http.Request, *oauth2.Token, *gooidc.IDToken) error {
 	return func(w http.ResponseWriter, r *http.Request, oauthToken *oauth2.Token, idToken *gooidc.IDToken) error {
-		logger.Debug().Str("svc", svc).Str("subject", idToken.Subject).Msg("session callback called")
-
-		// it is somewhat ok if this stays a nil pointer
-		var user *models.User
-
-		// clumsy but the only way to go
-		var claims struct {
-			CSCUserName   string   `json:"CSCUserName"`
-			GivenName     string   `json:"given_name"`
-			FamilyName    string   `json:"family_name"`
-			Name          string   `json:"name"`
-			Email         string   `json:"email"`
-			EmailVerified bool     `json:"email_verified"`
-			Audience      []string `json:"audience"`
-			Projects      []string `json:"group_names"`
-			Eppn          string   `json:"eppn"`
-			Org           string   `json:"schacHomeOrganization"`
-			OrgType       string   `json:"schacHomeOrganizationType"`
-		}
-		if err := idToken.Claims(&claims); err != nil {
-			// let user be nil pointer
-			logger.Warn().Err(err).Msg("failed to get token claims")
-			return err
-		}
+		logger.Debug().Str("idp", provider).Str("svc", svc).Str("subject", idToken.Subject).Msg("session callback called")
 
-		identity := idToken.Subject
-		if claims.CSCUserName == "" {
-			usingOldProxy := strings.HasSuffix(idToken.Subject, "@fairdataid")
-			if !usingOldProxy && mgr.RequireCSCUserName {
-				return oidc.ErrMissingCSCUserName
-			}
-		} else {
-			identity = claims.CSCUserName
+		user, err := mapClaims(idToken)
+		if err != nil {
+			return err
 		}
 
-		//user should have home organization
-		if claims.Org == "" {
-			return oidc.ErrMissingOrganization
+		if mode, ok := getLinkCookie(r); ok {
+			deleteLinkCookie(w)
+			return linkIdentity(r, mgr, db, logger, provider, svc, user.Identity, idToken.Subject, mode == linkModeMerge)
 		}
 
-		uid, isNew, err := db.RegisterIdentity(svc, identity)
+		uid, isNew, err := registerLogin(r.Context(), db, logger, provider, svc, user.Identity, idToken.Subject)
 		if err != nil {
 			return err
 		}
+		user.Uid = uid
+		user.Service = svc
 
-		name := claims.Name
-		if claims.GivenName != "" || claims.FamilyName != "" {
-			name = strings.TrimSpace(claims.GivenName + " " + claims.FamilyName)
+		// remember the IdP session for logout; dev logins have no oauth token
+		var sidClaim struct {
+			Sid string `json:"sid"`
 		}
-		user = &models.User{
-			Uid:          uid,
-			Identity:     identity,
-			Service:      svc,
-			Name:         name,
-			Email:        claims.Email,
-			Organisation: claims.Org,
+		if err := idToken.Claims(&sidClaim); err != nil {
+			return err
 		}
-
-		// filter project names returned from the token to include only IDA project numbers
-		projects := filterOnAndTrimPrefix(claims.Projects, FairdataTokenProjectPrefixes...)
-		if len(projects) > 0 {
-			user.Projects = projects
-			logger.Debug().Strs("projects", projects).Msg("ida projects in token")
+		var rawIDToken string
+		if oauthToken != nil {
+			rawIDToken, _ = oauthToken.Extra("id_token").(string)
 		}
 
 		_, err = mgr.NewLoginWithCookie(
@@ -95,25 +71,123 @@ func MakeSessionHandlerForFairdata(mgr *sessions.Manager, db *psql.DB, onLogin l
 			&uid,
 			user,
 			sessions.WithExpiration(idToken.Expiry),
+			sessions.WithIdpLogin(provider, idToken.Subject, sidClaim.Sid, rawIDToken),
 		)
 		if err != nil {
 			return err
 		}
 
-		logger.Info().Str("svc", svc).Str("identity", idToken.Subject).Str("uid", uid.String()).Bool("new", isNew).Msg("new session")
+		logger.Info().Str("idp", provider).Str("svc", svc).Str("identity", idToken.Subject).Str("uid", uid.String()).Bool("new", isNew).Msg("new session")
 
 		if onLogin != nil {
-			go onLogin(user)
+			// the hook outlives the login request
+			go onLogin(context.Background(), user)
 		}
 		return nil
 	}
 }
 
-type loginHook func(*models.User) error
+// MakeLogoutHandler is a callback function for the OIDC logout handlers that destroys the sessions created by the provider for a subject or IdP session.
+// Without subject and session id, the session of the current request is destroyed.
+func MakeLogoutHandler(mgr *sessions.Manager, logger zerolog.Logger, provider string) func(http.ResponseWriter, *http.Request, string, string) error {
+	return func(w http.ResponseWriter, r *http.Request, sub string, sid string) error {
+		if sub == "" && sid == "" {
+			if cookieSid, err := sessions.GetSessionCookie(r); err == nil {
+				mgr.DestroyWithCookie(w, cookieSid)
+				logger.Info().Str("idp", provider).Msg("logged out current session")
+			}
+			return nil
+		}
+
+		n := mgr.DestroyIdpSessions(provider, sub, sid)
+		logger.Info().Str("idp", provider).Str("subject", sub).Int("sessions", n).Msg("logged out idp sessions")
+		return nil
+	}
+}
+
+// fullName prefers given and family name claims over the display name claim.
+func fullName(name, givenName, familyName string) string {
+	if givenName != "" || familyName != "" {
+		return strings.TrimSpace(givenName + " " + familyName)
+	}
+	return name
+}
+
+// linkIdentity links an external identity to the user of the current session.
+//
+// If the identity already belongs to another user, that user is merged into the current one. When both users own datasets,
+// the merge is only done if the user confirmed it by starting the link request in merge mode; otherwise the user is sent
+// back to the frontend with a `linkconflict` flag. If the current user already has a different identity for the service,
+// the user is sent back with a `linkotheridentity` flag.
+func linkIdentity(r *http.Request, mgr *sessions.Manager, db *psql.DB, logger zerolog.Logger, provider, svc, identity, subject string, merge bool) error {
+	session, err := mgr.UserSessionFromRequest(r)
+	if err != nil {
+		return oidc.NewFrontendError("linknosession")
+	}
+	uid := session.User.Uid
+	ctx := r.Context()
+
+	err = db.LinkIdentity(ctx, uid, svc, identity)
+	if err == psql.ErrExists {
+		var other uuid.UUID
+		other, err = db.GetUidForIdentity(ctx, svc, identity)
+		if err != nil {
+			return err
+		}
+		err = db.MergeIdentities(ctx, uid, other, merge)
+		if err == nil {
+			logger.Info().Str("idp", provider).Str("svc", svc).Str("uid", uid.String()).Str("merged", other.String()).Msg("merged users")
+		}
+	}
+	switch err {
+	case nil:
+	case psql.ErrConflict:
+		logger.Info().Str("idp", provider).Str("svc", svc).Str("uid", uid.String()).Msg("link conflict: both users own datasets")
+		return oidc.NewFrontendError("linkconflict")
+	case psql.ErrExists:
+		logger.Info().Str("idp", provider).Str("svc", svc).Str("uid", uid.String()).Msg("link conflict: service identity exists")
+		return oidc.NewFrontendError("linkexists")
+	case psql.ErrOtherIdentity:
+		logger.Info().Str("idp", provider).Str("svc", svc).Str("uid", uid.String()).Msg("link conflict: user has another identity for the service")
+		return oidc.NewFrontendError("linkotheridentity")
+	default:
+		return err
+	}
+
+	if provider != svc && subject != "" {
+		if err := db.LinkIdentity(ctx, uid, provider, subject); err != nil {
+			logger.Warn().Err(err).Str("idp", provider).Str("subject", subject).Str("uid", uid.String()).Msg("can't link provider identity")
+		}
+	}
+
+	logger.Info().Str("idp", provider).Str("svc", svc).Str("identity", identity).Str("uid", uid.String()).Msg("linked identity")
+	return nil
+}
+
+// registerLogin gets or creates the application uid for the service identity a user logged in with.
+//
+// When the provider stores its identities under a shared service key, the provider-specific token subject
+// is linked to the same uid, so that one user can have external ids from several providers in identities.extids.
+func registerLogin(ctx context.Context, db *psql.DB, logger zerolog.Logger, provider, svc, identity, subject string) (uuid.UUID, bool, error) {
+	uid, isNew, err := db.RegisterIdentity(ctx, svc, identity)
+	if err != nil {
+		return uid, isNew, err
+	}
+
+	if provider != svc && subject != "" {
+		if err := db.LinkIdentity(ctx, uid, provider, subject); err != nil {
+			// not fatal; the user can still log in with the service identity
+			logger.Warn().Err(err).Str("idp", provider).Str("subject", subject).Str("uid", uid.String()).Msg("can't link provider identity")
+		}
+	}
+	return uid, isNew, nil
+}
+
+type loginHook func(context.Context, *models.User) error
 
 func makeOnFairdataLogin(metax *metax.MetaxService, db *psql.DB, logger zerolog.Logger) loginHook {
-	return func(user *models.User) error {
-		return shared.Fetch(metax, db, logger, user.Uid, user.Identity)
+	return func(ctx context.Context, user *models.User) error {
+		return shared.Fetch(ctx, metax, db, logger, user.Uid, user.Identity)
 	}
 }
 
@@ -89,7 +89,7 @@ func (api *StatsApi) Datasets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := api.db.CountDatasets(filter)
+	result, err := api.db.CountDatasets(r.Context(), filter)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		enc.AppendByte('{')
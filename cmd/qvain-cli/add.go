@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -51,7 +52,7 @@ func runAddRecord(psql *psql.DB, args []string) error {
 		return err
 	}
 
-	identity, err := psql.GetIdentityForUid("fairdata", creator.Get())
+	identity, err := psql.GetIdentityForUid(context.Background(), "fairdata", creator.Get())
 	if err != nil || identity == "" {
 		// No fairdata id available, use a fake one
 		identity = "qvain-user-" + creator.String()
@@ -63,7 +64,7 @@ func runAddRecord(psql *psql.DB, args []string) error {
 	}
 	dataset.CreateData(metax.MetaxDatasetFamily, schema, blob, extra)
 
-	err = psql.Create(dataset.Unwrap())
+	err = psql.Create(context.Background(), dataset.Unwrap())
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 
@@ -28,7 +29,7 @@ func runExportDataset(psql *psql.DB, args []string) error {
 		return fmt.Errorf("error: invalid id: %s", err)
 	}
 
-	blob, err := psql.ExportAsJson(id)
+	blob, err := psql.ExportAsJson(context.Background(), id)
 	if err != nil {
 		return err
 	}
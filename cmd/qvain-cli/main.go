@@ -68,8 +68,10 @@ func usage() {
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "  api:")
 	fmt.Fprintln(os.Stderr, "  view        view datasets by owner [json]")
+	fmt.Fprintln(os.Stderr, "  sync        import datasets of an organisation or project from Metax")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "  db          query db version")
+	fmt.Fprintln(os.Stderr, "  migrate     apply, revert or list schema migrations, or seed the db")
 	fmt.Fprintln(os.Stderr, "  version     show version tag if compiled in")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "This program outputs valid JSON on STDOUT for many commands.")
@@ -93,6 +95,10 @@ func main() {
 		run = runViewDatasetsByOwner
 	case "export":
 		run = runExportDataset
+	case "sync":
+		run = runSync
+	case "migrate":
+		run = runMigrate
 	case "version":
 		if len(version.CommitTag) > 0 {
 			fmt.Fprintln(os.Stderr, "qvain-cli", version.CommitTag)
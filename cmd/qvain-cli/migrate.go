@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+)
+
+func runMigrate(db *psql.DB, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var (
+		target   int
+		seedFile string
+	)
+	flags.IntVar(&target, "to", -1, "target `version` (up: latest, down: previous)")
+	flags.StringVar(&seedFile, "file", "schema/seed.sql", "SQL `file` with seed data")
+
+	flags.Usage = usageFor(flags, "migrate [flags] <up|down|status|seed>")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("error: expected one of up, down, status or seed")
+	}
+
+	ctx := context.Background()
+
+	switch flags.Arg(0) {
+	case "up":
+		if target < 0 {
+			target = 0
+		}
+		applied, err := db.MigrateUp(ctx, target)
+		if err != nil {
+			return err
+		}
+		printMigrations("applied", applied)
+	case "down":
+		if target < 0 {
+			current, err := currentMigration(ctx, db)
+			if err != nil {
+				return err
+			}
+			if current == 0 {
+				fmt.Fprintln(os.Stderr, "no migrations to revert")
+				return nil
+			}
+			target = current - 1
+		}
+		reverted, err := db.MigrateDown(ctx, target)
+		if err != nil {
+			return err
+		}
+		printMigrations("reverted", reverted)
+	case "status":
+		status, err := db.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+		fmt.Fprintf(w, "VERSION\tNAME\tAPPLIED\n")
+		for _, migration := range status {
+			applied := "pending"
+			if !migration.Applied.IsZero() {
+				applied = migration.Applied.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", migration.Version, migration.Name, applied)
+		}
+		w.Flush()
+	case "seed":
+		script, err := ioutil.ReadFile(seedFile)
+		if err != nil {
+			return err
+		}
+		if err = db.Seed(ctx, string(script)); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "seeded database from %s\n", seedFile)
+	default:
+		flags.Usage()
+		return fmt.Errorf("error: unknown migrate command: %s", flags.Arg(0))
+	}
+	return nil
+}
+
+// currentMigration returns the version of the last applied migration, or 0 if none have been applied.
+func currentMigration(ctx context.Context, db *psql.DB) (int, error) {
+	status, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for _, migration := range status {
+		if !migration.Applied.IsZero() {
+			current = migration.Version
+		}
+	}
+	return current, nil
+}
+
+func printMigrations(action string, migrations []psql.Migration) {
+	if len(migrations) == 0 {
+		fmt.Fprintf(os.Stderr, "no migrations %s\n", action)
+		return
+	}
+	for _, migration := range migrations {
+		fmt.Fprintf(os.Stderr, "%s migration %d: %s\n", action, migration.Version, migration.Name)
+	}
+}
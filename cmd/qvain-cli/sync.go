@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/internal/shared"
+	"github.com/CSCfi/qvain-api/pkg/env"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/rs/zerolog"
+	"github.com/wvh/uuid"
+	uuidflag "github.com/wvh/uuid/flag"
+)
+
+func runSync(db *psql.DB, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	var (
+		org      string
+		project  string
+		mapFile  string
+		identity string
+		since    string
+		owner    uuidflag.Uuid
+		verbose  bool
+	)
+	flags.StringVar(&org, "org", "", "import datasets of metadata provider `organisation`")
+	flags.StringVar(&project, "project", "", "import datasets with files in IDA `project`")
+	flags.StringVar(&mapFile, "mapping", "", "JSON `file` mapping metadata provider users to Qvain uids")
+	flags.StringVar(&identity, "identity", "fairdata", "identity `service` of metadata provider users")
+	flags.StringVar(&since, "since", "", "only import datasets modified since `date` (RFC3339)")
+	flags.Var(&owner, "owner", "fallback owner `uuid` for datasets without known owner")
+	flags.BoolVar(&verbose, "v", false, "log every dataset")
+
+	flags.Usage = usageFor(flags, "sync [flags]")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if org == "" && project == "" {
+		flags.Usage()
+		return fmt.Errorf("error: either flag `org` or flag `project` must be set")
+	}
+
+	params := []metax.DatasetOption{metax.WithOrganisation(org), metax.WithProject(project)}
+	if since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return fmt.Errorf("error: invalid date: %s", err)
+		}
+		params = append(params, metax.Since(t))
+	}
+
+	var mapping map[string]uuid.UUID
+	if mapFile != "" {
+		f, err := os.Open(mapFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if mapping, err = shared.ReadOwnerMapping(f); err != nil {
+			return fmt.Errorf("error: invalid mapping file: %s", err)
+		}
+	}
+
+	level := zerolog.InfoLevel
+	if verbose {
+		level = zerolog.DebugLevel
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05.000000"}).Level(level).With().Timestamp().Logger()
+
+	api := metax.NewMetaxService(
+		os.Getenv("APP_METAX_API_HOST"),
+		metax.WithCredentials(os.Getenv("APP_METAX_API_USER"), os.Getenv("APP_METAX_API_PASS")),
+		metax.WithInsecureCertificates(env.GetBool("APP_DEV_MODE")),
+	)
+
+	mapper := shared.NewOwnerMapper(db, identity, mapping, owner.Get())
+	outcome, err := shared.Import(context.Background(), api, db, logger, mapper.Owner, params...)
+	fmt.Fprintf(os.Stderr, "written: %d, skipped: %d, deleted: %d, failed: %d, conflicts: %d\n",
+		outcome.Written, outcome.Skipped, outcome.Deleted, outcome.Failed, outcome.Conflicts)
+	for _, msg := range outcome.Errors {
+		fmt.Fprintf(os.Stderr, "  %s\n", msg)
+	}
+	return err
+}
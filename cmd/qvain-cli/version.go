@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/CSCfi/qvain-api/internal/psql"
@@ -8,11 +9,12 @@ import (
 
 func runPgVersion(psql *psql.DB, args []string) error {
 	var version string
-	conn, err := psql.Connect()
+	ctx := context.Background()
+	conn, err := psql.Connect(ctx)
 	if err != nil {
 		panic(err)
 	}
-	err = conn.QueryRow("select version()").Scan(&version)
+	err = conn.QueryRow(ctx, "select version()").Scan(&version)
 	if err != nil {
 		panic(err)
 	}
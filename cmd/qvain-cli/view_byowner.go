@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -28,7 +29,7 @@ func runViewDatasetsByOwner(psql *psql.DB, args []string) error {
 		return fmt.Errorf("error: either flag `owner` or flag `extid` must be set")
 	}
 
-	blob, err := psql.ViewDatasetsByOwner(owner.Get())
+	blob, err := psql.ViewDatasetsByOwner(context.Background(), owner.Get())
 	if err != nil {
 		return err
 	}
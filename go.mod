@@ -11,17 +11,17 @@ require (
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/google/pprof v0.0.0-20190515194954-54271f7e092f // indirect
 	github.com/ianlancetaylor/demangle v0.0.0-20181102032728-5e5cf60278f6 // indirect
-	github.com/jackc/pgx v3.4.0+incompatible
+	github.com/jackc/pgconn v1.14.3
+	github.com/jackc/pgx/v4 v4.18.3
 	github.com/json-iterator/go v1.1.6
-	github.com/kr/pty v1.1.5 // indirect
-	github.com/mattn/go-isatty v0.0.7
+	github.com/mattn/go-isatty v0.0.12
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/muesli/cache2go v0.0.0-20190501130654-46a3a44c1a5f
 	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
 	github.com/pquerna/ffjson v0.0.0-20181028064349-e517b90714f7
 	github.com/rs/xid v1.2.1
-	github.com/rs/zerolog v1.14.3
+	github.com/rs/zerolog v1.15.0
 	github.com/securego/gosec v0.0.0-20190612222248-04dc713f2259 // indirect
 	github.com/tidwall/gjson v1.2.1
 	github.com/tidwall/match v1.0.1 // indirect
@@ -31,14 +31,7 @@ require (
 	github.com/wvh/sourcelink v0.0.0-20180329151122-13c149cfaa37 // indirect
 	github.com/wvh/uuid v0.0.0-20180305145759-746bc10d0c6f
 	golang.org/x/arch v0.0.0-20190312162104-788fe5ffcd8c // indirect
-	golang.org/x/crypto v0.0.0-20190618222545-ea8f1a30c443 // indirect
-	golang.org/x/lint v0.0.0-20190409202823-959b441ac422 // indirect
-	golang.org/x/mod v0.1.0 // indirect
-	golang.org/x/net v0.0.0-20190619014844-b5b0513f8c1b
+	golang.org/x/net v0.21.0
 	golang.org/x/oauth2 v0.0.0-20190402181905-9f3314589c9a
-	golang.org/x/sys v0.0.0-20190619183051-17bc6164aac4 // indirect
-	golang.org/x/text v0.3.2 // indirect
-	golang.org/x/tools v0.0.0-20190619181801-b76e30ffa0aa // indirect
-	gopkg.in/square/go-jose.v2 v2.3.1 // indirect
-	honnef.co/go/tools v0.0.0-20190614002413-cb51c254f01b // indirect
+	gopkg.in/square/go-jose.v2 v2.3.1
 )
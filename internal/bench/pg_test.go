@@ -1,28 +1,30 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"time"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v4"
 )
 
 func BenchmarkSelect(b *testing.B) {
 	var query string = "SELECT schema FROM datasets WHERE id = '055f1f96-1d1d-e046-3457-b15e1bd8c10c'"
 
-	config, err := pgx.ParseEnvLibpq()
+	ctx := context.Background()
+	config, err := pgx.ParseConfig("")
 	if err != nil {
 		b.Fatal("can't parse psql config from env: ", err)
 	}
 
-	conn, err := pgx.Connect(config)
+	conn, err := pgx.ConnectConfig(ctx, config)
 	if err != nil {
 		b.Fatal("can't connect to postgresql: ", err)
 	}
 
 	var tmp string
 	start := time.Now()
-	err = conn.QueryRow(query).Scan(&tmp)
+	err = conn.QueryRow(ctx, query).Scan(&tmp)
 	if err != nil {
 		b.Fatal("query fails: ", err)
 	}
@@ -32,7 +34,7 @@ func BenchmarkSelect(b *testing.B) {
 		var res string
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			err := conn.QueryRow(query).Scan(&res)
+			err := conn.QueryRow(ctx, query).Scan(&res)
 			if err != nil {
 				b.Fatal("error during query:", err)
 			}
@@ -7,8 +7,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/CSCfi/qvain-api/internal/randomkey"
-
 	gooidc "github.com/coreos/go-oidc"
 	"github.com/rs/zerolog"
 	"golang.org/x/net/context"
@@ -28,13 +26,37 @@ var ErrMissingCSCUserName = errors.New("Missing CSCUserName field")
 // User should have home organization
 var ErrMissingOrganization = errors.New("Missing Organization field")
 
+// FrontendError can be returned from the OnLogin callback to send the user back to the frontend with an error flag in the query string.
+type FrontendError struct {
+	flag string
+}
+
+// NewFrontendError creates a FrontendError that redirects to the frontend url with `?flag=1`.
+func NewFrontendError(flag string) *FrontendError {
+	return &FrontendError{flag: flag}
+}
+
+// Error satisfies the Error interface.
+func (e *FrontendError) Error() string {
+	return "login failed: " + e.flag
+}
+
+// Flag returns the query parameter added to the frontend url.
+func (e *FrontendError) Flag() string {
+	return e.flag
+}
+
 // OidcClient holds the OpenID Connect and OAuth2 configuration for an authentication provider.
 type OidcClient struct {
 	Name        string
 	clientID    string
 	frontendUrl string
-	state       string
-	logger      zerolog.Logger
+	states      *stateStore
+
+	// issuer and end session endpoint from the provider's discovery document
+	issuer        string
+	endSessionUrl string
+	logger        zerolog.Logger
 
 	allowDevLogin bool
 
@@ -46,6 +68,10 @@ type OidcClient struct {
 	//OnLogin func(w http.ResponseWriter, r *http.Request, sub string, exp time.Time) error
 	//OnLogin func(http.ResponseWriter, *http.Request, *oauth2.Token, *gooidc.IDToken) error
 	OnLogin func(http.ResponseWriter, *http.Request, *oauth2.Token, *gooidc.IDToken) error
+
+	// OnLogout is called on back-channel and front-channel logout with the subject and/or IdP session id to log out;
+	// both are empty on a front-channel logout without session id, meaning the current browser session.
+	OnLogout func(w http.ResponseWriter, r *http.Request, sub string, sid string) error
 }
 
 // WithAllowDevLogin enables logging in at [login_url]?token=[jwt_id_token] with a custom token.
@@ -77,6 +103,7 @@ func NewOidcClient(name string, id string, secret string, redirectUrl string,
 		Name:        name,
 		clientID:    id,
 		frontendUrl: frontendUrl,
+		states:      newStateStore(DefaultLoginTimeout * time.Second),
 		logger:      zerolog.Nop(),
 	}
 
@@ -85,6 +112,16 @@ func NewOidcClient(name string, id string, secret string, redirectUrl string,
 		return nil, err
 	}
 
+	var discovery struct {
+		Issuer        string `json:"issuer"`
+		EndSessionUrl string `json:"end_session_endpoint"`
+	}
+	if err = client.oidcProvider.Claims(&discovery); err != nil {
+		return nil, err
+	}
+	client.issuer = discovery.Issuer
+	client.endSessionUrl = discovery.EndSessionUrl
+
 	client.oidcConfig = &gooidc.Config{
 		ClientID:        id,
 		SkipExpiryCheck: false,
@@ -100,8 +137,6 @@ func NewOidcClient(name string, id string, secret string, redirectUrl string,
 		Scopes:       []string{gooidc.ScopeOpenID, "profile", "email"},
 	}
 
-	client.state = "foobar"
-
 	for _, option := range options {
 		option(&client)
 	}
@@ -116,17 +151,17 @@ func (client *OidcClient) SetLogger(logger zerolog.Logger) {
 }
 
 // Auth is a HTTP handler that forwards the OIDC client to the Authorization endpoint.
+//
+// Each request gets a new single-use state with a nonce and a PKCE (S256) code verifier that are kept server-side;
+// the state is also set in a cookie to bind it to the browser that started the login.
 func (client *OidcClient) Auth() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		nonce := r.URL.RawQuery
-
-		key, err := randomkey.Random16()
+		state, entry, err := client.states.New()
 		if err != nil {
 			client.logger.Error().Err(err).Msg("can't create state parameter")
 			http.Error(w, "can't create state parameter", http.StatusInternalServerError)
 			return
 		}
-		state := key.Base64()
 
 		http.SetCookie(w, &http.Cookie{
 			Name:  "state",
@@ -148,13 +183,18 @@ func (client *OidcClient) Auth() http.HandlerFunc {
 			}
 
 			// redirect to our callback url instead of the IdP
-			client.logger.Debug().Str("state", state).Bool("withNonce", len(nonce) > 0).Msg("logging in with dev token, redirect to callback")
+			client.logger.Debug().Msg("logging in with dev token, redirect to callback")
 			http.Redirect(w, r, client.oauthConfig.RedirectURL+"?token="+rawIDToken+"&state="+state, http.StatusFound)
 			return
 		}
 
-		client.logger.Debug().Str("state", state).Bool("withNonce", len(nonce) > 0).Msg("redirect to IdP")
-		http.Redirect(w, r, client.oauthConfig.AuthCodeURL(state, gooidc.Nonce(nonce)), http.StatusFound)
+		client.logger.Debug().Msg("redirect to IdP")
+		http.Redirect(w, r, client.oauthConfig.AuthCodeURL(
+			state,
+			gooidc.Nonce(entry.nonce),
+			oauth2.SetAuthURLParam("code_challenge", codeChallenge(entry.verifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		), http.StatusFound)
 	}
 }
 
@@ -175,11 +215,21 @@ func (client *OidcClient) Callback() http.HandlerFunc {
 			return
 		}
 
-		if r.URL.Query().Get("state") != cookie.Value {
-			client.logger.Debug().Str("param", r.URL.Query().Get("state")).Str("cookie", cookie.Value).Msg("state did not match")
+		state := r.URL.Query().Get("state")
+		if state != cookie.Value {
+			client.logger.Debug().Msg("state did not match")
 			http.Error(w, "state did not match", http.StatusBadRequest)
 			return
 		}
+		clearStateCookie(w)
+
+		// states are single-use; a replayed or expired state is rejected
+		entry, err := client.states.Take(state)
+		if err != nil {
+			client.logger.Debug().Err(err).Msg("state lookup failed")
+			http.Error(w, "login session expired", http.StatusBadRequest)
+			return
+		}
 
 		if rawIDToken = r.URL.Query().Get("token"); rawIDToken != "" {
 			// login with custom ID token, oauth2Token will be nil
@@ -190,7 +240,7 @@ func (client *OidcClient) Callback() http.HandlerFunc {
 			}
 		} else {
 			// get OAuth2 token using authorization code, extract ID token
-			oauth2Token, err = client.oauthConfig.Exchange(ctx, r.URL.Query().Get("code"))
+			oauth2Token, err = client.oauthConfig.Exchange(ctx, r.URL.Query().Get("code"), oauth2.SetAuthURLParam("code_verifier", entry.verifier))
 			if err != nil {
 				client.logger.Error().Err(err).Msg("token exchange failed")
 				http.Error(w, "failed to exchange code for token", http.StatusInternalServerError)
@@ -211,6 +261,13 @@ func (client *OidcClient) Callback() http.HandlerFunc {
 			return
 		}
 
+		// custom dev tokens can't know the nonce
+		if oauth2Token != nil && idToken.Nonce != entry.nonce {
+			client.logger.Error().Msg("id token nonce did not match")
+			http.Error(w, "id token verification failed", http.StatusBadRequest)
+			return
+		}
+
 		// client is now successfully logged in
 		client.logger.Info().Str("sub", idToken.Subject).Msg("login")
 
@@ -226,6 +283,11 @@ func (client *OidcClient) Callback() http.HandlerFunc {
 					http.Redirect(w, r, client.frontendUrl+"?missingorg=1", http.StatusFound)
 					return
 				}
+				if ferr, ok := err.(*FrontendError); ok {
+					client.logger.Info().Str("sub", idToken.Subject).Str("flag", ferr.Flag()).Msg("OnLogin callback redirected to frontend")
+					http.Redirect(w, r, client.frontendUrl+"?"+ferr.Flag()+"=1", http.StatusFound)
+					return
+				}
 
 				client.logger.Error().Err(err).Str("sub", idToken.Subject).Msg("OnLogin callback failed")
 				http.Error(w, "Login failed", http.StatusInternalServerError)
@@ -238,6 +300,19 @@ func (client *OidcClient) Callback() http.HandlerFunc {
 	}
 }
 
+// clearStateCookie removes the state cookie once the login has been handled.
+func clearStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "state",
+		Value:    "",
+		Path:     DefaultCookiePath,
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+}
+
 func (client *OidcClient) DumpToken(w http.ResponseWriter, token *oauth2.Token, idToken *gooidc.IDToken) {
 	// censor access token
 	if token.AccessToken != "" {
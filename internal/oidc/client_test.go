@@ -0,0 +1,345 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	gooidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const testClientID = "qvain-test"
+
+// mockProvider is a minimal OpenID Connect provider that issues signed ID tokens for codes handed out by Authorize.
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	sync.Mutex
+	codes map[string]mockGrant
+
+	// badNonce makes the provider return ID tokens with the wrong nonce
+	badNonce bool
+}
+
+type mockGrant struct {
+	nonce     string
+	challenge string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := &mockProvider{key: key, codes: make(map[string]mockGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 mp.URL,
+			"authorization_endpoint": mp.URL + "/authorize",
+			"token_endpoint":         mp.URL + "/token",
+			"jwks_uri":               mp.URL + "/jwks",
+			"end_session_endpoint":   mp.URL + "/logout?ui=1",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &mp.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", mp.token)
+	mp.Server = httptest.NewServer(mux)
+
+	return mp
+}
+
+// Authorize simulates the user logging in at the IdP and returns the code the IdP would send to the callback.
+func (mp *mockProvider) Authorize(t *testing.T, authUrl string) (code string, state string) {
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Errorf("expected S256 code challenge, got %q", q.Get("code_challenge_method"))
+	}
+	if q.Get("nonce") == "" {
+		t.Error("missing nonce in authorization request")
+	}
+
+	mp.Lock()
+	defer mp.Unlock()
+	code = "code-" + q.Get("state")
+	mp.codes[code] = mockGrant{nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+	return code, q.Get("state")
+}
+
+func (mp *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mp.Lock()
+	grant, ok := mp.codes[r.PostForm.Get("code")]
+	delete(mp.codes, r.PostForm.Get("code"))
+	mp.Unlock()
+
+	if !ok || codeChallenge(r.PostForm.Get("code_verifier")) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	nonce := grant.nonce
+	if mp.badNonce {
+		nonce = "not-the-nonce"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     mp.idToken(nonce),
+	})
+}
+
+func (mp *mockProvider) idToken(nonce string) string {
+	return mp.sign(map[string]interface{}{
+		"iss":   mp.URL,
+		"sub":   "user1",
+		"aud":   testClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": nonce,
+	})
+}
+
+func (mp *mockProvider) sign(claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: mp.key}, (&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		panic(err)
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		panic(err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+// login runs the Auth handler and returns the authorization url and state cookie.
+func login(t *testing.T, client *OidcClient) (string, *http.Cookie) {
+	rec := httptest.NewRecorder()
+	client.Auth().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/auth/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("auth: expected status %d, got %d", http.StatusFound, rec.Code)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "state" {
+		t.Fatalf("auth: expected state cookie, got %v", cookies)
+	}
+	return rec.Header().Get("Location"), cookies[0]
+}
+
+// callback runs the Callback handler with the given query and cookie and returns the response.
+func callback(client *OidcClient, code, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/cb?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	client.Callback().ServeHTTP(rec, req)
+	return rec
+}
+
+func newTestClient(t *testing.T, mp *mockProvider) (*OidcClient, *string) {
+	client, err := NewOidcClient("test", testClientID, "secret", "https://qvain.example.com/api/auth/cb", mp.URL, "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sub string
+	client.OnLogin = func(w http.ResponseWriter, r *http.Request, token *oauth2.Token, idToken *gooidc.IDToken) error {
+		sub = idToken.Subject
+		return nil
+	}
+	return client, &sub
+}
+
+func TestLogin(t *testing.T) {
+	mp := newMockProvider(t)
+	defer mp.Close()
+
+	t.Run("ok", func(t *testing.T) {
+		client, sub := newTestClient(t, mp)
+
+		authUrl, cookie := login(t, client)
+		code, state := mp.Authorize(t, authUrl)
+
+		rec := callback(client, code, state, cookie)
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/login" {
+			t.Fatalf("expected redirect to frontend, got %d %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body.String())
+		}
+		if *sub != "user1" {
+			t.Errorf("expected OnLogin for user1, got %q", *sub)
+		}
+		if client.states.Len() != 0 {
+			t.Errorf("expected state to be consumed, %d left", client.states.Len())
+		}
+
+		// replaying the callback must fail
+		if rec := callback(client, code, state, cookie); rec.Code != http.StatusBadRequest {
+			t.Errorf("replay: expected status %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("state mismatch", func(t *testing.T) {
+		client, sub := newTestClient(t, mp)
+
+		authUrl, _ := login(t, client)
+		code, state := mp.Authorize(t, authUrl)
+
+		_, other := login(t, client)
+		if rec := callback(client, code, state, other); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+		if rec := callback(client, code, state, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("no cookie: expected status %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+		if *sub != "" {
+			t.Error("OnLogin should not have been called")
+		}
+	})
+
+	t.Run("expired state", func(t *testing.T) {
+		client, sub := newTestClient(t, mp)
+
+		authUrl, cookie := login(t, client)
+		code, state := mp.Authorize(t, authUrl)
+
+		client.states.now = func() time.Time { return time.Now().Add(2 * DefaultLoginTimeout * time.Second) }
+		if rec := callback(client, code, state, cookie); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+		if *sub != "" {
+			t.Error("OnLogin should not have been called")
+		}
+	})
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		client, sub := newTestClient(t, mp)
+
+		authUrl, cookie := login(t, client)
+		code, state := mp.Authorize(t, authUrl)
+
+		// swap the stored verifier for another one
+		client.states.Lock()
+		entry := client.states.states[state]
+		entry.verifier = "tampered"
+		client.states.states[state] = entry
+		client.states.Unlock()
+
+		if rec := callback(client, code, state, cookie); rec.Code != http.StatusInternalServerError {
+			t.Errorf("expected status %d, got %d", http.StatusInternalServerError, rec.Code)
+		}
+		if *sub != "" {
+			t.Error("OnLogin should not have been called")
+		}
+	})
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		client, sub := newTestClient(t, mp)
+		mp.badNonce = true
+		defer func() { mp.badNonce = false }()
+
+		authUrl, cookie := login(t, client)
+		code, state := mp.Authorize(t, authUrl)
+
+		if rec := callback(client, code, state, cookie); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+		if *sub != "" {
+			t.Error("OnLogin should not have been called")
+		}
+	})
+}
+
+func TestStateStore(t *testing.T) {
+	store := newStateStore(time.Minute)
+
+	state1, entry1, err := store.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state2, entry2, err := store.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state1 == state2 || entry1.nonce == entry2.nonce || entry1.verifier == entry2.verifier {
+		t.Error("expected unique states, nonces and verifiers")
+	}
+	if entry1.nonce == entry1.verifier {
+		t.Error("nonce and verifier should differ")
+	}
+
+	if _, err := store.Take(state1); err != nil {
+		t.Errorf("take: unexpected error: %v", err)
+	}
+	if _, err := store.Take(state1); err != ErrUnknownState {
+		t.Errorf("second take: expected %v, got %v", ErrUnknownState, err)
+	}
+
+	// expired states are cleaned up when a new one is created
+	store.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, _, err := store.New(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Take(state2); err != ErrUnknownState {
+		t.Errorf("expired: expected %v, got %v", ErrUnknownState, err)
+	}
+	if store.Len() != 1 {
+		t.Errorf("expected 1 state, got %d", store.Len())
+	}
+
+	// a full store drops the oldest state
+	store.max = 2
+	first := store.now()
+	for i := 0; i < 3; i++ {
+		store.now = func() time.Time { return first.Add(time.Duration(i) * time.Second) }
+		if state2, _, err = store.New(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.Len() != 2 {
+		t.Errorf("expected 2 states, got %d", store.Len())
+	}
+	if _, err := store.Take(state2); err != nil {
+		t.Errorf("newest state: unexpected error: %v", err)
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// example from RFC 7636, appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	expected := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if challenge := codeChallenge(verifier); challenge != expected {
+		t.Errorf("expected %s, got %s", expected, challenge)
+	}
+}
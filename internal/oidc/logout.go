@@ -0,0 +1,154 @@
+package oidc
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+)
+
+// BackChannelLogoutEvent is the event type identifying a logout token.
+const BackChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// ErrInvalidLogoutToken is returned when a logout token is missing required claims or contains forbidden ones.
+var ErrInvalidLogoutToken = errors.New("invalid logout token")
+
+// LogoutToken holds the claims from a validated back-channel logout token.
+// At least one of Subject and Sid is set.
+type LogoutToken struct {
+	Subject string
+	Sid     string
+}
+
+// VerifyLogoutToken validates a back-channel logout token as specified in OpenID Connect Back-Channel Logout 1.0.
+//
+// The token signature, issuer, audience and expiry are checked like for ID tokens; in addition the token must contain
+// the back-channel logout event, a `sub` or `sid` claim, and must not contain a nonce.
+func (client *OidcClient) VerifyLogoutToken(ctx context.Context, rawToken string) (*LogoutToken, error) {
+	token, err := client.oidcVerifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Sid    string                            `json:"sid"`
+		Nonce  *string                           `json:"nonce"`
+		Events map[string]map[string]interface{} `json:"events"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	if _, ok := claims.Events[BackChannelLogoutEvent]; !ok {
+		return nil, ErrInvalidLogoutToken
+	}
+	// a nonce is forbidden to prevent ID tokens being used as logout tokens
+	if claims.Nonce != nil {
+		return nil, ErrInvalidLogoutToken
+	}
+	if token.Subject == "" && claims.Sid == "" {
+		return nil, ErrInvalidLogoutToken
+	}
+
+	return &LogoutToken{Subject: token.Subject, Sid: claims.Sid}, nil
+}
+
+// BackChannelLogout is a HTTP handler that takes logout requests sent directly from the IdP.
+// It validates the logout token and calls the OnLogout callback with the subject and session id from the token.
+func (client *OidcClient) BackChannelLogout() http.HandlerFunc {
+	ctx := context.Background()
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		rawToken := r.PostFormValue("logout_token")
+		if rawToken == "" {
+			client.logger.Debug().Msg("back-channel logout without logout token")
+			http.Error(w, "missing logout token", http.StatusBadRequest)
+			return
+		}
+
+		token, err := client.VerifyLogoutToken(ctx, rawToken)
+		if err != nil {
+			client.logger.Info().Err(err).Msg("logout token does not verify")
+			http.Error(w, "invalid logout token", http.StatusBadRequest)
+			return
+		}
+
+		if client.OnLogout != nil {
+			if err := client.OnLogout(w, r, token.Subject, token.Sid); err != nil {
+				client.logger.Error().Err(err).Str("sub", token.Subject).Msg("OnLogout callback failed")
+				http.Error(w, "logout failed", http.StatusNotImplemented)
+				return
+			}
+		}
+
+		client.logger.Info().Str("sub", token.Subject).Bool("withSid", token.Sid != "").Msg("back-channel logout")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// FrontChannelLogout is a HTTP handler for logout requests rendered by the IdP in an iframe in the user's browser.
+//
+// If the IdP sends the `iss` and `sid` parameters, the issuer must match and OnLogout is called with the session id;
+// otherwise OnLogout is called without subject or session id and should end the session of the current browser.
+func (client *OidcClient) FrontChannelLogout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		iss, sid := r.URL.Query().Get("iss"), r.URL.Query().Get("sid")
+		if iss != "" && iss != client.issuer {
+			client.logger.Info().Str("iss", iss).Msg("front-channel logout from wrong issuer")
+			http.Error(w, "issuer did not match", http.StatusBadRequest)
+			return
+		}
+		if (iss == "") != (sid == "") {
+			http.Error(w, "iss and sid must be given together", http.StatusBadRequest)
+			return
+		}
+
+		if client.OnLogout != nil {
+			if err := client.OnLogout(w, r, "", sid); err != nil {
+				client.logger.Error().Err(err).Msg("OnLogout callback failed")
+				http.Error(w, "logout failed", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		client.logger.Info().Bool("withSid", sid != "").Msg("front-channel logout")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// EndSessionUrl returns the url for RP-initiated logout at the IdP, or an empty string if the IdP doesn't support it.
+// Both arguments are optional.
+func (client *OidcClient) EndSessionUrl(idTokenHint string, postLogoutRedirect string) string {
+	if client.endSessionUrl == "" {
+		return ""
+	}
+
+	u, err := url.Parse(client.endSessionUrl)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	if idTokenHint != "" {
+		q.Set("id_token_hint", idTokenHint)
+	}
+	if postLogoutRedirect != "" {
+		q.Set("post_logout_redirect_uri", postLogoutRedirect)
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
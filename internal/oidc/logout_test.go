@@ -0,0 +1,147 @@
+package oidc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackChannelLogout(t *testing.T) {
+	mp := newMockProvider(t)
+	defer mp.Close()
+
+	client, _ := newTestClient(t, mp)
+
+	var gotSub, gotSid string
+	client.OnLogout = func(w http.ResponseWriter, r *http.Request, sub string, sid string) error {
+		gotSub, gotSid = sub, sid
+		return nil
+	}
+
+	claims := func(modify func(map[string]interface{})) string {
+		c := map[string]interface{}{
+			"iss":    mp.URL,
+			"sub":    "user1",
+			"sid":    "idp-session",
+			"aud":    testClientID,
+			"iat":    time.Now().Unix(),
+			"exp":    time.Now().Add(time.Minute).Unix(),
+			"jti":    "logout-1",
+			"events": map[string]interface{}{BackChannelLogoutEvent: map[string]interface{}{}},
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return mp.sign(c)
+	}
+
+	var tests = []struct {
+		name   string
+		token  string
+		status int
+		sub    string
+		sid    string
+	}{
+		{name: "ok", token: claims(nil), status: http.StatusOK, sub: "user1", sid: "idp-session"},
+		{name: "sid only", token: claims(func(c map[string]interface{}) { delete(c, "sub") }), status: http.StatusOK, sid: "idp-session"},
+		{name: "no token", token: "", status: http.StatusBadRequest},
+		{name: "garbage", token: "not.a.token", status: http.StatusBadRequest},
+		{name: "no event", token: claims(func(c map[string]interface{}) { delete(c, "events") }), status: http.StatusBadRequest},
+		{name: "nonce", token: claims(func(c map[string]interface{}) { c["nonce"] = "x" }), status: http.StatusBadRequest},
+		{name: "no sub or sid", token: claims(func(c map[string]interface{}) { delete(c, "sub"); delete(c, "sid") }), status: http.StatusBadRequest},
+		{name: "wrong audience", token: claims(func(c map[string]interface{}) { c["aud"] = "someone-else" }), status: http.StatusBadRequest},
+		{name: "wrong issuer", token: claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }), status: http.StatusBadRequest},
+		{name: "expired", token: claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }), status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotSub, gotSid = "", ""
+
+			req := httptest.NewRequest(http.MethodPost, "/api/auth/test/backchannel-logout", strings.NewReader(url.Values{"logout_token": {test.token}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			client.BackChannelLogout().ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, rec.Code, rec.Body.String())
+			}
+			if rec.Header().Get("Cache-Control") != "no-store" {
+				t.Error("expected Cache-Control: no-store")
+			}
+			if gotSub != test.sub || gotSid != test.sid {
+				t.Errorf("expected OnLogout(%q, %q), got (%q, %q)", test.sub, test.sid, gotSub, gotSid)
+			}
+		})
+	}
+}
+
+func TestFrontChannelLogout(t *testing.T) {
+	mp := newMockProvider(t)
+	defer mp.Close()
+
+	client, _ := newTestClient(t, mp)
+
+	var called bool
+	var gotSid string
+	client.OnLogout = func(w http.ResponseWriter, r *http.Request, sub string, sid string) error {
+		called, gotSid = true, sid
+		return nil
+	}
+
+	var tests = []struct {
+		name   string
+		query  url.Values
+		status int
+		called bool
+		sid    string
+	}{
+		{name: "with sid", query: url.Values{"iss": {mp.URL}, "sid": {"idp-session"}}, status: http.StatusOK, called: true, sid: "idp-session"},
+		{name: "current session", query: url.Values{}, status: http.StatusOK, called: true},
+		{name: "wrong issuer", query: url.Values{"iss": {"https://evil.example.com"}, "sid": {"idp-session"}}, status: http.StatusBadRequest},
+		{name: "sid without issuer", query: url.Values{"sid": {"idp-session"}}, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called, gotSid = false, ""
+
+			rec := httptest.NewRecorder()
+			client.FrontChannelLogout().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/auth/test/frontchannel-logout?"+test.query.Encode(), nil))
+
+			if rec.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, rec.Code, rec.Body.String())
+			}
+			if called != test.called || gotSid != test.sid {
+				t.Errorf("expected OnLogout called=%v with sid %q, got called=%v with sid %q", test.called, test.sid, called, gotSid)
+			}
+		})
+	}
+}
+
+func TestEndSessionUrl(t *testing.T) {
+	mp := newMockProvider(t)
+	defer mp.Close()
+
+	client, _ := newTestClient(t, mp)
+
+	u, err := url.Parse(client.EndSessionUrl("raw.id.token", "https://qvain.example.com/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/logout" {
+		t.Errorf("expected end session path, got %q", u.Path)
+	}
+	q := u.Query()
+	if q.Get("ui") != "1" || q.Get("id_token_hint") != "raw.id.token" || q.Get("post_logout_redirect_uri") != "https://qvain.example.com/" {
+		t.Errorf("unexpected query: %v", q)
+	}
+
+	client.endSessionUrl = ""
+	if url := client.EndSessionUrl("raw.id.token", ""); url != "" {
+		t.Errorf("expected no url without end session endpoint, got %q", url)
+	}
+}
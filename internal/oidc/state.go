@@ -0,0 +1,129 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/randomkey"
+)
+
+// MaxLoginStates limits the number of pending login states kept in memory per identity provider.
+const MaxLoginStates = 10000
+
+var (
+	// ErrUnknownState is returned when a login state is missing, expired or already used.
+	ErrUnknownState = errors.New("unknown or expired login state")
+)
+
+// loginState holds the server-side values for one authorization request.
+type loginState struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// stateStore keeps single-use login states in memory until they expire.
+// It holds at most max states; when it's full, the oldest state is dropped to make room for a new one.
+type stateStore struct {
+	sync.Mutex
+	states  map[string]loginState
+	timeout time.Duration
+	max     int
+	now     func() time.Time
+}
+
+// newStateStore creates a store for login states that are valid for the given duration.
+func newStateStore(timeout time.Duration) *stateStore {
+	return &stateStore{
+		states:  make(map[string]loginState),
+		timeout: timeout,
+		max:     MaxLoginStates,
+		now:     time.Now,
+	}
+}
+
+// New creates a random state, nonce and PKCE code verifier and remembers them until they expire.
+func (store *stateStore) New() (string, loginState, error) {
+	var keys [3]string
+	for i := range keys {
+		key, err := randomkey.Random32()
+		if err != nil {
+			return "", loginState{}, err
+		}
+		keys[i] = base64.RawURLEncoding.EncodeToString(key.Bytes())
+	}
+
+	state := keys[0]
+	entry := loginState{
+		nonce:    keys[1],
+		verifier: keys[2],
+		expires:  store.now().Add(store.timeout),
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	store.expire()
+	if len(store.states) >= store.max {
+		store.dropOldest()
+	}
+	store.states[state] = entry
+
+	return state, entry, nil
+}
+
+// Take returns the login state and removes it from the store, so a state can only be used once.
+func (store *stateStore) Take(state string) (loginState, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, ok := store.states[state]
+	if !ok {
+		return loginState{}, ErrUnknownState
+	}
+	delete(store.states, state)
+
+	if store.now().After(entry.expires) {
+		return loginState{}, ErrUnknownState
+	}
+	return entry, nil
+}
+
+// Len returns the number of pending login states.
+func (store *stateStore) Len() int {
+	store.Lock()
+	defer store.Unlock()
+	return len(store.states)
+}
+
+// expire removes expired states; the caller must hold the lock.
+func (store *stateStore) expire() {
+	now := store.now()
+	for state, entry := range store.states {
+		if now.After(entry.expires) {
+			delete(store.states, state)
+		}
+	}
+}
+
+// dropOldest removes the state that expires first; the caller must hold the lock.
+func (store *stateStore) dropOldest() {
+	var (
+		oldest  string
+		expires time.Time
+	)
+	for state, entry := range store.states {
+		if oldest == "" || entry.expires.Before(expires) {
+			oldest, expires = state, entry.expires
+		}
+	}
+	delete(store.states, oldest)
+}
+
+// codeChallenge returns the S256 PKCE code challenge for a code verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
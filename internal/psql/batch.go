@@ -1,6 +1,7 @@
 package psql
 
 import (
+	"context"
 	"time"
 
 	"github.com/CSCfi/qvain-api/pkg/models"
@@ -8,21 +9,35 @@ import (
 )
 
 type BatchManager struct {
+	db         *DB
+	begin      func(context.Context) (*Tx, error)
 	tx         *Tx
 	triggerUid *uuid.UUID
 	at         time.Time
+
+	// chunked commits; see SetChunkSize
+	chunkSize int
+	pending   int
+	progress  int
+	started   time.Time
+}
+
+func (db *DB) NewBatch(ctx context.Context) (*BatchManager, error) {
+	return db.newBatch(ctx, db.Begin)
 }
 
-func (db *DB) NewBatch() (*BatchManager, error) {
-	tx, err := db.Begin()
+// newBatch starts a batch whose transactions are started with begin.
+func (db *DB) newBatch(ctx context.Context, begin func(context.Context) (*Tx, error)) (*BatchManager, error) {
+	tx, err := begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return &BatchManager{tx: tx, at: time.Now()}, nil
+	now := time.Now()
+	return &BatchManager{db: db, begin: begin, tx: tx, at: now, started: now}, nil
 }
 
-func (db *DB) NewBatchForUser(uid uuid.UUID) (*BatchManager, error) {
-	b, err := db.NewBatch()
+func (db *DB) NewBatchForUser(ctx context.Context, uid uuid.UUID) (*BatchManager, error) {
+	b, err := db.NewBatch(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -31,66 +46,159 @@ func (db *DB) NewBatchForUser(uid uuid.UUID) (*BatchManager, error) {
 	return b, nil
 }
 
-func (b *BatchManager) Create(dataset *models.Dataset) error {
-	return b.tx.Create(dataset)
+// SetChunkSize makes the batch commit after every size records marked done with RecordDone, so a large batch doesn't
+// run in a single transaction. For user batches, progress is stored with each chunk so an interrupted batch can be resumed.
+// Zero, the default, commits only at the end.
+func (b *BatchManager) SetChunkSize(size int) {
+	b.chunkSize = size
+}
+
+// ResumeFrom sets the start time of an interrupted batch this batch resumes, so stored progress keeps pointing to it.
+func (b *BatchManager) ResumeFrom(started time.Time) {
+	b.started = started
+}
+
+// RecordDone marks a record as processed, committing the current chunk if it is full.
+func (b *BatchManager) RecordDone(ctx context.Context) error {
+	b.progress++
+	b.pending++
+	if b.chunkSize <= 0 || b.pending < b.chunkSize {
+		return nil
+	}
+
+	if b.triggerUid != nil {
+		_, err := b.tx.Exec(ctx, `INSERT INTO lastsync(uid, started, progress) VALUES($1, $2, $3) ON CONFLICT (uid) DO UPDATE SET started = $2, progress = $3`,
+			b.triggerUid.Array(), b.started, b.progress)
+		if err != nil {
+			return handleError(err)
+		}
+	}
+	if err := b.tx.Commit(ctx); err != nil {
+		return handleError(err)
+	}
+
+	tx, err := b.begin(ctx)
+	if err != nil {
+		return err
+	}
+	b.tx = tx
+	b.pending = 0
+	return nil
 }
 
-func (b *BatchManager) CreateWithMetadata(dataset *models.Dataset) error {
+// FindForSync finds a Metax dataset of the batch user by Qvain id or, if not found, by Metax identifier.
+// Batches without a user, such as organisation imports, search the datasets of all users.
+// Pass a zero id or empty identifier to search by one of them only. It returns ErrNotFound if there is no such dataset.
+func (b *BatchManager) FindForSync(ctx context.Context, id uuid.UUID, identifier string) (*models.Dataset, error) {
+	var owner interface{}
+	if b.triggerUid != nil {
+		owner = b.triggerUid.Array()
+	}
+
+	var (
+		dataset models.Dataset
+		synced  *time.Time
+		family  int
+		schema  string
+		blob    []byte
+	)
+	err := b.tx.QueryRow(ctx, `SELECT id, creator, owner, modified, synced, published, family, schema, blob FROM datasets
+		WHERE ($1::uuid IS NULL OR owner = $1) AND family = 2 AND (id = $2 OR ($3 <> '' AND blob->>'identifier' = $3))
+		ORDER BY id = $2 DESC LIMIT 1`, owner, id.Array(), identifier).Scan(
+		dataset.Id.Array(), dataset.Creator.Array(), dataset.Owner.Array(), &dataset.Modified, &synced, &dataset.Published, &family, &schema, &blob)
+	if err != nil {
+		return nil, handleError(err)
+	}
+	if synced != nil {
+		dataset.Synced = *synced
+	}
+	dataset.SetData(family, schema, blob)
+	return &dataset, nil
+}
+
+// LockOwner takes the sync lock of a dataset owner until the current chunk is committed, so that a batch without a user,
+// such as an organisation import, doesn't write datasets of a user while the user is being synced. It doesn't wait:
+// ok is false if the owner's sync lock is held elsewhere. User batches hold the lock of their user already.
+func (b *BatchManager) LockOwner(ctx context.Context, uid uuid.UUID) (ok bool, err error) {
+	if b.triggerUid != nil {
+		return true, nil
+	}
+	// transaction-level advisory locks conflict with the session-level ones of TryLockSync, but need no connection of their own
+	err = b.tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock($1, $2)`, syncLockClass, syncLockKey(uid)).Scan(&ok)
+	return ok, handleError(err)
+}
+
+func (b *BatchManager) Create(ctx context.Context, dataset *models.Dataset) error {
+	return b.tx.Create(ctx, dataset)
+}
+
+func (b *BatchManager) CreateWithMetadata(ctx context.Context, dataset *models.Dataset) error {
 	dataset.Synced = b.at
-	return b.tx.createWithMetadata(dataset)
+	return b.tx.createWithMetadata(ctx, dataset)
 }
 
-func (b *BatchManager) UpdateSynced(id uuid.UUID) error {
-	return b.tx.updateSyncedByService(id)
+func (b *BatchManager) UpdateSynced(ctx context.Context, id uuid.UUID) error {
+	return b.tx.updateSyncedByService(ctx, id)
 }
 
-func (b *BatchManager) Update(id uuid.UUID, blob []byte) error {
-	return b.tx.updateByService(id, blob)
+func (b *BatchManager) Update(ctx context.Context, id uuid.UUID, blob []byte) error {
+	return b.tx.updateByService(ctx, id, blob)
 }
 
-func (b *BatchManager) Upsert(data *models.Dataset) error {
+// UpdatePublished updates a dataset and marks it as published, e.g. when a draft was published in Metax.
+func (b *BatchManager) UpdatePublished(ctx context.Context, id uuid.UUID, blob []byte) error {
+	return b.tx.updatePublishedByService(ctx, id, blob)
+}
+
+func (b *BatchManager) Upsert(ctx context.Context, data *models.Dataset) error {
 	return ErrNotImplemented
 }
 
-func (b *BatchManager) Delete(id uuid.UUID) error {
-	return b.tx.deleteByService(id)
+func (b *BatchManager) Delete(ctx context.Context, id uuid.UUID) error {
+	return b.tx.deleteByService(ctx, id)
 }
 
-func (b *BatchManager) writeStamp() error {
+func (b *BatchManager) writeStamp(ctx context.Context) error {
 	if b.triggerUid == nil {
 		return nil
 	}
-	_, err := b.tx.Exec(`INSERT INTO lastsync(uid, ts, success) VALUES($1, $2, $3) ON CONFLICT (uid) DO UPDATE SET ts = $2, success = $3 WHERE lastsync.uid = $1`, b.triggerUid.Array(), time.Now(), true)
+	// changes made upstream while the batch ran are picked up by the next sync, because the stamp is the start time
+	_, err := b.tx.Exec(ctx, `INSERT INTO lastsync(uid, ts, success, started, progress) VALUES($1, $2, $3, NULL, 0)
+		ON CONFLICT (uid) DO UPDATE SET ts = $2, success = $3, started = NULL, progress = 0 WHERE lastsync.uid = $1`, b.triggerUid.Array(), b.at, true)
 	return err
 }
 
-func (b *BatchManager) Commit() error {
-	err := b.writeStamp()
+func (b *BatchManager) Commit(ctx context.Context) error {
+	err := b.writeStamp(ctx)
 	if err != nil {
 		return err
 	}
-	return b.tx.Commit()
+	return b.tx.Commit(ctx)
 }
 
-func (b *BatchManager) Rollback() {
-	defer b.tx.Rollback()
+func (b *BatchManager) Rollback(ctx context.Context) {
+	defer b.tx.Rollback(ctx)
 }
 
-func (db *DB) GetLastSync(uid uuid.UUID) (time.Time, error) {
-	tx, err := db.Begin()
+func (db *DB) GetLastSync(ctx context.Context, uid uuid.UUID) (time.Time, error) {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return time.Time{}, err
 	}
-	defer tx.Rollback()
-	return tx.getLastSync(uid)
+	defer tx.Rollback(ctx)
+	return tx.getLastSync(ctx, uid)
 }
 
-func (tx *Tx) getLastSync(uid uuid.UUID) (time.Time, error) {
-	var last time.Time
-	err := tx.QueryRow("SELECT ts FROM lastsync WHERE uid = $1", uid.Array()).Scan(&last)
+func (tx *Tx) getLastSync(ctx context.Context, uid uuid.UUID) (time.Time, error) {
+	var last *time.Time
+	err := tx.QueryRow(ctx, "SELECT ts FROM lastsync WHERE uid = $1", uid.Array()).Scan(&last)
 	if err != nil {
 		return time.Time{}, handleError(err)
 	}
 
-	return last, nil
+	// a row without timestamp means all sync runs so far have failed
+	if last == nil {
+		return time.Time{}, ErrNotFound
+	}
+	return *last, nil
 }
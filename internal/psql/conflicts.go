@@ -0,0 +1,74 @@
+package psql
+
+import (
+	"context"
+	"time"
+
+	"github.com/wvh/uuid"
+)
+
+// Conflict is the upstream version of a dataset that was changed both locally and upstream since the last sync.
+type Conflict struct {
+	Id       uuid.UUID
+	Detected time.Time
+	Blob     []byte
+}
+
+// StoreConflict stores the upstream version of a dataset in conflict with local changes, replacing an earlier conflict.
+// The local dataset is left as is.
+func (b *BatchManager) StoreConflict(ctx context.Context, id uuid.UUID, blob []byte) error {
+	_, err := b.tx.Exec(ctx, `INSERT INTO conflicts(id, detected, blob) VALUES($1, now(), $2)
+		ON CONFLICT (id) DO UPDATE SET detected = now(), blob = $2`, id.Array(), blob)
+	return handleError(err)
+}
+
+// GetConflict returns the sync conflict of a dataset, or ErrNotFound if there is none.
+// It doesn't check ownership.
+func (db *DB) GetConflict(ctx context.Context, id uuid.UUID) (*Conflict, error) {
+	conflict := &Conflict{Id: id}
+	err := db.pool.QueryRow(ctx, `SELECT detected, blob FROM conflicts WHERE id = $1`, id.Array()).Scan(&conflict.Detected, &conflict.Blob)
+	if err != nil {
+		return nil, handleError(err)
+	}
+	return conflict, nil
+}
+
+// HasConflict returns true if a dataset has an unresolved sync conflict.
+func (db *DB) HasConflict(ctx context.Context, id uuid.UUID) (bool, error) {
+	var exists bool
+	err := db.pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM conflicts WHERE id = $1)`, id.Array()).Scan(&exists)
+	return exists, handleError(err)
+}
+
+// ResolveConflict replaces a dataset in conflict with the resolved version and removes the conflict.
+//
+// If the resolved version keeps local changes, the dataset counts as synced at the time the conflict was detected,
+// so it has local changes to publish but isn't in conflict again with the same upstream version on the next sync.
+// Otherwise the dataset counts as synced now.
+func (db *DB) ResolveConflict(ctx context.Context, id uuid.UUID, blob []byte, keepsLocal bool) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return handleError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	ct, err := tx.Exec(ctx, `UPDATE datasets SET blob = $2, modified = now(), seq = seq + 1,
+		synced = CASE WHEN $3 THEN (SELECT detected FROM conflicts WHERE id = $1) ELSE now() END
+		WHERE id = $1`, id.Array(), blob, keepsLocal)
+	if err != nil {
+		return handleError(err)
+	}
+	if ct.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+
+	ct, err = tx.Exec(ctx, `DELETE FROM conflicts WHERE id = $1`, id.Array())
+	if err != nil {
+		return handleError(err)
+	}
+	if ct.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+
+	return handleError(tx.Commit(ctx))
+}
@@ -1,6 +1,7 @@
 package psql
 
 import (
+	"context"
 	//"errors"
 
 	"log"
@@ -11,55 +12,55 @@ import (
 )
 
 // Create creates a new dataset. It is a convenience wrapper for the Create method on transactions.
-func (db *DB) Create(dataset *models.Dataset) error {
-	tx, err := db.Begin()
+func (db *DB) Create(ctx context.Context, dataset *models.Dataset) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.Create(dataset)
+	err = tx.Create(ctx, dataset)
 	if err != nil {
 		return handleError(err)
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
 // CreateWithMetadata creates a new dataset with extra metadata instead of default values.
-func (db *DB) CreateWithMetadata(dataset *models.Dataset) error {
-	tx, err := db.Begin()
+func (db *DB) CreateWithMetadata(ctx context.Context, dataset *models.Dataset) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.createWithMetadata(dataset)
+	err = tx.createWithMetadata(ctx, dataset)
 	if err != nil {
 		return handleError(err)
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
 // BatchStore takes a list of datasets and stores them as new datasets.
-func (db *DB) BatchStore(datasets []*models.Dataset) error {
-	tx, err := db.Begin()
+func (db *DB) BatchStore(ctx context.Context, datasets []*models.Dataset) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
 	// do something batch-like
 	for _, dataset := range datasets {
-		err = tx.Create(dataset)
+		err = tx.Create(ctx, dataset)
 		if err != nil {
-			tx.Rollback()
+			tx.Rollback(ctx)
 			return err
 		}
 	}
 
-	err = tx.Commit()
+	err = tx.Commit(ctx)
 	if err != nil {
 		return err
 	}
@@ -69,8 +70,8 @@ func (db *DB) BatchStore(datasets []*models.Dataset) error {
 
 // Create inserts a new dataset into the database using default values for date and boolean fields.
 // Use this for new datasets created in this application.
-func (tx *Tx) Create(dataset *models.Dataset) error {
-	_, err := tx.Exec("INSERT INTO datasets(id, creator, owner, family, schema, blob) VALUES($1, $2, $3, $4, $5, $6)",
+func (tx *Tx) Create(ctx context.Context, dataset *models.Dataset) error {
+	_, err := tx.Exec(ctx, "INSERT INTO datasets(id, creator, owner, family, schema, blob) VALUES($1, $2, $3, $4, $5, $6)",
 		dataset.Id.Array(),
 		dataset.Creator.Array(),
 		dataset.Owner.Array(),
@@ -89,8 +90,8 @@ func (tx *Tx) Create(dataset *models.Dataset) error {
 // Use this when the new dataset already has some metadata fields set, such as when it origates from other services.
 //
 // This method does not set Modified, as that field is reserved for user edits.
-func (tx *Tx) createWithMetadata(dataset *models.Dataset) error {
-	_, err := tx.Exec("INSERT INTO datasets(id, creator, owner, created, synced, published, valid, family, schema, blob) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+func (tx *Tx) createWithMetadata(ctx context.Context, dataset *models.Dataset) error {
+	_, err := tx.Exec(ctx, "INSERT INTO datasets(id, creator, owner, created, synced, published, valid, family, schema, blob) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
 		dataset.Id.Array(),
 		dataset.Creator.Array(),
 		dataset.Owner.Array(),
@@ -110,8 +111,8 @@ func (tx *Tx) createWithMetadata(dataset *models.Dataset) error {
 }
 
 // StoreNewVersion inserts a new version of an existing dataset, copying most fields.
-func (tx *Tx) StoreNewVersion(basedOn uuid.UUID, id uuid.UUID, created time.Time, blob []byte) error {
-	tag, err := tx.Exec(`
+func (tx *Tx) StoreNewVersion(ctx context.Context, basedOn uuid.UUID, id uuid.UUID, created time.Time, blob []byte) error {
+	tag, err := tx.Exec(ctx, `
 	INSERT INTO datasets (id, creator, owner, created, modified, synced, published, valid, family, schema, blob)
 		SELECT $2, creator, owner, $3, $3, $3, true, true, family, schema, $4
 		FROM datasets
@@ -132,79 +133,79 @@ func (tx *Tx) StoreNewVersion(basedOn uuid.UUID, id uuid.UUID, created time.Time
 // WithTransaction abstracts some of the database logic by wrapping Tx methods.
 //
 // example:
-// 	db.WithTransaction(func(tx psql.Tx) error {
-// 		return tx.StoreNewVersion(id, parent, created, blob)
+// 	db.WithTransaction(ctx, func(tx psql.Tx) error {
+// 		return tx.StoreNewVersion(ctx, id, parent, created, blob)
 // 	})
-func (db *DB) WithTransaction(f func(tx *Tx) error) error {
-	tx, err := db.Begin()
+func (db *DB) WithTransaction(ctx context.Context, f func(tx *Tx) error) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
 	err = f(tx)
 	if err != nil {
 		return handleError(err)
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
 // StoreNewVersion wraps a StoreNewVersion transaction.
-func (db *DB) StoreNewVersion(id uuid.UUID, basedOn uuid.UUID, created time.Time, blob []byte) error {
-	tx, err := db.Begin()
+func (db *DB) StoreNewVersion(ctx context.Context, id uuid.UUID, basedOn uuid.UUID, created time.Time, blob []byte) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.StoreNewVersion(id, basedOn, created, blob)
+	err = tx.StoreNewVersion(ctx, id, basedOn, created, blob)
 	if err != nil {
 		return handleError(err)
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
-func (db *DB) Update(id uuid.UUID, blob []byte) error {
-	tx, err := db.Begin()
+func (db *DB) Update(ctx context.Context, id uuid.UUID, blob []byte) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.update(id, blob)
+	err = tx.update(ctx, id, blob)
 	if err != nil {
 		return handleError(err)
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
 // UpdateWithOwner updates a dataset with ownership checks.
-func (db *DB) UpdateWithOwner(id uuid.UUID, blob []byte, owner uuid.UUID) error {
-	tx, err := db.Begin()
+func (db *DB) UpdateWithOwner(ctx context.Context, id uuid.UUID, blob []byte, owner uuid.UUID) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.CheckOwner(id, owner)
+	err = tx.CheckOwner(ctx, id, owner)
 	if err != nil {
 		return err
 	}
 
-	err = tx.update(id, blob)
+	err = tx.update(ctx, id, blob)
 	if err != nil {
 		return handleError(err)
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
 // internal update, user triggered
-func (tx *Tx) update(id uuid.UUID, blob []byte) error {
-	ct, err := tx.Exec("UPDATE datasets SET modified = now(), seq = seq + 1, blob = $2 WHERE id = $1", id.Array(), blob)
+func (tx *Tx) update(ctx context.Context, id uuid.UUID, blob []byte) error {
+	ct, err := tx.Exec(ctx, "UPDATE datasets SET modified = now(), seq = seq + 1, blob = $2 WHERE id = $1", id.Array(), blob)
 	if err != nil {
 		return err
 	}
@@ -217,8 +218,12 @@ func (tx *Tx) update(id uuid.UUID, blob []byte) error {
 }
 
 // internal update synced, service triggered
-func (tx *Tx) updateSyncedByService(id uuid.UUID) error {
-	ct, err := tx.Exec("UPDATE datasets SET synced = now(), seq = seq + 1 WHERE id = $1", id.Array())
+//
+// Datasets with local changes since the last sync keep their sync time, which is how later syncs detect conflicts.
+func (tx *Tx) updateSyncedByService(ctx context.Context, id uuid.UUID) error {
+	ct, err := tx.Exec(ctx, `UPDATE datasets SET seq = seq + 1,
+		synced = CASE WHEN synced IS NULL OR modified <= synced THEN now() ELSE synced END
+		WHERE id = $1`, id.Array())
 	if err != nil {
 		return err
 	}
@@ -231,8 +236,22 @@ func (tx *Tx) updateSyncedByService(id uuid.UUID) error {
 }
 
 // internal update, service triggered
-func (tx *Tx) updateByService(id uuid.UUID, blob []byte) error {
-	ct, err := tx.Exec("UPDATE datasets SET synced = now(), modified = now(), seq = seq + 1, blob = $2 WHERE id = $1", id.Array(), blob)
+func (tx *Tx) updateByService(ctx context.Context, id uuid.UUID, blob []byte) error {
+	ct, err := tx.Exec(ctx, "UPDATE datasets SET synced = now(), modified = now(), seq = seq + 1, blob = $2 WHERE id = $1", id.Array(), blob)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// internal update of a dataset published upstream, service triggered
+func (tx *Tx) updatePublishedByService(ctx context.Context, id uuid.UUID, blob []byte) error {
+	ct, err := tx.Exec(ctx, "UPDATE datasets SET synced = now(), modified = now(), seq = seq + 1, published = true, blob = $2 WHERE id = $1", id.Array(), blob)
 	if err != nil {
 		return err
 	}
@@ -245,8 +264,8 @@ func (tx *Tx) updateByService(id uuid.UUID, blob []byte) error {
 }
 
 // internal delete, service triggered
-func (tx *Tx) deleteByService(id uuid.UUID) error {
-	ct, err := tx.Exec(`DELETE FROM datasets WHERE id = $1`, id.Array())
+func (tx *Tx) deleteByService(ctx context.Context, id uuid.UUID) error {
+	ct, err := tx.Exec(ctx, `DELETE FROM datasets WHERE id = $1`, id.Array())
 	if err != nil {
 		return err
 	}
@@ -258,44 +277,44 @@ func (tx *Tx) deleteByService(id uuid.UUID) error {
 	return nil
 }
 
-func (db *DB) Patch(id uuid.UUID, blob []byte) error {
-	tx, err := db.Begin()
+func (db *DB) Patch(ctx context.Context, id uuid.UUID, blob []byte) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.patch(id, blob)
+	err = tx.patch(ctx, id, blob)
 	if err != nil {
 		return handleError(err)
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
 // PatchWithOwner patches a dataset JSON blob with ownership checks.
-func (db *DB) PatchWithOwner(id uuid.UUID, blob []byte, owner uuid.UUID) error {
-	tx, err := db.Begin()
+func (db *DB) PatchWithOwner(ctx context.Context, id uuid.UUID, blob []byte, owner uuid.UUID) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.CheckOwner(id, owner)
+	err = tx.CheckOwner(ctx, id, owner)
 	if err != nil {
 		return err
 	}
 
-	err = tx.patch(id, blob)
+	err = tx.patch(ctx, id, blob)
 	if err != nil {
 		return handleError(err)
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
-func (tx *Tx) patch(id uuid.UUID, blob []byte) error {
-	ct, err := tx.Exec("UPDATE datasets SET modified = now(), seq = seq + 1, blob = blob || $2 WHERE id = $1", id.Array(), blob)
+func (tx *Tx) patch(ctx context.Context, id uuid.UUID, blob []byte) error {
+	ct, err := tx.Exec(ctx, "UPDATE datasets SET modified = now(), seq = seq + 1, blob = blob || $2 WHERE id = $1", id.Array(), blob)
 	if err != nil {
 		return err
 	}
@@ -307,19 +326,19 @@ func (tx *Tx) patch(id uuid.UUID, blob []byte) error {
 	return nil
 }
 
-func (db *DB) SmartGetWithOwner(id uuid.UUID, owner uuid.UUID) (*models.Dataset, error) {
-	tx, err := db.Begin()
+func (db *DB) SmartGetWithOwner(ctx context.Context, id uuid.UUID, owner uuid.UUID) (*models.Dataset, error) {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.CheckOwner(id, owner)
+	err = tx.CheckOwner(ctx, id, owner)
 	if err != nil {
 		return nil, err
 	}
 
-	famId, err := tx.getFamily(id)
+	famId, err := tx.getFamily(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -330,24 +349,24 @@ func (db *DB) SmartGetWithOwner(id uuid.UUID, owner uuid.UUID) (*models.Dataset,
 	}
 
 	if family.IsPartial() {
-		return tx.get(id, family.Key())
+		return tx.get(ctx, id, family.Key())
 	}
-	return tx.get(id, "")
+	return tx.get(ctx, id, "")
 }
 
-func (db *DB) SmartUpdateWithOwner(id uuid.UUID, blob []byte, owner uuid.UUID) error {
-	tx, err := db.Begin()
+func (db *DB) SmartUpdateWithOwner(ctx context.Context, id uuid.UUID, blob []byte, owner uuid.UUID) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.CheckOwner(id, owner)
+	err = tx.CheckOwner(ctx, id, owner)
 	if err != nil {
 		return err
 	}
 
-	famId, err := tx.getFamily(id)
+	famId, err := tx.getFamily(ctx, id)
 	if err != nil {
 		return err
 	}
@@ -358,27 +377,27 @@ func (db *DB) SmartUpdateWithOwner(id uuid.UUID, blob []byte, owner uuid.UUID) e
 	}
 
 	if family.IsPartial() {
-		err = tx.patch(id, blob)
+		err = tx.patch(ctx, id, blob)
 	} else {
-		err = tx.update(id, blob)
+		err = tx.update(ctx, id, blob)
 	}
 	if err != nil {
 		return handleError(err)
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
 // StorePublished saves a published dataset to the database and marks it as published.
 // TODO: handle empty blob
-func (db *DB) StorePublished(id uuid.UUID, blob []byte, synced time.Time) error {
-	tx, err := db.Begin()
+func (db *DB) StorePublished(ctx context.Context, id uuid.UUID, blob []byte, synced time.Time) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	ct, err := tx.Exec("UPDATE datasets SET blob = $2, published = true, synced = $3, seq = seq + 1 WHERE id = $1",
+	ct, err := tx.Exec(ctx, "UPDATE datasets SET blob = $2, published = true, synced = $3, seq = seq + 1 WHERE id = $1",
 		id.Array(), blob, synced)
 	if err != nil {
 		return handleError(err)
@@ -388,17 +407,39 @@ func (db *DB) StorePublished(id uuid.UUID, blob []byte, synced time.Time) error
 		return ErrNotFound
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
+}
+
+// StoreDraft merges the Metax fields of a draft, such as its identifier, into an unpublished dataset.
+// Other fields are kept as they are, so the draft can still be edited locally.
+func (db *DB) StoreDraft(ctx context.Context, id uuid.UUID, fields []byte, synced time.Time) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	ct, err := tx.Exec(ctx, "UPDATE datasets SET blob = blob || $2, synced = $3 WHERE id = $1 AND NOT published",
+		id.Array(), fields, synced)
+	if err != nil {
+		return handleError(err)
+	}
+
+	if ct.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+
+	return tx.Commit(ctx)
 }
 
-func (db *DB) Clone(id uuid.UUID, newid uuid.UUID, blob []byte) error {
-	tx, err := db.Begin()
+func (db *DB) Clone(ctx context.Context, id uuid.UUID, newid uuid.UUID, blob []byte) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	ct, err := tx.Exec(`
+	ct, err := tx.Exec(ctx, `
 		INSERT INTO datasets(id, creator, owner, created, modified, synced, published, valid, family, schema, blob)
 		(SELECT $2, creator, owner, created, modified, synced, published, valid, family, schema, $3 WHERE id = $1)`,
 		id, newid, blob)
@@ -410,12 +451,12 @@ func (db *DB) Clone(id uuid.UUID, newid uuid.UUID, blob []byte) error {
 		return ErrNotFound
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
-func (tx *Tx) getFamily(id uuid.UUID) (int, error) {
+func (tx *Tx) getFamily(ctx context.Context, id uuid.UUID) (int, error) {
 	var fam int
-	err := tx.QueryRow("SELECT family FROM datasets WHERE id = $1", id.Array()).Scan(&fam)
+	err := tx.QueryRow(ctx, "SELECT family FROM datasets WHERE id = $1", id.Array()).Scan(&fam)
 	if err != nil {
 		return 0, handleError(err)
 	}
@@ -424,9 +465,9 @@ func (tx *Tx) getFamily(id uuid.UUID) (int, error) {
 }
 
 // CheckOwner returns an error if the record is not owned by the given user.
-func (tx *Tx) CheckOwner(id uuid.UUID, owner uuid.UUID) error {
+func (tx *Tx) CheckOwner(ctx context.Context, id uuid.UUID, owner uuid.UUID) error {
 	var isOwner bool
-	err := tx.QueryRow("SELECT (owner = $2) FROM datasets WHERE id = $1", id.Array(), owner.Array()).Scan(&isOwner)
+	err := tx.QueryRow(ctx, "SELECT (owner = $2) FROM datasets WHERE id = $1", id.Array(), owner.Array()).Scan(&isOwner)
 	if err != nil {
 		return handleError(err)
 	}
@@ -439,18 +480,18 @@ func (tx *Tx) CheckOwner(id uuid.UUID, owner uuid.UUID) error {
 }
 
 // CheckOwner calls tx.CheckOwner to check if the record exists and is owner by the given user.
-func (db *DB) CheckOwner(id uuid.UUID, owner uuid.UUID) (err error) {
-	tx, err := db.Begin()
+func (db *DB) CheckOwner(ctx context.Context, id uuid.UUID, owner uuid.UUID) (err error) {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	return tx.CheckOwner(id, owner)
+	return tx.CheckOwner(ctx, id, owner)
 }
 
 // Get retrieves a dataset from the database.
-func (db *DB) Get(id uuid.UUID) (*models.Dataset, error) {
+func (db *DB) Get(ctx context.Context, id uuid.UUID) (*models.Dataset, error) {
 	var (
 		valid  *bool
 		family *int
@@ -459,7 +500,7 @@ func (db *DB) Get(id uuid.UUID) (*models.Dataset, error) {
 	)
 
 	res := new(models.Dataset)
-	err := db.pool.QueryRow("select id, creator, owner, valid, family, schema, blob from datasets where id=$1", id.Array()).Scan(res.Id.Array(), res.Creator.Array(), res.Owner.Array(), &valid, &family, &schema, &blob)
+	err := db.pool.QueryRow(ctx, "select id, creator, owner, valid, family, schema, blob from datasets where id=$1", id.Array()).Scan(res.Id.Array(), res.Creator.Array(), res.Owner.Array(), &valid, &family, &schema, &blob)
 	if err != nil {
 		return nil, handleError(err)
 	}
@@ -475,22 +516,22 @@ func (db *DB) Get(id uuid.UUID) (*models.Dataset, error) {
 }
 
 // GetWithOwner retrieves a dataset from the database if the owner matches.
-func (db *DB) GetWithOwner(id uuid.UUID, owner uuid.UUID) (*models.Dataset, error) {
-	tx, err := db.Begin()
+func (db *DB) GetWithOwner(ctx context.Context, id uuid.UUID, owner uuid.UUID) (*models.Dataset, error) {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.CheckOwner(id, owner)
+	err = tx.CheckOwner(ctx, id, owner)
 	if err != nil {
 		return nil, err
 	}
 
-	return tx.get(id, "")
+	return tx.get(ctx, id, "")
 }
 
-func (tx *Tx) get(id uuid.UUID, key string) (*models.Dataset, error) {
+func (tx *Tx) get(ctx context.Context, id uuid.UUID, key string) (*models.Dataset, error) {
 	var (
 		family *int
 		schema *string
@@ -501,11 +542,11 @@ func (tx *Tx) get(id uuid.UUID, key string) (*models.Dataset, error) {
 
 	res := new(models.Dataset)
 	if key == "" {
-		err = tx.QueryRow("select id, creator, owner, family, schema, published, blob from datasets where id=$1",
+		err = tx.QueryRow(ctx, "select id, creator, owner, family, schema, published, blob from datasets where id=$1",
 			id.Array(),
 		).Scan(res.Id.Array(), res.Creator.Array(), res.Owner.Array(), &family, &schema, &res.Published, &blob)
 	} else {
-		err = tx.QueryRow(`select id, creator, owner, family, schema, published, blob#>$2 from datasets where id=$1`,
+		err = tx.QueryRow(ctx, `select id, creator, owner, family, schema, published, blob#>$2 from datasets where id=$1`,
 			id.Array(), []string{key},
 		).Scan(res.Id.Array(), res.Creator.Array(), res.Owner.Array(), &family, &schema, &res.Published, &blob)
 	}
@@ -522,21 +563,21 @@ func (tx *Tx) get(id uuid.UUID, key string) (*models.Dataset, error) {
 }
 
 // Delete removes one dataset from the database if the owner matches.
-func (db *DB) Delete(id uuid.UUID, owner *uuid.UUID) error {
-	tx, err := db.Begin()
+func (db *DB) Delete(ctx context.Context, id uuid.UUID, owner *uuid.UUID) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
 	if owner != nil {
-		err = tx.CheckOwner(id, *owner)
+		err = tx.CheckOwner(ctx, id, *owner)
 		if err != nil {
 			return handleError(err)
 		}
 	}
 
-	ct, err := tx.Exec(`DELETE FROM datasets WHERE id = $1`, id.Array())
+	ct, err := tx.Exec(ctx, `DELETE FROM datasets WHERE id = $1`, id.Array())
 	if err != nil {
 		return handleError(err)
 	}
@@ -545,14 +586,14 @@ func (db *DB) Delete(id uuid.UUID, owner *uuid.UUID) error {
 		return ErrNotFound
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
 // GetAllForUid returns all datasets for a given user.
-func (db *DB) GetAllForUid(uid uuid.UUID) ([]*models.Dataset, error) {
+func (db *DB) GetAllForUid(ctx context.Context, uid uuid.UUID) ([]*models.Dataset, error) {
 	var list []*models.Dataset
 
-	rows, err := db.pool.Query("select id, creator, owner, synced, family, schema, valid, blob from datasets where owner=$1", uid.Array())
+	rows, err := db.pool.Query(ctx, "select id, creator, owner, modified, synced, published, family, schema, valid, blob from datasets where owner=$1", uid.Array())
 	if err != nil {
 		return list, err
 	}
@@ -567,7 +608,7 @@ func (db *DB) GetAllForUid(uid uuid.UUID) ([]*models.Dataset, error) {
 			valid  bool
 			blob   []byte
 		)
-		err = rows.Scan(dataset.Id.Array(), dataset.Creator.Array(), dataset.Owner.Array(), &synced, &family, &schema, &valid, &blob)
+		err = rows.Scan(dataset.Id.Array(), dataset.Creator.Array(), dataset.Owner.Array(), &dataset.Modified, &synced, &dataset.Published, &family, &schema, &valid, &blob)
 		if err != nil {
 			return nil, err
 		}
@@ -589,10 +630,10 @@ func (db *DB) GetAllForUid(uid uuid.UUID) ([]*models.Dataset, error) {
 }
 
 // ListAllForUid returns the list of datasets for a given user.
-func (db *DB) ListAllForUid(uid uuid.UUID) ([]*models.Dataset, error) {
+func (db *DB) ListAllForUid(ctx context.Context, uid uuid.UUID) ([]*models.Dataset, error) {
 	var list []*models.Dataset
 
-	rows, err := db.pool.Query("select id, creator, owner, family, schema, valid from datasets where owner=$1", uid.Array())
+	rows, err := db.pool.Query(ctx, "select id, creator, owner, family, schema, valid from datasets where owner=$1", uid.Array())
 	if err != nil {
 		return list, err
 	}
@@ -624,18 +665,18 @@ func (db *DB) ListAllForUid(uid uuid.UUID) ([]*models.Dataset, error) {
 }
 
 // ChangeOwnerTo updates a dataset's owner.
-func (db *DB) ChangeOwnerTo(id uuid.UUID, uid uuid.UUID) error {
-	tx, err := db.pool.Begin()
+func (db *DB) ChangeOwnerTo(ctx context.Context, id uuid.UUID, uid uuid.UUID) error {
+	tx, err := db.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	tag, err := tx.Exec("UPDATE datasets SET owner = $1 WHERE id = $2", uid.Array(), id.Array())
+	tag, err := tx.Exec(ctx, "UPDATE datasets SET owner = $1 WHERE id = $2", uid.Array(), id.Array())
 	if err != nil {
 		return handleError(err)
 	}
 	log.Println("tag:", tag)
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
@@ -1,6 +1,7 @@
 package psql
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 	"time"
@@ -26,6 +27,7 @@ func TestDatasetNewVersion(t *testing.T) {
 	if err != nil {
 		t.Fatal("psql:", err)
 	}
+	ctx := context.Background()
 
 	var v1 uuid.UUID
 	t.Run("create", func(t *testing.T) {
@@ -39,11 +41,11 @@ func TestDatasetNewVersion(t *testing.T) {
 
 		v1 = dataset.Id
 
-		err = db.Create(dataset)
+		err = db.Create(ctx, dataset)
 		if err != nil {
 			t.Fatal("db.Create():", err)
 		}
-		//defer db.Delete(id, nil)
+		//defer db.Delete(ctx, id, nil)
 	})
 
 	var v2 uuid.UUID
@@ -55,7 +57,7 @@ func TestDatasetNewVersion(t *testing.T) {
 
 		blob := []byte(`{"title":"test dataset","version":2}`)
 
-		err = db.StoreNewVersion(v1, id, time.Now(), blob)
+		err = db.StoreNewVersion(ctx, v1, id, time.Now(), blob)
 		if err != nil {
 			t.Error(err)
 		}
@@ -63,7 +65,7 @@ func TestDatasetNewVersion(t *testing.T) {
 	})
 
 	t.Run("get", func(t *testing.T) {
-		dataset, err := db.Get(v2)
+		dataset, err := db.Get(ctx, v2)
 		if err != nil {
 			t.Error(err)
 		}
@@ -1,10 +1,13 @@
 package psql
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 )
 
 // New returns an error that formats as the given text.
@@ -27,8 +30,11 @@ var (
 	ErrExists         = NewError("exists")
 	ErrNotFound       = NewError("not found")
 	ErrNotOwner       = NewError("not owner")
+	ErrConflict       = NewError("conflict")
 	ErrInvalidJson    = NewError("invalid json")
 	ErrNotImplemented = NewError("not implemented")
+	ErrTooManySyncs   = NewError("too many syncs running")
+	ErrOtherIdentity  = NewError("user has another identity for the service")
 )
 
 // Errors from the underlying database connection.
@@ -53,8 +59,14 @@ func handleError(err error) error {
 		return ErrNotFound
 	}
 
+	// cancelled or past its deadline, while waiting for a connection or a query
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || pgconn.Timeout(err) {
+		return ErrTimeout
+	}
+
 	// pgx/postgres error
-	if pgerr, ok := err.(pgx.PgError); ok {
+	var pgerr *pgconn.PgError
+	if errors.As(err, &pgerr) {
 		switch pgerr.Code {
 		//case "22P02":
 		//	return ErrInvalidJson
@@ -68,7 +80,8 @@ func handleError(err error) error {
 	}
 
 	// net connection error
-	if neterr, ok := err.(*net.OpError); ok {
+	var neterr *net.OpError
+	if errors.As(err, &neterr) {
 		if neterr.Temporary() {
 			return ErrTemporary
 		}
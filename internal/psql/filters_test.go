@@ -1,6 +1,7 @@
 package psql
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"testing"
@@ -40,7 +41,7 @@ func createDataset(t *testing.T, db *DB, created string, user string, org string
 	dataset.Modified = tim
 	dataset.Published = published
 
-	err = db.CreateWithMetadata(dataset)
+	err = db.CreateWithMetadata(context.Background(), dataset)
 	if err != nil {
 		t.Fatal("db.Create:", err)
 	}
@@ -53,16 +54,17 @@ func TestDatasetFilter(t *testing.T) {
 	if err != nil {
 		t.Fatal("psql:", err)
 	}
+	ctx := context.Background()
 
 	// remove test data
 	cleanUp := func() {
-		datasets, err := db.GetAllForUid(filterDatasetOwner)
+		datasets, err := db.GetAllForUid(ctx, filterDatasetOwner)
 		if err != nil {
 			t.Fatal("db.GetAllForUid:", err)
 		}
 
 		for _, d := range datasets {
-			db.Delete(d.Id, &d.Owner)
+			db.Delete(ctx, d.Id, &d.Owner)
 		}
 	}
 	cleanUp()
@@ -85,7 +87,7 @@ func TestDatasetFilter(t *testing.T) {
 			Count int `json:"count"`
 		}
 		filter.QvainOwner = filterDatasetOwner.String()
-		result, err := db.CountDatasets(&filter)
+		result, err := db.CountDatasets(ctx, &filter)
 		if err != nil {
 			t.Error(err)
 		}
@@ -98,7 +100,7 @@ func TestDatasetFilter(t *testing.T) {
 
 		filter.QvainOwner = filterDatasetOwner.String()
 		filter.GroupTimeZone = "UTC"
-		result, err := db.CountDatasets(&filter)
+		result, err := db.CountDatasets(ctx, &filter)
 		if err != nil {
 			t.Error(err)
 		}
@@ -1,8 +1,10 @@
 package psql
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/wvh/uuid"
 )
 
@@ -11,15 +13,15 @@ import (
 //
 // Note that while external ids are not guaranteed to be unique and might refer to multiple application users,
 // this function allows only unique registrations as it creates real (login) users mapped to external accounts.
-func (db *DB) RegisterIdentity(svc, id string) (uid uuid.UUID, isNew bool, err error) {
+func (db *DB) RegisterIdentity(ctx context.Context, svc, id string) (uid uuid.UUID, isNew bool, err error) {
 	var tx *Tx
 
-	tx, err = db.Begin()
+	tx, err = db.Begin(ctx)
 	if err != nil {
 		fmt.Println("ERROR:", err)
 		return uid, isNew, handleError(err)
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
 	// the database can't create our UIDs, so create one in case we need it
 	uid, err = uuid.NewUUID()
@@ -28,20 +30,20 @@ func (db *DB) RegisterIdentity(svc, id string) (uid uuid.UUID, isNew bool, err e
 		return
 	}
 
-	err = tx.QueryRow(`SELECT uid, is_new FROM register_identity($1, $2, $3)`, uid.Array(), svc, id).Scan(uid.Array(), &isNew)
+	err = tx.QueryRow(ctx, `SELECT uid, is_new FROM register_identity($1, $2, $3)`, uid.Array(), svc, id).Scan(uid.Array(), &isNew)
 	if err != nil {
 		return uid, isNew, handleError(err)
 	}
 
-	return uid, isNew, tx.Commit()
+	return uid, isNew, tx.Commit(ctx)
 }
 
 // GetUidForIdentity gets the application uid for a given external service and identity.
 //
 // Note that identities need not be unique, though those used for login ought to be.
-func (db *DB) GetUidForIdentity(svc, id string) (uid uuid.UUID, err error) {
+func (db *DB) GetUidForIdentity(ctx context.Context, svc, id string) (uid uuid.UUID, err error) {
 	// typecast is necessary for Postgresql to know the data type of variadic arguments in prepared statements
-	err = db.pool.QueryRow(`SELECT uid FROM identities WHERE extids @> jsonb_build_object($1::text, $2::text)`, svc, id).Scan(uid.Array())
+	err = db.pool.QueryRow(ctx, `SELECT uid FROM identities WHERE extids @> jsonb_build_object($1::text, $2::text)`, svc, id).Scan(uid.Array())
 	if err != nil {
 		return uid, handleError(err)
 	}
@@ -50,11 +52,136 @@ func (db *DB) GetUidForIdentity(svc, id string) (uid uuid.UUID, err error) {
 }
 
 // GetIdentityForUid gets the identity for a given uid and service.
-func (db *DB) GetIdentityForUid(svc string, uid uuid.UUID) (id string, err error) {
-	err = db.pool.QueryRow(`SELECT extids->>$1 FROM identities WHERE uid = $2`, svc, uid.Array()).Scan(&id)
+func (db *DB) GetIdentityForUid(ctx context.Context, svc string, uid uuid.UUID) (id string, err error) {
+	err = db.pool.QueryRow(ctx, `SELECT extids->>$1 FROM identities WHERE uid = $2`, svc, uid.Array()).Scan(&id)
 	if err != nil {
 		return "", err
 	}
 
 	return id, nil
 }
+
+// LinkIdentity adds an external service identity to an existing application user,
+// so that several external ids can map to the same uid.
+//
+// Linking is idempotent. If the identity already belongs to another user, ErrExists is returned;
+// if the user already has a different identity for the same service, ErrOtherIdentity is returned.
+func (db *DB) LinkIdentity(ctx context.Context, uid uuid.UUID, svc, id string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return handleError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var current uuid.UUID
+	err = tx.QueryRow(ctx, `SELECT uid FROM identities WHERE extids @> jsonb_build_object($1::text, $2::text) LIMIT 1`, svc, id).Scan(current.Array())
+	switch err {
+	case nil:
+		if current != uid {
+			return ErrExists
+		}
+		return nil
+	case pgx.ErrNoRows:
+	default:
+		return handleError(err)
+	}
+
+	var existing *string
+	err = tx.QueryRow(ctx, `SELECT extids->>$2 FROM identities WHERE uid = $1`, uid.Array(), svc).Scan(&existing)
+	if err != nil {
+		return handleError(err)
+	}
+	if existing != nil && *existing != id {
+		return ErrOtherIdentity
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE identities SET extids = extids || jsonb_build_object($2::text, $3::text) WHERE uid = $1`, uid.Array(), svc, id)
+	if err != nil {
+		return handleError(err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// UnlinkIdentity removes the identity for an external service from an application user.
+// The last remaining identity of a user can't be removed; in that case, or if the user has no identity for the service, ErrNotFound is returned.
+func (db *DB) UnlinkIdentity(ctx context.Context, uid uuid.UUID, svc string) error {
+	ct, err := db.pool.Exec(ctx, `
+		UPDATE identities SET extids = extids - $2::text
+		WHERE uid = $1 AND extids ? $2::text AND (SELECT count(*) FROM jsonb_object_keys(extids)) > 1`,
+		uid.Array(), svc)
+	if err != nil {
+		return handleError(err)
+	}
+
+	if ct.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// GetIdentities returns all external identities for a given uid as a map of service to identity.
+func (db *DB) GetIdentities(ctx context.Context, uid uuid.UUID) (map[string]string, error) {
+	var extids map[string]string
+
+	err := db.pool.QueryRow(ctx, `SELECT extids FROM identities WHERE uid = $1`, uid.Array()).Scan(&extids)
+	if err != nil {
+		return nil, handleError(err)
+	}
+
+	return extids, nil
+}
+
+// MergeIdentities moves all external identities, datasets and objects of user `from` to user `into` and removes `from`.
+//
+// If both users own datasets, the merge is refused with ErrConflict unless force is true.
+// If both users have an identity for the same service, the merge is refused with ErrExists.
+func (db *DB) MergeIdentities(ctx context.Context, into uuid.UUID, from uuid.UUID, force bool) error {
+	if into == from {
+		return nil
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return handleError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var intoIds, fromIds map[string]string
+	if err = tx.QueryRow(ctx, `SELECT extids FROM identities WHERE uid = $1 FOR UPDATE`, into.Array()).Scan(&intoIds); err != nil {
+		return handleError(err)
+	}
+	if err = tx.QueryRow(ctx, `SELECT extids FROM identities WHERE uid = $1 FOR UPDATE`, from.Array()).Scan(&fromIds); err != nil {
+		return handleError(err)
+	}
+	for svc, id := range fromIds {
+		if existing, ok := intoIds[svc]; ok && existing != id {
+			return ErrExists
+		}
+	}
+
+	var intoCount, fromCount int
+	err = tx.QueryRow(ctx, `SELECT count(*) FILTER (WHERE owner = $1), count(*) FILTER (WHERE owner = $2) FROM datasets WHERE owner IN ($1, $2)`,
+		into.Array(), from.Array()).Scan(&intoCount, &fromCount)
+	if err != nil {
+		return handleError(err)
+	}
+	if intoCount > 0 && fromCount > 0 && !force {
+		return ErrConflict
+	}
+
+	for _, query := range []string{
+		`UPDATE datasets SET owner = $1 WHERE owner = $2`,
+		`UPDATE datasets SET creator = $1 WHERE creator = $2`,
+		`UPDATE objects SET owner = $1 WHERE owner = $2`,
+		`UPDATE identities SET extids = extids || (SELECT extids FROM identities WHERE uid = $2), login = true WHERE uid = $1`,
+		`DELETE FROM identities WHERE uid = $2`,
+	} {
+		if _, err = tx.Exec(ctx, query, into.Array(), from.Array()); err != nil {
+			return handleError(err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -1,20 +1,35 @@
 package psql
 
 import (
+	"context"
+
 	"github.com/wvh/uuid"
 )
 
-func (db *DB) LookupByQvainId(id uuid.UUID) (bool, error) {
+func (db *DB) LookupByQvainId(ctx context.Context, id uuid.UUID) (bool, error) {
 	var exists bool
-	err := db.pool.QueryRow(`SELECT true FROM datasets WHERE id = $1 LIMIT 1`, id.Array()).Scan(&exists)
+	err := db.pool.QueryRow(ctx, `SELECT true FROM datasets WHERE id = $1 LIMIT 1`, id.Array()).Scan(&exists)
 	return exists, handleError(err)
 }
 
 // LookupByFairdataIdentifier returns the Qvain id for a given Fairdata identifier.
-func (db *DB) LookupByFairdataIdentifier(fdid string) (uuid.UUID, error) {
+func (db *DB) LookupByFairdataIdentifier(ctx context.Context, fdid string) (uuid.UUID, error) {
+	var id uuid.UUID
+	//err := db.pool.QueryRow(ctx, `SELECT id FROM datasets WHERE family = 2 AND blob @> '{"identifier": $1}'`, `"` + fdid + `"`).Scan(&id)
+	err := db.pool.QueryRow(ctx, `SELECT id FROM datasets WHERE family = 2 AND blob @> jsonb_build_object('identifier', $1::text)`, fdid).Scan(id.Array())
+	if err != nil {
+		return id, handleError(err)
+	}
+
+	return id, nil
+}
+
+// LookupByFairdataIdentifierWithOwner returns the Qvain id of the owner's dataset with a given Fairdata identifier.
+// Other users can have their own copy of the same dataset, so lookups on behalf of a user should use this.
+func (db *DB) LookupByFairdataIdentifierWithOwner(ctx context.Context, fdid string, owner uuid.UUID) (uuid.UUID, error) {
 	var id uuid.UUID
-	//err := db.pool.QueryRow(`SELECT id FROM datasets WHERE family = 2 AND blob @> '{"identifier": $1}'`, `"` + fdid + `"`).Scan(&id)
-	err := db.pool.QueryRow(`SELECT id FROM datasets WHERE family = 2 AND blob @> jsonb_build_object('identifier', $1::text)`, fdid).Scan(id.Array())
+	err := db.pool.QueryRow(ctx, `SELECT id FROM datasets WHERE family = 2 AND owner = $2 AND blob @> jsonb_build_object('identifier', $1::text) LIMIT 1`,
+		fdid, owner.Array()).Scan(id.Array())
 	if err != nil {
 		return id, handleError(err)
 	}
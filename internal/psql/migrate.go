@@ -0,0 +1,236 @@
+package psql
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// migrationLock is the advisory lock key that keeps concurrent migrations, e.g. from several starting backends, apart.
+const migrationLock = 0x7176616e
+
+// ErrUnknownMigration means the database has a migration applied that this version of the application doesn't know.
+var ErrUnknownMigration = NewError("database has unknown migration applied")
+
+// Migration is a versioned change to the database schema, with SQL scripts to apply and revert it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration with the time it was applied, which is zero if it hasn't been applied.
+type MigrationStatus struct {
+	Migration
+	Applied time.Time
+}
+
+// Migrations returns the schema migrations known to the application, in order of version.
+func Migrations() []Migration {
+	return append([]Migration(nil), migrations...)
+}
+
+// LatestMigration returns the version of the last known migration.
+func LatestMigration() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrationStatus returns the known migrations and when they were applied to the database.
+func (db *DB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, handleError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	if err = tx.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, handleError(err)
+	}
+
+	applied := make(map[int]time.Time)
+	if exists {
+		if applied, err = tx.appliedMigrations(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		status[i] = MigrationStatus{Migration: migration, Applied: applied[migration.Version]}
+	}
+	return status, nil
+}
+
+// MigrateUp applies all pending migrations up to and including the target version, or all of them if target is 0.
+// Migrations are applied in a single transaction, so either all of them succeed or none.
+// A database that has the schema but no migration table, e.g. one created by hand, is marked as having the first migration applied.
+// It returns the migrations that were applied.
+func (db *DB) MigrateUp(ctx context.Context, target int) ([]Migration, error) {
+	if target == 0 {
+		target = LatestMigration()
+	}
+
+	tx, applied, err := db.beginMigration(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var done []Migration
+	for _, migration := range migrations {
+		if migration.Version > target {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if _, err = tx.Exec(ctx, migration.Up); err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %s", migration.Version, migration.Name, err)
+		}
+		if _, err = tx.Exec(ctx, `INSERT INTO schema_migrations(version, name) VALUES($1, $2)`, migration.Version, migration.Name); err != nil {
+			return nil, handleError(err)
+		}
+		done = append(done, migration)
+	}
+
+	return done, handleError(tx.Commit(ctx))
+}
+
+// MigrateDown reverts all applied migrations after the target version, newest first, in a single transaction.
+// It returns the migrations that were reverted.
+func (db *DB) MigrateDown(ctx context.Context, target int) ([]Migration, error) {
+	tx, applied, err := db.beginMigration(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if migration.Version <= target {
+			break
+		}
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if _, err = tx.Exec(ctx, migration.Down); err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %s", migration.Version, migration.Name, err)
+		}
+		if _, err = tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version); err != nil {
+			return nil, handleError(err)
+		}
+		done = append(done, migration)
+	}
+
+	return done, handleError(tx.Commit(ctx))
+}
+
+// Seed runs an SQL script, such as development data, in a transaction.
+func (db *DB) Seed(ctx context.Context, script string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return handleError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, script); err != nil {
+		return handleError(err)
+	}
+	return handleError(tx.Commit(ctx))
+}
+
+// beginMigration starts a transaction holding the migration lock, creating the migration table if needed,
+// and returns the versions that have been applied.
+func (db *DB) beginMigration(ctx context.Context) (*Tx, map[int]time.Time, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, nil, handleError(err)
+	}
+
+	applied, err := tx.prepareMigration(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return nil, nil, err
+	}
+	return tx, applied, nil
+}
+
+func (tx *Tx) prepareMigration(ctx context.Context) (map[int]time.Time, error) {
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(migrationLock)); err != nil {
+		return nil, handleError(err)
+	}
+
+	var exists, hasSchema bool
+	err := tx.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL, to_regclass('datasets') IS NOT NULL`).Scan(&exists, &hasSchema)
+	if err != nil {
+		return nil, handleError(err)
+	}
+
+	if !exists {
+		_, err = tx.Exec(ctx, `CREATE TABLE schema_migrations (
+			version  int PRIMARY KEY,
+			name     text,
+			applied  timestamp with time zone DEFAULT now()
+		)`)
+		if err != nil {
+			return nil, handleError(err)
+		}
+
+		// adopt databases created from the schema script before migrations existed; later migrations upgrade them
+		if hasSchema && len(migrations) > 0 {
+			_, err = tx.Exec(ctx, `INSERT INTO schema_migrations(version, name) VALUES($1, $2)`, migrations[0].Version, migrations[0].Name)
+			if err != nil {
+				return nil, handleError(err)
+			}
+		}
+	}
+
+	applied, err := tx.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for version := range applied {
+		if !isKnownMigration(version) {
+			return nil, ErrUnknownMigration
+		}
+	}
+	return applied, nil
+}
+
+// appliedMigrations returns the applied migration versions and when they were applied.
+func (tx *Tx) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := tx.Query(ctx, `SELECT version, applied FROM schema_migrations`)
+	if err != nil {
+		return nil, handleError(err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			ts      time.Time
+		)
+		if err = rows.Scan(&version, &ts); err != nil {
+			return nil, handleError(err)
+		}
+		applied[version] = ts
+	}
+	return applied, handleError(rows.Err())
+}
+
+// isKnownMigration checks if a version is in the list of migrations.
+func isKnownMigration(version int) bool {
+	for _, migration := range migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
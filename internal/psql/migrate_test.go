@@ -0,0 +1,77 @@
+package psql
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMigrationList(t *testing.T) {
+	if len(migrations) == 0 {
+		t.Fatal("no migrations")
+	}
+
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %q: expected version %d, got %d", migration.Name, i+1, migration.Version)
+		}
+		if migration.Name == "" {
+			t.Errorf("migration %d: missing name", migration.Version)
+		}
+		if strings.TrimSpace(migration.Up) == "" || strings.TrimSpace(migration.Down) == "" {
+			t.Errorf("migration %d: missing up or down script", migration.Version)
+		}
+	}
+
+	if LatestMigration() != migrations[len(migrations)-1].Version {
+		t.Errorf("unexpected latest migration: %d", LatestMigration())
+	}
+}
+
+// TestMigrateRoundTrip reverts the latest migration and applies it again.
+func TestMigrateRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	db, err := NewPoolServiceFromEnv()
+	if err != nil {
+		t.Fatal("psql:", err)
+	}
+	ctx := context.Background()
+
+	if _, err = db.MigrateUp(ctx, 0); err != nil {
+		t.Fatal("db.MigrateUp():", err)
+	}
+
+	latest := LatestMigration()
+	if latest < 2 {
+		t.Skip("reverting the initial schema would drop test data")
+	}
+
+	reverted, err := db.MigrateDown(ctx, latest-1)
+	if err != nil {
+		t.Fatal("db.MigrateDown():", err)
+	}
+	if len(reverted) != 1 || reverted[0].Version != latest {
+		t.Errorf("expected migration %d to be reverted, got %v", latest, reverted)
+	}
+
+	applied, err := db.MigrateUp(ctx, 0)
+	if err != nil {
+		t.Fatal("db.MigrateUp():", err)
+	}
+	if len(applied) != 1 || applied[0].Version != latest {
+		t.Errorf("expected migration %d to be applied, got %v", latest, applied)
+	}
+
+	status, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal("db.MigrationStatus():", err)
+	}
+	for _, migration := range status {
+		if migration.Applied.IsZero() {
+			t.Errorf("migration %d not applied", migration.Version)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package psql
+
+// migrations lists the schema migrations of the Qvain database, in order of version.
+//
+// Migrations are append-only: once a migration has been released, it must not be changed.
+// Schema changes go into a new migration with the next version number and a Down script that reverts it.
+// The tables should be owned by the role the application connects as, which should not have admin privileges.
+//
+// Migration 1 is the schema of the hand-applied schema.sql script that predates migrations; databases created from it
+// are adopted at version 1. Some of them have the changes of later migrations already, so these use IF NOT EXISTS.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: `
+	-- Function next_object_id generates a 64-bit ID sequence like Instagram and Twitter Snowflake.
+	--
+	-- This ID is used as primary key for user object storage.
+	--
+	-- Based on articles by Instagram and Rob Conery:
+	--   https://instagram-engineering.com/sharding-ids-at-instagram-1cf5a71e5a5c
+	--   https://rob.conery.io/2014/05/28/a-better-id-generator-for-postgresql/
+	CREATE OR REPLACE FUNCTION next_object_id(OUT result bigint) AS $$
+	DECLARE
+	    our_epoch bigint := 1530540000666;
+	    seq_id bigint;
+	    now_millis bigint;
+	    shard_id int := 1;
+	BEGIN
+	    SELECT nextval('object_id_seq') % 1024 INTO seq_id;
+
+	    SELECT FLOOR(EXTRACT(EPOCH FROM clock_timestamp()) * 1000) INTO now_millis;
+	    result := (now_millis - our_epoch) << 23;
+	    result := result | (shard_id << 10);
+	    result := result | (seq_id);
+	END;
+	$$ LANGUAGE PLPGSQL;
+
+	CREATE SEQUENCE object_id_seq;
+
+	-- Table datasets contains datasets of different types (families).
+	--
+	-- The blob field has the actual dataset as it is known to external services;
+	-- the other fields are internal metadata.
+	CREATE TABLE datasets (
+		id          uuid PRIMARY KEY,
+		creator     uuid,
+		owner       uuid,
+
+		created     timestamp with time zone DEFAULT now(),
+		modified    timestamp with time zone DEFAULT now(),
+		synced      timestamp with time zone,
+		seq         integer DEFAULT 0,
+
+		published   boolean DEFAULT false,
+		valid       boolean DEFAULT false,
+
+		family      int,
+		schema      text,
+		blob        jsonb
+	);
+
+	-- Table identities lists app users and their external identities.
+	--
+	-- Performance-wise, t's a toss up between having a JSONB field or joining one-to-many with a normalised table,
+	-- but it might be easier to query for a dynamically chosen JSONB key when we need to show the identity most relevant to the requested view.
+	--
+	-- uid is Qvain's user id.
+	-- extids is a JSON object with external service name as key and external account as value.
+	-- login is a boolean that, if true, indicates that the account is an actual user that can log in.
+	-- profile is a JSON object for storing user settings across sessions.
+	--
+	-- Note: The JSONB field is indexed, don't stuff too much stuff in it.
+	--       You can drop unwanted identities trivially with a JSON operator (the WHERE clause speeds up the operation if not all users have that key):
+	--       UPDATE identities SET extids = extids - 'some_id' WHERE extids->'some_id' IS NOT NULL;
+	CREATE TABLE identities (
+		uid     uuid PRIMARY KEY,
+		extids  jsonb DEFAULT '{}'::JSONB,
+		login   boolean DEFAULT false,
+		profile jsonb DEFAULT '{}'::JSONB
+		--CONSTRAINT unique_identity UNIQUE (extid)
+	);
+
+
+	-- Index idx_btree_extid_fairdata indexes the fairdata identity;
+	-- this sort of index needs to be done for every JSONB field one might want to query against.
+	CREATE INDEX idx_btree_extid_fairdata ON identities USING BTREE ((extids->>'fairdata'));
+
+	-- Index idx_gin_extid_all indexes all key/value combinations in extids;
+	-- this index has all key->path->value paths but supports existence checking only.
+	CREATE INDEX idx_gin_extid_all ON identities USING GIN (extids jsonb_path_ops);
+
+	-- Table lastsync stores the time of last synchronisation for a user's records from an external service.
+	CREATE TABLE lastsync (
+		uid      uuid PRIMARY KEY REFERENCES identities(uid) ON DELETE CASCADE ON UPDATE CASCADE,
+		ts       timestamp with time zone,
+		success  boolean DEFAULT false,
+		msg      text
+	);
+
+	-- Table objects stores user saved objects.
+	CREATE TABLE objects (
+	    id       bigint NOT NULL DEFAULT next_object_id(),
+	    owner    uuid REFERENCES identities(uid) ON DELETE CASCADE ON UPDATE CASCADE,
+	    family   int,
+	    schema   text,
+	    type     text,
+	    blob     jsonb
+	);
+
+	-- View view_fairdata_dataset is the API view of a Fairdata dataset.
+	-- Note: Sub-queries were faster than joins for test data.
+	CREATE OR REPLACE VIEW view_fairdata_dataset AS
+	    SELECT id, row_to_json(ds) "json" FROM (
+	        SELECT id, created, modified, synced, published, family AS type, schema, blob AS dataset,
+	        (SELECT extids->'fairdata' FROM identities WHERE uid = creator) AS creator,
+	        (SELECT extids->'fairdata' FROM identities WHERE uid = owner) AS owner
+	        FROM datasets
+	    ) ds, pg_sleep(0.5);
+
+	-- View view_fairdata_list is the API view of a Fairdata dataset listing.
+	CREATE OR REPLACE VIEW view_fairdata_list AS
+	    SELECT json_agg(dslist) "by_owner"
+	    FROM (
+	        SELECT id, owner, created, modified, published,
+	            blob#>'{research_dataset,identifier}' identifier,
+	            blob#>'{research_dataset,title}' title,
+	            blob#>'{research_dataset,description}' description,
+	            blob#>'{preservation_state}' preservation_state
+	        FROM datasets
+	        -- WHERE owner = $1
+	    ) dslist;
+
+	-- Function register_identity creates a new user on login from an external service.
+	CREATE OR REPLACE FUNCTION register_identity(_uid UUID, _svc TEXT, _extid TEXT) RETURNS TABLE (
+	 uid UUID,
+	 is_new boolean
+	) AS
+	$func$
+	BEGIN
+	   RETURN QUERY
+	   SELECT ids.uid, false
+	   FROM   identities ids
+	   WHERE  extids @> jsonb_build_object(_svc, _extid)
+	   LIMIT  1;
+
+	   IF NOT FOUND THEN
+	      RETURN QUERY
+	      INSERT INTO identities(uid, extids, login)
+	      VALUES (_uid, jsonb_build_object(_svc, _extid), true)
+	      RETURNING identities.uid, true;
+	   END IF;
+	END
+	$func$ LANGUAGE plpgsql;
+
+	-- Function owner_exception returns a boolean value or exception if the wanted owner doesn't match the actual owner.
+	--
+	-- Example ($1 is the current application user and $2 is the id of the wanted dataset):
+	--   SELECT owner_exception($1, owner), blob->'dataset_version_set' from datasets where id = $2;
+	--
+	-- NOTE: Not used until the performance impact is more clear.
+	CREATE OR REPLACE FUNCTION owner_exception(in wanted uuid, in actual uuid)
+	RETURNS boolean AS
+	$$
+	BEGIN
+	  IF wanted = actual THEN
+	    RETURN true;
+	  ELSE
+	    RAISE EXCEPTION 'not owner';
+		RETURN false;
+	  END IF;
+	END;
+	$$
+	LANGUAGE plpgsql;
+`,
+		Down: `
+	DROP FUNCTION IF EXISTS owner_exception(uuid, uuid);
+	DROP FUNCTION IF EXISTS register_identity(uuid, text, text);
+	DROP VIEW IF EXISTS view_fairdata_list;
+	DROP VIEW IF EXISTS view_fairdata_dataset;
+	DROP TABLE IF EXISTS objects;
+	DROP TABLE IF EXISTS lastsync;
+	DROP TABLE IF EXISTS identities;
+	DROP TABLE IF EXISTS datasets;
+	DROP FUNCTION IF EXISTS next_object_id();
+	DROP SEQUENCE IF EXISTS object_id_seq;
+`,
+	},
+	{
+		Version: 2,
+		Name:    "sync outcomes",
+		Up: `
+	-- ts is the time of the last successful sync, used as starting point for incremental syncs.
+	-- run is the time of the last sync run, success and msg its outcome and error messages,
+	-- and the counters count the datasets it wrote, skipped, deleted and failed to sync.
+	ALTER TABLE lastsync
+		ADD COLUMN IF NOT EXISTS run      timestamp with time zone,
+		ADD COLUMN IF NOT EXISTS written  int DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS skipped  int DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS deleted  int DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS failed   int DEFAULT 0;
+`,
+		Down: `
+	ALTER TABLE lastsync
+		DROP COLUMN IF EXISTS run,
+		DROP COLUMN IF EXISTS written,
+		DROP COLUMN IF EXISTS skipped,
+		DROP COLUMN IF EXISTS deleted,
+		DROP COLUMN IF EXISTS failed;
+`,
+	},
+	{
+		Version: 3,
+		Name:    "sync conflicts",
+		Up: `
+	-- conflicts counts the datasets the last sync run found in conflict.
+	ALTER TABLE lastsync ADD COLUMN IF NOT EXISTS conflicts int DEFAULT 0;
+
+	-- Table conflicts stores the upstream version of published datasets that were changed both locally and upstream since the last sync.
+	-- The local version is kept in datasets until the user resolves the conflict.
+	CREATE TABLE IF NOT EXISTS conflicts (
+		id        uuid PRIMARY KEY REFERENCES datasets(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		detected  timestamp with time zone DEFAULT now(),
+		blob      jsonb
+	);
+`,
+		Down: `
+	DROP TABLE IF EXISTS conflicts;
+	ALTER TABLE lastsync DROP COLUMN IF EXISTS conflicts;
+`,
+	},
+	{
+		Version: 4,
+		Name:    "resumable syncs",
+		Up: `
+	-- Index idx_btree_datasets_identifier indexes the Metax identifier of datasets, used to match datasets when syncing.
+	CREATE INDEX IF NOT EXISTS idx_btree_datasets_identifier ON datasets USING BTREE ((blob->>'identifier'));
+
+	-- started and progress are set while a sync is committed in chunks, so an interrupted sync can be resumed.
+	ALTER TABLE lastsync
+		ADD COLUMN IF NOT EXISTS started  timestamp with time zone,
+		ADD COLUMN IF NOT EXISTS progress int DEFAULT 0;
+`,
+		Down: `
+	ALTER TABLE lastsync
+		DROP COLUMN IF EXISTS started,
+		DROP COLUMN IF EXISTS progress;
+	DROP INDEX IF EXISTS idx_btree_datasets_identifier;
+`,
+	},
+	{
+		Version: 5,
+		Name:    "new version drafts",
+		Up: `
+	-- Table version_drafts links local drafts of new dataset versions to the published version they are based on.
+	-- Publishing the draft creates the new version in Metax; there can be only one draft per published version.
+	CREATE TABLE IF NOT EXISTS version_drafts (
+		id        uuid PRIMARY KEY REFERENCES datasets(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		based_on  uuid NOT NULL UNIQUE REFERENCES datasets(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		created   timestamp with time zone DEFAULT now()
+	);
+`,
+		Down: `
+	DROP TABLE IF EXISTS version_drafts;
+`,
+	},
+}
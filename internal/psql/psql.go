@@ -4,74 +4,87 @@ package psql
 import (
 	"context"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/wvh/uuid"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/rs/zerolog"
 )
 
-// DefaultPoolAcquireTimeout is the duration pgx waits for a connection to become available from the pool.
-const DefaultPoolAcquireTimeout = 10 * time.Second
+// DefaultPoolMaxConns is the size of the connection pool unless the connection string sets `pool_max_conns`.
+const DefaultPoolMaxConns = 5
 
 // DB holds the database methods and configuration.
+//
+// All methods that talk to the database take a context; cancelling it, or its deadline passing, aborts the query
+// and makes the method return ErrTimeout. The context also limits how long to wait for a connection from the pool.
 type DB struct {
-	config *pgx.ConnConfig
-	//poolConfig *pgx.ConnPoolConfig
-	pool   *pgx.ConnPool
+	config *pgxpool.Config
+	pool   *pgxpool.Pool
 	logger zerolog.Logger
+
+	// syncSlots limits the number of sync locks, which each hold a connection; see TryLockSync
+	syncSlots chan struct{}
 }
 
 // NewService returns a database handle configured with the given connection string.
 // It does not try to connect.
 func NewService(connString string) (db *DB, err error) {
-	connConfig, err := pgx.ParseConnectionString(connString)
+	config, err := parseConfig(connString)
 	if err != nil {
 		return nil, err
 	}
 
-	db = newService(&connConfig)
+	db = newService(config)
 	return
 }
 
-// newService is the actual constructor that takes a ConnConfig populated by the calling function in whatever way.
-func newService(config *pgx.ConnConfig) (db *DB) {
+// newService is the actual constructor that takes a pool Config populated by the calling function in whatever way.
+func newService(config *pgxpool.Config) (db *DB) {
 	db = &DB{
-		config: config,
-		logger: zerolog.Nop(),
+		config:    config,
+		logger:    zerolog.Nop(),
+		syncSlots: make(chan struct{}, maxSyncs(config.MaxConns)),
 	}
 	if true {
 		// self-referential, should be ok with the garbage collector...
-		db.config.Logger = db
+		db.config.ConnConfig.Logger = db
 	}
 	return
 }
 
-// NewPoolService creates a psql service from a connection string and initialises the connection pool.
-func NewPoolService(connString string) (db *DB, err error) {
-	connConfig, err := pgx.ParseConnectionString(connString)
+// parseConfig parses a connection string, or the environment if it's empty, into a pool configuration.
+func parseConfig(connString string) (*pgxpool.Config, error) {
+	config, err := pgxpool.ParseConfig(connString)
 	if err != nil {
 		return nil, err
 	}
-
-	db = newService(&connConfig)
-	err = db.InitPool()
-	return
+	if !strings.Contains(connString, "pool_max_conns") {
+		config.MaxConns = DefaultPoolMaxConns
+	}
+	return config, nil
 }
 
-// NewPoolService creates a psql service using environment variables and initialises the connection pool.
-func NewPoolServiceFromEnv() (db *DB, err error) {
-	connConfig, err := pgx.ParseEnvLibpq()
+// NewPoolService creates a psql service from a connection string and initialises the connection pool.
+func NewPoolService(connString string) (db *DB, err error) {
+	config, err := parseConfig(connString)
 	if err != nil {
 		return nil, err
 	}
 
-	db = newService(&connConfig)
+	db = newService(config)
 	err = db.InitPool()
 	return
 }
 
+// NewPoolServiceFromEnv creates a psql service using environment variables and initialises the connection pool.
+func NewPoolServiceFromEnv() (db *DB, err error) {
+	return NewPoolService("")
+}
+
 // SetLogger assigns a zerolog logger to the database service.
 // It is not safe to call this function after initialisation.
 func (psql *DB) SetLogger(logger zerolog.Logger) {
@@ -79,63 +92,96 @@ func (psql *DB) SetLogger(logger zerolog.Logger) {
 }
 
 // Connect returns a single database conn or an error.
-func (psql *DB) Connect() (*pgx.Conn, error) {
-	return pgx.Connect(*psql.config)
+func (psql *DB) Connect(ctx context.Context) (*pgx.Conn, error) {
+	return pgx.ConnectConfig(ctx, psql.config.ConnConfig)
 }
 
 // MustConnect returns a single database conn and panics on failure.
-func (psql *DB) MustConnect() *pgx.Conn {
-	conn, err := pgx.Connect(*psql.config)
+func (psql *DB) MustConnect(ctx context.Context) *pgx.Conn {
+	conn, err := pgx.ConnectConfig(ctx, psql.config.ConnConfig)
 	if err != nil {
 		panic(err)
 	}
 	return conn
 }
 
-// InitPool initialises a pool with default settings on the database object.
+// InitPool initialises a pool with the parsed settings on the database object.
+// It makes one connection to check the settings.
 func (psql *DB) InitPool() (err error) {
-	// default MaxConnections: 5
-	psql.pool, err = pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:     *psql.config,
-		AcquireTimeout: DefaultPoolAcquireTimeout,
-	})
+	psql.pool, err = pgxpool.ConnectConfig(context.Background(), psql.config)
 	return err
 }
 
+// Close closes all connections in the pool.
+func (psql *DB) Close() {
+	psql.pool.Close()
+}
+
 type Tx struct {
-	*pgx.Tx
+	pgx.Tx
 }
 
-func (psql *DB) Begin() (*Tx, error) {
-	tx, err := psql.pool.Begin()
+func (psql *DB) Begin(ctx context.Context) (*Tx, error) {
+	tx, err := psql.pool.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return &Tx{tx}, nil
 }
 
-func (psql *DB) Version() (string, error) {
+func (psql *DB) Version(ctx context.Context) (string, error) {
 	var version string
 
-	err := psql.pool.QueryRow("select version()").Scan(&version)
+	err := psql.pool.QueryRow(ctx, "select version()").Scan(&version)
 	return version, err
 }
 
-func (psql *DB) Check() error {
-	conn, err := psql.pool.Acquire()
+func (psql *DB) Check(ctx context.Context) error {
+	conn, err := psql.pool.Acquire(ctx)
 	if err != nil {
 		return err
 	}
-	defer psql.pool.Release(conn)
-	if !conn.IsAlive() {
+	defer conn.Release()
+	if conn.Conn().IsClosed() {
 		return errors.New("connection is dead")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
-	return conn.Ping(ctx)
+	return conn.Conn().Ping(ctx)
+}
+
+// PoolStats is a snapshot of the connection pool.
+type PoolStats struct {
+	// connections currently in use, idle, in total, and the maximum size of the pool
+	AcquiredConns int32
+	IdleConns     int32
+	TotalConns    int32
+	MaxConns      int32
+
+	// cumulative number of acquired connections, of those that had to wait or open a new connection,
+	// of cancelled acquires, and the total time spent waiting for connections
+	AcquireCount         int64
+	EmptyAcquireCount    int64
+	CanceledAcquireCount int64
+	AcquireDuration      time.Duration
+}
+
+// Stats returns the current statistics of the connection pool.
+func (psql *DB) Stats() PoolStats {
+	stat := psql.pool.Stat()
+	return PoolStats{
+		AcquiredConns:        stat.AcquiredConns(),
+		IdleConns:            stat.IdleConns(),
+		TotalConns:           stat.TotalConns(),
+		MaxConns:             stat.MaxConns(),
+		AcquireCount:         stat.AcquireCount(),
+		EmptyAcquireCount:    stat.EmptyAcquireCount(),
+		CanceledAcquireCount: stat.CanceledAcquireCount(),
+		AcquireDuration:      stat.AcquireDuration(),
+	}
 }
 
-func (psql *DB) Log(plevel pgx.LogLevel, msg string, data map[string]interface{}) {
+func (psql *DB) Log(ctx context.Context, plevel pgx.LogLevel, msg string, data map[string]interface{}) {
 	var zlevel zerolog.Level
 
 	switch plevel {
@@ -0,0 +1,226 @@
+package psql
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/wvh/uuid"
+)
+
+// syncLockClass is the first key of the two-key advisory locks taken while syncing a user,
+// so they don't clash with advisory locks used for other purposes.
+const syncLockClass int32 = 0x51766e // "Qvn"
+
+// syncUnlockTimeout limits how long releasing a sync lock may take.
+const syncUnlockTimeout = 5 * time.Second
+
+// maxSyncs returns how many syncs can run at the same time with a pool of the given size. Each sync holds a connection
+// for its lock and batch, and needs another one now and then for its outcome; half of the pool is left for API requests.
+func maxSyncs(poolSize int32) int {
+	if poolSize < 2 {
+		return 1
+	}
+	return int(poolSize / 2)
+}
+
+// MaxSyncs returns how many users can be synced at the same time; TryLockSync refuses more locks.
+func (db *DB) MaxSyncs() int {
+	return cap(db.syncSlots)
+}
+
+// SyncCandidate is a user whose datasets can be synced from an external service.
+type SyncCandidate struct {
+	Uid      uuid.UUID
+	Identity string
+	LastSync time.Time
+}
+
+// SyncOutcome is the outcome of a user's sync run.
+type SyncOutcome struct {
+	// Run is when the sync ran; Last is the time of the last successful sync, zero if there has been none.
+	Run  time.Time
+	Last time.Time
+
+	// Started is when an unfinished sync started, with Progress records processed; zero if there is none.
+	Started  time.Time
+	Progress int
+
+	Success   bool
+	Written   int
+	Skipped   int
+	Deleted   int
+	Failed    int
+	Conflicts int
+	Errors    []string
+}
+
+// StoreSyncOutcome records the outcome of a user's sync run. It doesn't change the time of the last successful sync,
+// which is written when the synced datasets are committed.
+func (db *DB) StoreSyncOutcome(ctx context.Context, uid uuid.UUID, outcome *SyncOutcome) error {
+	_, err := db.pool.Exec(ctx, `INSERT INTO lastsync(uid, run, success, msg, written, skipped, deleted, failed, conflicts)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (uid) DO UPDATE SET run = $2, success = $3, msg = $4, written = $5, skipped = $6, deleted = $7, failed = $8, conflicts = $9`,
+		uid.Array(), outcome.Run, outcome.Success, strings.Join(outcome.Errors, "\n"),
+		outcome.Written, outcome.Skipped, outcome.Deleted, outcome.Failed, outcome.Conflicts)
+	return handleError(err)
+}
+
+// GetSyncOutcome returns the outcome of a user's last sync run, or ErrNotFound if the user has never been synced.
+func (db *DB) GetSyncOutcome(ctx context.Context, uid uuid.UUID) (*SyncOutcome, error) {
+	var (
+		outcome  SyncOutcome
+		last     *time.Time
+		run      *time.Time
+		started  *time.Time
+		msg      string
+		counters [6]int32
+	)
+	err := db.pool.QueryRow(ctx, `SELECT ts, run, started, COALESCE(success, false), COALESCE(msg, ''),
+		COALESCE(written, 0), COALESCE(skipped, 0), COALESCE(deleted, 0), COALESCE(failed, 0), COALESCE(conflicts, 0), COALESCE(progress, 0)
+		FROM lastsync WHERE uid = $1`, uid.Array()).Scan(
+		&last, &run, &started, &outcome.Success, &msg, &counters[0], &counters[1], &counters[2], &counters[3], &counters[4], &counters[5])
+	if err != nil {
+		return nil, handleError(err)
+	}
+
+	if last != nil {
+		outcome.Last = *last
+	}
+	if run != nil {
+		outcome.Run = *run
+	} else {
+		// synced before outcomes were recorded
+		outcome.Run = outcome.Last
+	}
+	if started != nil {
+		outcome.Started, outcome.Progress = *started, int(counters[5])
+	}
+	if msg != "" {
+		outcome.Errors = strings.Split(msg, "\n")
+	}
+	outcome.Written, outcome.Skipped, outcome.Deleted, outcome.Failed, outcome.Conflicts =
+		int(counters[0]), int(counters[1]), int(counters[2]), int(counters[3]), int(counters[4])
+	return &outcome, nil
+}
+
+// GetSyncProgress returns the start time and progress of a user's unfinished sync, or ErrNotFound if there is none.
+func (db *DB) GetSyncProgress(ctx context.Context, uid uuid.UUID) (started time.Time, progress int, err error) {
+	var ts *time.Time
+	var count int32
+	err = db.pool.QueryRow(ctx, `SELECT started, COALESCE(progress, 0) FROM lastsync WHERE uid = $1`, uid.Array()).Scan(&ts, &count)
+	if err != nil {
+		return time.Time{}, 0, handleError(err)
+	}
+	if ts == nil {
+		return time.Time{}, 0, ErrNotFound
+	}
+	return *ts, int(count), nil
+}
+
+// UsersToSync returns login users with an identity for the given service that have not been synced since the given time,
+// least recently tried first, so users whose syncs keep failing don't hold up the others. Users that have never been synced
+// come first and have a zero LastSync.
+func (db *DB) UsersToSync(ctx context.Context, svc string, before time.Time, limit int) ([]SyncCandidate, error) {
+	rows, err := db.pool.Query(ctx, `SELECT i.uid, i.extids->>$1, l.ts
+		FROM identities i LEFT JOIN lastsync l ON l.uid = i.uid
+		WHERE i.login AND i.extids ? $1 AND (l.ts IS NULL OR l.ts < $2)
+		ORDER BY COALESCE(l.run, l.ts) ASC NULLS FIRST
+		LIMIT $3`, svc, before, limit)
+	if err != nil {
+		return nil, handleError(err)
+	}
+	defer rows.Close()
+
+	var users []SyncCandidate
+	for rows.Next() {
+		var user SyncCandidate
+		var ts *time.Time
+		if err := rows.Scan(user.Uid.Array(), &user.Identity, &ts); err != nil {
+			return nil, handleError(err)
+		}
+		if ts != nil {
+			user.LastSync = *ts
+		}
+		users = append(users, user)
+	}
+	return users, handleError(rows.Err())
+}
+
+// SyncLock is a lock for syncing a user. It holds a connection from the pool, which the user's sync batch runs on.
+type SyncLock struct {
+	db   *DB
+	conn *pgxpool.Conn
+	uid  uuid.UUID
+	key  int32
+}
+
+// TryLockSync takes a session-level advisory lock for syncing the given user, so that several application instances
+// sharing the database don't sync the same user at the same time. It doesn't wait: if another session holds the lock,
+// ok is false. If ok is true, the caller must call Unlock when done, which also returns the connection to the pool.
+// It returns ErrTooManySyncs if MaxSyncs locks are held already, so syncs can't take all connections of the pool.
+//
+// Locks are keyed on a 32-bit hash of the uid; a collision makes one of two unrelated users wait for the next round.
+func (db *DB) TryLockSync(ctx context.Context, uid uuid.UUID) (lock *SyncLock, ok bool, err error) {
+	select {
+	case db.syncSlots <- struct{}{}:
+	default:
+		return nil, false, ErrTooManySyncs
+	}
+
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		<-db.syncSlots
+		return nil, false, handleError(err)
+	}
+
+	key := syncLockKey(uid)
+	err = conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1, $2)`, syncLockClass, key).Scan(&ok)
+	if err != nil || !ok {
+		conn.Release()
+		<-db.syncSlots
+		return nil, false, handleError(err)
+	}
+
+	return &SyncLock{db: db, conn: conn, uid: uid, key: key}, true, nil
+}
+
+// NewBatch starts a batch for the locked user on the connection of the lock.
+func (lock *SyncLock) NewBatch(ctx context.Context) (*BatchManager, error) {
+	b, err := lock.db.newBatch(ctx, func(ctx context.Context) (*Tx, error) {
+		tx, err := lock.conn.Begin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &Tx{tx}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.triggerUid = &lock.uid
+	return b, nil
+}
+
+// Unlock releases the lock and returns its connection to the pool.
+func (lock *SyncLock) Unlock() {
+	// the sync's context might be done by now, but the lock has to be released anyway
+	ctx, cancel := context.WithTimeout(context.Background(), syncUnlockTimeout)
+	defer cancel()
+	if _, err := lock.conn.Exec(ctx, `SELECT pg_advisory_unlock($1, $2)`, syncLockClass, lock.key); err != nil {
+		// the lock would outlive us on a pooled connection, so close it instead
+		lock.db.logger.Error().Err(err).Str("uid", lock.uid.String()).Msg("can't release sync lock")
+		lock.conn.Conn().Close(ctx)
+	}
+	lock.conn.Release()
+	<-lock.db.syncSlots
+}
+
+// syncLockKey hashes a uid into the second key of a two-key advisory lock.
+func syncLockKey(uid uuid.UUID) int32 {
+	h := fnv.New32a()
+	h.Write(uid.Bytes())
+	return int32(h.Sum32())
+}
@@ -0,0 +1,55 @@
+package psql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/wvh/uuid"
+)
+
+// TestLockOwner tests that batches without a user don't get the sync lock of a user who is being synced.
+func TestLockOwner(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	db, err := NewPoolServiceFromEnv()
+	if err != nil {
+		t.Fatal("psql:", err)
+	}
+	ctx := context.Background()
+
+	syncing := uuid.MustFromString("a5a0a2e2f1f14a7a8b1f6f1f6c2d2b01")
+	other := uuid.MustFromString("a5a0a2e2f1f14a7a8b1f6f1f6c2d2b02")
+
+	lock, ok, err := db.TryLockSync(ctx, syncing)
+	if err != nil || !ok {
+		t.Fatalf("db.TryLockSync(): ok: %v, err: %v", ok, err)
+	}
+
+	tryLock := func(uid uuid.UUID) bool {
+		batch, err := db.NewBatch(ctx)
+		if err != nil {
+			t.Fatal("db.NewBatch():", err)
+		}
+		defer batch.Rollback(ctx)
+
+		ok, err := batch.LockOwner(ctx, uid)
+		if err != nil {
+			t.Fatal("batch.LockOwner():", err)
+		}
+		return ok
+	}
+
+	if tryLock(syncing) {
+		t.Error("expected the owner being synced not to be locked")
+	}
+	if !tryLock(other) {
+		t.Error("expected other owners to be locked")
+	}
+
+	lock.Unlock()
+	if !tryLock(syncing) {
+		t.Error("expected the owner to be locked after the sync")
+	}
+}
@@ -0,0 +1,63 @@
+package psql
+
+import (
+	"context"
+	"time"
+
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/wvh/uuid"
+)
+
+// CreateVersionDraft stores a local draft for a new version of a published dataset.
+// It returns ErrExists if there already is a draft for a new version of that dataset.
+func (db *DB) CreateVersionDraft(ctx context.Context, basedOn uuid.UUID, draft *models.Dataset) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return handleError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = tx.Create(ctx, draft); err != nil {
+		return handleError(err)
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO version_drafts(id, based_on) VALUES($1, $2)`, draft.Id.Array(), basedOn.Array())
+	if err != nil {
+		return handleError(err)
+	}
+
+	return handleError(tx.Commit(ctx))
+}
+
+// GetVersionDraftBase returns the id of the published dataset a draft for a new version is based on,
+// or ErrNotFound if the dataset isn't such a draft.
+func (db *DB) GetVersionDraftBase(ctx context.Context, id uuid.UUID) (uuid.UUID, error) {
+	var basedOn uuid.UUID
+	err := db.pool.QueryRow(ctx, `SELECT based_on FROM version_drafts WHERE id = $1`, id.Array()).Scan(basedOn.Array())
+	return basedOn, handleError(err)
+}
+
+// StorePublishedVersion replaces a draft for a new version with the new version published in Metax, keeping its id.
+// The new version is stored like other new versions, with StoreNewVersion, and the draft link is removed.
+func (db *DB) StorePublishedVersion(ctx context.Context, id uuid.UUID, basedOn uuid.UUID, created time.Time, blob []byte) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return handleError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// deleting the draft also removes the link in version_drafts
+	ct, err := tx.Exec(ctx, `DELETE FROM datasets WHERE id = $1 AND id IN (SELECT id FROM version_drafts WHERE based_on = $2)`, id.Array(), basedOn.Array())
+	if err != nil {
+		return handleError(err)
+	}
+	if ct.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+
+	if err = tx.StoreNewVersion(ctx, basedOn, id, created, blob); err != nil {
+		return handleError(err)
+	}
+
+	return handleError(tx.Commit(ctx))
+}
@@ -1,6 +1,7 @@
 package psql
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -13,12 +14,12 @@ var apiEmptyList = json.RawMessage([]byte(`[]`))
 var apiEmptyObject = json.RawMessage([]byte(`{}`))
 
 // ViewDatasetsByOwner builds a JSON array with the datasets for a given owner.
-func (db *DB) ViewDatasetsByOwner(owner uuid.UUID) (json.RawMessage, error) {
+func (db *DB) ViewDatasetsByOwner(ctx context.Context, owner uuid.UUID) (json.RawMessage, error) {
 	var result json.RawMessage
 
 	// note that if there are no results, json_agg will return NULL;
 	// we could also catch NULLs by wrapping json_agg with coalesce: coalesce(json_agg(result), '[]')
-	err := db.pool.QueryRow(`
+	err := db.pool.QueryRow(ctx, `
 		SELECT json_agg(result) "by_owner"
 		FROM (
 			SELECT id, owner, created, modified, synced, seq, published, schema,
@@ -55,13 +56,13 @@ func (db *DB) ViewDatasetsByOwner(owner uuid.UUID) (json.RawMessage, error) {
 }
 
 // ViewVersions returns a (JSON) array with existing versions for a given dataset and owner.
-func (db *DB) ViewVersions(owner uuid.UUID, dataset uuid.UUID) (json.RawMessage, error) {
+func (db *DB) ViewVersions(ctx context.Context, owner uuid.UUID, dataset uuid.UUID) (json.RawMessage, error) {
 	var (
 		isOwner   bool
 		jsonArray json.RawMessage
 	)
 
-	err := db.pool.QueryRow(
+	err := db.pool.QueryRow(ctx,
 		`SELECT owner = $1 "is_owner", CASE WHEN owner = $1 AND jsonb_array_length(blob->'dataset_version_set') > 0 THEN blob->'dataset_version_set' ELSE '[]'::jsonb END versions FROM datasets WHERE id = $2`,
 		owner.Array(),
 		dataset.Array(),
@@ -77,19 +78,19 @@ func (db *DB) ViewVersions(owner uuid.UUID, dataset uuid.UUID) (json.RawMessage,
 	return jsonArray, nil
 }
 
-func (db *DB) ViewDatasetWithOwner(id uuid.UUID, owner uuid.UUID, svc string) (json.RawMessage, error) {
-	tx, err := db.Begin()
+func (db *DB) ViewDatasetWithOwner(ctx context.Context, id uuid.UUID, owner uuid.UUID, svc string) (json.RawMessage, error) {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	err = tx.CheckOwner(id, owner)
+	err = tx.CheckOwner(ctx, id, owner)
 	if err != nil {
 		return nil, err
 	}
 
-	famId, err := tx.getFamily(id)
+	famId, err := tx.getFamily(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -100,12 +101,12 @@ func (db *DB) ViewDatasetWithOwner(id uuid.UUID, owner uuid.UUID, svc string) (j
 	}
 
 	if family.IsPartial() {
-		return tx.viewDataset(id, family.Key(), svc)
+		return tx.viewDataset(ctx, id, family.Key(), svc)
 	}
-	return tx.viewDataset(id, "", svc)
+	return tx.viewDataset(ctx, id, "", svc)
 }
 
-func (tx *Tx) viewDataset(id uuid.UUID, key string, svc string) (json.RawMessage, error) {
+func (tx *Tx) viewDataset(ctx context.Context, id uuid.UUID, key string, svc string) (json.RawMessage, error) {
 	var (
 		record json.RawMessage
 		err    error
@@ -113,7 +114,7 @@ func (tx *Tx) viewDataset(id uuid.UUID, key string, svc string) (json.RawMessage
 
 	// annoyingly similar...
 	if key == "" {
-		err = tx.QueryRow(`
+		err = tx.QueryRow(ctx, `
 		SELECT row_to_json(result) "record"
 		FROM (
 			SELECT id, created, modified, seq, synced, published,
@@ -130,7 +131,7 @@ func (tx *Tx) viewDataset(id uuid.UUID, key string, svc string) (json.RawMessage
 			WHERE id = $1) result
 		`, id.Array(), svc).Scan(&record)
 	} else {
-		err = tx.QueryRow(`
+		err = tx.QueryRow(ctx, `
 		SELECT row_to_json(result) "record"
 		FROM (
 			SELECT id, created, modified, seq, synced, published,
@@ -155,14 +156,14 @@ func (tx *Tx) viewDataset(id uuid.UUID, key string, svc string) (json.RawMessage
 }
 
 // ViewDatasetInfoByIdentifier gives basic information for a single dataset with a given identifier.
-func (db *DB) ViewDatasetInfoByIdentifier(identifierType string, identifier string) (json.RawMessage, error) {
+func (db *DB) ViewDatasetInfoByIdentifier(ctx context.Context, identifierType string, identifier string) (json.RawMessage, error) {
 	var record json.RawMessage
 
-	tx, err := db.Begin()
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
 	var where string
 	switch identifierType {
@@ -174,7 +175,7 @@ func (db *DB) ViewDatasetInfoByIdentifier(identifierType string, identifier stri
 		return nil, fmt.Errorf("invalid identifierType")
 	}
 
-	err = tx.QueryRow(`
+	err = tx.QueryRow(ctx, `
 	SELECT row_to_json(result) "record"
 	FROM (
 		SELECT id, owner, created, modified, synced, seq, published, schema,
@@ -198,10 +199,10 @@ func (db *DB) ViewDatasetInfoByIdentifier(identifierType string, identifier stri
 	return record, nil
 }
 
-func (db *DB) ExportAsJson(id uuid.UUID) (json.RawMessage, error) {
+func (db *DB) ExportAsJson(ctx context.Context, id uuid.UUID) (json.RawMessage, error) {
 	var dataset json.RawMessage
 
-	err := db.pool.QueryRow(`SELECT row_to_json(datasets) FROM datasets WHERE id = $1`, id.Array()).Scan(&dataset)
+	err := db.pool.QueryRow(ctx, `SELECT row_to_json(datasets) FROM datasets WHERE id = $1`, id.Array()).Scan(&dataset)
 	if err != nil {
 		return nil, handleError(err)
 	}
@@ -212,7 +213,7 @@ func (db *DB) ExportAsJson(id uuid.UUID) (json.RawMessage, error) {
 // CountDatasets gives the number of datasets matching the DatasetFilter.
 // Returns a json object containing the count.
 // If grouping is enabled, returns a json array containing the grouped results.
-func (db *DB) CountDatasets(filter *DatasetFilter) (json.RawMessage, error) {
+func (db *DB) CountDatasets(ctx context.Context, filter *DatasetFilter) (json.RawMessage, error) {
 	where, args := filter.Where()
 	groupBy := filter.GroupByPath()
 
@@ -222,7 +223,7 @@ func (db *DB) CountDatasets(filter *DatasetFilter) (json.RawMessage, error) {
 	)
 
 	if groupBy != "" {
-		err = db.pool.QueryRow(fmt.Sprintf(
+		err = db.pool.QueryRow(ctx, fmt.Sprintf(
 			`SELECT COALESCE(json_agg(r), '[]')
 			FROM (
 				SELECT %s, COUNT(*) as count
@@ -234,7 +235,7 @@ func (db *DB) CountDatasets(filter *DatasetFilter) (json.RawMessage, error) {
 			return apiEmptyList, handleError(err)
 		}
 	} else {
-		err = db.pool.QueryRow(fmt.Sprintf(
+		err = db.pool.QueryRow(ctx, fmt.Sprintf(
 			`SELECT row_to_json(r)
 			FROM (
 				select COUNT(*) as count FROM datasets %s
@@ -1,6 +1,7 @@
 package psql
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"path/filepath"
@@ -30,7 +31,7 @@ func createDatasetFromFile(tb testing.TB, db *DB, fn string, owner uuid.UUID) uu
 	}
 	dataset.SetData(1, metax.SchemaIda, blob)
 
-	err = db.Create(dataset)
+	err = db.Create(context.Background(), dataset)
 	if err != nil {
 		tb.Fatal("db.Create():", err)
 	}
@@ -81,11 +82,12 @@ func TestViewDatasetsByOwner(t *testing.T) {
 	if err != nil {
 		t.Fatal("psql:", err)
 	}
+	ctx := context.Background()
 
 	// on exit, clean-up datasets by test user
 	defer func() {
-		if err := db.WithTransaction(func(tx *Tx) error {
-			tag, err := tx.Exec("DELETE FROM datasets WHERE owner = $1 AND family = 1", owner.Array())
+		if err := db.WithTransaction(ctx, func(tx *Tx) error {
+			tag, err := tx.Exec(ctx, "DELETE FROM datasets WHERE owner = $1 AND family = 1", owner.Array())
 			if err == nil {
 				t.Logf("cleaned up %d datasets", tag.RowsAffected())
 			}
@@ -98,9 +100,9 @@ func TestViewDatasetsByOwner(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.fn, func(t *testing.T) {
 			id := createDatasetFromFile(t, db, test.fn, owner)
-			defer db.Delete(id, nil)
+			defer db.Delete(ctx, id, nil)
 
-			response, err := db.ViewDatasetsByOwner(owner)
+			response, err := db.ViewDatasetsByOwner(ctx, owner)
 			if err != nil {
 				t.Error("view:", response)
 			}
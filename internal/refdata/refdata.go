@@ -0,0 +1,250 @@
+// Package refdata keeps Metax reference data in an in-memory cache with prefix search.
+//
+// The data is loaded from the Metax Elastic Search instance and refreshed periodically; if a refresh fails,
+// the previously loaded data is kept.
+package refdata
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/es"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultRefreshInterval is how often the reference data is reloaded.
+	DefaultRefreshInterval = 6 * time.Hour
+
+	// DefaultLimit is the number of search results returned if no limit is given.
+	DefaultLimit = 50
+)
+
+var (
+	ErrUnknownType = errors.New("unknown reference data type")
+	ErrNotLoaded   = errors.New("reference data not loaded")
+)
+
+// Index is the location of a reference data type in Elastic Search.
+type Index struct {
+	Index   string
+	DocType string
+}
+
+// Types lists the reference data types kept in the cache.
+var Types = map[string]Index{
+	"access_type":      {"reference_data", "access_type"},
+	"field_of_science": {"reference_data", "field_of_science"},
+	"language":         {"reference_data", "language"},
+	"license":          {"reference_data", "license"},
+	"organization":     {"organization_data", "organization"},
+}
+
+// Loader returns all documents of an Elastic Search index as search response.
+type Loader interface {
+	All(index, doctype string) ([]byte, error)
+}
+
+// Item is a reference data entry.
+type Item struct {
+	ID        string            `json:"id"`
+	Code      string            `json:"code"`
+	URI       string            `json:"uri"`
+	Label     map[string]string `json:"label"`
+	ParentIds []string          `json:"parent_ids,omitempty"`
+
+	// keys are the lowercase strings prefix searches are matched against
+	keys []string
+}
+
+// matches checks if any of the search keys of the item start with the given lowercase prefix.
+func (item *Item) matches(prefix string) bool {
+	for _, key := range item.keys {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// index builds the search keys: code, id, and the labels as a whole and word by word.
+func (item *Item) index() {
+	item.keys = append(item.keys, strings.ToLower(item.Code), strings.ToLower(item.ID))
+	for _, label := range item.Label {
+		label = strings.ToLower(label)
+		item.keys = append(item.keys, label)
+		if words := strings.Fields(label); len(words) > 1 {
+			item.keys = append(item.keys, words[1:]...)
+		}
+	}
+}
+
+// refdata holds the loaded items of one type.
+type refdata struct {
+	items  []*Item
+	byURI  map[string]*Item
+	loaded time.Time
+}
+
+// Cache holds reference data in memory.
+type Cache struct {
+	loader Loader
+	logger zerolog.Logger
+
+	mu   sync.RWMutex
+	data map[string]*refdata
+}
+
+// NewCache creates an empty reference data cache loading data with the given loader.
+func NewCache(loader Loader, logger zerolog.Logger) *Cache {
+	return &Cache{
+		loader: loader,
+		logger: logger,
+		data:   make(map[string]*refdata),
+	}
+}
+
+// NewElasticCache creates a reference data cache loading data from the Elastic Search instance at the given url.
+func NewElasticCache(url string, logger zerolog.Logger) *Cache {
+	return NewCache(es.NewClient(url), logger)
+}
+
+// Refresh reloads all reference data types. Types that fail to load keep their old data; the first error is returned.
+func (cache *Cache) Refresh() error {
+	var firstErr error
+	for typ := range Types {
+		if err := cache.RefreshType(typ); err != nil {
+			cache.logger.Warn().Err(err).Str("type", typ).Msg("failed to load reference data")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// RefreshType reloads one reference data type.
+func (cache *Cache) RefreshType(typ string) error {
+	index, ok := Types[typ]
+	if !ok {
+		return ErrUnknownType
+	}
+
+	res, err := cache.loader.All(index.Index, index.DocType)
+	if err != nil {
+		return err
+	}
+
+	var items []*Item
+	if err := json.Unmarshal(es.Filter(res), &items); err != nil {
+		return err
+	}
+
+	data := &refdata{
+		items:  items,
+		byURI:  make(map[string]*Item, len(items)),
+		loaded: time.Now(),
+	}
+	for _, item := range items {
+		item.index()
+		if item.URI != "" {
+			data.byURI[item.URI] = item
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Code < items[j].Code })
+
+	cache.mu.Lock()
+	cache.data[typ] = data
+	cache.mu.Unlock()
+
+	cache.logger.Debug().Str("type", typ).Int("count", len(items)).Msg("loaded reference data")
+	return nil
+}
+
+// Start loads the reference data in the background and refreshes it at the given interval until stop is called.
+func (cache *Cache) Start(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		cache.Refresh()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cache.Refresh()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// get returns the loaded data for a type.
+func (cache *Cache) get(typ string) (*refdata, error) {
+	if _, ok := Types[typ]; !ok {
+		return nil, ErrUnknownType
+	}
+
+	cache.mu.RLock()
+	data := cache.data[typ]
+	cache.mu.RUnlock()
+
+	if data == nil {
+		return nil, ErrNotLoaded
+	}
+	return data, nil
+}
+
+// Search returns up to limit items of a type with a code, id or label (or a word in it) starting with the query string.
+// The search is case-insensitive; an empty query matches all items.
+func (cache *Cache) Search(typ, query string, limit int) ([]*Item, error) {
+	data, err := cache.get(typ)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 1 {
+		limit = DefaultLimit
+	}
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	results := make([]*Item, 0, limit)
+	for _, item := range data.items {
+		if len(results) >= limit {
+			break
+		}
+		if query == "" || item.matches(query) {
+			results = append(results, item)
+		}
+	}
+	return results, nil
+}
+
+// Loaded returns the time a reference data type was last loaded, or the zero time if it hasn't been loaded yet.
+func (cache *Cache) Loaded(typ string) time.Time {
+	data, err := cache.get(typ)
+	if err != nil {
+		return time.Time{}
+	}
+	return data.loaded
+}
+
+// Lookup returns the label of the item with the given URI and whether it exists; it satisfies the metax.Refdata interface.
+func (cache *Cache) Lookup(typ, uri string) (map[string]string, bool, error) {
+	data, err := cache.get(typ)
+	if err != nil {
+		return nil, false, err
+	}
+	item, found := data.byURI[uri]
+	if !found {
+		return nil, false, nil
+	}
+	return item.Label, true, nil
+}
@@ -0,0 +1,96 @@
+package refdata
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+const testLanguages = `{"hits":{"hits":[
+	{"_source":{"id":"language_fin","code":"fin","uri":"http://lexvo.org/id/iso639-3/fin","label":{"fi":"suomi","en":"Finnish"}}},
+	{"_source":{"id":"language_swe","code":"swe","uri":"http://lexvo.org/id/iso639-3/swe","label":{"fi":"ruotsi","en":"Swedish"}}},
+	{"_source":{"id":"language_fij","code":"fij","uri":"http://lexvo.org/id/iso639-3/fij","label":{"en":"Fijian"}}},
+	{"_source":{"id":"language_nor","code":"nor","uri":"http://lexvo.org/id/iso639-3/nor","label":{"en":"Norwegian","fi":"norja"}}},
+	{"_source":{"id":"language_sme","code":"sme","uri":"http://lexvo.org/id/iso639-3/sme","label":{"en":"Northern Sami","fi":"pohjoissaame"}}}
+]}}`
+
+// fakeLoader returns canned Elastic Search responses by doctype.
+type fakeLoader map[string]string
+
+func (loader fakeLoader) All(index, doctype string) ([]byte, error) {
+	if res, ok := loader[doctype]; ok {
+		return []byte(res), nil
+	}
+	return nil, errors.New("index not available")
+}
+
+func TestSearch(t *testing.T) {
+	cache := NewCache(fakeLoader{"language": testLanguages}, zerolog.Nop())
+
+	if _, err := cache.Search("language", "fi", 0); err != ErrNotLoaded {
+		t.Errorf("expected %v before loading, got %v", ErrNotLoaded, err)
+	}
+	if err := cache.Refresh(); err == nil {
+		t.Error("expected error for types without data")
+	}
+
+	var tests = []struct {
+		query    string
+		limit    int
+		expected []string
+	}{
+		{"", 0, []string{"fij", "fin", "nor", "sme", "swe"}},
+		{"", 2, []string{"fij", "fin"}},
+		{"fi", 0, []string{"fij", "fin"}},
+		{"FIN", 0, []string{"fin"}},
+		{"suo", 0, []string{"fin"}},
+		{"sami", 0, []string{"sme"}},
+		{"nor", 0, []string{"nor", "sme"}},
+		{"language_sw", 0, []string{"swe"}},
+		{"xyz", 0, []string{}},
+	}
+	for _, test := range tests {
+		items, err := cache.Search("language", test.query, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes := make([]string, 0, len(items))
+		for _, item := range items {
+			codes = append(codes, item.Code)
+		}
+		if len(codes) != len(test.expected) {
+			t.Errorf("query %q: expected %v, got %v", test.query, test.expected, codes)
+			continue
+		}
+		for i := range codes {
+			if codes[i] != test.expected[i] {
+				t.Errorf("query %q: expected %v, got %v", test.query, test.expected, codes)
+				break
+			}
+		}
+	}
+
+	if _, err := cache.Search("colour", "", 0); err != ErrUnknownType {
+		t.Errorf("expected %v, got %v", ErrUnknownType, err)
+	}
+	if cache.Loaded("language").IsZero() || !cache.Loaded("license").IsZero() {
+		t.Error("wrong loaded times")
+	}
+}
+
+func TestRefreshKeepsData(t *testing.T) {
+	loader := fakeLoader{"language": testLanguages}
+	cache := NewCache(loader, zerolog.Nop())
+	if err := cache.RefreshType("language"); err != nil {
+		t.Fatal(err)
+	}
+
+	loader["language"] = `{"hits":`
+	if err := cache.RefreshType("language"); err == nil {
+		t.Error("expected error for invalid response")
+	}
+	if items, err := cache.Search("language", "", 0); err != nil || len(items) != 5 {
+		t.Errorf("expected old data to be kept, got %d items (err: %v)", len(items), err)
+	}
+}
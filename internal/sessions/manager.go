@@ -148,6 +148,34 @@ func (mgr *Manager) DestroyWithCookie(w http.ResponseWriter, sid string) bool {
 	return mgr.Destroy(sid)
 }
 
+// DestroyIdpSessions destroys all sessions created by a login at the given identity provider with the given subject and/or provider session id.
+// Empty arguments match any value. It returns the number of sessions destroyed.
+func (mgr *Manager) DestroyIdpSessions(provider, sub, sid string) int {
+	if sub == "" && sid == "" {
+		return 0
+	}
+
+	var keys []interface{}
+	mgr.cache.Foreach(func(key interface{}, item *cache2go.CacheItem) {
+		idp := item.Data().(*Session).idp
+		if idp == nil || idp.Provider != provider {
+			return
+		}
+		if (sub == "" || idp.Subject == sub) && (sid == "" || idp.Sid == sid) {
+			keys = append(keys, key)
+		}
+	})
+
+	// don't delete while iterating, Foreach holds the cache lock
+	destroyed := 0
+	for _, key := range keys {
+		if _, err := mgr.cache.Delete(key); err == nil {
+			destroyed++
+		}
+	}
+	return destroyed
+}
+
 func (mgr *Manager) Count() int {
 	return mgr.cache.Count()
 }
@@ -266,6 +294,18 @@ func WithExpiration(expAt time.Time) SessionOption {
 	}
 }
 
+// WithIdpLogin records the identity provider login a session was created from.
+func WithIdpLogin(provider, sub, sid, rawIDToken string) SessionOption {
+	return func(session *Session) {
+		session.idp = &IdpLogin{
+			Provider: provider,
+			Subject:  sub,
+			Sid:      sid,
+			IDToken:  rawIDToken,
+		}
+	}
+}
+
 func WithDuration(exp time.Duration) SessionOption {
 	return func(session *Session) {
 		session.Expiration = time.Now().Add(exp)
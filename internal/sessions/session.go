@@ -23,6 +23,25 @@ type Session struct {
 
 	// User is the application user object.
 	User *models.User
+
+	// idp holds details of the identity provider login, if the session was created by one.
+	idp *IdpLogin
+}
+
+// IdpLogin identifies the identity provider session a user session was created from.
+// It is used for logout and not included in the JSON representation of the session.
+type IdpLogin struct {
+	// Provider is the name of the identity provider.
+	Provider string
+
+	// Subject is the token subject at the provider.
+	Subject string
+
+	// Sid is the provider session id from the ID token, if any.
+	Sid string
+
+	// IDToken is the raw ID token, used as hint for logout at the provider.
+	IDToken string
 }
 
 // Uid returns the user id or an error if the session doesn't have a valid (application) user.
@@ -41,6 +60,11 @@ func (session *Session) MaybeUid() string {
 	return ""
 }
 
+// Idp returns the identity provider login for the session, or nil if the session wasn't created by an OIDC login.
+func (session *Session) Idp() *IdpLogin {
+	return session.idp
+}
+
 // HasUser returns true if the session is an end user session with a valid user object.
 func (session *Session) HasUser() bool {
 	return session.User != nil
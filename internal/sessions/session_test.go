@@ -252,6 +252,52 @@ func TestSerialisation(t *testing.T) {
 	}
 }
 
+func TestDestroyIdpSessions(t *testing.T) {
+	mgr := NewManager()
+	uid := uuid.MustFromString("053bffbcc41edad4853bea91fc42ea20")
+
+	mgr.new("idp-a-1", &uid, nil, WithIdpLogin("idp-a", "sub1", "sid1", ""))
+	mgr.new("idp-a-2", &uid, nil, WithIdpLogin("idp-a", "sub1", "sid2", ""))
+	mgr.new("idp-a-3", &uid, nil, WithIdpLogin("idp-a", "sub2", "sid3", ""))
+	mgr.new("idp-b-1", &uid, nil, WithIdpLogin("idp-b", "sub1", "sid1", ""))
+	mgr.new("no-idp", &uid, nil)
+	defer func() {
+		for _, sid := range []string{"idp-a-1", "idp-a-2", "idp-a-3", "idp-b-1", "no-idp"} {
+			mgr.Destroy(sid)
+		}
+	}()
+
+	var tests = []struct {
+		provider, sub, sid string
+		destroyed          int
+		gone               []string
+	}{
+		{provider: "idp-a", destroyed: 0},
+		{provider: "idp-c", sub: "sub1", destroyed: 0},
+		{provider: "idp-a", sid: "sid2", destroyed: 1, gone: []string{"idp-a-2"}},
+		{provider: "idp-a", sub: "sub2", sid: "sid1", destroyed: 0},
+		{provider: "idp-a", sub: "sub1", destroyed: 1, gone: []string{"idp-a-1"}},
+		{provider: "idp-b", sub: "sub1", sid: "sid1", destroyed: 1, gone: []string{"idp-b-1"}},
+	}
+
+	for _, test := range tests {
+		if n := mgr.DestroyIdpSessions(test.provider, test.sub, test.sid); n != test.destroyed {
+			t.Errorf("%+v: expected %d destroyed sessions, got %d", test, test.destroyed, n)
+		}
+		for _, sid := range test.gone {
+			if mgr.Exists(sid) {
+				t.Errorf("%+v: session %q should have been destroyed", test, sid)
+			}
+		}
+	}
+
+	for _, sid := range []string{"idp-a-3", "no-idp"} {
+		if !mgr.Exists(sid) {
+			t.Errorf("session %q should still exist", sid)
+		}
+	}
+}
+
 func TestGetJwtSignature(t *testing.T) {
 	var tests = []struct {
 		jwt string
@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"context"
+	"errors"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/wvh/uuid"
+)
+
+// Conflict resolutions: keep the local changes, take the upstream version, or keep the local changes except for some upstream fields.
+const (
+	ResolveLocal    = "local"
+	ResolveUpstream = "upstream"
+	ResolveMerge    = "merge"
+)
+
+// conflictPath is the part of the dataset compared and merged when resolving conflicts; the rest is managed by Metax.
+const conflictPath = "research_dataset"
+
+var (
+	// ErrSyncConflict means the dataset has been changed both locally and upstream, and the conflict needs to be resolved first.
+	ErrSyncConflict = errors.New("dataset has an unresolved sync conflict")
+
+	// ErrInvalidResolution means the conflict resolution is not one of the known resolutions.
+	ErrInvalidResolution = errors.New("invalid conflict resolution")
+
+	// ErrFieldNotInConflict means a field to take from upstream doesn't differ between the local and upstream versions.
+	ErrFieldNotInConflict = errors.New("field not in conflict")
+)
+
+// GetConflict returns the upstream version of a dataset in conflict with local changes,
+// and the fields of the research dataset that differ between the local (old) and upstream (new) versions.
+func GetConflict(ctx context.Context, db *psql.DB, id uuid.UUID, owner uuid.UUID) (*psql.Conflict, []metax.FieldDiff, error) {
+	_, conflict, diffs, err := getConflict(ctx, db, id, owner)
+	return conflict, diffs, err
+}
+
+// getConflict is GetConflict that also returns the local dataset.
+func getConflict(ctx context.Context, db *psql.DB, id uuid.UUID, owner uuid.UUID) (*models.Dataset, *psql.Conflict, []metax.FieldDiff, error) {
+	dataset, err := db.GetWithOwner(ctx, id, owner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	conflict, err := db.GetConflict(ctx, id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	diffs, err := metax.DiffFields(dataset.Blob(), conflict.Blob, conflictPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return dataset, conflict, diffs, nil
+}
+
+// ResolveConflict resolves a sync conflict of a dataset. The upstream resolution replaces the dataset with the upstream version;
+// the local resolution takes the upstream version with the local research dataset; and the merge resolution does the same,
+// but takes the given fields from upstream. Fields are given as paths from the conflict differences.
+//
+// If the result keeps local changes, the dataset can be published to make them upstream.
+func ResolveConflict(ctx context.Context, db *psql.DB, id uuid.UUID, owner uuid.UUID, resolution string, upstreamFields []string) error {
+	dataset, conflict, diffs, err := getConflict(ctx, db, id, owner)
+	if err != nil {
+		return err
+	}
+
+	switch resolution {
+	case ResolveUpstream:
+		return db.ResolveConflict(ctx, id, conflict.Blob, false)
+	case ResolveLocal:
+		upstreamFields = nil
+	case ResolveMerge:
+		inConflict := make(map[string]bool, len(diffs))
+		for _, diff := range diffs {
+			inConflict[diff.Path] = true
+		}
+		for _, field := range upstreamFields {
+			if !inConflict[field] {
+				return ErrFieldNotInConflict
+			}
+		}
+	default:
+		return ErrInvalidResolution
+	}
+
+	merged := conflict.Blob
+	if local := gjson.GetBytes(dataset.Blob(), conflictPath); local.Exists() {
+		merged, err = sjson.SetRawBytes(merged, conflictPath, []byte(local.Raw))
+	} else {
+		merged, err = sjson.DeleteBytes(merged, conflictPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	merged, err = metax.ApplyFields(merged, conflict.Blob, upstreamFields)
+	if err != nil {
+		return err
+	}
+
+	remaining, err := metax.DiffFields(merged, conflict.Blob, conflictPath)
+	if err != nil {
+		return err
+	}
+	return db.ResolveConflict(ctx, id, merged, len(remaining) > 0)
+}
@@ -0,0 +1,229 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/metax/metaxtest"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	"github.com/wvh/uuid"
+)
+
+// metaxTestDataset returns a Metax dataset of the given metadata provider user.
+// The identifier and modification date are left out if empty.
+func metaxTestDataset(user, identifier, title, description string, modified time.Time) []byte {
+	ds := map[string]interface{}{
+		"data_catalog":           map[string]string{"identifier": "urn:nbn:fi:att:data-catalog-ida"},
+		"metadata_provider_user": user,
+		"research_dataset": map[string]interface{}{
+			"title":       map[string]string{"en": title},
+			"description": map[string]string{"en": description},
+		},
+	}
+	if identifier != "" {
+		ds["identifier"] = identifier
+	}
+	if !modified.IsZero() {
+		ds[metax.DateModifiedKey] = modified.UTC().Format(time.RFC3339Nano)
+	}
+	blob, _ := json.Marshal(ds)
+	return blob
+}
+
+// newSyncTestUser registers a new user with a unique Fairdata identity and returns the user's uid and identity.
+func newSyncTestUser(tb testing.TB, ctx context.Context, db *psql.DB) (uuid.UUID, string) {
+	extid := "sync-test-" + uuid.MustNewUUID().String()
+	uid, _, err := db.RegisterIdentity(ctx, "fairdata", extid)
+	if err != nil {
+		tb.Fatal("db.RegisterIdentity():", err)
+	}
+	return uid, extid
+}
+
+// syncedAt returns when a dataset was last synced.
+func syncedAt(tb testing.TB, ctx context.Context, db *psql.DB, id uuid.UUID) time.Time {
+	batch, err := db.NewBatch(ctx)
+	if err != nil {
+		tb.Fatal("db.NewBatch():", err)
+	}
+	defer batch.Rollback(ctx)
+
+	dataset, err := batch.FindForSync(ctx, id, "")
+	if err != nil {
+		tb.Fatal("batch.FindForSync():", err)
+	}
+	return dataset.Synced
+}
+
+// TestConflicts syncs a dataset from a fake Metax, changes it both locally and upstream, syncs it again to detect the conflict,
+// and resolves the conflict.
+func TestConflicts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	db, err := psql.NewPoolServiceFromEnv()
+	if err != nil {
+		t.Fatal("psql:", err)
+	}
+	ctx := context.Background()
+
+	fake := metaxtest.NewServer()
+	defer fake.Close()
+	api := fake.Client()
+	logger := zerolog.Nop()
+
+	tests := []struct {
+		name        string
+		resolution  string
+		fields      []string
+		allFields   bool
+		err         error
+		title       string
+		description string
+		keepsLocal  bool
+	}{
+		{
+			name:        "local",
+			resolution:  ResolveLocal,
+			title:       "local",
+			description: "original",
+			keepsLocal:  true,
+		},
+		{
+			name:        "upstream",
+			resolution:  ResolveUpstream,
+			title:       "upstream",
+			description: "upstream",
+		},
+		{
+			name:        "merge title",
+			resolution:  ResolveMerge,
+			fields:      []string{"research_dataset.title.en"},
+			title:       "upstream",
+			description: "original",
+			keepsLocal:  true,
+		},
+		{
+			name:        "merge all",
+			resolution:  ResolveMerge,
+			allFields:   true,
+			title:       "upstream",
+			description: "upstream",
+		},
+		{
+			name:       "merge field not in conflict",
+			resolution: ResolveMerge,
+			fields:     []string{"research_dataset.keyword"},
+			err:        ErrFieldNotInConflict,
+		},
+		{
+			name:       "invalid resolution",
+			resolution: "theirs",
+			err:        ErrInvalidResolution,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uid, extid := newSyncTestUser(t, ctx, db)
+
+			// sync the original dataset
+			stored, err := fake.Add(metaxTestDataset(extid, "", "original", "original", time.Time{}))
+			if err != nil {
+				t.Fatal("fake.Add():", err)
+			}
+			identifier := metax.GetIdentifier(stored)
+			if err := Fetch(ctx, api, db, logger, uid, extid); err != nil {
+				t.Fatal("Fetch():", err)
+			}
+			datasets, err := db.GetAllForUid(ctx, uid)
+			if err != nil || len(datasets) != 1 {
+				t.Fatalf("expected one synced dataset, got %d (%v)", len(datasets), err)
+			}
+			id := datasets[0].Id
+
+			// change the dataset on both sides and sync again
+			if err := modifyTitleFromDataset(ctx, db, id, "local"); err != nil {
+				t.Fatal("modifyTitleFromDataset():", err)
+			}
+			if _, err := fake.Add(metaxTestDataset(extid, identifier, "upstream", "upstream", time.Now())); err != nil {
+				t.Fatal("fake.Add():", err)
+			}
+			if err := Fetch(ctx, api, db, logger, uid, extid); err != nil {
+				t.Fatal("Fetch():", err)
+			}
+
+			outcome, err := db.GetSyncOutcome(ctx, uid)
+			if err != nil {
+				t.Fatal("db.GetSyncOutcome():", err)
+			}
+			if outcome.Conflicts != 1 {
+				t.Errorf("expected 1 conflict in sync outcome, got %d", outcome.Conflicts)
+			}
+			conflict, diffs, err := GetConflict(ctx, db, id, uid)
+			if err != nil {
+				t.Fatal("GetConflict():", err)
+			}
+			if title := gjson.GetBytes(conflict.Blob, "research_dataset.title.en").String(); title != "upstream" {
+				t.Errorf("expected upstream title in conflict, got %q", title)
+			}
+			if dataset, err := db.Get(ctx, id); err != nil {
+				t.Fatal("db.Get():", err)
+			} else if title := gjson.GetBytes(dataset.Blob(), "research_dataset.title.en").String(); title != "local" {
+				t.Errorf("expected local title to be kept until the conflict is resolved, got %q", title)
+			}
+
+			fields := test.fields
+			if test.allFields {
+				for _, diff := range diffs {
+					fields = append(fields, diff.Path)
+				}
+			}
+
+			err = ResolveConflict(ctx, db, id, uid, test.resolution, fields)
+			if err != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if err != nil {
+				if exists, _ := db.HasConflict(ctx, id); !exists {
+					t.Error("expected conflict to remain after failed resolution")
+				}
+				return
+			}
+
+			if exists, _ := db.HasConflict(ctx, id); exists {
+				t.Error("expected conflict to be removed")
+			}
+			dataset, err := db.Get(ctx, id)
+			if err != nil {
+				t.Fatal("db.Get():", err)
+			}
+			if title := gjson.GetBytes(dataset.Blob(), "research_dataset.title.en").String(); title != test.title {
+				t.Errorf("expected title %q, got %q", test.title, title)
+			}
+			if description := gjson.GetBytes(dataset.Blob(), "research_dataset.description.en").String(); description != test.description {
+				t.Errorf("expected description %q, got %q", test.description, description)
+			}
+
+			// resolutions that keep local changes count as synced when the conflict was detected, the others as synced now
+			synced := syncedAt(t, ctx, db, id)
+			if test.keepsLocal != synced.Equal(conflict.Detected) {
+				t.Errorf("keeps local changes: %t, but synced at %v with conflict detected at %v", test.keepsLocal, synced, conflict.Detected)
+			}
+
+			// the same upstream version doesn't conflict again
+			if err := Fetch(ctx, api, db, logger, uid, extid); err != nil {
+				t.Fatal("Fetch():", err)
+			}
+			if exists, _ := db.HasConflict(ctx, id); exists {
+				t.Error("expected no new conflict with the same upstream version")
+			}
+		})
+	}
+}
@@ -14,11 +14,11 @@ import (
 // ChangeDatasetCumulativeState uses a Metax RPC call to change cumulative_state for a dataset with the given
 // Metax identifier. The updated dataset is fetched from Metax and it replaces the current version in the DB,
 // so any unpublished changes are lost. If a new dataset version was created, returns the new Qvain identifier.
-func ChangeDatasetCumulativeState(api *metax.MetaxService, db *psql.DB, logger *zerolog.Logger, owner *models.User, id uuid.UUID, cumulativeState string) (newQVersionId *uuid.UUID, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+func ChangeDatasetCumulativeState(ctx context.Context, api *metax.MetaxService, db *psql.DB, logger *zerolog.Logger, owner *models.User, id uuid.UUID, cumulativeState string) (newQVersionId *uuid.UUID, err error) {
+	ctx, cancel := context.WithTimeout(ctx, PublishTimeout)
 	defer cancel()
 
-	dataset, err := db.GetWithOwner(id, owner.Uid)
+	dataset, err := db.GetWithOwner(ctx, id, owner.Uid)
 	if err != nil {
 		return nil, err
 	}
@@ -39,14 +39,18 @@ func ChangeDatasetCumulativeState(api *metax.MetaxService, db *psql.DB, logger *
 	logger.Debug().Str("identifier", identifier).
 		Str("cumulative_state", cumulativeState).Str("new_version_identifier", newMetaxIdentifier).Msg("changed cumulative_state")
 
-	qvainId, err := FetchDataset(api, db, *logger, owner.Uid, identifier)
+	// Metax has changed the dataset; fetching the changes must not be cancelled with the request
+	ctx, cancel = detachedContext()
+	defer cancel()
+
+	qvainId, err := FetchDataset(ctx, api, db, *logger, owner.Uid, identifier)
 	if err != nil {
 		return nil, err
 	}
 	logger.Debug().Str("identifier", identifier).Str("id", qvainId.String()).Msg("fetched updated dataset")
 
 	if newMetaxIdentifier != "" {
-		newQVersionId, err = FetchDataset(api, db, *logger, owner.Uid, newMetaxIdentifier)
+		newQVersionId, err = FetchDataset(ctx, api, db, *logger, owner.Uid, newMetaxIdentifier)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,61 @@
+package shared
+
+import (
+	"context"
+	"errors"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/wvh/uuid"
+)
+
+// ErrNotVersion means a dataset to compare against isn't the owner's and isn't a version of the compared dataset either.
+var ErrNotVersion = errors.New("not a version of the dataset")
+
+// DiffDataset compares the research dataset of a dataset with another dataset, given as Qvain id or Metax identifier.
+// The other dataset is the old side of the comparison. Metax identifiers are looked up locally first; other versions
+// of the dataset that don't exist locally are read from Metax without storing them.
+func DiffDataset(ctx context.Context, api *metax.MetaxService, db *psql.DB, owner uuid.UUID, id uuid.UUID, against string) (*metax.DatasetDiff, error) {
+	dataset, err := db.GetWithOwner(ctx, id, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous []byte
+	if otherId, err := uuid.FromString(against); err == nil {
+		other, err := db.GetWithOwner(ctx, otherId, owner)
+		if err != nil {
+			return nil, err
+		}
+		previous = other.Blob()
+	} else if other, err := findVersion(ctx, db, owner, against); err != nil {
+		return nil, err
+	} else if other != nil {
+		previous = other.Blob()
+	} else {
+		if !isVersionOf(dataset.Blob(), against) {
+			return nil, ErrNotVersion
+		}
+		ctx, cancel := context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+		if previous, err = api.GetId(ctx, against); err != nil {
+			return nil, err
+		}
+	}
+
+	return metax.DiffDatasets(previous, dataset.Blob())
+}
+
+// isVersionOf checks if a Metax identifier is in the version set of a dataset.
+func isVersionOf(blob []byte, identifier string) bool {
+	typed, err := metax.ParseDataset(blob)
+	if err != nil {
+		return false
+	}
+	for _, version := range typed.DatasetVersionSet {
+		if version.Identifier == identifier {
+			return true
+		}
+	}
+	return false
+}
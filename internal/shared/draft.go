@@ -0,0 +1,81 @@
+package shared
+
+import (
+	"context"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/wvh/uuid"
+)
+
+// draftKeys are the top-level fields of a Metax draft that are kept in the Qvain dataset.
+var draftKeys = []string{metax.IdentifierKey, metax.StateKey, metax.DateCreatedKey, metax.DateModifiedKey}
+
+// SaveDraft creates or updates a Metax draft for an unpublished dataset and stores the draft identifier in the Qvain database.
+// A later Publish promotes the draft to a published dataset.
+// It returns the Metax identifier of the draft; published datasets are skipped and return an empty identifier.
+func SaveDraft(ctx context.Context, api metax.DatasetStore, db *psql.DB, id uuid.UUID, owner *models.User) (draftId string, err error) {
+	dataset, err := db.GetWithOwner(ctx, id, owner.Uid)
+	if err != nil {
+		return
+	}
+	if dataset.Published {
+		return
+	}
+
+	blob := dataset.Blob()
+	if !metax.IsDraft(blob) {
+		blob, err = sjson.SetBytes(blob, "user_created", owner.Identity)
+	} else {
+		blob, err = sjson.SetBytes(blob, "user_modified", owner.Identity)
+	}
+	if err != nil {
+		return
+	}
+
+	logger := api.Logger().With().Str("id", id.String()).Logger()
+
+	ctx, cancel := context.WithTimeout(ctx, PublishTimeout)
+	defer cancel()
+
+	res, err := api.StoreDraft(ctx, blob, owner)
+	if err != nil {
+		err = keepCreated(db, &logger, id, err)
+		logApiError(&logger, err, "saving draft failed")
+		return
+	}
+
+	// Metax has the draft now; storing that must not be cancelled with the request
+	ctx, cancel = detachedContext()
+	defer cancel()
+
+	draftId = metax.GetIdentifier(res)
+	if draftId == "" {
+		return "", ErrNoIdentifier
+	}
+
+	fields := []byte("{}")
+	for _, key := range draftKeys {
+		if value := gjson.GetBytes(res, key); value.Exists() {
+			if fields, err = sjson.SetRawBytes(fields, key, []byte(value.Raw)); err != nil {
+				return
+			}
+		}
+	}
+
+	synced := metax.GetModificationDate(res)
+	if synced.IsZero() {
+		synced = time.Now()
+	}
+
+	if err = db.StoreDraft(ctx, id, fields, synced); err != nil {
+		return
+	}
+
+	logger.Info().Str("identifier", draftId).Msg("saved draft dataset")
+	return
+}
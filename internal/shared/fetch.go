@@ -3,10 +3,12 @@ package shared
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/CSCfi/qvain-api/internal/psql"
 	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/models"
 	"github.com/rs/xid"
 	"github.com/rs/zerolog"
 	"github.com/wvh/uuid"
@@ -14,59 +16,106 @@ import (
 
 const DefaultRequestTimeout = 15 * time.Second
 
+// SyncTimeout limits how long streaming a user's datasets from Metax may take.
+const SyncTimeout = 30 * time.Minute
+
+// SyncChunkSize is the number of synced datasets committed to the database at a time.
+const SyncChunkSize = 500
+
+// MaxSyncErrors is the maximum number of error messages stored for a sync run.
+const MaxSyncErrors = 20
+
+// ErrSyncInProgress means the user is being synced already, possibly by another application instance.
+var ErrSyncInProgress = errors.New("sync already in progress")
+
 const (
 	SyncWritten = iota
 	SyncDeleted = iota
 	SyncSkipped = iota
 	SyncFailed  = iota
+
+	// SyncConflict means the dataset was changed both locally and upstream, and the upstream version was stored as conflict.
+	SyncConflict = iota
 )
 
-func Fetch(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, extid string) error {
-	last, err := db.GetLastSync(uid)
+// Fetch syncs the user's datasets changed in Metax since the last sync. It takes the user's sync lock and returns
+// ErrSyncInProgress if the user is being synced already, or psql.ErrTooManySyncs if too many users are being synced.
+func Fetch(ctx context.Context, api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, extid string) error {
+	lock, err := lockSync(ctx, db, uid)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return FetchLocked(ctx, api, db, lock, logger, uid, extid)
+}
+
+// FetchLocked is Fetch for callers that hold the user's sync lock already.
+func FetchLocked(ctx context.Context, api *metax.MetaxService, db *psql.DB, lock *psql.SyncLock, logger zerolog.Logger, uid uuid.UUID, extid string) error {
+	last, err := db.GetLastSync(ctx, uid)
 	if err != nil && err != psql.ErrNotFound {
 		return err
 	}
-	return fetch(api, db, logger, uid, extid, last)
+	return fetch(ctx, api, db, lock, logger, uid, extid, last)
+}
+
+func FetchSince(ctx context.Context, api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, extid string, since time.Time) error {
+	lock, err := lockSync(ctx, db, uid)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return fetch(ctx, api, db, lock, logger, uid, extid, since)
 }
 
-func FetchSince(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, extid string, since time.Time) error {
-	return fetch(api, db, logger, uid, extid, since)
+func FetchAll(ctx context.Context, api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, extid string) error {
+	return FetchSince(ctx, api, db, logger, uid, extid, time.Time{})
 }
 
-func FetchAll(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, extid string) error {
-	return fetch(api, db, logger, uid, extid, time.Time{})
+// lockSync takes the user's sync lock, returning ErrSyncInProgress if someone else holds it.
+func lockSync(ctx context.Context, db *psql.DB, uid uuid.UUID) (*psql.SyncLock, error) {
+	lock, ok, err := db.TryLockSync(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrSyncInProgress
+	}
+	return lock, nil
 }
 
 // FetchDataset syncs a dataset from Metax and returns its Qvain identifier.
-func FetchDataset(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, metaxIdentifier string) (*uuid.UUID, error) {
-	blob, err := api.GetId(metaxIdentifier)
+func FetchDataset(ctx context.Context, api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, metaxIdentifier string) (*uuid.UUID, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultRequestTimeout)
+	defer cancel()
+
+	blob, err := api.GetId(ctx, metaxIdentifier)
 	if err != nil {
 		return nil, err
 	}
 
 	// setup DB batch transaction
-	batch, err := db.NewBatchForUser(uid)
+	batch, err := db.NewBatchForUser(ctx, uid)
 	if err != nil {
 		return nil, err
 	}
-	defer batch.Rollback()
+	defer batch.Rollback(ctx)
 
 	// sync record
-	metaxDatasetQvainId, qvainDatasetSyncTime := getSyncInfo(db, logger, uid)
 	metaxRecord := metax.MetaxRawRecord{json.RawMessage(blob)}
-	qvainId, _, err := syncRecord(api, db, logger, batch, metaxDatasetQvainId, qvainDatasetSyncTime, uid, &metaxRecord)
+	qvainId, _, err := syncRecord(ctx, logger, batch, userOwner(uid), &metaxRecord, time.Time{})
 	if err != nil {
 		return nil, err
 	}
 
-	err = batch.Commit()
+	err = batch.Commit(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return qvainId, nil
 }
 
-func fetch(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, extid string, since time.Time) error {
+// fetch syncs the user's datasets in a batch on the connection of the user's sync lock.
+func fetch(ctx context.Context, api *metax.MetaxService, db *psql.DB, lock *psql.SyncLock, logger zerolog.Logger, uid uuid.UUID, extid string, since time.Time) error {
 	var params []metax.DatasetOption
 
 	// build query options
@@ -82,9 +131,32 @@ func fetch(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid
 		params = append(params, metax.Since(since))
 	}
 
+	outcome := &psql.SyncOutcome{Run: time.Now()}
+	defer storeSyncOutcome(ctx, db, logger, uid, outcome)
+
+	// an interrupted sync is resumed: datasets it synced that haven't changed since are skipped without writing
+	resumeFrom, progress, err := db.GetSyncProgress(ctx, uid)
+	if err != nil && err != psql.ErrNotFound {
+		addSyncError(outcome, err)
+		return err
+	}
+
+	// setup DB batch transaction, committed in chunks
+	batch, err := lock.NewBatch(ctx)
+	if err != nil {
+		addSyncError(outcome, err)
+		return err
+	}
+	defer batch.Rollback(ctx)
+	batch.SetChunkSize(SyncChunkSize)
+	if !resumeFrom.IsZero() {
+		logger.Info().Str("user", uid.String()).Time("started", resumeFrom).Int("progress", progress).Msg("resuming interrupted sync")
+		batch.ResumeFrom(resumeFrom)
+	}
+
 	// fetch user datasets from Metax
 	logger.Info().Str("user", uid.String()).Str("identity", extid).Msg("starting sync")
-	err := syncBatch(api, db, logger, uid, params)
+	err = syncBatch(ctx, api, logger, batch, userOwner(uid), params, outcome, resumeFrom)
 	if err != nil {
 		logger.Info().Err(err).Msg("fetch failed")
 		return err
@@ -93,129 +165,100 @@ func fetch(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid
 	// fetch removed user datasets from Metax
 	logger.Info().Str("user", uid.String()).Str("identity", extid).Msg("syncing removed")
 	params = append(params, metax.WithRemoved())
-	err = syncBatch(api, db, logger, uid, params)
+	err = syncBatch(ctx, api, logger, batch, userOwner(uid), params, outcome, resumeFrom)
 	if err != nil {
 		logger.Info().Err(err).Msg("fetch failed")
 		return err
 	}
 
+	if err = batch.Commit(ctx); err != nil {
+		logger.Info().Err(err).Msg("batch error")
+		addSyncError(outcome, err)
+		return err
+	}
+
+	outcome.Success = true
 	return nil
 }
 
-func getSyncInfo(db *psql.DB, logger zerolog.Logger, uid uuid.UUID) (map[string]*uuid.UUID, map[uuid.UUID]time.Time) {
-	metaxDatasetQvainId := make(map[string]*uuid.UUID)
-	qvainDatasetSyncTime := make(map[uuid.UUID]time.Time)
-	// get existing Qvain datasets for user
-	userDatasets, err := db.GetAllForUid(uid)
-	if err != nil {
-		logger.Error().Err(err).Msg("failed to get user datasets")
+// storeSyncOutcome records the outcome of a sync run; failing to do so doesn't fail the sync.
+func storeSyncOutcome(ctx context.Context, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, outcome *psql.SyncOutcome) {
+	if err := db.StoreSyncOutcome(ctx, uid, outcome); err != nil {
+		logger.Warn().Err(err).Str("user", uid.String()).Msg("can't store sync outcome")
 	}
+}
 
-	// Map Metax identifier in Qvain dataset to the dataset id.
-	// Used when a dataset from Metax does not have a Qvain id in its editor metadata.
-	// Also get per-dataset timestamp of last sync.
-	for _, ds := range userDatasets {
-		if ds.Family() != metax.MetaxDatasetFamily {
-			continue
-		}
-
-		qvainDatasetSyncTime[ds.Id] = ds.Synced
-		metaxIdentifier := metax.GetIdentifier(ds.Blob())
-		if metaxIdentifier == "" {
-			continue
-		}
-		if _, exists := metaxDatasetQvainId[metaxIdentifier]; exists {
-			logger.Warn().Str("identifier", metaxIdentifier).Msg("multiple datasets have the same Metax indentifier")
-			continue
-		}
-		metaxDatasetQvainId[metaxIdentifier] = &ds.Id
+// addSyncError adds an error message to the sync outcome, up to MaxSyncErrors messages.
+func addSyncError(outcome *psql.SyncOutcome, err error) {
+	if err == nil {
+		return
 	}
-
-	return metaxDatasetQvainId, qvainDatasetSyncTime
+	if len(outcome.Errors) >= MaxSyncErrors {
+		return
+	}
+	outcome.Errors = append(outcome.Errors, err.Error())
 }
 
-func syncBatch(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, uid uuid.UUID, params []metax.DatasetOption) error {
-	// setup DB batch transaction
-	batch, err := db.NewBatchForUser(uid)
-	if err != nil {
-		return err
-	}
-	defer batch.Rollback()
+// syncBatch streams the datasets matching the given parameters from Metax into the batch and adds the counts to the sync outcome.
+// Datasets are processed one at a time as they are read, and the batch commits them in chunks.
+func syncBatch(ctx context.Context, api *metax.MetaxService, logger zerolog.Logger, batch *psql.BatchManager, owner OwnerFunc, params []metax.DatasetOption,
+	outcome *psql.SyncOutcome, resumeFrom time.Time) (err error) {
+	defer func() { addSyncError(outcome, err) }()
 
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+	ctx, cancel := context.WithTimeout(ctx, SyncTimeout)
 	defer cancel()
 
 	// create sub-logger to correlate possibly multiple log entries
 	syncLogger := logger.With().Str("sync-id", xid.New().String()).Logger()
 
-	// make API request
-	total, c, errc, err := api.ReadStreamChannel(ctx, params...)
-	if err != nil {
-		return err
-	}
-
 	read := 0
 	written := 0
 	deleted := 0
 	skipped := 0
 	failed := 0
-	success := false
-
-	metaxDatasetQvainId := make(map[string]*uuid.UUID)
-	qvainDatasetSyncTime := make(map[uuid.UUID]time.Time)
-	if total > 0 {
-		metaxDatasetQvainId, qvainDatasetSyncTime = getSyncInfo(db, syncLogger, uid)
-	}
-
-	// loop until all read, error or timeout
-Done:
-	for {
-		select {
-		case fdDataset, more := <-c:
-			if !more {
-				success = true
-				break Done
-			}
+	conflicts := 0
+
+	// make API request and process datasets as they come in
+	total, err := api.StreamDatasets(ctx, func(fdDataset *metax.MetaxRawRecord) error {
+		read++
+		_, status, recordErr := syncRecord(ctx, syncLogger, batch, owner, fdDataset, resumeFrom)
+		switch status {
+		case SyncWritten:
+			written++
+		case SyncDeleted:
+			deleted++
+		case SyncSkipped:
+			skipped++
+		case SyncFailed:
+			failed++
+			addSyncError(outcome, recordErr)
+		case SyncConflict:
+			conflicts++
+		}
+		return batch.RecordDone(ctx)
+	}, params...)
 
-			read++
-			_, status, _ := syncRecord(api, db, syncLogger, batch, metaxDatasetQvainId, qvainDatasetSyncTime, uid, fdDataset)
-			switch status {
-			case SyncWritten:
-				written++
-			case SyncDeleted:
-				deleted++
-			case SyncSkipped:
-				skipped++
-			case SyncFailed:
-				failed++
-			}
+	outcome.Written += written
+	outcome.Skipped += skipped
+	outcome.Deleted += deleted
+	outcome.Failed += failed
+	outcome.Conflicts += conflicts
 
-		case err := <-errc:
-			// error while streaming
-			logger.Info().Err(err).Msg("api error")
-			return err
-		case <-ctx.Done():
-			// timeout
-			logger.Info().Err(ctx.Err()).Msg("api timeout")
-			return err
-		}
-	}
-	if success {
-		err = batch.Commit()
-	}
 	if err != nil {
-		logger.Info().Err(err).Msg("batch error")
+		// error while streaming, timeout or failed chunk commit
+		logger.Info().Err(err).Int("read", read).Msg("sync error")
 		return err
 	}
 
 	logger.Info().Int("total", total).Int("written", written).
-		Int("skipped", skipped).Int("deleted", deleted).Int("failed", failed).Msg("successful sync")
+		Int("skipped", skipped).Int("deleted", deleted).Int("failed", failed).Int("conflicts", conflicts).Msg("successful sync")
 	return nil
 }
 
-func syncRecord(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, batch *psql.BatchManager,
-	metaxDatasetQvainId map[string]*uuid.UUID, qvainDatasetSyncTime map[uuid.UUID]time.Time,
-	uid uuid.UUID, record *metax.MetaxRawRecord) (*uuid.UUID, int, error) {
+// syncRecord syncs a Metax dataset into the batch. Datasets are matched to existing datasets by the Qvain id
+// in their editor metadata or, for datasets not from Qvain, by Metax identifier; new datasets get the owner returned by owner.
+// If resuming an interrupted sync, unmodified datasets synced after it started are skipped without writing.
+func syncRecord(ctx context.Context, logger zerolog.Logger, batch *psql.BatchManager, owner OwnerFunc, record *metax.MetaxRawRecord, resumeFrom time.Time) (*uuid.UUID, int, error) {
 	// create dataset, use Qvain id from editor metadata if available
 	dataset, isNew, err := record.ToQvain()
 	if err != nil {
@@ -223,30 +266,43 @@ func syncRecord(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, bat
 		return nil, SyncFailed, err
 	}
 
-	// was the Metax dataset not from Qvain?
+	// find the existing Qvain dataset; was the Metax dataset not from Qvain, check if we have one with the same Metax identifier
+	var existing *models.Dataset
 	if isNew {
-		// check if we already have a dataset with the same Metax identifier
-		identifier := metax.GetIdentifier(record.RawMessage)
-		if identifier != "" {
-			newId, found := metaxDatasetQvainId[identifier]
-			if found {
-				// update the existing dataset blob instead of creating a new dataset
-				isNew = false
-				dataset.Id = *newId
-			}
+		if identifier := metax.GetIdentifier(record.RawMessage); identifier != "" {
+			existing, err = batch.FindForSync(ctx, uuid.UUID{}, identifier)
+		}
+	} else {
+		existing, err = batch.FindForSync(ctx, dataset.Id, "")
+	}
+	if err != nil && err != psql.ErrNotFound {
+		logger.Debug().Err(err).Str("id", dataset.Id.String()).Msg("can't look up dataset")
+		return nil, SyncFailed, err
+	}
+	if existing != nil && isNew {
+		// update the existing dataset blob instead of creating a new dataset
+		isNew = false
+		dataset.Id = existing.Id
+	}
+
+	// if there's no previous sync, assume dataset does not exist in qvain
+	var synced time.Time
+	if existing != nil {
+		synced = existing.Synced
+		if status, err := lockOwner(ctx, logger, batch, existing.Owner); status != SyncWritten {
+			return nil, status, err
 		}
 	}
 
 	// delete qvain dataset
 	if dataset.Removed {
-		// if the map doesn't contain a previous sync, assume dataset does not exist in qvain
-		if qvainDatasetSyncTime[dataset.Id].IsZero() {
-			logger.Debug().Err(err).Str("id", dataset.Id.String()).Msg("not in qvain, skipping deletion")
+		if synced.IsZero() {
+			logger.Debug().Str("id", dataset.Id.String()).Msg("not in qvain, skipping deletion")
 			return nil, SyncSkipped, nil
 		}
 
 		// delete qvain dataset
-		if err = batch.Delete(dataset.Id); err != nil {
+		if err = batch.Delete(ctx, dataset.Id); err != nil {
 			logger.Debug().Err(err).Str("id", dataset.Id.String()).Msg("can't delete dataset")
 			return nil, SyncFailed, err
 		}
@@ -256,6 +312,15 @@ func syncRecord(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, bat
 
 	// create new qvain dataset
 	if isNew {
+		uid, ok := owner(ctx, record)
+		if !ok {
+			logger.Debug().Str("identifier", metax.GetIdentifier(record.RawMessage)).Msg("no owner for dataset, skipping")
+			return nil, SyncSkipped, nil
+		}
+		if status, err := lockOwner(ctx, logger, batch, uid); status != SyncWritten {
+			return nil, status, err
+		}
+
 		// create new id
 		dataset.Id, err = uuid.NewUUID()
 		if err != nil {
@@ -263,15 +328,15 @@ func syncRecord(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, bat
 			return nil, SyncFailed, err
 		}
 
-		// inject current user for datasets created externally
+		// inject owner for datasets created externally
 		dataset.Creator = uid
 		dataset.Owner = uid
 
-		// dataset comes from upstream, so consider it published and valid
-		dataset.Published = true
+		// dataset comes from upstream, so consider it published – unless it's a Metax draft – and valid
+		dataset.Published = !metax.IsDraft(record.RawMessage)
 		dataset.SetValid(true)
 
-		if err = batch.CreateWithMetadata(dataset); err != nil {
+		if err = batch.CreateWithMetadata(ctx, dataset); err != nil {
 			logger.Debug().Err(err).Str("id", dataset.Id.String()).Msg("can't store dataset")
 			return nil, SyncFailed, err
 		}
@@ -281,20 +346,60 @@ func syncRecord(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, bat
 
 	// check if we have already synced the Qvain dataset based on modification dates
 	modified := metax.GetModificationDate(dataset.Blob())
-	if !modified.IsZero() && !modified.After(qvainDatasetSyncTime[dataset.Id]) {
+	if !modified.IsZero() && !modified.After(synced) {
 		logger.Debug().Str("id", dataset.Id.String()).Msg("dataset not modified in Metax after last sync")
-		if err = batch.UpdateSynced(dataset.Id); err != nil {
+		if !resumeFrom.IsZero() && !synced.Before(resumeFrom) {
+			return &dataset.Id, SyncSkipped, nil
+		}
+		if err = batch.UpdateSynced(ctx, dataset.Id); err != nil {
 			logger.Debug().Err(err).Str("id", dataset.Id.String()).Msg("could't update sync timestamp")
 			return nil, SyncFailed, err
 		}
 		return &dataset.Id, SyncSkipped, nil
 	}
 
-	// update qvain dataset
-	if err = batch.Update(dataset.Id, dataset.Blob()); err != nil {
+	// don't overwrite local changes to published datasets made since the last sync; keep the upstream version aside for the user to resolve
+	if existing != nil && existing.Published && !synced.IsZero() && existing.Modified.After(synced) {
+		diffs, err := metax.DiffFields(existing.Blob(), dataset.Blob(), "research_dataset")
+		if err != nil {
+			logger.Debug().Err(err).Str("id", dataset.Id.String()).Msg("can't compare dataset")
+			return nil, SyncFailed, err
+		}
+		if len(diffs) > 0 {
+			if err = batch.StoreConflict(ctx, dataset.Id, dataset.Blob()); err != nil {
+				logger.Debug().Err(err).Str("id", dataset.Id.String()).Msg("can't store conflict")
+				return nil, SyncFailed, err
+			}
+			logger.Info().Str("id", dataset.Id.String()).Int("fields", len(diffs)).Msg("dataset changed locally and upstream")
+			return &dataset.Id, SyncConflict, nil
+		}
+	}
+
+	// update qvain dataset; drafts published in Metax are published in Qvain as well
+	if metax.IsDraft(record.RawMessage) {
+		err = batch.Update(ctx, dataset.Id, dataset.Blob())
+	} else {
+		err = batch.UpdatePublished(ctx, dataset.Id, dataset.Blob())
+	}
+	if err != nil {
 		logger.Debug().Err(err).Str("id", dataset.Id.String()).Msg("can't update dataset")
 		return nil, SyncFailed, err
 	}
 	logger.Debug().Bool("new", isNew).Str("id", dataset.Id.String()).Msg("updated dataset")
 	return &dataset.Id, SyncWritten, nil
 }
+
+// lockOwner takes the sync lock of a dataset owner in batches without a user. It returns SyncWritten if the dataset can be
+// written, SyncSkipped if the owner is being synced – the owner's sync writes the dataset anyway – or SyncFailed on error.
+func lockOwner(ctx context.Context, logger zerolog.Logger, batch *psql.BatchManager, uid uuid.UUID) (int, error) {
+	ok, err := batch.LockOwner(ctx, uid)
+	if err != nil {
+		logger.Debug().Err(err).Str("owner", uid.String()).Msg("can't lock dataset owner")
+		return SyncFailed, err
+	}
+	if !ok {
+		logger.Debug().Str("owner", uid.String()).Msg("dataset owner is being synced, skipping")
+		return SyncSkipped, nil
+	}
+	return SyncWritten, nil
+}
@@ -0,0 +1,126 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/metax/metaxtest"
+	"github.com/rs/zerolog"
+)
+
+// abortingWriter breaks off a streamed response after a number of flushed datasets, as if the connection was lost.
+type abortingWriter struct {
+	http.ResponseWriter
+	flushes int
+}
+
+func (w *abortingWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+	w.flushes--
+	if w.flushes == 0 {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// TestFetchResume interrupts a sync after the first chunk has been committed, and checks that the next sync resumes it,
+// skipping the datasets synced by the interrupted sync.
+func TestFetchResume(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	db, err := psql.NewPoolServiceFromEnv()
+	if err != nil {
+		t.Fatal("psql:", err)
+	}
+	ctx := context.Background()
+	logger := zerolog.Nop()
+
+	const (
+		total     = SyncChunkSize + 100
+		abortedAt = SyncChunkSize + 50
+	)
+
+	fake := metaxtest.NewServer()
+	defer fake.Close()
+
+	// the first dataset stream is broken off after abortedAt datasets
+	var abort int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stream") == "true" && atomic.CompareAndSwapInt32(&abort, 1, 0) {
+			w = &abortingWriter{ResponseWriter: w, flushes: abortedAt}
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	api := metax.NewMetaxService(strings.TrimPrefix(srv.URL, "http://"), fake.Options()...)
+
+	uid, extid := newSyncTestUser(t, ctx, db)
+	for i := 0; i < total; i++ {
+		if _, err := fake.Add(metaxTestDataset(extid, "", "dataset", "", time.Time{})); err != nil {
+			t.Fatal("fake.Add():", err)
+		}
+	}
+
+	countDatasets := func(t *testing.T) int {
+		datasets, err := db.GetAllForUid(ctx, uid)
+		if err != nil {
+			t.Fatal("db.GetAllForUid():", err)
+		}
+		return len(datasets)
+	}
+
+	t.Run("interrupted", func(t *testing.T) {
+		if err := Fetch(ctx, api, db, logger, uid, extid); err == nil {
+			t.Fatal("expected broken stream to fail the sync")
+		}
+
+		outcome, err := db.GetSyncOutcome(ctx, uid)
+		if err != nil {
+			t.Fatal("db.GetSyncOutcome():", err)
+		}
+		if outcome.Success {
+			t.Error("expected unsuccessful sync outcome")
+		}
+		if outcome.Started.IsZero() || outcome.Progress != SyncChunkSize {
+			t.Errorf("expected unfinished sync with progress %d, got started %v with progress %d", SyncChunkSize, outcome.Started, outcome.Progress)
+		}
+		if n := countDatasets(t); n != SyncChunkSize {
+			t.Errorf("expected the first chunk of %d datasets to be committed, got %d", SyncChunkSize, n)
+		}
+	})
+
+	t.Run("resumed", func(t *testing.T) {
+		if err := Fetch(ctx, api, db, logger, uid, extid); err != nil {
+			t.Fatal("Fetch():", err)
+		}
+
+		outcome, err := db.GetSyncOutcome(ctx, uid)
+		if err != nil {
+			t.Fatal("db.GetSyncOutcome():", err)
+		}
+		if !outcome.Success {
+			t.Errorf("expected successful sync outcome, got errors %v", outcome.Errors)
+		}
+		if outcome.Written != total-SyncChunkSize || outcome.Skipped != SyncChunkSize {
+			t.Errorf("expected %d written and %d skipped, got %d written and %d skipped",
+				total-SyncChunkSize, SyncChunkSize, outcome.Written, outcome.Skipped)
+		}
+		if !outcome.Started.IsZero() {
+			t.Errorf("expected no unfinished sync, got one started %v", outcome.Started)
+		}
+		if _, _, err := db.GetSyncProgress(ctx, uid); err != psql.ErrNotFound {
+			t.Errorf("expected sync progress to be cleared, got %v", err)
+		}
+		if n := countDatasets(t); n != total {
+			t.Errorf("expected %d datasets, got %d", total, n)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/wvh/uuid"
+)
+
+var (
+	// ErrNotPublished means the operation needs a dataset that has been published to Metax.
+	ErrNotPublished = errors.New("dataset has not been published")
+
+	// ErrNotDeprecated means the dataset has not been deprecated by Metax, so there is nothing to fix.
+	ErrNotDeprecated = errors.New("dataset is not deprecated")
+)
+
+// FixDeprecated asks Metax to fix a deprecated dataset, which creates a new version without the removed files.
+// The new version is stored in the Qvain database like new versions created by Publish, and the deprecated version is updated.
+// It returns the Metax identifier and Qvain id of the new version.
+func FixDeprecated(ctx context.Context, api metax.DatasetStore, db *psql.DB, id uuid.UUID, owner *models.User) (newVersionId string, newQVersionId *uuid.UUID, err error) {
+	dataset, err := db.GetWithOwner(ctx, id, owner.Uid)
+	if err != nil {
+		return
+	}
+
+	identifier := metax.GetIdentifier(dataset.Blob())
+	if !dataset.Published || identifier == "" {
+		return "", nil, ErrNotPublished
+	}
+	if !metax.IsDeprecated(dataset.Blob()) {
+		return "", nil, ErrNotDeprecated
+	}
+
+	logger := api.Logger().With().Str("id", id.String()).Str("identifier", identifier).Logger()
+
+	ctx, cancel := context.WithTimeout(ctx, PublishTimeout)
+	defer cancel()
+
+	newVersionId, err = api.FixDeprecated(ctx, identifier)
+	if err != nil {
+		logApiError(&logger, err, "fix deprecated failed")
+		return
+	}
+	logger.Info().Str("new_version", newVersionId).Msg("fixed deprecated dataset")
+
+	// Metax has the new version now; storing it must not be cancelled with the request
+	ctx, cancel = detachedContext()
+	defer cancel()
+
+	// the deprecated version now links to the new version
+	old, err := api.GetId(ctx, identifier)
+	if err != nil {
+		return
+	}
+	synced := metax.GetModificationDate(old)
+	if synced.IsZero() {
+		synced = time.Now()
+	}
+	if err = db.StorePublished(ctx, id, old, synced); err != nil {
+		return
+	}
+
+	newQVersionId, err = storeNewVersion(ctx, api, db, &logger, id, newVersionId)
+	return
+}
@@ -0,0 +1,159 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	"github.com/wvh/uuid"
+)
+
+// OwnerFunc returns the Qvain owner for a Metax dataset that doesn't exist in Qvain yet, or false if it has none.
+type OwnerFunc func(ctx context.Context, record *metax.MetaxRawRecord) (uuid.UUID, bool)
+
+// ownerStore is the part of the database used to look up owners.
+type ownerStore interface {
+	GetIdentities(ctx context.Context, uid uuid.UUID) (map[string]string, error)
+	GetUidForIdentity(ctx context.Context, svc, id string) (uuid.UUID, error)
+}
+
+// OwnerMapper assigns Qvain owners to imported datasets. The owner is, in order of preference:
+// the Qvain owner in the dataset's editor metadata if that user exists; the user the metadata provider is mapped to;
+// the user with the metadata provider as identity for the given service; and the fallback owner.
+type OwnerMapper struct {
+	store    ownerStore
+	service  string
+	mapping  map[string]uuid.UUID
+	fallback uuid.UUID
+
+	// cache of owner lookups, by editor owner id and metadata provider
+	users      map[uuid.UUID]bool
+	identities map[string]*uuid.UUID
+}
+
+// NewOwnerMapper returns an owner mapper. The mapping from metadata provider user to Qvain user and the fallback owner are optional.
+func NewOwnerMapper(db *psql.DB, service string, mapping map[string]uuid.UUID, fallback uuid.UUID) *OwnerMapper {
+	return newOwnerMapper(db, service, mapping, fallback)
+}
+
+func newOwnerMapper(store ownerStore, service string, mapping map[string]uuid.UUID, fallback uuid.UUID) *OwnerMapper {
+	return &OwnerMapper{
+		store:      store,
+		service:    service,
+		mapping:    mapping,
+		fallback:   fallback,
+		users:      make(map[uuid.UUID]bool),
+		identities: make(map[string]*uuid.UUID),
+	}
+}
+
+// Owner returns the owner for a Metax dataset; it can be used as OwnerFunc.
+func (m *OwnerMapper) Owner(ctx context.Context, record *metax.MetaxRawRecord) (uuid.UUID, bool) {
+	if uid, err := uuid.FromString(gjson.GetBytes(record.RawMessage, "editor.owner_id").String()); err == nil && m.userExists(ctx, uid) {
+		return uid, true
+	}
+
+	if user := gjson.GetBytes(record.RawMessage, "metadata_provider_user").String(); user != "" {
+		if uid, ok := m.mapping[user]; ok {
+			return uid, true
+		}
+		if uid := m.identity(ctx, user); uid != nil {
+			return *uid, true
+		}
+	}
+
+	if m.fallback != (uuid.UUID{}) {
+		return m.fallback, true
+	}
+	return uuid.UUID{}, false
+}
+
+func (m *OwnerMapper) userExists(ctx context.Context, uid uuid.UUID) bool {
+	exists, ok := m.users[uid]
+	if !ok {
+		_, err := m.store.GetIdentities(ctx, uid)
+		exists = err == nil
+		m.users[uid] = exists
+	}
+	return exists
+}
+
+func (m *OwnerMapper) identity(ctx context.Context, user string) *uuid.UUID {
+	uid, ok := m.identities[user]
+	if !ok {
+		if found, err := m.store.GetUidForIdentity(ctx, m.service, user); err == nil {
+			uid = &found
+		}
+		m.identities[user] = uid
+	}
+	return uid
+}
+
+// ReadOwnerMapping reads a mapping from metadata provider user to Qvain user, given as JSON object.
+func ReadOwnerMapping(r io.Reader) (map[string]uuid.UUID, error) {
+	var raw map[string]string
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	mapping := make(map[string]uuid.UUID, len(raw))
+	for user, owner := range raw {
+		uid, err := uuid.FromString(owner)
+		if err != nil {
+			return nil, err
+		}
+		mapping[user] = uid
+	}
+	return mapping, nil
+}
+
+// Import syncs all Metax datasets matching the given parameters – typically an organisation or project – into Qvain.
+// Datasets that already exist in Qvain are updated for their current owner; new datasets get the owner returned by owner,
+// and are skipped if there is none. Datasets of users who are being synced at the same time are skipped as well, since the
+// user's sync writes them; see psql.BatchManager.LockOwner. Unlike user syncs, imports aren't recorded in the user's sync state.
+func Import(ctx context.Context, api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, owner OwnerFunc, params ...metax.DatasetOption) (*psql.SyncOutcome, error) {
+	outcome := &psql.SyncOutcome{Run: time.Now()}
+
+	batch, err := db.NewBatch(ctx)
+	if err != nil {
+		addSyncError(outcome, err)
+		return outcome, err
+	}
+	defer batch.Rollback(ctx)
+	batch.SetChunkSize(SyncChunkSize)
+
+	logger.Info().Msg("starting import")
+	if err = syncBatch(ctx, api, logger, batch, owner, params, outcome, time.Time{}); err != nil {
+		logger.Info().Err(err).Msg("import failed")
+		return outcome, err
+	}
+
+	logger.Info().Msg("importing removed")
+	params = append(params, metax.WithRemoved())
+	if err = syncBatch(ctx, api, logger, batch, owner, params, outcome, time.Time{}); err != nil {
+		logger.Info().Err(err).Msg("import failed")
+		return outcome, err
+	}
+
+	if err = batch.Commit(ctx); err != nil {
+		logger.Info().Err(err).Msg("batch error")
+		addSyncError(outcome, err)
+		return outcome, err
+	}
+
+	outcome.Last = outcome.Run
+	outcome.Success = true
+	return outcome, nil
+}
+
+// userOwner returns an OwnerFunc that gives all datasets to the same user.
+func userOwner(uid uuid.UUID) OwnerFunc {
+	return func(context.Context, *metax.MetaxRawRecord) (uuid.UUID, bool) {
+		return uid, true
+	}
+}
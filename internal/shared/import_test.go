@@ -0,0 +1,94 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/wvh/uuid"
+)
+
+// fakeOwnerStore knows the given users and identities, and counts lookups.
+type fakeOwnerStore struct {
+	users      map[uuid.UUID]bool
+	identities map[string]uuid.UUID
+	lookups    int
+}
+
+func (store *fakeOwnerStore) GetIdentities(ctx context.Context, uid uuid.UUID) (map[string]string, error) {
+	store.lookups++
+	if !store.users[uid] {
+		return nil, psql.ErrNotFound
+	}
+	return map[string]string{}, nil
+}
+
+func (store *fakeOwnerStore) GetUidForIdentity(ctx context.Context, svc, id string) (uuid.UUID, error) {
+	store.lookups++
+	if uid, ok := store.identities[svc+":"+id]; ok {
+		return uid, nil
+	}
+	return uuid.UUID{}, psql.ErrNotFound
+}
+
+func TestOwnerMapper(t *testing.T) {
+	var (
+		editorOwner = uuid.MustNewUUID()
+		mapped      = uuid.MustNewUUID()
+		known       = uuid.MustNewUUID()
+		fallback    = uuid.MustNewUUID()
+	)
+	ctx := context.Background()
+	store := &fakeOwnerStore{
+		users:      map[uuid.UUID]bool{editorOwner: true},
+		identities: map[string]uuid.UUID{"fairdata:known": known},
+	}
+
+	mapping, err := ReadOwnerMapping(strings.NewReader(`{"mapped":"` + mapped.String() + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadOwnerMapping(strings.NewReader(`{"bad":"not-a-uuid"}`)); err == nil {
+		t.Error("expected error for invalid uid in mapping")
+	}
+
+	record := func(blob string) *metax.MetaxRawRecord {
+		return &metax.MetaxRawRecord{RawMessage: json.RawMessage(blob)}
+	}
+	tests := []struct {
+		name   string
+		record *metax.MetaxRawRecord
+		owner  uuid.UUID
+	}{
+		{"editor owner", record(`{"editor":{"owner_id":"` + editorOwner.String() + `"},"metadata_provider_user":"mapped"}`), editorOwner},
+		{"unknown editor owner", record(`{"editor":{"owner_id":"` + uuid.MustNewUUID().String() + `"},"metadata_provider_user":"mapped"}`), mapped},
+		{"mapping", record(`{"metadata_provider_user":"mapped"}`), mapped},
+		{"identity", record(`{"metadata_provider_user":"known"}`), known},
+		{"fallback", record(`{"metadata_provider_user":"unknown"}`), fallback},
+		{"no user", record(`{}`), fallback},
+	}
+
+	mapper := newOwnerMapper(store, "fairdata", mapping, fallback)
+	for _, test := range tests {
+		if owner, ok := mapper.Owner(ctx, test.record); !ok || owner != test.owner {
+			t.Errorf("%s: expected owner %s, got %s (%t)", test.name, test.owner, owner, ok)
+		}
+	}
+
+	// lookups are cached
+	lookups := store.lookups
+	mapper.Owner(ctx, tests[0].record)
+	mapper.Owner(ctx, tests[3].record)
+	if store.lookups != lookups {
+		t.Errorf("expected cached lookups, got %d more", store.lookups-lookups)
+	}
+
+	// without fallback, datasets without known owner are skipped
+	mapper = newOwnerMapper(store, "fairdata", nil, uuid.UUID{})
+	if owner, ok := mapper.Owner(ctx, tests[4].record); ok {
+		t.Errorf("expected no owner, got %s", owner)
+	}
+}
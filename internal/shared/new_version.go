@@ -0,0 +1,197 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/wvh/uuid"
+)
+
+var (
+	// ErrNotLatestVersion means the operation needs the latest version of a dataset.
+	ErrNotLatestVersion = errors.New("dataset is not the latest version")
+
+	// ErrNoFileChanges means a new version doesn't change the files of the dataset, which Metax API v1 needs to create a new version.
+	ErrNoFileChanges = errors.New("new version must change files or directories")
+)
+
+// versionDraftKeys are the fields managed by Metax for each version, removed from drafts for new versions.
+var versionDraftKeys = []string{
+	"id", metax.IdentifierKey, metax.StateKey, metax.DateCreatedKey, metax.DateModifiedKey, metax.DateDeprecatedKey,
+	metax.DeprecatedKey, "removed", "user_created", "user_modified", "dataset_version_set",
+	"previous_dataset_version", "next_dataset_version", metax.NewVersionKey,
+	"research_dataset.preferred_identifier", "research_dataset.metadata_version_identifier",
+}
+
+// CreateNewVersion creates a local draft for a new version of the latest version of a published dataset.
+// The published dataset is left as it is; publishing the draft creates the new version in Metax.
+// It returns the Qvain id of the draft.
+func CreateNewVersion(ctx context.Context, db *psql.DB, id uuid.UUID, owner *models.User) (*uuid.UUID, error) {
+	dataset, err := db.GetWithOwner(ctx, id, owner.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := dataset.Blob()
+	if !dataset.Published || !metax.IsPublished(blob) {
+		return nil, ErrNotPublished
+	}
+	if gjson.GetBytes(blob, "next_dataset_version.identifier").String() != "" {
+		return nil, ErrNotLatestVersion
+	}
+
+	draft, err := models.NewDataset(owner.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range versionDraftKeys {
+		if blob, err = sjson.DeleteBytes(blob, key); err != nil {
+			return nil, err
+		}
+	}
+	if metax.GetQvainId(blob) != "" {
+		if blob, err = sjson.SetBytes(blob, metax.EditorKey+"."+metax.QvainIdKey, draft.Id.String()); err != nil {
+			return nil, err
+		}
+	}
+	if err = draft.SetData(dataset.Family(), dataset.Schema(), blob); err != nil {
+		return nil, err
+	}
+
+	if err = db.CreateVersionDraft(ctx, id, draft); err != nil {
+		return nil, err
+	}
+	return &draft.Id, nil
+}
+
+// publishNewVersion publishes a draft for a new version of a dataset. With Metax API v2, the new version is created
+// explicitly and then updated with the draft; with API v1, the draft is stored over the published version,
+// which makes Metax create a new version because the files change. The draft is replaced by the published version,
+// and the version it's based on is updated to link to it. It returns the Metax identifier of the new version.
+//
+// The identifier of a version created with API v2 is stored in the draft right away, so that publishing the draft
+// again after a failure finishes that version instead of creating another one.
+func publishNewVersion(ctx context.Context, api metax.DatasetStore, db *psql.DB, logger *zerolog.Logger,
+	id uuid.UUID, basedOn uuid.UUID, blob []byte, owner *models.User) (string, error) {
+	base, err := db.GetWithOwner(ctx, basedOn, owner.Uid)
+	if err != nil {
+		return "", err
+	}
+	baseIdentifier := metax.GetIdentifier(base.Blob())
+	if baseIdentifier == "" {
+		return "", ErrNotPublished
+	}
+
+	var res []byte
+	versionId := metax.GetIdentifier(blob)
+	created := versionId == ""
+	if created {
+		versionId, err = api.CreateNewVersion(ctx, baseIdentifier, owner)
+	}
+	switch {
+	case err == metax.ErrVersioningNotSupported:
+		// only file changes make Metax API v1 create a new version instead of updating the published one
+		changed, err := filesChanged(base.Blob(), blob)
+		if err != nil {
+			return "", err
+		}
+		if !changed {
+			return "", ErrNoFileChanges
+		}
+		if blob, err = sjson.SetBytes(blob, metax.IdentifierKey, baseIdentifier); err != nil {
+			return "", err
+		}
+		if blob, err = sjson.DeleteBytes(blob, "user_created"); err != nil {
+			return "", err
+		}
+		if blob, err = sjson.SetBytes(blob, "user_modified", owner.Identity); err != nil {
+			return "", err
+		}
+		if res, err = api.Store(ctx, blob, owner); err != nil {
+			logApiError(logger, err, "publishing new version failed")
+			return "", err
+		}
+
+		// Metax has the new version now; storing it must not be cancelled with the request
+		var cancel context.CancelFunc
+		ctx, cancel = detachedContext()
+		defer cancel()
+
+		if versionId = metax.MaybeNewVersionId(res); versionId == "" {
+			return "", ErrNoIdentifier
+		}
+		if res, err = api.GetId(ctx, versionId); err != nil {
+			return "", err
+		}
+	case err != nil:
+		logApiError(logger, err, "creating new version failed")
+		return "", err
+	default:
+		// Metax has the new version now; finishing it must not be cancelled with the request
+		var cancel context.CancelFunc
+		ctx, cancel = detachedContext()
+		defer cancel()
+
+		if blob, err = sjson.SetBytes(blob, metax.IdentifierKey, versionId); err != nil {
+			return "", err
+		}
+		if created {
+			if err = storeIdentifier(ctx, db, id, versionId, true); err != nil {
+				logger.Warn().Err(err).Str("identifier", versionId).Msg("can't store new version identifier in draft")
+			}
+		}
+		if blob, err = sjson.SetBytes(blob, metax.StateKey, metax.StateDraft); err != nil {
+			return "", err
+		}
+		if res, err = api.Store(ctx, blob, owner); err != nil {
+			logApiError(logger, err, "publishing new version failed")
+			return "", err
+		}
+	}
+
+	synced := metax.GetModificationDate(res)
+	if synced.IsZero() {
+		synced = time.Now()
+	}
+	if err = db.StorePublishedVersion(ctx, id, basedOn, synced, res); err != nil {
+		return "", err
+	}
+
+	// the previous version now links to the new version
+	old, err := api.GetId(ctx, baseIdentifier)
+	if err != nil {
+		return "", err
+	}
+	synced = metax.GetModificationDate(old)
+	if synced.IsZero() {
+		synced = time.Now()
+	}
+	if err = db.StorePublished(ctx, basedOn, old, synced); err != nil {
+		return "", err
+	}
+
+	logger.Info().Str("identifier", versionId).Str("previous", baseIdentifier).Msg("published new version")
+	return versionId, nil
+}
+
+// filesChanged checks if the files or directories of a dataset differ from those of another dataset.
+func filesChanged(oldBlob, newBlob []byte) (bool, error) {
+	for _, path := range []string{"research_dataset.files", "research_dataset.directories"} {
+		equal, err := metax.EqualJSON(gjson.GetBytes(oldBlob, path).Raw, gjson.GetBytes(newBlob, path).Raw)
+		if err != nil {
+			return false, err
+		}
+		if !equal {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,31 @@
+package shared
+
+import "testing"
+
+func TestFilesChanged(t *testing.T) {
+	const base = `{"research_dataset":{"title":{"en":"Test"},"files":[{"identifier":"f1","title":"File 1"}],"directories":[{"identifier":"d1"}]}}`
+
+	tests := []struct {
+		name    string
+		blob    string
+		changed bool
+	}{
+		{"same", base, false},
+		{"reordered keys", `{"research_dataset":{"directories":[{"identifier":"d1"}],"files":[{"title":"File 1","identifier":"f1"}],"title":{"en":"Changed"}}}`, false},
+		{"file added", `{"research_dataset":{"files":[{"identifier":"f1","title":"File 1"},{"identifier":"f2"}],"directories":[{"identifier":"d1"}]}}`, true},
+		{"directory removed", `{"research_dataset":{"files":[{"identifier":"f1","title":"File 1"}]}}`, true},
+		{"file metadata changed", `{"research_dataset":{"files":[{"identifier":"f1","title":"Renamed"}],"directories":[{"identifier":"d1"}]}}`, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changed, err := filesChanged([]byte(base), []byte(test.blob))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != test.changed {
+				t.Errorf("expected changed to be %v, got %v", test.changed, changed)
+			}
+		})
+	}
+}
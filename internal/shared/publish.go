@@ -3,13 +3,12 @@ package shared
 import (
 	"context"
 	"errors"
-	"fmt"
-	"os"
 	"time"
 
 	"github.com/CSCfi/qvain-api/internal/psql"
 	"github.com/CSCfi/qvain-api/pkg/metax"
 	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/rs/zerolog"
 	"github.com/tidwall/sjson"
 	"github.com/wvh/uuid"
 )
@@ -26,14 +25,25 @@ var (
 
 // Publish stores a dataset in Metax and updates the Qvain database.
 // It returns the Metax identifier for the dataset, the new version idenifier if such was created, and an error.
+// Drafts for new versions created with CreateNewVersion are published as new version of the dataset they're based on.
 // The error returned can be a Metax ApiError, a Qvain database error, or a basic Go error.
-func Publish(api *metax.MetaxService, db *psql.DB, id uuid.UUID, owner *models.User) (versionId string, newVersionId string, newQVersionId *uuid.UUID, err error) {
+func Publish(ctx context.Context, api metax.DatasetStore, db *psql.DB, id uuid.UUID, owner *models.User) (versionId string, newVersionId string, newQVersionId *uuid.UUID, err error) {
 
-	dataset, err := db.GetWithOwner(id, owner.Uid)
+	dataset, err := db.GetWithOwner(ctx, id, owner.Uid)
 	if err != nil {
 		return
 	}
 
+	// publishing would overwrite upstream changes the user hasn't seen yet
+	inConflict, err := db.HasConflict(ctx, id)
+	if err != nil {
+		return
+	}
+	if inConflict {
+		err = ErrSyncConflict
+		return
+	}
+
 	// Add user_created or user_modified based on whether this was already published
 	blob := dataset.Blob()
 	if dataset.Published {
@@ -45,26 +55,31 @@ func Publish(api *metax.MetaxService, db *psql.DB, id uuid.UUID, owner *models.U
 		return
 	}
 
-	fmt.Fprintln(os.Stderr, "About to publish:", id)
+	logger := api.Logger().With().Str("id", id.String()).Logger()
+	logger.Debug().Bool("published", dataset.Published).Msg("publishing dataset")
 
-	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	ctx, cancel := context.WithTimeout(ctx, PublishTimeout)
 	defer cancel()
 
+	basedOn, err := db.GetVersionDraftBase(ctx, id)
+	if err == nil {
+		versionId, err = publishNewVersion(ctx, api, db, &logger, id, basedOn, blob, owner)
+		return
+	}
+	if err != psql.ErrNotFound {
+		return
+	}
+
 	res, err := api.Store(ctx, blob, owner)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "type: %T\n", err)
-		if apiErr, ok := err.(*metax.ApiError); ok {
-			fmt.Fprintf(os.Stderr, "metax error: [%d] %s\n", apiErr.StatusCode(), apiErr.OriginalError())
-		}
-		//return err
+		err = keepCreated(db, &logger, id, err)
+		logApiError(&logger, err, "publish failed")
 		return
 	}
 
-	fmt.Fprintln(os.Stderr, "Success! Response follows:")
-	fmt.Printf("%s", res)
-	fmt.Fprintln(os.Stderr)
-	fmt.Fprintln(os.Stderr)
-	fmt.Fprintln(os.Stderr, "Marking dataset as published...")
+	// Metax has the dataset now; storing that must not be cancelled with the request
+	ctx, cancel = detachedContext()
+	defer cancel()
 
 	versionId = metax.GetIdentifier(res)
 	if versionId == "" {
@@ -73,80 +88,133 @@ func Publish(api *metax.MetaxService, db *psql.DB, id uuid.UUID, owner *models.U
 
 	synced := metax.GetModificationDate(res)
 	if synced.IsZero() {
-		fmt.Fprintln(os.Stderr, "Could not find date_modified or date_created from dataset!")
+		logger.Warn().Str("identifier", versionId).Msg("no date_modified or date_created in published dataset")
 		synced = time.Now()
 	}
 
-	err = db.StorePublished(id, res, synced)
+	err = db.StorePublished(ctx, id, res, synced)
 	if err != nil {
 		//return err
 		return
 	}
 
+	// only API v1 creates new versions implicitly; v2 refuses file changes with metax.ErrNewVersionRequired
 	if newVersionId = metax.MaybeNewVersionId(res); newVersionId != "" {
-		fmt.Println("created new version:", newVersionId)
+		logger.Info().Str("identifier", versionId).Str("new_version", newVersionId).Msg("publish created new version")
 
-		var newVersion []byte
-		// get the new version from the Metax api
-		newVersion, err = api.GetId(newVersionId)
+		newQVersionId, err = storeNewVersion(ctx, api, db, &logger, id, newVersionId)
 		if err != nil {
-			fmt.Println("error getting new version:", err)
-			//return err
 			return versionId, newVersionId, nil, err
 		}
-		fmt.Printf("new: %s\n\n", newVersion)
+	}
 
-		// create a Qvain id for the new version
-		var tmp uuid.UUID
-		tmp, err = uuid.NewUUID()
-		if err != nil {
-			return
-		}
-		newQVersionId = &tmp
+	logger.Info().Str("identifier", versionId).Msg("published dataset")
+	return
+}
 
-		synced := metax.GetModificationDate(newVersion)
-		if synced.IsZero() {
-			fmt.Fprintln(os.Stderr, "Could not find date_modified or date_created from new version!")
-			synced = time.Now()
-		}
+// storeNewVersion gets a new version created by Metax and stores it in the Qvain database as new version of the given dataset.
+// It returns the Qvain id of the new version.
+func storeNewVersion(ctx context.Context, api metax.DatasetStore, db *psql.DB, logger *zerolog.Logger, id uuid.UUID, newVersionId string) (*uuid.UUID, error) {
+	// get the new version from the Metax api
+	newVersion, err := api.GetId(ctx, newVersionId)
+	if err != nil {
+		logger.Error().Err(err).Str("new_version", newVersionId).Msg("failed to get new version")
+		return nil, err
+	}
 
-		// store the new version
-		err = db.WithTransaction(func(tx *psql.Tx) error {
-			return tx.StoreNewVersion(id, *newQVersionId, synced, newVersion)
-		})
-		if err != nil {
-			return
-		}
+	// create a Qvain id for the new version
+	newQVersionId, err := uuid.NewUUID()
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Fprintln(os.Stderr, "success")
-	return
+	synced := metax.GetModificationDate(newVersion)
+	if synced.IsZero() {
+		logger.Warn().Str("new_version", newVersionId).Msg("no date_modified or date_created in new version")
+		synced = time.Now()
+	}
+
+	// store the new version
+	err = db.WithTransaction(ctx, func(tx *psql.Tx) error {
+		return tx.StoreNewVersion(ctx, id, newQVersionId, synced, newVersion)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &newQVersionId, nil
 }
 
 // UnpublishAndDelete marks a dataset as removed in Metax and deletes it from the Qvain db.
 // The dataset will no longer be visible in Metax queries unless the ?removed=true parameter is used.
-func UnpublishAndDelete(api *metax.MetaxService, db *psql.DB, id uuid.UUID, owner uuid.UUID) error {
-	dataset, err := db.GetWithOwner(id, owner)
+func UnpublishAndDelete(ctx context.Context, api metax.DatasetStore, db *psql.DB, id uuid.UUID, owner uuid.UUID) error {
+	dataset, err := db.GetWithOwner(ctx, id, owner)
 	if err != nil {
 		return err
 	}
 
 	// mark as removed in Metax
-	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	ctx, cancel := context.WithTimeout(ctx, PublishTimeout)
 	defer cancel()
 	if err := api.Delete(ctx, dataset.Blob()); err != nil {
-		fmt.Fprintf(os.Stderr, "type: %T\n", err)
-		if apiErr, ok := err.(*metax.ApiError); ok {
-			fmt.Fprintf(os.Stderr, "metax error: [%d] %s\n", apiErr.StatusCode(), apiErr.OriginalError())
-		}
+		logger := api.Logger().With().Str("id", id.String()).Logger()
+		logApiError(&logger, err, "unpublish failed")
 		return err
 	}
 
-	// delete from db
-	err = db.Delete(id, &owner)
+	// delete from db, even if the request is gone by now
+	ctx, cancel = detachedContext()
+	defer cancel()
+	err = db.Delete(ctx, id, &owner)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// detachedContext returns a context for storing the outcome of a Metax write that succeeded in the Qvain database.
+// It isn't cancelled with the request, so a client that goes away doesn't leave Qvain out of step with Metax.
+func detachedContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), PublishTimeout)
+}
+
+// keepCreated stores the identifier of a dataset that Metax created before a later step failed, so that trying again
+// updates that dataset instead of creating another one. It returns the error that made the request fail.
+func keepCreated(db *psql.DB, logger *zerolog.Logger, id uuid.UUID, err error) error {
+	created, ok := err.(*metax.CreatedError)
+	if !ok {
+		return err
+	}
+
+	// Metax has the dataset now; storing that must not be cancelled with the request
+	ctx, cancel := detachedContext()
+	defer cancel()
+
+	if serr := storeIdentifier(ctx, db, id, created.Identifier, created.Draft); serr != nil {
+		logger.Error().Err(serr).Str("identifier", created.Identifier).Msg("can't store identifier of created dataset")
+	}
+	return created.Err
+}
+
+// storeIdentifier stores the Metax identifier of a dataset in the local dataset, and marks it as draft if it is one.
+func storeIdentifier(ctx context.Context, db *psql.DB, id uuid.UUID, identifier string, draft bool) error {
+	fields, err := sjson.SetBytes([]byte(`{}`), metax.IdentifierKey, identifier)
+	if err != nil {
+		return err
+	}
+	if draft {
+		if fields, err = sjson.SetBytes(fields, metax.StateKey, metax.StateDraft); err != nil {
+			return err
+		}
+	}
+	return db.Patch(ctx, id, fields)
+}
+
+// logApiError logs an error from the Metax client, including the status and Metax's own error for API errors.
+func logApiError(logger *zerolog.Logger, err error, msg string) {
+	ev := logger.Warn().Err(err)
+	if apiErr, ok := err.(*metax.ApiError); ok {
+		ev = ev.Int("status", apiErr.StatusCode()).Str("metax_error", string(apiErr.OriginalError()))
+	}
+	ev.Msg(msg)
+}
@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"context"
 	"io/ioutil"
 	"path/filepath"
 	"testing"
@@ -29,14 +30,14 @@ func readFile(tb testing.TB, fn string) []byte {
 	return bytes
 }
 
-func modifyTitleFromDataset(db *psql.DB, id uuid.UUID, title string) error {
-	tx, err := db.Begin()
+func modifyTitleFromDataset(ctx context.Context, db *psql.DB, id uuid.UUID, title string) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	ct, err := tx.Exec("UPDATE datasets SET blob = jsonb_set(blob, '{research_dataset,title,en}', to_jsonb($2::text)), modified = now() WHERE id = $1", id.Array(), title)
+	ct, err := tx.Exec(ctx, "UPDATE datasets SET blob = jsonb_set(blob, '{research_dataset,title,en}', to_jsonb($2::text)), modified = now() WHERE id = $1", id.Array(), title)
 	if err != nil {
 		return err
 	}
@@ -45,21 +46,21 @@ func modifyTitleFromDataset(db *psql.DB, id uuid.UUID, title string) error {
 		return psql.ErrNotFound
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
-func deleteFilesFromFairdataDataset(db *psql.DB, id uuid.UUID) error {
-	return deletePathFromDataset(db, id, "{research_dataset,files}")
+func deleteFilesFromFairdataDataset(ctx context.Context, db *psql.DB, id uuid.UUID) error {
+	return deletePathFromDataset(ctx, db, id, "{research_dataset,files}")
 }
 
-func deletePathFromDataset(db *psql.DB, id uuid.UUID, path string) error {
-	tx, err := db.Begin()
+func deletePathFromDataset(ctx context.Context, db *psql.DB, id uuid.UUID, path string) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	ct, err := tx.Exec("UPDATE datasets SET blob = blob #- $2, modified = now() WHERE id = $1", id.Array(), path)
+	ct, err := tx.Exec(ctx, "UPDATE datasets SET blob = blob #- $2, modified = now() WHERE id = $1", id.Array(), path)
 	if err != nil {
 		return err
 	}
@@ -68,7 +69,7 @@ func deletePathFromDataset(db *psql.DB, id uuid.UUID, path string) error {
 		return psql.ErrNotFound
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 }
 
 // TestPublish creates a Qvain dataset, saves it, publishes it to metax, and saves the resulting version.
@@ -89,6 +90,7 @@ func TestPublish(t *testing.T) {
 	if err != nil {
 		t.Fatal("psql:", err)
 	}
+	ctx := context.Background()
 
 	api := metax.NewMetaxService(
 		env.Get("APP_METAX_API_HOST"),
@@ -131,7 +133,7 @@ func TestPublish(t *testing.T) {
 
 		id := dataset.Id
 
-		err = db.Create(dataset)
+		err = db.Create(ctx, dataset)
 		if err != nil {
 			t.Fatal("db.Create():", err)
 		}
@@ -141,14 +143,14 @@ func TestPublish(t *testing.T) {
 
 		// tests that should fail with *metax.ApiError 403 due to project permissions
 		t.Run(test.fn+"(wrong project)", func(t *testing.T) {
-			_, _, _, err := Publish(api, db, id, wrongProjectOwner)
+			_, _, _, err := Publish(ctx, api, db, id, wrongProjectOwner)
 			if apiErr, ok := err.(*metax.ApiError); !ok || apiErr.StatusCode() != 403 {
 				t.Error("error: wrongProjectOwner should have failed with 403")
 			}
 		})
 
 		t.Run(test.fn+"(no project)", func(t *testing.T) {
-			_, _, _, err := Publish(api, db, id, noProjectOwner)
+			_, _, _, err := Publish(ctx, api, db, id, noProjectOwner)
 			if apiErr, ok := err.(*metax.ApiError); !ok || apiErr.StatusCode() != 403 {
 				t.Error("error: noProjectOwner should have failed with 403")
 			}
@@ -156,7 +158,7 @@ func TestPublish(t *testing.T) {
 
 		// test that should publish succesfully
 		t.Run(test.fn+"(new)", func(t *testing.T) {
-			vId, nId, _, err := Publish(api, db, id, owner)
+			vId, nId, _, err := Publish(ctx, api, db, id, owner)
 			if err != nil {
 				if apiErr, ok := err.(*metax.ApiError); ok {
 					t.Errorf("API error: [%d] %s", apiErr.StatusCode(), apiErr.Error())
@@ -172,7 +174,7 @@ func TestPublish(t *testing.T) {
 			versionId = vId
 
 			// check that the dataset has been updated with a user_created field
-			publishedDataset, err := db.Get(id)
+			publishedDataset, err := db.Get(ctx, id)
 			if err != nil {
 				t.Error("error retrieving dataset:", err)
 			}
@@ -181,14 +183,14 @@ func TestPublish(t *testing.T) {
 			}
 		})
 
-		err = modifyTitleFromDataset(db, id, "Less Wonderful Title")
+		err = modifyTitleFromDataset(ctx, db, id, "Less Wonderful Title")
 		if err != nil {
 			t.Fatal("modifyTitleFromDataset():", err)
 		}
 
 		// test that should update
 		t.Run(test.fn+"(update)", func(t *testing.T) {
-			vId, nId, _, err := Publish(api, db, id, modifier)
+			vId, nId, _, err := Publish(ctx, api, db, id, modifier)
 			if err != nil {
 				if apiErr, ok := err.(*metax.ApiError); ok {
 					t.Errorf("API error: [%d] %s", apiErr.StatusCode(), apiErr.Error())
@@ -207,7 +209,7 @@ func TestPublish(t *testing.T) {
 			t.Logf("(re)published with version id %q", vId)
 
 			// check that the dataset has been updated with a user_modified field
-			publishedDataset, err := db.Get(id)
+			publishedDataset, err := db.Get(ctx, id)
 			if err != nil {
 				t.Error("error retrieving dataset:", err)
 			}
@@ -217,14 +219,14 @@ func TestPublish(t *testing.T) {
 			}
 		})
 
-		err = deleteFilesFromFairdataDataset(db, id)
+		err = deleteFilesFromFairdataDataset(ctx, db, id)
 		if err != nil {
 			t.Fatal("deleteFilesFromFairdataDataset():", err)
 		}
 
 		// test that should remove files and create a new version
 		t.Run(test.fn+"(files)", func(t *testing.T) {
-			vId, nId, qId, err := Publish(api, db, id, modifier)
+			vId, nId, qId, err := Publish(ctx, api, db, id, modifier)
 			if err != nil {
 				if apiErr, ok := err.(*metax.ApiError); ok {
 					t.Errorf("API error: [%d] %s", apiErr.StatusCode(), apiErr.Error())
@@ -245,7 +247,7 @@ func TestPublish(t *testing.T) {
 			t.Logf("(re)published with version id %q", vId)
 
 			// the new version should have the user who modified the dataset as user_created
-			publishedDataset, err := db.Get(*qId)
+			publishedDataset, err := db.Get(ctx, *qId)
 			if err != nil {
 				t.Error("error retrieving dataset:", err)
 			}
@@ -257,13 +259,13 @@ func TestPublish(t *testing.T) {
 		// test that should unpublish and delete
 		t.Run(test.fn+"(new)", func(t *testing.T) {
 
-			dataset, err := db.GetWithOwner(id, owner.Uid)
+			dataset, err := db.GetWithOwner(ctx, id, owner.Uid)
 			if err != nil {
 				t.Error("error:", err)
 			}
 			identifier := metax.GetIdentifier(dataset.Blob())
 
-			err = UnpublishAndDelete(api, db, id, owner.Uid)
+			err = UnpublishAndDelete(ctx, api, db, id, owner.Uid)
 			if err != nil {
 				if apiErr, ok := err.(*metax.ApiError); ok {
 					t.Errorf("API error: [%d] %s", apiErr.StatusCode(), apiErr.Error())
@@ -272,7 +274,7 @@ func TestPublish(t *testing.T) {
 			}
 
 			// retrieve the deleted dataset from Metax
-			removedDataset, err := api.GetIdRemoved(identifier)
+			removedDataset, err := api.GetIdRemoved(ctx, identifier)
 			if err != nil {
 				t.Error("error:", err)
 				return
@@ -284,7 +286,7 @@ func TestPublish(t *testing.T) {
 			}
 
 			// try to retrieve the deleted dataset from Qvain db
-			_, err = db.GetWithOwner(id, owner.Uid)
+			_, err = db.GetWithOwner(ctx, id, owner.Uid)
 			if err == nil {
 				t.Errorf("dataset was not deleted from Qvain")
 			}
@@ -294,7 +296,7 @@ func TestPublish(t *testing.T) {
 
 		// if we want to make it invalid again...
 		/*
-			err = deletePathFromDataset(db, id, "{research_dataset,title,en}")
+			err = deletePathFromDataset(ctx, db, id, "{research_dataset,title,en}")
 			if err != nil {
 				t.Fatal("deletePathFromDataset():", err)
 			}
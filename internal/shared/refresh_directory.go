@@ -14,11 +14,11 @@ import (
 // RefreshDatasetDirectoryContent uses a Metax RPC call to update directory contents for a directory in a
 // dataset with the given Metax identifier. The updated dataset is fetched from Metax and it replaces the current version in the DB,
 // so any unpublished changes are lost. If a new dataset version was created, returns the new Qvain identifier.
-func RefreshDatasetDirectoryContent(api *metax.MetaxService, db *psql.DB, logger *zerolog.Logger, owner *models.User, id uuid.UUID, directoryIdentifier string) (newQVersionId *uuid.UUID, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+func RefreshDatasetDirectoryContent(ctx context.Context, api *metax.MetaxService, db *psql.DB, logger *zerolog.Logger, owner *models.User, id uuid.UUID, directoryIdentifier string) (newQVersionId *uuid.UUID, err error) {
+	ctx, cancel := context.WithTimeout(ctx, PublishTimeout)
 	defer cancel()
 
-	dataset, err := db.GetWithOwner(id, owner.Uid)
+	dataset, err := db.GetWithOwner(ctx, id, owner.Uid)
 	if err != nil {
 		return nil, err
 	}
@@ -39,14 +39,18 @@ func RefreshDatasetDirectoryContent(api *metax.MetaxService, db *psql.DB, logger
 	logger.Debug().Str("identifier", identifier).
 		Str("dir_identifier", directoryIdentifier).Str("new_version_identifier", newMetaxIdentifier).Msg("refresh directory")
 
-	qvainId, err := FetchDataset(api, db, *logger, owner.Uid, identifier)
+	// Metax has changed the dataset; fetching the changes must not be cancelled with the request
+	ctx, cancel = detachedContext()
+	defer cancel()
+
+	qvainId, err := FetchDataset(ctx, api, db, *logger, owner.Uid, identifier)
 	if err != nil {
 		return nil, err
 	}
 	logger.Debug().Str("identifier", identifier).Str("id", qvainId.String()).Msg("fetched updated dataset")
 
 	if newMetaxIdentifier != "" {
-		newQVersionId, err = FetchDataset(api, db, *logger, owner.Uid, newMetaxIdentifier)
+		newQVersionId, err = FetchDataset(ctx, api, db, *logger, owner.Uid, newMetaxIdentifier)
 		if err != nil {
 			return nil, err
 		}
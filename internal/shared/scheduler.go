@@ -0,0 +1,251 @@
+package shared
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/rs/zerolog"
+	"github.com/wvh/uuid"
+)
+
+const (
+	// DefaultSyncInterval is how often the scheduler looks for users to sync, and how old a user's last sync must be.
+	DefaultSyncInterval = 30 * time.Minute
+
+	// DefaultSyncWorkers is the number of users synced concurrently.
+	DefaultSyncWorkers = 2
+
+	// DefaultSyncRate is the minimum delay between starting user syncs, to limit the load on Metax.
+	DefaultSyncRate = 2 * time.Second
+
+	// DefaultSyncBatchSize is the maximum number of users synced in one round; the rest wait for the next round.
+	DefaultSyncBatchSize = 100
+)
+
+// syncStore is the database part of the scheduler; it's satisfied by *psql.DB.
+type syncStore interface {
+	UsersToSync(ctx context.Context, svc string, before time.Time, limit int) ([]psql.SyncCandidate, error)
+	GetLastSync(ctx context.Context, uid uuid.UUID) (time.Time, error)
+}
+
+// SyncScheduler periodically syncs the datasets of users from Metax in the background.
+// Syncs are incremental from the time of the user's last sync. Users are synced by a bounded pool of workers
+// and the start of each sync is rate limited. An advisory lock in the database makes sure that application
+// instances sharing a database don't sync the same user at the same time; fetch takes it and returns
+// ErrSyncInProgress if it's held elsewhere.
+type SyncScheduler struct {
+	db      syncStore
+	logger  zerolog.Logger
+	service string
+	fetch   func(ctx context.Context, uid uuid.UUID, extid string) error
+
+	interval  time.Duration
+	workers   int
+	rate      time.Duration
+	batchSize int
+}
+
+// SyncOption is a functional option for the sync scheduler.
+type SyncOption func(*SyncScheduler)
+
+// WithSyncInterval sets how often the scheduler runs; users synced more recently than this are skipped.
+func WithSyncInterval(interval time.Duration) SyncOption {
+	return func(s *SyncScheduler) {
+		if interval > 0 {
+			s.interval = interval
+		}
+	}
+}
+
+// WithSyncWorkers sets the number of users synced concurrently.
+func WithSyncWorkers(workers int) SyncOption {
+	return func(s *SyncScheduler) {
+		if workers > 0 {
+			s.workers = workers
+		}
+	}
+}
+
+// WithSyncRate sets the minimum delay between starting user syncs; zero disables rate limiting.
+func WithSyncRate(rate time.Duration) SyncOption {
+	return func(s *SyncScheduler) {
+		if rate >= 0 {
+			s.rate = rate
+		}
+	}
+}
+
+// WithSyncBatchSize sets the maximum number of users synced in one round.
+func WithSyncBatchSize(size int) SyncOption {
+	return func(s *SyncScheduler) {
+		if size > 0 {
+			s.batchSize = size
+		}
+	}
+}
+
+// NewSyncScheduler creates a scheduler that syncs users with an identity for the given service from Metax.
+func NewSyncScheduler(api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, svc string, options ...SyncOption) *SyncScheduler {
+	s := newSyncScheduler(db, logger, svc, func(ctx context.Context, uid uuid.UUID, extid string) error {
+		return Fetch(ctx, api, db, logger, uid, extid)
+	})
+	for _, option := range options {
+		option(s)
+	}
+
+	// more workers would wait for sync locks, which each hold a database connection
+	if max := db.MaxSyncs(); s.workers > max {
+		logger.Warn().Int("workers", s.workers).Int("max", max).Msg("too many sync workers for the database pool")
+		s.workers = max
+	}
+	return s
+}
+
+// newSyncScheduler creates a scheduler with default settings for the given store and sync function.
+func newSyncScheduler(db syncStore, logger zerolog.Logger, svc string, fetch func(context.Context, uuid.UUID, string) error) *SyncScheduler {
+	return &SyncScheduler{
+		db:        db,
+		logger:    logger,
+		service:   svc,
+		fetch:     fetch,
+		interval:  DefaultSyncInterval,
+		workers:   DefaultSyncWorkers,
+		rate:      DefaultSyncRate,
+		batchSize: DefaultSyncBatchSize,
+	}
+}
+
+// Start runs a sync round at every interval in the background until stop is called.
+// Stop doesn't start new syncs and waits for running ones to finish.
+func (s *SyncScheduler) Start() (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.RunOnce(done)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	s.logger.Info().Dur("interval", s.interval).Int("workers", s.workers).Dur("rate", s.rate).Msg("started sync scheduler")
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+		})
+	}
+}
+
+// RunOnce syncs the users whose last sync is older than the interval, at most the batch size of them.
+// Closing done stops the round early but lets running syncs finish, so they don't use the done channel as context.
+// It returns the number of users synced, skipped and failed.
+func (s *SyncScheduler) RunOnce(done <-chan struct{}) (synced, skipped, failed int) {
+	ctx := context.Background()
+	cutoff := time.Now().Add(-s.interval)
+	users, err := s.db.UsersToSync(ctx, s.service, cutoff, s.batchSize)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("can't get users to sync")
+		return
+	}
+	if len(users) == 0 {
+		return
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		jobs    = make(chan psql.SyncCandidate)
+		workers = s.workers
+	)
+	if workers > len(users) {
+		workers = len(users)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range jobs {
+				status := s.syncUser(ctx, user, cutoff)
+				mu.Lock()
+				switch status {
+				case SyncWritten:
+					synced++
+				case SyncSkipped:
+					skipped++
+				default:
+					failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var throttle <-chan time.Time
+	if s.rate > 0 {
+		ticker := time.NewTicker(s.rate)
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+Dispatch:
+	for i, user := range users {
+		if i > 0 && throttle != nil {
+			select {
+			case <-throttle:
+			case <-done:
+				break Dispatch
+			}
+		}
+		select {
+		case jobs <- user:
+		case <-done:
+			break Dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	s.logger.Info().Int("users", len(users)).Int("synced", synced).Int("skipped", skipped).Int("failed", failed).Msg("sync round finished")
+	return
+}
+
+// syncUser syncs one user if no one else is doing so and the user hasn't been synced since the round started.
+// It returns SyncWritten, SyncSkipped or SyncFailed.
+func (s *SyncScheduler) syncUser(ctx context.Context, user psql.SyncCandidate, cutoff time.Time) int {
+	logger := s.logger.With().Str("uid", user.Uid.String()).Logger()
+
+	// another instance might have synced the user after we got the list
+	last, err := s.db.GetLastSync(ctx, user.Uid)
+	if err != nil && err != psql.ErrNotFound {
+		logger.Error().Err(err).Msg("can't get last sync")
+		return SyncFailed
+	}
+	if last.After(cutoff) {
+		return SyncSkipped
+	}
+
+	switch err := s.fetch(ctx, user.Uid, user.Identity); err {
+	case nil:
+	case ErrSyncInProgress, psql.ErrTooManySyncs:
+		logger.Debug().Err(err).Msg("user is being synced elsewhere")
+		return SyncSkipped
+	default:
+		logger.Warn().Err(err).Msg("background sync failed")
+		return SyncFailed
+	}
+	return SyncWritten
+}
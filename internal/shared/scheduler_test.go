@@ -0,0 +1,123 @@
+package shared
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/rs/zerolog"
+	"github.com/wvh/uuid"
+)
+
+// fakeSyncStore keeps sync state in memory; uids in locked are held by someone else.
+type fakeSyncStore struct {
+	mu     sync.Mutex
+	users  []psql.SyncCandidate
+	last   map[uuid.UUID]time.Time
+	locked map[uuid.UUID]bool
+}
+
+func (store *fakeSyncStore) UsersToSync(ctx context.Context, svc string, before time.Time, limit int) ([]psql.SyncCandidate, error) {
+	var users []psql.SyncCandidate
+	for _, user := range store.users {
+		if user.LastSync.Before(before) && len(users) < limit {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (store *fakeSyncStore) tryLock(uid uuid.UUID) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.locked[uid] {
+		return false
+	}
+	store.locked[uid] = true
+	return true
+}
+
+func (store *fakeSyncStore) unlock(uid uuid.UUID) {
+	store.mu.Lock()
+	delete(store.locked, uid)
+	store.mu.Unlock()
+}
+
+func (store *fakeSyncStore) GetLastSync(ctx context.Context, uid uuid.UUID) (time.Time, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if ts, ok := store.last[uid]; ok {
+		return ts, nil
+	}
+	return time.Time{}, psql.ErrNotFound
+}
+
+func TestSyncScheduler(t *testing.T) {
+	store := &fakeSyncStore{last: make(map[uuid.UUID]time.Time), locked: make(map[uuid.UUID]bool)}
+	for i := 0; i < 6; i++ {
+		store.users = append(store.users, psql.SyncCandidate{Uid: uuid.MustNewUUID(), Identity: "user"})
+	}
+	// synced elsewhere after the list was fetched
+	store.last[store.users[1].Uid] = time.Now()
+	// being synced elsewhere
+	store.locked[store.users[2].Uid] = true
+
+	var (
+		mu         sync.Mutex
+		running    int
+		maxRunning int
+		fetched    []uuid.UUID
+	)
+	fetch := func(ctx context.Context, uid uuid.UUID, extid string) error {
+		if !store.tryLock(uid) {
+			return ErrSyncInProgress
+		}
+		defer store.unlock(uid)
+
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		fetched = append(fetched, uid)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}
+
+	s := newSyncScheduler(store, zerolog.Nop(), "fairdata", fetch)
+	WithSyncWorkers(2)(s)
+	WithSyncRate(0)(s)
+	WithSyncBatchSize(5)(s)
+
+	synced, skipped, failed := s.RunOnce(nil)
+	if synced != 3 || skipped != 2 || failed != 0 {
+		t.Errorf("expected 3 synced, 2 skipped and 0 failed, got %d, %d and %d", synced, skipped, failed)
+	}
+	if maxRunning > 2 {
+		t.Errorf("expected at most 2 concurrent syncs, got %d", maxRunning)
+	}
+	for _, uid := range fetched {
+		if uid == store.users[1].Uid || uid == store.users[2].Uid || uid == store.users[5].Uid {
+			t.Errorf("user %s should not have been synced", uid)
+		}
+	}
+	if len(store.locked) != 1 {
+		t.Errorf("expected only the foreign lock to remain, got %d locks", len(store.locked))
+	}
+
+	// closing done stops dispatching
+	done := make(chan struct{})
+	close(done)
+	WithSyncRate(time.Hour)(s)
+	if synced, _, _ := s.RunOnce(done); synced > 1 {
+		t.Errorf("expected at most one sync after stop, got %d", synced)
+	}
+}
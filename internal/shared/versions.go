@@ -0,0 +1,132 @@
+package shared
+
+import (
+	"context"
+	"time"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/rs/zerolog"
+	"github.com/wvh/uuid"
+)
+
+// Version is a version of a published dataset, linked to the versions before and after it.
+type Version struct {
+	Identifier          string
+	PreferredIdentifier string
+	Removed             bool
+	Published           time.Time
+
+	// Id is the Qvain id of the version if it exists locally for the owner, nil otherwise.
+	Id *uuid.UUID
+
+	// Previous and Next are the Metax identifiers of the adjacent versions, or empty if there are none.
+	Previous string
+	Next     string
+}
+
+// versionStore is the part of the database used to resolve versions.
+type versionStore interface {
+	GetWithOwner(ctx context.Context, id uuid.UUID, owner uuid.UUID) (*models.Dataset, error)
+	LookupByFairdataIdentifierWithOwner(ctx context.Context, fdid string, owner uuid.UUID) (uuid.UUID, error)
+}
+
+// VersionGraph returns all versions of a dataset, newest first, resolved to their Qvain ids where they exist locally.
+// If fetch is true, versions that don't exist locally are synced from Metax for the owner.
+// A dataset that hasn't been published has no versions.
+func VersionGraph(ctx context.Context, api *metax.MetaxService, db *psql.DB, logger zerolog.Logger, owner uuid.UUID, id uuid.UUID, fetch bool) ([]Version, error) {
+	var fetchVersion func(string) (*uuid.UUID, error)
+	if fetch {
+		fetchVersion = func(identifier string) (*uuid.UUID, error) {
+			return FetchDataset(ctx, api, db, logger, owner, identifier)
+		}
+	}
+	return versionGraph(ctx, db, owner, id, fetchVersion)
+}
+
+func versionGraph(ctx context.Context, store versionStore, owner uuid.UUID, id uuid.UUID, fetchVersion func(string) (*uuid.UUID, error)) ([]Version, error) {
+	dataset, err := store.GetWithOwner(ctx, id, owner)
+	if err != nil {
+		return nil, err
+	}
+	typed, err := metax.ParseDataset(dataset.Blob())
+	if err != nil {
+		return nil, err
+	}
+
+	refs := typed.DatasetVersionSet
+	if len(refs) == 0 {
+		if typed.Identifier == "" {
+			return []Version{}, nil
+		}
+		// a dataset without version set has only one version
+		ref := &metax.VersionRef{Identifier: typed.Identifier, Removed: typed.Removed, DateCreated: typed.DateCreated}
+		if typed.ResearchDataset != nil {
+			ref.PreferredIdentifier = typed.ResearchDataset.PreferredIdentifier
+		}
+		refs = []*metax.VersionRef{ref}
+	}
+
+	versions := make([]Version, len(refs))
+	for i, ref := range refs {
+		version := &versions[i]
+		version.Identifier = ref.Identifier
+		version.PreferredIdentifier = ref.PreferredIdentifier
+		version.Removed = ref.Removed != nil && *ref.Removed
+		version.Published, _ = time.Parse(time.RFC3339, ref.DateCreated)
+
+		// the version set is ordered newest first
+		if i+1 < len(refs) {
+			version.Previous = refs[i+1].Identifier
+		}
+		if i > 0 {
+			version.Next = refs[i-1].Identifier
+		}
+
+		local := dataset
+		if ref.Identifier != typed.Identifier {
+			if local, err = findVersion(ctx, store, owner, ref.Identifier); err != nil {
+				return nil, err
+			}
+			if local == nil && fetchVersion != nil && !version.Removed {
+				if version.Id, err = fetchVersion(ref.Identifier); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		if local == nil {
+			continue
+		}
+		version.Id = &local.Id
+
+		// prefer the links stored in the version itself
+		if localTyped, err := metax.ParseDataset(local.Blob()); err == nil {
+			if localTyped.PreviousDatasetVersion != nil && localTyped.PreviousDatasetVersion.Identifier != "" {
+				version.Previous = localTyped.PreviousDatasetVersion.Identifier
+			}
+			if localTyped.NextDatasetVersion != nil && localTyped.NextDatasetVersion.Identifier != "" {
+				version.Next = localTyped.NextDatasetVersion.Identifier
+			}
+		}
+	}
+	return versions, nil
+}
+
+// findVersion returns the owner's local dataset with the given Metax identifier, or nil if there is none.
+func findVersion(ctx context.Context, store versionStore, owner uuid.UUID, identifier string) (*models.Dataset, error) {
+	id, err := store.LookupByFairdataIdentifierWithOwner(ctx, identifier, owner)
+	if err == psql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dataset, err := store.GetWithOwner(ctx, id, owner)
+	if err == psql.ErrNotFound {
+		return nil, nil
+	}
+	return dataset, err
+}
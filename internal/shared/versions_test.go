@@ -0,0 +1,95 @@
+package shared
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CSCfi/qvain-api/internal/psql"
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/wvh/uuid"
+)
+
+// fakeVersionStore holds datasets by Qvain id.
+type fakeVersionStore map[uuid.UUID]*models.Dataset
+
+func (store fakeVersionStore) GetWithOwner(ctx context.Context, id uuid.UUID, owner uuid.UUID) (*models.Dataset, error) {
+	dataset, ok := store[id]
+	if !ok {
+		return nil, psql.ErrNotFound
+	}
+	if dataset.Owner != owner {
+		return nil, psql.ErrNotOwner
+	}
+	return dataset, nil
+}
+
+func (store fakeVersionStore) LookupByFairdataIdentifierWithOwner(ctx context.Context, fdid string, owner uuid.UUID) (uuid.UUID, error) {
+	for id, dataset := range store {
+		if dataset.Owner == owner && metax.GetIdentifier(dataset.Blob()) == fdid {
+			return id, nil
+		}
+	}
+	return uuid.UUID{}, psql.ErrNotFound
+}
+
+func (store fakeVersionStore) add(owner uuid.UUID, blob string) uuid.UUID {
+	dataset, _ := models.NewDataset(owner)
+	dataset.SetData(2, "metax", []byte(blob))
+	store[dataset.Id] = dataset
+	return dataset.Id
+}
+
+func TestVersionGraph(t *testing.T) {
+	const versionSet = `"dataset_version_set":[
+		{"identifier":"v3","preferred_identifier":"urn:v3","date_created":"2019-03-01T00:00:00Z"},
+		{"identifier":"v2","preferred_identifier":"urn:v2","removed":true,"date_created":"2019-02-01T00:00:00Z"},
+		{"identifier":"v1","preferred_identifier":"urn:v1","date_created":"2019-01-01T00:00:00Z"}]`
+
+	ctx := context.Background()
+	owner, other := uuid.MustNewUUID(), uuid.MustNewUUID()
+	store := make(fakeVersionStore)
+	current := store.add(owner, `{"identifier":"v1","next_dataset_version":{"identifier":"v2"},`+versionSet+`}`)
+	newest := store.add(owner, `{"identifier":"v3","previous_dataset_version":{"identifier":"v2"},`+versionSet+`}`)
+	store.add(other, `{"identifier":"v2"}`)
+	store.add(other, `{"identifier":"v3"}`)
+
+	versions, err := versionGraph(ctx, store, owner, current, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %d", len(versions))
+	}
+	if versions[0].Id == nil || *versions[0].Id != newest || versions[0].Previous != "v2" || versions[0].Next != "" {
+		t.Errorf("unexpected newest version: %+v", versions[0])
+	}
+	if versions[1].Id != nil || !versions[1].Removed || versions[1].Previous != "v1" || versions[1].Next != "v3" {
+		t.Errorf("version of another owner should not be local: %+v", versions[1])
+	}
+	if versions[2].Id == nil || *versions[2].Id != current || versions[2].Published.Year() != 2019 || versions[2].PreferredIdentifier != "urn:v1" {
+		t.Errorf("unexpected current version: %+v", versions[2])
+	}
+
+	// missing versions are fetched, except removed ones
+	delete(store, newest)
+	var fetched []string
+	fetch := func(identifier string) (*uuid.UUID, error) {
+		fetched = append(fetched, identifier)
+		id := store.add(owner, `{"identifier":"`+identifier+`"}`)
+		return &id, nil
+	}
+	versions, err = versionGraph(ctx, store, owner, current, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 1 || fetched[0] != "v3" || versions[0].Id == nil {
+		t.Errorf("expected v3 to be fetched, got %v", fetched)
+	}
+
+	// unpublished datasets have no versions
+	draft := store.add(owner, `{"research_dataset":{}}`)
+	if versions, err = versionGraph(ctx, store, owner, draft, nil); err != nil || len(versions) != 0 {
+		t.Errorf("expected no versions for unpublished dataset, got %v, %v", versions, err)
+	}
+}
@@ -28,8 +28,11 @@ const (
 	Verbose = false
 
 	DatasetsEndpoint                = "/rest/datasets/"
+	FilesEndpoint                   = "/rest/files/"
+	DirectoriesEndpoint             = "/rest/directories/"
 	ChangeCumulativeStateEndpoint   = "/rpc/datasets/change_cumulative_state"
 	RefreshDirectoryContentEndpoint = "/rpc/datasets/refresh_directory_content"
+	FixDeprecatedEndpoint           = "/rpc/datasets/fix_deprecated"
 )
 
 var (
@@ -40,16 +43,24 @@ var (
 // MetaxService represents the Metax API server.
 type MetaxService struct {
 	host                string
+	name                string
 	baseUrl             string
 	client              *http.Client
+	streamClient        *http.Client
 	userAgent           string
 	disableHttps        bool
 	returnLatestVersion bool
+	version             ApiVersion
 	logger              zerolog.Logger
+	retry               retryPolicy
+	breaker             *circuitBreaker
 
 	urlDatasets                string
+	urlFiles                   string
+	urlDirectories             string
 	urlChangeCumulativeState   string
 	urlRefreshDirectoryContent string
+	urlFixDeprecated           string
 
 	user string
 	pass string
@@ -86,16 +97,53 @@ func WithCredentials(user, pass string) MetaxOption {
 	}
 }
 
+// WithName sets a name for the client that tells it apart from other clients of the same host in the metrics.
+func WithName(name string) MetaxOption {
+	return func(svc *MetaxService) {
+		svc.name = name
+	}
+}
+
 func WithLatestVersion(svc *MetaxService) {
 	svc.returnLatestVersion = true
 }
 
+// WithRetry sets the number of attempts for idempotent requests and the range of the exponential backoff between them.
+// Requests are retried on network errors and 5xx responses; an attempt count of one disables retries.
+func WithRetry(attempts int, minBackoff, maxBackoff time.Duration) MetaxOption {
+	return func(svc *MetaxService) {
+		svc.retry = retryPolicy{maxAttempts: attempts, minBackoff: minBackoff, maxBackoff: maxBackoff}
+	}
+}
+
+// WithCircuitBreaker sets the number of consecutive failures after which requests fail fast, and for how long.
+// A threshold of zero disables the circuit breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) MetaxOption {
+	return func(svc *MetaxService) {
+		svc.breaker = newCircuitBreaker(threshold, cooldown)
+	}
+}
+
+// metricsKey returns the key of the client in per-service metrics: the host, prefixed with the name if set.
+func (api *MetaxService) metricsKey() string {
+	if api.name != "" {
+		return api.name + "@" + api.host
+	}
+	return api.host
+}
+
 // NewMetaxService returns a Metax API client.
 func NewMetaxService(host string, params ...MetaxOption) *MetaxService {
 	svc := &MetaxService{
 		host:      host,
+		version:   ApiV1,
 		logger:    zerolog.Nop(),
 		userAgent: "qvain (Go-http-client/" + runtime.Version() + ")",
+		retry: retryPolicy{
+			maxAttempts: DefaultMaxAttempts,
+			minBackoff:  DefaultMinBackoff,
+			maxBackoff:  DefaultMaxBackoff,
+		},
 		client: &http.Client{
 			Timeout: 10 * time.Second,
 			Transport: &http.Transport{
@@ -114,10 +162,18 @@ func NewMetaxService(host string, params ...MetaxOption) *MetaxService {
 		},
 	}
 
+	// streaming responses can take much longer than the client timeout, so they rely on the context deadline instead
+	svc.streamClient = &http.Client{Transport: svc.client.Transport}
+
 	for _, param := range params {
 		param(svc)
 	}
 
+	if svc.breaker == nil {
+		svc.breaker = newCircuitBreaker(DefaultBreakerThreshold, DefaultBreakerCooldown)
+	}
+	svc.breaker.expose(svc.metricsKey())
+
 	if svc.disableHttps {
 		svc.baseUrl = "http://" + svc.host
 	} else {
@@ -141,9 +197,20 @@ func NewMetaxService(host string, params ...MetaxOption) *MetaxService {
 }
 
 func (api *MetaxService) makeEndpoints(base string) {
+	api.urlFiles = base + FilesEndpoint
+	api.urlDirectories = base + DirectoriesEndpoint
+
+	if api.version == ApiV2 {
+		api.urlDatasets = base + DatasetsEndpointV2
+		api.urlChangeCumulativeState = base + RpcEndpointV2 + "change_cumulative_state"
+		api.urlRefreshDirectoryContent = ""
+		api.urlFixDeprecated = base + RpcEndpointV2 + "fix_deprecated"
+		return
+	}
 	api.urlDatasets = base + DatasetsEndpoint
 	api.urlChangeCumulativeState = base + ChangeCumulativeStateEndpoint
 	api.urlRefreshDirectoryContent = base + RefreshDirectoryContentEndpoint
+	api.urlFixDeprecated = base + FixDeprecatedEndpoint
 }
 
 type PaginatedResponse struct {
@@ -187,6 +254,30 @@ func WithUser(id string) DatasetOption {
 	}
 }
 
+// WithOrganisation is a dataset option that filters dataset queries to those provided by the given organisation.
+func WithOrganisation(org string) DatasetOption {
+	return func(req *http.Request) {
+		if org == "" {
+			return
+		}
+		qvals := req.URL.Query()
+		qvals.Add("metadata_provider_org", org)
+		req.URL.RawQuery = qvals.Encode()
+	}
+}
+
+// WithProject is a dataset option that filters dataset queries to those that have files in the given IDA project.
+func WithProject(project string) DatasetOption {
+	return func(req *http.Request) {
+		if project == "" {
+			return
+		}
+		qvals := req.URL.Query()
+		qvals.Add("projects", project)
+		req.URL.RawQuery = qvals.Encode()
+	}
+}
+
 // WithRemoved is a dataset option that filters dataset queries to those that have been removed.
 func WithRemoved() DatasetOption {
 	return func(req *http.Request) {
@@ -211,6 +302,17 @@ func WithStreaming(req *http.Request) {
 	req.URL.RawQuery = qvals.Encode()
 }
 
+// addVersionQuery adds the query parameters the API version needs to return complete datasets.
+// API v2 only returns the files and directories of datasets on request.
+func (api *MetaxService) addVersionQuery(req *http.Request) {
+	if api.version != ApiV2 {
+		return
+	}
+	query := req.URL.Query()
+	query.Set("include_user_metadata", "true")
+	req.URL.RawQuery = query.Encode()
+}
+
 func (api *MetaxService) getRequest(url string) (*http.Request, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -221,35 +323,32 @@ func (api *MetaxService) getRequest(url string) (*http.Request, error) {
 	return req, nil
 }
 
-func (api *MetaxService) Datasets(params ...DatasetOption) (*PaginatedResponse, error) {
+func (api *MetaxService) Datasets(ctx context.Context, params ...DatasetOption) (*PaginatedResponse, error) {
 	req, err := http.NewRequest("GET", api.urlDatasets, nil)
+	if err != nil {
+		return nil, err
+	}
 	//req.Header.Add("If-None-Match", `W/"example-tag"`)
 	api.writeApiHeaders(req)
 
 	for _, param := range params {
 		param(req)
 	}
+	api.addVersionQuery(req)
 
-	api.logger.Printf("metax: GET %v\n", req.URL)
-
-	start := time.Now()
-	count := 0
-	defer func() {
-		api.logger.Printf("metax: paginated query processed in %v (count: %d)", time.Since(start), count)
-	}()
-
-	res, err := api.client.Do(req)
+	res, err := api.do(ctx, req, "")
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
 	if Verbose {
-		api.logger.Printf("response: %+v\n", res)
-		api.logger.Print("Content-Length:", res.Header.Get("Content-Length"))
-		api.logger.Print("Content-Type:", res.Header["Content-Type"])
-		api.logger.Printf("%T\n", res.Header["Content-Type"])
-		api.logger.Print("Status code:", res.StatusCode)
+		api.logger.Debug().
+			Str("request_id", req.Header.Get(RequestIdHeader)).
+			Str("content-length", res.Header.Get("Content-Length")).
+			Str("content-type", res.Header.Get("Content-Type")).
+			Int("status", res.StatusCode).
+			Msg("metax response")
 	}
 
 	//clientHeaders := []string{"If-Modified-Since", "If-Unmodified-Since", "If-Match", "If-None-Match", "If-Range", "ETag"}
@@ -280,16 +379,11 @@ func (api *MetaxService) Datasets(params ...DatasetOption) (*PaginatedResponse,
 
 	var page PaginatedResponse
 	err = json.NewDecoder(res.Body).Decode(&page)
+	api.drainBody(res.Body)
 	if err != nil {
-		if n, err2 := io.CopyN(ioutil.Discard, res.Body, 4096); n > 0 || err != nil {
-			api.logger.Printf("drained response: bytes=%d, err=%s", n, err2)
-		}
 		return nil, err
 	}
-	if n, err := io.CopyN(ioutil.Discard, res.Body, 4096); n > 0 || err != nil {
-		api.logger.Printf("drained response: bytes=%d, err=%s", n, err)
-	}
-	count = page.Count
+	api.logger.Debug().Str("request_id", req.Header.Get(RequestIdHeader)).Int("count", page.Count).Msg("metax paginated query")
 
 	return &page, nil
 }
@@ -298,195 +392,177 @@ func (api *MetaxService) Datasets(params ...DatasetOption) (*PaginatedResponse,
 // Murky stuff; is this still/again needed in whatever Go version this is compiled with?
 func (api *MetaxService) drainBody(body io.ReadCloser) {
 	// hmm... arbitrary trade-off limit
-	if n, err := io.CopyN(ioutil.Discard, body, 4096); n > 0 || err != nil {
-		api.logger.Printf("drained response: bytes=%d, err=%s", n, err)
+	if n, err := io.CopyN(ioutil.Discard, body, 4096); n > 0 || (err != nil && err != io.EOF) {
+		api.logger.Debug().Err(err).Int64("bytes", n).Msg("drained response")
 	}
 }
 
 // ReadStream queries the dataset endpoint with an unpaged request.
+// All records are held in memory; use StreamDatasets() to process large results.
 //
 // Deprecated: use ReadStreamChannel() for actual asynchronous stream processing.
-func (api *MetaxService) ReadStream(params ...DatasetOption) ([]MetaxRecord, error) {
-	req, err := http.NewRequest("GET", api.urlDatasets+"?stream=true&no_pagination=true", nil)
-	//req.Header.Add("If-None-Match", `W/"example-tag"`)
-	api.writeApiHeaders(req)
-
-	for _, param := range params {
-		param(req)
-	}
-	WithStreaming(req)
-
-	api.logger.Printf("request headers: %+v\n", req)
-
-	start := time.Now()
-	defer func() {
-		api.logger.Printf("metax: stream query processed in %v", time.Since(start))
-	}()
-
-	res, err := api.client.Do(req)
+func (api *MetaxService) ReadStream(ctx context.Context, params ...DatasetOption) ([]MetaxRecord, error) {
+	recs := make([]MetaxRecord, 0, 0)
+	_, err := api.StreamDatasets(ctx, func(raw *MetaxRawRecord) error {
+		var rec MetaxRecord
+		if err := json.Unmarshal(raw.RawMessage, &rec); err != nil {
+			return err
+		}
+		recs = append(recs, rec)
+		return nil
+	}, params...)
 	if err != nil {
 		return noRecords, err
 	}
-	defer res.Body.Close()
 
-	switch res.StatusCode {
-	case 200:
-	case 404:
-		return noRecords, fmt.Errorf("error: not found (code: %d)", res.StatusCode)
-	case 403:
-		return noRecords, fmt.Errorf("error: forbidden (code: %d)", res.StatusCode)
-	default:
-		return noRecords, fmt.Errorf("error: can't retrieve record (code: %d)", res.StatusCode)
-	}
-
-	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
-		return noRecords, fmt.Errorf("unknown content-type, expected json")
-	}
+	return recs, nil
+}
 
-	if res.Header.Get("X-Count") == "" {
-		api.logger.Print("metax: missing X-Count header in streaming response")
-	} else {
-		api.logger.Print("metax: x-count:", res.Header.Get("X-Count"))
+// StreamDatasets queries the dataset endpoint with an unpaged request and calls fn for each dataset as it is read from the stream.
+// Only one dataset is held in memory at a time, and the stream is read no faster than fn processes datasets.
+// If fn returns an error, reading stops and the error is returned.
+// It returns the number of datasets announced by the server, which might be zero if the server doesn't tell.
+func (api *MetaxService) StreamDatasets(ctx context.Context, fn func(*MetaxRawRecord) error, params ...DatasetOption) (int, error) {
+	count, stream, reqId, err := api.openStream(ctx, params...)
+	if err != nil {
+		return 0, err
 	}
+	start := time.Now()
+	defer func() {
+		api.drainBody(stream)
+		stream.Close()
+		api.logger.Debug().Str("request_id", reqId).Int("count", count).Dur("latency", time.Since(start)).Msg("metax stream processed")
+	}()
 
-	recs := make([]MetaxRecord, 0, 0)
-
-	dec := json.NewDecoder(res.Body)
+	err = decodeStream(stream, func(rec *MetaxRawRecord) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(rec)
+	})
+	return count, err
+}
 
-	// start stream
-	t, err := dec.Token()
+// ReadStreamChannel queries the dataset endpoint streaming the resulting datasets asynchronously throught a channel.
+func (api *MetaxService) ReadStreamChannel(ctx context.Context, params ...DatasetOption) (int, chan *MetaxRawRecord, chan error, error) {
+	start := time.Now()
+	count, stream, reqId, err := api.openStream(ctx, params...)
 	if err != nil {
-		api.logger.Print(err)
-		return nil, err
-	}
-	if delim, ok := t.(json.Delim); !ok || delim.String() != "[" {
-		return noRecords, errStreamMustBeArray
+		return 0, nil, nil, err
 	}
+	// WARNING: go routine below is responsible for closing the response body
 
-	// streaming array values...
-	for dec.More() {
-		var rec MetaxRecord
+	outc := make(chan *MetaxRawRecord)
+	errc := make(chan error, 1)
+
+	go func(stream io.ReadCloser) {
+		defer func() {
+			api.drainBody(stream)
+			stream.Close()
+			api.logger.Debug().Str("request_id", reqId).Int("count", count).Dur("latency", time.Since(start)).Msg("metax stream processed")
+		}()
 
-		err := dec.Decode(&rec)
+		err := decodeStream(stream, func(rec *MetaxRawRecord) error {
+			select {
+			case outc <- rec:
+				return nil
+			case <-ctx.Done():
+				api.logger.Debug().Str("request_id", reqId).Err(ctx.Err()).Msg("metax stream cancelled")
+				return ctx.Err()
+			}
+		})
 		if err != nil {
-			return noRecords, err
+			// cancellation is noticed by the reader as well
+			if err != ctx.Err() {
+				errc <- err
+			}
+			return
 		}
-		recs = append(recs, rec)
-	}
-
-	// end stream
-	t, err = dec.Token()
-	if err != nil {
-		return noRecords, err
-	}
-	fmt.Printf("%T: %v\n", t, t)
+		close(outc)
+	}(stream)
 
-	return recs, nil
+	return count, outc, errc, nil
 }
 
-// ReadStreamChannel queries the dataset endpoint streaming the resulting datasets asynchronously throught a channel.
-func (api *MetaxService) ReadStreamChannel(ctx context.Context, params ...DatasetOption) (int, chan *MetaxRawRecord, chan error, error) {
+// openStream makes an unpaged streaming request to the dataset endpoint and checks the response.
+// It returns the number of datasets announced by the server, the response body, which the caller must close, and the request id.
+func (api *MetaxService) openStream(ctx context.Context, params ...DatasetOption) (int, io.ReadCloser, string, error) {
 	var count int
 
 	req, err := http.NewRequest("GET", api.urlDatasets, nil)
+	if err != nil {
+		return 0, nil, "", err
+	}
 	api.writeApiHeaders(req)
 
 	for _, param := range params {
 		param(req)
 	}
 	WithStreaming(req)
+	api.addVersionQuery(req)
 
-	api.logger.Printf("request headers: %+v\n", req)
-	fmt.Printf("[sync] request: %+v\n", req)
-
-	start := time.Now()
-	defer func() {
-		api.logger.Printf("metax: stream query processed in %v", time.Since(start))
-	}()
-
-	res, err := api.client.Do(req)
+	res, err := api.doWith(ctx, api.streamClient, req, "")
 	if err != nil {
-		return 0, nil, nil, err
+		return 0, nil, "", err
 	}
-	// WARNING: go routine below is responsible for closing the response body
-
-	fmt.Printf("[sync] response: %+v\n", res)
+	reqId := req.Header.Get(RequestIdHeader)
 
 	switch res.StatusCode {
 	case 200:
 	case 404:
-		return 0, nil, nil, fmt.Errorf("error: not found (status: %d)", res.StatusCode)
+		res.Body.Close()
+		return 0, nil, "", fmt.Errorf("error: not found (status: %d)", res.StatusCode)
 	case 403:
-		return 0, nil, nil, fmt.Errorf("error: forbidden (status: %d)", res.StatusCode)
+		res.Body.Close()
+		return 0, nil, "", fmt.Errorf("error: forbidden (status: %d)", res.StatusCode)
 	default:
-		return 0, nil, nil, fmt.Errorf("error: can't retrieve dataset (status: %d)", res.StatusCode)
+		res.Body.Close()
+		return 0, nil, "", fmt.Errorf("error: can't retrieve dataset (status: %d)", res.StatusCode)
 	}
 
 	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
-		return 0, nil, nil, fmt.Errorf("unknown content-type, expected json")
+		res.Body.Close()
+		return 0, nil, "", fmt.Errorf("unknown content-type, expected json")
 	}
 
 	strCount := res.Header.Get("X-Count")
 	if strCount == "" {
-		api.logger.Print("metax: missing X-Count header in streaming response")
-		fmt.Println("metax: missing X-Count header in streaming response")
+		api.logger.Debug().Str("request_id", reqId).Msg("missing X-Count header in streaming response")
 	} else {
-		count, err = strconv.Atoi(strCount)
-		api.logger.Print("metax: x-count:", count)
-		fmt.Println("metax: x-count:", count)
+		count, _ = strconv.Atoi(strCount)
 	}
 
-	outc := make(chan *MetaxRawRecord)
-	errc := make(chan error, 1)
-
-	go func(stream io.ReadCloser) {
-		defer func() {
-			api.drainBody(stream)
-			stream.Close()
-			api.logger.Printf("metax: stream data processed in %v", time.Since(start))
-		}()
-
-		dec := json.NewDecoder(stream)
+	return count, res.Body, reqId, nil
+}
 
-		// start stream
-		t, err := dec.Token()
-		if err != nil {
-			api.logger.Print(err)
-			errc <- err
-			return
-		}
-		if delim, ok := t.(json.Delim); !ok || delim.String() != "[" {
-			errc <- errStreamMustBeArray
-			return
-		}
+// decodeStream decodes a JSON array of datasets one by one, calling fn for each of them until it returns an error.
+func decodeStream(stream io.Reader, fn func(*MetaxRawRecord) error) error {
+	dec := json.NewDecoder(stream)
 
-		// while records in the array stream...
-		for dec.More() {
-			var rec MetaxRawRecord
+	// start stream
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := t.(json.Delim); !ok || delim.String() != "[" {
+		return errStreamMustBeArray
+	}
 
-			err := dec.Decode(&rec)
-			if err != nil {
-				errc <- err
-				return
-			}
+	// while records in the array stream...
+	for dec.More() {
+		var rec MetaxRawRecord
 
-			select {
-			case outc <- &rec:
-			case <-ctx.Done():
-				api.logger.Print("context timeout triggered")
-				return
-			}
+		if err := dec.Decode(&rec); err != nil {
+			return err
 		}
-
-		// end stream
-		t, err = dec.Token()
-		if err != nil {
-			errc <- err
+		if err := fn(&rec); err != nil {
+			return err
 		}
-		close(outc)
-	}(res.Body)
+	}
 
-	return count, outc, errc, nil
+	// end stream
+	_, err = dec.Token()
+	return err
 }
 
 // writeApiHeaders sets default headers for API requests.
@@ -505,15 +581,12 @@ func (api *MetaxService) Create(ctx context.Context, blob json.RawMessage) (json
 	}
 
 	req, err := http.NewRequest(http.MethodPost, api.urlDatasets, bytes.NewBuffer(blob))
+	if err != nil {
+		return nil, err
+	}
 	api.writeApiHeaders(req)
 
-	fmt.Printf("%v\n", req)
-	start := time.Now()
-	defer func() {
-		api.logger.Printf("metax: create processed in %v", time.Since(start))
-	}()
-
-	res, err := api.client.Do(req.WithContext(ctx))
+	res, err := api.do(ctx, req, "")
 	if err != nil {
 		return nil, err
 	}
@@ -535,15 +608,6 @@ func (api *MetaxService) Create(ctx context.Context, blob json.RawMessage) (json
 	default:
 		return nil, &ApiError{"API returned error", nil, res.StatusCode}
 	}
-
-	fmt.Println("response Status:", res.Status)
-	fmt.Println("response Headers:", res.Header)
-	fmt.Println("response Body:", string(body))
-	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
-		return body, nil
-	}
-
-	return nil, nil
 }
 
 // Store sends – or "publishes" – a dataset to the Metax dataset API.
@@ -555,6 +619,12 @@ func (api *MetaxService) Store(ctx context.Context, blob json.RawMessage, owner
 	if blob == nil || len(blob) < 1 {
 		return nil, errEmptyDataset
 	}
+	if api.version == ApiV2 {
+		return api.storeV2(ctx, blob, owner)
+	}
+	if IsDraft(blob) {
+		return nil, ErrDraftsNotSupported
+	}
 
 	id := GetIdentifier(blob)
 
@@ -575,13 +645,9 @@ func (api *MetaxService) Store(ctx context.Context, blob json.RawMessage, owner
 	req.URL.RawQuery = owner.AddAccessGranter(req.URL.RawQuery)
 
 	api.writeApiHeaders(req)
+	api.logBody(req, id, "request", blob)
 
-	start := time.Now()
-	defer func() {
-		api.logger.Printf("metax: create processed in %v", time.Since(start))
-	}()
-
-	res, err := api.client.Do(req.WithContext(ctx))
+	res, err := api.do(ctx, req, id)
 	if err != nil {
 		return nil, err
 	}
@@ -600,27 +666,19 @@ func (api *MetaxService) Store(ctx context.Context, blob json.RawMessage, owner
 		return nil, &ApiError{"invalid content-length: zero body", nil, res.StatusCode}
 	}
 
-	fmt.Println("Status:", res.StatusCode)
+	api.logBody(req, id, "response", body)
+	reqId := req.Header.Get(RequestIdHeader)
 
 	switch res.StatusCode {
 	case 200:
-		fmt.Println("updated dataset:", id)
 		if newId := MaybeNewVersionId(body); newId != "" {
-			fmt.Println("created new version:", newId)
-			//if api.returnLatestVersion {
-			if false {
-				newVersion, err := api.GetId(newId)
-				fmt.Println("called newVersion", err)
-				fmt.Printf("old: %s\n\n", body)
-				fmt.Printf("new: %s\n\n", newVersion)
-				return newVersion, err
-			}
+			api.logger.Info().Str("request_id", reqId).Str("dataset", id).Str("new_version", newId).Msg("metax created new dataset version")
+		} else {
+			api.logger.Info().Str("request_id", reqId).Str("dataset", id).Msg("metax updated dataset")
 		}
 		return body, nil
 	case 201:
-		if createdId := GetIdentifier(body); createdId != "" {
-			fmt.Println("created new dataset:", createdId)
-		}
+		api.logger.Info().Str("request_id", reqId).Str("dataset", GetIdentifier(body)).Msg("metax created dataset")
 		return body, nil
 	case 204:
 		// not sure how to handle this here
@@ -638,15 +696,6 @@ func (api *MetaxService) Store(ctx context.Context, blob json.RawMessage, owner
 	default:
 		return nil, &ApiError{"API returned error", body, res.StatusCode}
 	}
-
-	fmt.Println("response Status:", res.Status)
-	fmt.Println("response Headers:", res.Header)
-	fmt.Println("response Body:", string(body))
-	if hasJson {
-		return body, nil
-	}
-
-	return nil, nil
 }
 
 // Delete marks a dataset as removed in Metax.
@@ -664,12 +713,7 @@ func (api *MetaxService) Delete(ctx context.Context, blob json.RawMessage) error
 
 	api.writeApiHeaders(req)
 
-	start := time.Now()
-	defer func() {
-		api.logger.Printf("metax: delete processed in %v", time.Since(start))
-	}()
-
-	res, err := api.client.Do(req.WithContext(ctx))
+	res, err := api.do(ctx, req, id)
 	if err != nil {
 		return err
 	}
@@ -680,7 +724,7 @@ func (api *MetaxService) Delete(ctx context.Context, blob json.RawMessage) error
 
 	switch res.StatusCode {
 	case 204:
-		api.logger.Printf("removed dataset %s", id)
+		api.logger.Info().Str("request_id", req.Header.Get(RequestIdHeader)).Str("dataset", id).Msg("metax removed dataset")
 	case 400:
 		return &ApiError{"invalid dataset", body, res.StatusCode}
 	case 401:
@@ -696,19 +740,19 @@ func (api *MetaxService) Delete(ctx context.Context, blob json.RawMessage) error
 	return nil
 }
 
-// GetId queries the dataset endpoint for a dataset with the given id.
-func (api *MetaxService) GetIdRemoved(id string) (json.RawMessage, error) {
-	return api.getDataset(id, true)
+// GetIdRemoved queries the dataset endpoint for a removed dataset with the given id.
+func (api *MetaxService) GetIdRemoved(ctx context.Context, id string) (json.RawMessage, error) {
+	return api.getDataset(ctx, id, true)
 }
 
 // GetId queries the dataset endpoint for a dataset with the given id.
-func (api *MetaxService) GetId(id string) (json.RawMessage, error) {
-	return api.getDataset(id, false)
+func (api *MetaxService) GetId(ctx context.Context, id string) (json.RawMessage, error) {
+	return api.getDataset(ctx, id, false)
 }
 
-// GetId queries the dataset endpoint for a dataset with the given id. If removed
+// getDataset queries the dataset endpoint for a dataset with the given id. If removed
 // is true, query for removed datasets.
-func (api *MetaxService) getDataset(id string, removed bool) (json.RawMessage, error) {
+func (api *MetaxService) getDataset(ctx context.Context, id string, removed bool) (json.RawMessage, error) {
 	req, err := http.NewRequest("GET", api.UrlForId(id), nil)
 	if err != nil {
 		return nil, err
@@ -721,9 +765,9 @@ func (api *MetaxService) getDataset(id string, removed bool) (json.RawMessage, e
 		req.URL.RawQuery = query.Encode()
 	}
 
+	api.addVersionQuery(req)
 	api.writeApiHeaders(req)
-	api.logger.Printf("request headers: %+v\n", req)
-	res, err := api.client.Do(req)
+	res, err := api.do(ctx, req, id)
 	if err != nil {
 		return nil, err
 	}
@@ -765,12 +809,7 @@ func (api *MetaxService) ChangeCumulativeState(ctx context.Context, identifier s
 
 	api.writeApiHeaders(req)
 
-	start := time.Now()
-	defer func() {
-		api.logger.Printf("metax: change_cumulative_state processed in %v", time.Since(start))
-	}()
-
-	res, err := api.client.Do(req.WithContext(ctx))
+	res, err := api.do(ctx, req, identifier)
 	if err != nil {
 		return "", err
 	}
@@ -801,6 +840,10 @@ func (api *MetaxService) ChangeCumulativeState(ctx context.Context, identifier s
 // Returns the new Metax identifier if a new dataset version was created.
 func (api *MetaxService) RefreshDirectoryContent(ctx context.Context,
 	datasetIdentifier string, directoryIdentifier string) (newMetaxId string, err error) {
+	if api.version == ApiV2 {
+		return api.refreshDirectoryContentV2(ctx, datasetIdentifier, directoryIdentifier)
+	}
+
 	req, err := http.NewRequest(http.MethodPost, api.urlRefreshDirectoryContent, nil)
 	if err != nil {
 		return "", err
@@ -812,12 +855,7 @@ func (api *MetaxService) RefreshDirectoryContent(ctx context.Context,
 
 	api.writeApiHeaders(req)
 
-	start := time.Now()
-	defer func() {
-		api.logger.Printf("metax: refresh_directory_content in %v", time.Since(start))
-	}()
-
-	res, err := api.client.Do(req.WithContext(ctx))
+	res, err := api.do(ctx, req, datasetIdentifier)
 	if err != nil {
 		return "", err
 	}
@@ -842,3 +880,45 @@ func (api *MetaxService) RefreshDirectoryContent(ctx context.Context,
 		return "", &ApiError{"API returned error", body, res.StatusCode}
 	}
 }
+
+// FixDeprecated calls Metax RPC for fixing a deprecated dataset with the given Metax identifier.
+// Metax creates a new version of the dataset without the files that have been removed; its identifier is returned.
+func (api *MetaxService) FixDeprecated(ctx context.Context, identifier string) (newMetaxId string, err error) {
+	req, err := http.NewRequest(http.MethodPost, api.urlFixDeprecated, nil)
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	q.Add("identifier", identifier)
+	req.URL.RawQuery = q.Encode()
+
+	api.writeApiHeaders(req)
+
+	res, err := api.do(ctx, req, identifier)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+
+	switch res.StatusCode {
+	case 200: // success, new version created
+		newMetaxId = gjson.GetBytes(body, "new_version_created.identifier").String()
+		if newMetaxId == "" {
+			return "", &ApiError{"no new version in response", body, res.StatusCode}
+		}
+		api.logger.Info().Str("request_id", req.Header.Get(RequestIdHeader)).Str("dataset", identifier).Str("new_version", newMetaxId).Msg("metax fixed deprecated dataset")
+		return newMetaxId, nil
+	case 400:
+		return "", &ApiError{"invalid request", body, res.StatusCode}
+	case 401:
+		return "", &ApiError{"authorisation required", body, res.StatusCode}
+	case 403:
+		return "", &ApiError{"forbidden", body, res.StatusCode}
+	case 404:
+		return "", &ApiError{"not found", body, res.StatusCode}
+	default:
+		return "", &ApiError{"API returned error", body, res.StatusCode}
+	}
+}
@@ -0,0 +1,380 @@
+package metax
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ApiVersion is the version of the Metax API the client talks to.
+type ApiVersion int
+
+const (
+	// ApiV1 is the original Metax API; files are part of the dataset and file changes create new versions implicitly.
+	ApiV1 ApiVersion = 1
+
+	// ApiV2 has draft datasets, explicit versioning and separate endpoints for linking files to datasets.
+	ApiV2 ApiVersion = 2
+)
+
+const (
+	DatasetsEndpointV2 = "/rest/v2/datasets/"
+	RpcEndpointV2      = "/rpc/v2/datasets/"
+)
+
+// DatasetStore is the part of the Metax client used for publishing datasets; it works against both API versions.
+type DatasetStore interface {
+	Store(ctx context.Context, blob json.RawMessage, owner *models.User) (json.RawMessage, error)
+	GetId(ctx context.Context, id string) (json.RawMessage, error)
+	Delete(ctx context.Context, blob json.RawMessage) error
+	ChangeCumulativeState(ctx context.Context, identifier string, cumulativeState string) (string, error)
+	RefreshDirectoryContent(ctx context.Context, datasetIdentifier string, directoryIdentifier string) (string, error)
+	StoreDraft(ctx context.Context, blob json.RawMessage, owner *models.User) (json.RawMessage, error)
+	FixDeprecated(ctx context.Context, identifier string) (string, error)
+	CreateNewVersion(ctx context.Context, identifier string, owner *models.User) (string, error)
+	Logger() *zerolog.Logger
+}
+
+// WithApiVersion sets the Metax API version. The default is ApiV1; see also NegotiateVersion().
+func WithApiVersion(version ApiVersion) MetaxOption {
+	return func(svc *MetaxService) {
+		svc.version = version
+	}
+}
+
+// Version returns the Metax API version in use.
+func (api *MetaxService) Version() ApiVersion {
+	return api.version
+}
+
+// NegotiateVersion checks if the Metax server supports API v2 and switches to it if so.
+// It is not safe to call this method while the client is in use.
+func (api *MetaxService) NegotiateVersion(ctx context.Context) (ApiVersion, error) {
+	req, err := http.NewRequest(http.MethodGet, api.baseUrl+DatasetsEndpointV2+"?limit=1", nil)
+	if err != nil {
+		return api.version, err
+	}
+	api.writeApiHeaders(req)
+
+	res, err := api.do(ctx, req, "")
+	if err != nil {
+		return api.version, err
+	}
+	defer res.Body.Close()
+	api.drainBody(res.Body)
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		api.version = ApiV2
+	case http.StatusNotFound:
+		api.version = ApiV1
+	default:
+		return api.version, &ApiError{"can't determine API version", nil, res.StatusCode}
+	}
+	api.makeEndpoints(api.baseUrl)
+	api.logger.Info().Int("version", int(api.version)).Msg("metax api version")
+	return api.version, nil
+}
+
+// urlRpc returns the url for a v2 RPC call.
+func (api *MetaxService) urlRpc(call string) string {
+	return api.baseUrl + RpcEndpointV2 + call
+}
+
+// requestV2 sends a request with an optional JSON body and returns the response body.
+// Responses with other than 2xx status are returned as ApiError.
+func (api *MetaxService) requestV2(ctx context.Context, method string, url string, body []byte, owner *models.User, dataset string) ([]byte, error) {
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequest(method, url, bytes.NewBuffer(body))
+	} else {
+		req, err = http.NewRequest(method, url, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil {
+		req.URL.RawQuery = owner.AddAllowedProjects(req.URL.RawQuery)
+		req.URL.RawQuery = owner.AddAccessGranter(req.URL.RawQuery)
+	}
+
+	api.writeApiHeaders(req)
+	api.logBody(req, dataset, "request", body)
+
+	res, err := api.do(ctx, req, dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, _ := ioutil.ReadAll(res.Body)
+	api.logBody(req, dataset, "response", resBody)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return resBody, nil
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		resBody = nil
+	}
+	switch res.StatusCode {
+	case 400:
+		return nil, &ApiError{"invalid request", resBody, res.StatusCode}
+	case 401:
+		return nil, &ApiError{"authorisation required", resBody, res.StatusCode}
+	case 403:
+		return nil, &ApiError{"forbidden", resBody, res.StatusCode}
+	case 404:
+		return nil, &ApiError{"not found", resBody, res.StatusCode}
+	default:
+		return nil, &ApiError{"API returned error", resBody, res.StatusCode}
+	}
+}
+
+// rpcV2 calls a v2 dataset RPC with the given query parameters.
+func (api *MetaxService) rpcV2(ctx context.Context, call string, params url.Values, owner *models.User) ([]byte, error) {
+	return api.requestV2(ctx, http.MethodPost, api.urlRpc(call)+"?"+params.Encode(), nil, owner, params.Get("identifier"))
+}
+
+// splitFiles removes the file and directory lists from a dataset, since in v2 they are linked with separate calls.
+func splitFiles(blob []byte) (stripped []byte, files gjson.Result, dirs gjson.Result, err error) {
+	files = gjson.GetBytes(blob, "research_dataset.files")
+	dirs = gjson.GetBytes(blob, "research_dataset.directories")
+
+	stripped = blob
+	if files.Exists() {
+		if stripped, err = sjson.DeleteBytes(stripped, "research_dataset.files"); err != nil {
+			return
+		}
+	}
+	if dirs.Exists() {
+		stripped, err = sjson.DeleteBytes(stripped, "research_dataset.directories")
+	}
+	return
+}
+
+// identifiers returns the identifiers of the objects in a JSON array.
+func identifiers(list gjson.Result) map[string]bool {
+	ids := make(map[string]bool)
+	for _, obj := range list.Array() {
+		if id := obj.Get("identifier").String(); id != "" {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// filesDiffer checks if the identifiers of the files or directories in the lists differ from the current ones.
+func filesDiffer(files, dirs, currentFiles, currentDirs gjson.Result) bool {
+	return len(fileChanges(identifiers(files), identifiers(currentFiles))) > 0 ||
+		len(fileChanges(identifiers(dirs), identifiers(currentDirs))) > 0
+}
+
+// fileChange is an entry in a v2 file linking request.
+type fileChange struct {
+	Identifier string `json:"identifier"`
+	Exclude    bool   `json:"exclude,omitempty"`
+}
+
+// fileChanges lists the entries to add and to exclude so the dataset has the wanted files.
+func fileChanges(wanted, current map[string]bool) []fileChange {
+	var changes []fileChange
+	for id := range wanted {
+		if !current[id] {
+			changes = append(changes, fileChange{Identifier: id})
+		}
+	}
+	for id := range current {
+		if !wanted[id] {
+			changes = append(changes, fileChange{Identifier: id, Exclude: true})
+		}
+	}
+	return changes
+}
+
+// linkFilesV2 makes the files and directories linked to a dataset match the given lists, and stores their user metadata.
+// The current lists are those of the dataset before the change.
+func (api *MetaxService) linkFilesV2(ctx context.Context, id string, files, dirs, currentFiles, currentDirs gjson.Result, owner *models.User) error {
+	changes := struct {
+		Files       []fileChange `json:"files,omitempty"`
+		Directories []fileChange `json:"directories,omitempty"`
+	}{
+		Files:       fileChanges(identifiers(files), identifiers(currentFiles)),
+		Directories: fileChanges(identifiers(dirs), identifiers(currentDirs)),
+	}
+	if len(changes.Files) > 0 || len(changes.Directories) > 0 {
+		body, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		if _, err := api.requestV2(ctx, http.MethodPost, api.UrlForId(id)+"/files", body, owner, id); err != nil {
+			return err
+		}
+	}
+
+	if !files.Exists() && !dirs.Exists() {
+		return nil
+	}
+	metadata := struct {
+		Files       json.RawMessage `json:"files,omitempty"`
+		Directories json.RawMessage `json:"directories,omitempty"`
+	}{}
+	if files.IsArray() {
+		metadata.Files = json.RawMessage(files.Raw)
+	}
+	if dirs.IsArray() {
+		metadata.Directories = json.RawMessage(dirs.Raw)
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = api.requestV2(ctx, http.MethodPut, api.UrlForId(id)+"/files/user_metadata", body, owner, id)
+	return err
+}
+
+// storeV2 stores a dataset using API v2. New datasets are created as draft, their files are linked, and the draft is published.
+// Existing drafts are updated and published; for published datasets the metadata is updated in place, and ErrNewVersionRequired
+// is returned if the files change. API v2 doesn't create new versions implicitly like v1; use CreateNewVersion instead.
+//
+// If a new dataset was created but a later step fails, the error is a CreatedError with the identifier of the dataset.
+func (api *MetaxService) storeV2(ctx context.Context, blob json.RawMessage, owner *models.User) (json.RawMessage, error) {
+	id, err := api.saveDraftV2(ctx, blob, owner)
+	if err != nil {
+		return nil, createdError(blob, id, true, err)
+	}
+
+	if GetIdentifier(blob) == "" || IsDraft(blob) {
+		if _, err := api.rpcV2(ctx, "publish_dataset", url.Values{"identifier": {id}}, owner); err != nil {
+			return nil, createdError(blob, id, true, err)
+		}
+		api.logger.Info().Str("dataset", id).Msg("metax published draft dataset")
+	}
+
+	res, err := api.GetId(ctx, id)
+	if err != nil {
+		return nil, createdError(blob, id, false, err)
+	}
+	return res, nil
+}
+
+// createdError returns a CreatedError for an error after creating the dataset with the given identifier,
+// or the error itself if the dataset existed already.
+func createdError(blob json.RawMessage, id string, draft bool, err error) error {
+	if id == "" || GetIdentifier(blob) != "" {
+		return err
+	}
+	return &CreatedError{Identifier: id, Draft: draft, Err: err}
+}
+
+// StoreDraft creates or updates a draft dataset in Metax without publishing it; this requires API v2.
+// Datasets without identifier are created as new drafts, other datasets must be drafts.
+// If the request was successful, the draft will be returned. If a new draft was created but a later step fails,
+// the error is a CreatedError with the identifier of the draft.
+func (api *MetaxService) StoreDraft(ctx context.Context, blob json.RawMessage, owner *models.User) (json.RawMessage, error) {
+	if blob == nil || len(blob) < 1 {
+		return nil, errEmptyDataset
+	}
+	if api.version != ApiV2 {
+		return nil, ErrDraftsNotSupported
+	}
+	if GetIdentifier(blob) != "" && !IsDraft(blob) {
+		return nil, ErrAlreadyPublished
+	}
+
+	id, err := api.saveDraftV2(ctx, blob, owner)
+	if err != nil {
+		return nil, createdError(blob, id, true, err)
+	}
+
+	res, err := api.GetId(ctx, id)
+	if err != nil {
+		return nil, createdError(blob, id, true, err)
+	}
+	return res, nil
+}
+
+// CreateNewVersion creates a new version of a published dataset as draft, leaving the published version as it is;
+// this requires API v2. It returns the identifier of the new draft, which can be changed and published like other drafts.
+func (api *MetaxService) CreateNewVersion(ctx context.Context, identifier string, owner *models.User) (string, error) {
+	if api.version != ApiV2 {
+		return "", ErrVersioningNotSupported
+	}
+
+	res, err := api.rpcV2(ctx, "create_new_version", url.Values{"identifier": {identifier}}, owner)
+	if err != nil {
+		return "", err
+	}
+	id := GetIdentifier(res)
+	if id == "" {
+		return "", &ApiError{"no identifier in created version", res, http.StatusBadGateway}
+	}
+	api.logger.Info().Str("dataset", identifier).Str("new_version", id).Msg("metax created new version draft")
+	return id, nil
+}
+
+// saveDraftV2 creates a draft for datasets without identifier, or updates an existing dataset, and links its files.
+// It returns the identifier of the dataset, also if linking the files of a new draft fails.
+// The files of drafts are always synced, so removing all files from a draft unlinks them in Metax; the files of published
+// datasets can't change, and ErrNewVersionRequired is returned before anything is written if they do.
+func (api *MetaxService) saveDraftV2(ctx context.Context, blob json.RawMessage, owner *models.User) (string, error) {
+	id := GetIdentifier(blob)
+
+	stripped, files, dirs, err := splitFiles(blob)
+	if err != nil {
+		return "", err
+	}
+
+	if id == "" {
+		draft, err := api.requestV2(ctx, http.MethodPost, api.urlDatasets+"?draft=true", stripped, owner, "")
+		if err != nil {
+			return "", err
+		}
+		if id = GetIdentifier(draft); id == "" {
+			return "", &ApiError{"no identifier in created draft", nil, http.StatusBadGateway}
+		}
+		if err := api.linkFilesV2(ctx, id, files, dirs, gjson.Result{}, gjson.Result{}, owner); err != nil {
+			return id, err
+		}
+		api.logger.Info().Str("dataset", id).Msg("metax created draft dataset")
+		return id, nil
+	}
+
+	current, err := api.GetId(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	currentFiles, currentDirs := gjson.GetBytes(current, "research_dataset.files"), gjson.GetBytes(current, "research_dataset.directories")
+	if !IsDraft(current) && filesDiffer(files, dirs, currentFiles, currentDirs) {
+		return "", ErrNewVersionRequired
+	}
+
+	if _, err := api.requestV2(ctx, http.MethodPut, api.UrlForId(id), stripped, owner, id); err != nil {
+		return "", err
+	}
+	err = api.linkFilesV2(ctx, id, files, dirs, currentFiles, currentDirs, owner)
+	if err != nil {
+		return "", err
+	}
+	api.logger.Info().Str("dataset", id).Msg("metax updated dataset")
+	return id, nil
+}
+
+// refreshDirectoryContentV2 links the current contents of a directory to a dataset; API v2 doesn't create new versions implicitly.
+func (api *MetaxService) refreshDirectoryContentV2(ctx context.Context, datasetIdentifier string, directoryIdentifier string) (string, error) {
+	body, err := json.Marshal(map[string][]fileChange{"directories": {{Identifier: directoryIdentifier}}})
+	if err != nil {
+		return "", err
+	}
+	_, err = api.requestV2(ctx, http.MethodPost, api.UrlForId(datasetIdentifier)+"/files", body, nil, datasetIdentifier)
+	return "", err
+}
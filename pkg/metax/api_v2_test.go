@@ -0,0 +1,377 @@
+package metax
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/tidwall/gjson"
+)
+
+const testDatasetV2 = `{"research_dataset":{"title":{"en":"Test"},
+	"files":[{"identifier":"file1","title":"File 1"}],"directories":[{"identifier":"dir1","title":"Dir 1"}]}}`
+
+func TestStoreV2Create(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method + " " + r.URL.Path {
+		case "POST /rest/v2/datasets/":
+			if r.URL.Query().Get("draft") != "true" {
+				t.Error("dataset not created as draft")
+			}
+			if gjson.GetBytes(body, "research_dataset.files").Exists() || gjson.GetBytes(body, "research_dataset.directories").Exists() {
+				t.Error("files sent with dataset metadata")
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"identifier":"cr1","state":"draft"}`))
+		case "POST /rest/v2/datasets/cr1/files":
+			var changes struct {
+				Files       []fileChange `json:"files"`
+				Directories []fileChange `json:"directories"`
+			}
+			if err := json.Unmarshal(body, &changes); err != nil {
+				t.Error(err)
+			}
+			if len(changes.Files) != 1 || changes.Files[0].Identifier != "file1" || len(changes.Directories) != 1 {
+				t.Errorf("unexpected file changes: %s", body)
+			}
+			w.Write([]byte(`{}`))
+		case "PUT /rest/v2/datasets/cr1/files/user_metadata":
+			if gjson.GetBytes(body, "files.0.title").String() != "File 1" {
+				t.Errorf("unexpected user metadata: %s", body)
+			}
+			w.Write([]byte(`{}`))
+		case "POST /rpc/v2/datasets/publish_dataset":
+			if r.URL.Query().Get("identifier") != "cr1" {
+				t.Errorf("unexpected publish query: %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"preferred_identifier":"urn:1"}`))
+		case "GET /rest/v2/datasets/cr1":
+			if r.URL.Query().Get("include_user_metadata") != "true" {
+				t.Error("user metadata not requested")
+			}
+			w.Write([]byte(`{"identifier":"cr1","state":"published"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	api := newTestService(srv, WithApiVersion(ApiV2))
+	res, err := api.Store(context.Background(), json.RawMessage(testDatasetV2), &models.User{Identity: "jdoe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GetIdentifier(res) != "cr1" {
+		t.Errorf("unexpected response: %s", res)
+	}
+
+	expected := []string{
+		"POST /rest/v2/datasets/",
+		"POST /rest/v2/datasets/cr1/files",
+		"PUT /rest/v2/datasets/cr1/files/user_metadata",
+		"POST /rpc/v2/datasets/publish_dataset",
+		"GET /rest/v2/datasets/cr1",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("unexpected calls:\n%v\nexpected:\n%v", calls, expected)
+	}
+}
+
+func TestFileChanges(t *testing.T) {
+	wanted := map[string]bool{"a": true, "b": true}
+	current := map[string]bool{"b": true, "c": true}
+
+	changes := fileChanges(wanted, current)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Identifier < changes[j].Identifier })
+
+	expected := []fileChange{{Identifier: "a"}, {Identifier: "c", Exclude: true}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v, got %v", expected, changes)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		status   int
+		expected ApiVersion
+		err      bool
+	}{
+		{status: http.StatusOK, expected: ApiV2},
+		{status: http.StatusNotFound, expected: ApiV1},
+		{status: http.StatusForbidden, expected: ApiV1, err: true},
+	}
+
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/rest/v2/datasets/" {
+				t.Errorf("unexpected path: %s", r.URL.Path)
+			}
+			w.WriteHeader(test.status)
+		}))
+
+		api := newTestService(srv)
+		version, err := api.NegotiateVersion(context.Background())
+		if (err != nil) != test.err {
+			t.Errorf("status %d: unexpected error: %v", test.status, err)
+		}
+		if version != test.expected || api.Version() != test.expected {
+			t.Errorf("status %d: expected version %d, got %d", test.status, test.expected, version)
+		}
+		if test.expected == ApiV2 && api.UrlForId("cr1") != srv.URL+"/rest/v2/datasets/cr1" {
+			t.Errorf("endpoints not switched to v2: %s", api.UrlForId("cr1"))
+		}
+		srv.Close()
+	}
+}
+
+func TestStoreDraft(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method + " " + r.URL.Path {
+		case "POST /rest/v2/datasets/":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"identifier":"cr1","state":"draft"}`))
+		case "GET /rest/v2/datasets/cr1":
+			w.Write([]byte(`{"identifier":"cr1","state":"draft","research_dataset":{"files":[{"identifier":"file1"}]}}`))
+		case "PUT /rest/v2/datasets/cr1", "POST /rest/v2/datasets/cr1/files", "PUT /rest/v2/datasets/cr1/files/user_metadata",
+			"POST /rpc/v2/datasets/publish_dataset":
+			w.Write([]byte(`{}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	user := &models.User{Identity: "jdoe"}
+	api := newTestService(srv, WithApiVersion(ApiV2))
+
+	// new draft: created and files linked, but not published
+	res, err := api.StoreDraft(ctx, json.RawMessage(testDatasetV2), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsDraft(res) || IsPublished(res) {
+		t.Errorf("expected draft, got: %s", res)
+	}
+	expected := []string{
+		"POST /rest/v2/datasets/",
+		"POST /rest/v2/datasets/cr1/files",
+		"PUT /rest/v2/datasets/cr1/files/user_metadata",
+		"GET /rest/v2/datasets/cr1",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("unexpected calls:\n%v\nexpected:\n%v", calls, expected)
+	}
+
+	// publishing the draft: updated and promoted
+	calls = nil
+	draft := `{"identifier":"cr1","state":"draft","research_dataset":{"files":[{"identifier":"file1"}]}}`
+	if _, err := api.Store(ctx, json.RawMessage(draft), user); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"GET /rest/v2/datasets/cr1",
+		"PUT /rest/v2/datasets/cr1",
+		"PUT /rest/v2/datasets/cr1/files/user_metadata",
+		"POST /rpc/v2/datasets/publish_dataset",
+		"GET /rest/v2/datasets/cr1",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("unexpected calls:\n%v\nexpected:\n%v", calls, expected)
+	}
+
+	// removing all files unlinks them
+	calls = nil
+	if _, err := api.StoreDraft(ctx, json.RawMessage(`{"identifier":"cr1","state":"draft","research_dataset":{}}`), user); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"GET /rest/v2/datasets/cr1",
+		"PUT /rest/v2/datasets/cr1",
+		"POST /rest/v2/datasets/cr1/files",
+		"GET /rest/v2/datasets/cr1",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("unexpected calls:\n%v\nexpected:\n%v", calls, expected)
+	}
+
+	// published datasets can't be stored as draft, and v1 doesn't have drafts
+	if _, err := api.StoreDraft(ctx, json.RawMessage(`{"identifier":"cr2","state":"published"}`), user); err != ErrAlreadyPublished {
+		t.Errorf("expected ErrAlreadyPublished, got %v", err)
+	}
+	if _, err := newTestService(srv).StoreDraft(ctx, json.RawMessage(testDatasetV2), user); err != ErrDraftsNotSupported {
+		t.Errorf("expected ErrDraftsNotSupported, got %v", err)
+	}
+}
+
+func TestStoreV2Created(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method + " " + r.URL.Path {
+		case "POST /rest/v2/datasets/":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"identifier":"cr1","state":"draft"}`))
+		case "POST /rest/v2/datasets/cr1/files":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"detail":"no such file"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	api := newTestService(srv, WithApiVersion(ApiV2))
+	_, err := api.Store(context.Background(), json.RawMessage(testDatasetV2), &models.User{Identity: "jdoe"})
+	created, ok := err.(*CreatedError)
+	if !ok {
+		t.Fatalf("expected CreatedError, got %T: %v", err, err)
+	}
+	if created.Identifier != "cr1" || !created.Draft {
+		t.Errorf("unexpected created dataset: %+v", created)
+	}
+	if _, ok := created.Err.(*ApiError); !ok {
+		t.Errorf("expected ApiError, got %T: %v", created.Err, created.Err)
+	}
+}
+
+func TestStoreV2Published(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET /rest/v2/datasets/cr1":
+			w.Write([]byte(`{"identifier":"cr1","state":"published","research_dataset":{"files":[{"identifier":"file1"}]}}`))
+		case "PUT /rest/v2/datasets/cr1", "PUT /rest/v2/datasets/cr1/files/user_metadata":
+			w.Write([]byte(`{}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	user := &models.User{Identity: "jdoe"}
+	api := newTestService(srv, WithApiVersion(ApiV2))
+
+	// metadata changes are stored in place
+	same := `{"identifier":"cr1","state":"published","research_dataset":{"title":{"en":"New"},"files":[{"identifier":"file1","title":"File 1"}]}}`
+	if _, err := api.Store(ctx, json.RawMessage(same), user); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"GET /rest/v2/datasets/cr1",
+		"PUT /rest/v2/datasets/cr1",
+		"PUT /rest/v2/datasets/cr1/files/user_metadata",
+		"GET /rest/v2/datasets/cr1",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("unexpected calls:\n%v\nexpected:\n%v", calls, expected)
+	}
+
+	// file changes need a new version and write nothing
+	calls = nil
+	changed := `{"identifier":"cr1","state":"published","research_dataset":{"files":[{"identifier":"file2"}]}}`
+	if _, err := api.Store(ctx, json.RawMessage(changed), user); err != ErrNewVersionRequired {
+		t.Errorf("expected ErrNewVersionRequired, got %v", err)
+	}
+	if len(calls) != 1 {
+		t.Errorf("expected only the current dataset to be read, got %v", calls)
+	}
+}
+
+func TestListV2(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/v2/datasets/" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("include_user_metadata") != "true" {
+			t.Errorf("user metadata not requested: %s", r.URL.RawQuery)
+		}
+		queries = append(queries, r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/json")
+
+		record := `{"identifier":"cr1","research_dataset":{"files":[{"identifier":"file1"}]}}`
+		if r.URL.Query().Get("stream") == "true" {
+			w.Header().Set("X-Count", "1")
+			w.Write([]byte(`[` + record + `]`))
+			return
+		}
+		w.Write([]byte(`{"count":1,"results":[` + record + `]}`))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	api := newTestService(srv, WithApiVersion(ApiV2))
+
+	var files []string
+	count, err := api.StreamDatasets(ctx, func(rec *MetaxRawRecord) error {
+		files = append(files, gjson.GetBytes(rec.RawMessage, "research_dataset.files.0.identifier").String())
+		return nil
+	}, WithOwner("owner"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || len(files) != 1 || files[0] != "file1" {
+		t.Errorf("unexpected stream: count %d, files %v", count, files)
+	}
+
+	if _, err := api.Datasets(ctx, WithOwner("owner")); err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 {
+		t.Errorf("expected 2 requests, got %d", len(queries))
+	}
+}
+
+func TestCreateNewVersion(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method+" "+r.URL.Path != "POST /rpc/v2/datasets/create_new_version" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.Query().Get("identifier")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"identifier":"cr2","preferred_identifier":"draft:cr2"}`))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	user := &models.User{Identity: "jdoe"}
+
+	id, err := newTestService(srv, WithApiVersion(ApiV2)).CreateNewVersion(ctx, "cr1", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "cr2" || query != "cr1" {
+		t.Errorf("expected new version cr2 of cr1, got %q of %q", id, query)
+	}
+
+	if _, err := newTestService(srv).CreateNewVersion(ctx, "cr1", user); err != ErrVersioningNotSupported {
+		t.Errorf("expected ErrVersioningNotSupported, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package metax
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerThreshold is the number of consecutive failed requests that opens the circuit breaker.
+	DefaultBreakerThreshold = 5
+
+	// DefaultBreakerCooldown is how long the circuit breaker stays open before letting a trial request through.
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (state breakerState) String() string {
+	switch state {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker fails requests fast while the API is down.
+//
+// The breaker opens after a number of consecutive failures. While open, requests are refused until the cooldown period
+// has passed; then a single trial request is let through (half-open). If it succeeds the breaker closes, otherwise it opens again.
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	stateVar  *expvar.String
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// newCircuitBreaker creates a closed circuit breaker. A threshold of zero or less disables the breaker.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	cb := &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+	return cb
+}
+
+// Allow returns ErrCircuitOpen if a request should not be attempted.
+func (cb *circuitBreaker) Allow() error {
+	if cb.threshold <= 0 {
+		return nil
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			breakerRejectedC.Add(1)
+			return ErrCircuitOpen
+		}
+		cb.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		// only one trial request at a time
+		breakerRejectedC.Add(1)
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// Success records a request that reached the API and closes the breaker.
+func (cb *circuitBreaker) Success() {
+	if cb.threshold <= 0 {
+		return
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.failures = 0
+	if cb.state != breakerClosed {
+		cb.setState(breakerClosed)
+	}
+}
+
+// Failure records a failed request and opens the breaker if the threshold is reached or the trial request failed.
+func (cb *circuitBreaker) Failure() {
+	if cb.threshold <= 0 {
+		return
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+		cb.openedAt = cb.now()
+		if cb.state != breakerOpen {
+			breakerOpenedC.Add(1)
+		}
+		cb.setState(breakerOpen)
+	}
+}
+
+// Cancel records a request that was cancelled by the caller. That says nothing about the health of the API,
+// but a cancelled trial request opens the breaker again so that the next request after it becomes the new trial.
+func (cb *circuitBreaker) Cancel() {
+	if cb.threshold <= 0 {
+		return
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+
+	if cb.state == breakerHalfOpen {
+		// keep openedAt, the cooldown has passed already
+		cb.setState(breakerOpen)
+	}
+}
+
+// State returns the current state of the breaker.
+func (cb *circuitBreaker) State() breakerState {
+	cb.Lock()
+	defer cb.Unlock()
+	return cb.state
+}
+
+// setState changes the state; the caller must hold the lock.
+func (cb *circuitBreaker) setState(state breakerState) {
+	cb.state = state
+	cb.publish()
+}
+
+// expose publishes the breaker state in expvar under the given key.
+func (cb *circuitBreaker) expose(key string) {
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.stateVar = breakerStateVar(key)
+	cb.publish()
+}
+
+// publish updates the breaker state in expvar, if exposed; the caller must hold the lock.
+func (cb *circuitBreaker) publish() {
+	if cb.stateVar != nil {
+		cb.stateVar.Set(cb.state.String())
+	}
+}
@@ -76,7 +76,7 @@ func (dataset *MetaxDataset) CreateData(family int, schema string, blob []byte,
 
 	editorJson, err := json.Marshal(editor)
 	if err != nil {
-		fmt.Println("can't serialise editor", err)
+		return err
 	}
 	template["research_dataset"] = (*json.RawMessage)(&blob)
 	template["editor"] = (*json.RawMessage)(&editorJson)
@@ -245,41 +245,12 @@ func (dataset *MetaxDataset) ValidateUpdated(updated *models.Dataset) error {
 		catalog = gjson.GetBytes(dataset.Blob(), "data_catalog").String()
 	}
 
-	// Checks that two (potentially nested) json values are equal. Normalizes the values
-	// by performing Unmarshal and Marshal for each value, and compares the resulting strings.
-	// The Marshal function sorts map keys so its output should be deterministic.
 	checkEqual := func(jsonA string, jsonB string) error {
-		// since an empty string does not contain a JSON value, check it separately
-		if jsonA == "" || jsonB == "" {
-			if jsonA != jsonB {
-				return errors.New("changes not allowed")
-			}
-			return nil
-		}
-
-		// If there are duplicate keys in objects, performing json.Unmarshal into an interface{} will
-		// only use the last value, which is also how the PostgreSQL jsonb type behaves.
-		var a, b interface{}
-		err := json.Unmarshal([]byte(jsonA), &a)
-		if err != nil {
-			return err
-		}
-
-		err = json.Unmarshal([]byte(jsonB), &b)
-		if err != nil {
-			return err
-		}
-
-		normalizedA, err := json.Marshal(a)
-		if err != nil {
-			return err
-		}
-
-		normalizedB, err := json.Marshal(b)
+		equal, err := EqualJSON(jsonA, jsonB)
 		if err != nil {
 			return err
 		}
-		if string(normalizedA) != string(normalizedB) {
+		if !equal {
 			return errors.New("changes not allowed")
 		}
 		return nil
@@ -0,0 +1,302 @@
+package metax
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// FieldDiff is a field that differs between two datasets.
+// A field that's missing from one of the datasets has an empty Old or New value.
+type FieldDiff struct {
+	Path string          `json:"path"`
+	Old  json.RawMessage `json:"old,omitempty"`
+	New  json.RawMessage `json:"new,omitempty"`
+}
+
+// DiffFields compares the values at the given path of an old and a new dataset and returns the fields that differ, sorted by path.
+// Objects are compared key by key; arrays and other values are compared as a whole. An empty path compares the whole datasets.
+// The paths of the returned fields can be used with gjson and sjson, and with ApplyFields.
+func DiffFields(oldBlob, newBlob []byte, path string) ([]FieldDiff, error) {
+	a, hasA, err := decodePath(oldBlob, path)
+	if err != nil {
+		return nil, err
+	}
+	b, hasB, err := decodePath(newBlob, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []FieldDiff
+	if err := diffValues(&diffs, path, a, b, hasA, hasB); err != nil {
+		return nil, err
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs, nil
+}
+
+// ListDiff is the difference between the items of a list in two datasets. Items are matched by a key, such as their identifier.
+type ListDiff struct {
+	Path    string            `json:"path"`
+	Added   []json.RawMessage `json:"added,omitempty"`
+	Removed []json.RawMessage `json:"removed,omitempty"`
+
+	// Changed has the items that have the same key but differ otherwise; the path of each difference is the item key.
+	Changed []FieldDiff `json:"changed,omitempty"`
+}
+
+// DatasetDiff is the difference between the research datasets of two datasets. Lists of files, directories, actors
+// and licences are compared item by item; other fields are compared as with DiffFields.
+type DatasetDiff struct {
+	Fields []FieldDiff `json:"fields"`
+	Lists  []ListDiff  `json:"lists"`
+}
+
+// diffLists are the research dataset lists compared item by item, with the paths of the item keys in order of preference.
+// Items without any of the keys are keyed by their normalised value.
+var diffLists = []struct {
+	path string
+	keys []string
+}{
+	{"research_dataset.files", []string{"identifier"}},
+	{"research_dataset.directories", []string{"identifier"}},
+	{"research_dataset.remote_resources", []string{"identifier", "access_url.identifier", "title"}},
+	{"research_dataset.creator", []string{"identifier", "name"}},
+	{"research_dataset.contributor", []string{"identifier", "name"}},
+	{"research_dataset.curator", []string{"identifier", "name"}},
+	{"research_dataset.rights_holder", []string{"identifier", "name"}},
+	{"research_dataset.access_rights.license", []string{"identifier", "license"}},
+	{"research_dataset.keyword", nil},
+}
+
+// DiffDatasets compares the research datasets of an old and a new dataset. Values that are equal after normalisation,
+// such as numbers written differently, are not reported as changed.
+func DiffDatasets(oldBlob, newBlob []byte) (*DatasetDiff, error) {
+	diff := &DatasetDiff{Fields: []FieldDiff{}, Lists: []ListDiff{}}
+
+	fields, err := DiffFields(oldBlob, newBlob, "research_dataset")
+	if err != nil {
+		return nil, err
+	}
+
+	isList := make(map[string]bool, len(diffLists))
+	for _, list := range diffLists {
+		isList[list.path] = true
+	}
+	for _, field := range fields {
+		if isList[field.Path] {
+			continue
+		}
+		equal, err := EqualJSON(string(field.Old), string(field.New))
+		if err != nil {
+			return nil, err
+		}
+		if !equal {
+			diff.Fields = append(diff.Fields, field)
+		}
+	}
+
+	for _, list := range diffLists {
+		listDiff, err := diffList(gjson.GetBytes(oldBlob, list.path), gjson.GetBytes(newBlob, list.path), list.keys)
+		if err != nil {
+			return nil, err
+		}
+		if len(listDiff.Added)+len(listDiff.Removed)+len(listDiff.Changed) > 0 {
+			listDiff.Path = list.path
+			diff.Lists = append(diff.Lists, listDiff)
+		}
+	}
+	return diff, nil
+}
+
+// diffList compares the items of two lists by key; items with the same key are matched in order.
+func diffList(oldList, newList gjson.Result, keys []string) (ListDiff, error) {
+	var diff ListDiff
+
+	oldItems := make(map[string][]gjson.Result)
+	matched := make(map[string]int)
+	for _, item := range oldList.Array() {
+		key, err := itemKey(item, keys)
+		if err != nil {
+			return diff, err
+		}
+		oldItems[key] = append(oldItems[key], item)
+	}
+
+	for _, item := range newList.Array() {
+		key, err := itemKey(item, keys)
+		if err != nil {
+			return diff, err
+		}
+		if len(oldItems[key]) == 0 {
+			diff.Added = append(diff.Added, json.RawMessage(item.Raw))
+			continue
+		}
+
+		old := oldItems[key][0]
+		oldItems[key] = oldItems[key][1:]
+		matched[key]++
+		equal, err := EqualJSON(old.Raw, item.Raw)
+		if err != nil {
+			return diff, err
+		}
+		if !equal {
+			diff.Changed = append(diff.Changed, FieldDiff{Path: key, Old: json.RawMessage(old.Raw), New: json.RawMessage(item.Raw)})
+		}
+	}
+
+	// unmatched items are removed; keep their original order
+	for _, item := range oldList.Array() {
+		key, _ := itemKey(item, keys)
+		if matched[key] > 0 {
+			matched[key]--
+			continue
+		}
+		diff.Removed = append(diff.Removed, json.RawMessage(item.Raw))
+	}
+	return diff, nil
+}
+
+// itemKey returns the value of the first key that exists in a list item, or the normalised item if there is none.
+func itemKey(item gjson.Result, keys []string) (string, error) {
+	for _, key := range keys {
+		if value := item.Get(key); value.Exists() {
+			item = value
+			break
+		}
+	}
+	if item.Type == gjson.String {
+		return item.String(), nil
+	}
+	normalised, err := normalizeJSON(item.Raw)
+	return string(normalised), err
+}
+
+// EqualJSON checks that two (potentially nested) JSON values are equal. It normalises the values by unmarshalling
+// and marshalling them, so differences in formatting, key order or the notation of numbers don't count.
+// An empty string, which does not contain a JSON value, is only equal to another empty string.
+func EqualJSON(jsonA string, jsonB string) (bool, error) {
+	if jsonA == "" || jsonB == "" {
+		return jsonA == jsonB, nil
+	}
+
+	normalizedA, err := normalizeJSON(jsonA)
+	if err != nil {
+		return false, err
+	}
+	normalizedB, err := normalizeJSON(jsonB)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(normalizedA, normalizedB), nil
+}
+
+// normalizeJSON unmarshals and marshals a JSON value. The Marshal function sorts map keys so its output should be deterministic.
+// If there are duplicate keys in objects, performing json.Unmarshal into an interface{} will
+// only use the last value, which is also how the PostgreSQL jsonb type behaves.
+func normalizeJSON(raw string) ([]byte, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// ApplyFields copies the fields at the given paths from src to dst, removing them from dst if they don't exist in src.
+func ApplyFields(dst, src []byte, paths []string) (res []byte, err error) {
+	res = dst
+	for _, path := range paths {
+		value := gjson.GetBytes(src, path)
+		if value.Exists() {
+			res, err = sjson.SetRawBytes(res, path, []byte(value.Raw))
+		} else {
+			res, err = sjson.DeleteBytes(res, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// decodePath decodes the value at path into generic Go values, using json.Number to keep numbers intact.
+func decodePath(blob []byte, path string) (value interface{}, exists bool, err error) {
+	raw := string(blob)
+	if path != "" {
+		res := gjson.GetBytes(blob, path)
+		if !res.Exists() {
+			return nil, false, nil
+		}
+		raw = res.Raw
+	}
+
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// diffValues appends the differences between a and b to diffs, descending into objects that exist on both sides.
+func diffValues(diffs *[]FieldDiff, path string, a, b interface{}, hasA, hasB bool) error {
+	objA, isObjA := a.(map[string]interface{})
+	objB, isObjB := b.(map[string]interface{})
+	if isObjA && isObjB {
+		for key, valA := range objA {
+			valB, ok := objB[key]
+			if err := diffValues(diffs, joinPath(path, key), valA, valB, true, ok); err != nil {
+				return err
+			}
+		}
+		for key, valB := range objB {
+			if _, ok := objA[key]; !ok {
+				if err := diffValues(diffs, joinPath(path, key), nil, valB, false, true); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if hasA == hasB && reflect.DeepEqual(a, b) {
+		return nil
+	}
+
+	diff := FieldDiff{Path: path}
+	var err error
+	if hasA {
+		if diff.Old, err = json.Marshal(a); err != nil {
+			return err
+		}
+	}
+	if hasB {
+		if diff.New, err = json.Marshal(b); err != nil {
+			return err
+		}
+	}
+	*diffs = append(*diffs, diff)
+	return nil
+}
+
+// joinPath adds an object key to a gjson path, escaping characters that have a special meaning in paths.
+func joinPath(path, key string) string {
+	var buf bytes.Buffer
+	buf.WriteString(path)
+	if path != "" {
+		buf.WriteByte('.')
+	}
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '.', '*', '?', '\\':
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(key[i])
+	}
+	return buf.String()
+}
@@ -0,0 +1,127 @@
+package metax
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestDiffFields(t *testing.T) {
+	local := []byte(`{"identifier":"cr1","research_dataset":{"title":{"en":"Local","fi":"Sama"},"keyword":["a","b"],
+		"issued":"2019-01-01","a.b":1}}`)
+	upstream := []byte(`{"identifier":"cr1","research_dataset":{"title":{"fi":"Sama","en":"Upstream"},"keyword":["b","a"],
+		"modified":"2019-02-01","a.b":1.0}}`)
+
+	diffs, err := DiffFields(local, upstream, "research_dataset")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, diff := range diffs {
+		paths = append(paths, diff.Path)
+	}
+	expected := []string{
+		`research_dataset.a\.b`,
+		"research_dataset.issued",
+		"research_dataset.keyword",
+		"research_dataset.modified",
+		"research_dataset.title.en",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected paths %v, got %v", expected, paths)
+	}
+	if string(diffs[1].Old) != `"2019-01-01"` || diffs[1].New != nil {
+		t.Errorf("unexpected removed field: %s -> %s", diffs[1].Old, diffs[1].New)
+	}
+	if diffs[3].Old != nil || string(diffs[3].New) != `"2019-02-01"` {
+		t.Errorf("unexpected added field: %s -> %s", diffs[3].Old, diffs[3].New)
+	}
+
+	// take some fields from upstream
+	merged, err := ApplyFields(local, upstream, []string{expected[0], expected[1], expected[3], expected[4]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, value := range map[string]string{
+		`research_dataset.a\.b`:     `1.0`,
+		"research_dataset.title.en": `"Upstream"`,
+		"research_dataset.modified": `"2019-02-01"`,
+		"research_dataset.issued":   ``,
+		"research_dataset.keyword":  `["a","b"]`,
+	} {
+		if raw := gjson.GetBytes(merged, path).Raw; raw != value {
+			t.Errorf("%s: expected %s, got %s", path, value, raw)
+		}
+	}
+
+	// no differences
+	diffs, err = DiffFields(local, local, "")
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v, %v", diffs, err)
+	}
+}
+
+func TestDiffDatasets(t *testing.T) {
+	previous := []byte(`{"research_dataset":{"title":{"en":"Old"},"total_files_byte_size":10,
+		"files":[{"identifier":"f1","title":"One"},{"identifier":"f2","title":"Two"}],
+		"creator":[{"@type":"Person","name":"Jane"}],
+		"access_rights":{"license":[{"identifier":"CC-BY-4.0"}]},"keyword":["a","b"]}}`)
+	current := []byte(`{"research_dataset":{"title":{"en":"New"},"total_files_byte_size":10.0,
+		"files":[{"title":"Two (edited)","identifier":"f2"},{"identifier":"f3","title":"Three"}],
+		"creator":[{"name":"Jane","@type":"Person"},{"@type":"Person","name":"John"}],
+		"access_rights":{"license":[{"identifier":"CC0-1.0"}]},"keyword":["b","a"]}}`)
+
+	diff, err := DiffDatasets(previous, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diff.Fields) != 1 || diff.Fields[0].Path != "research_dataset.title.en" {
+		t.Errorf("expected only the title to change, got %+v", diff.Fields)
+	}
+
+	lists := make(map[string]ListDiff)
+	for _, list := range diff.Lists {
+		lists[list.Path] = list
+	}
+	if len(lists) != 3 {
+		t.Errorf("expected 3 changed lists, got %d", len(lists))
+	}
+	files := lists["research_dataset.files"]
+	if len(files.Added) != 1 || len(files.Removed) != 1 || len(files.Changed) != 1 || files.Changed[0].Path != "f2" {
+		t.Errorf("unexpected file changes: %+v", files)
+	}
+	if gjson.GetBytes(files.Removed[0], "identifier").String() != "f1" || gjson.GetBytes(files.Added[0], "identifier").String() != "f3" {
+		t.Errorf("unexpected added or removed files: %s, %s", files.Added, files.Removed)
+	}
+	if creators := lists["research_dataset.creator"]; len(creators.Added) != 1 || len(creators.Removed) != 0 || len(creators.Changed) != 0 {
+		t.Errorf("unexpected creator changes: %+v", creators)
+	}
+	if licenses := lists["research_dataset.access_rights.license"]; len(licenses.Added) != 1 || len(licenses.Removed) != 1 {
+		t.Errorf("unexpected licence changes: %+v", licenses)
+	}
+
+	// no differences
+	diff, err = DiffDatasets(previous, previous)
+	if err != nil || len(diff.Fields) != 0 || len(diff.Lists) != 0 {
+		t.Errorf("expected no differences, got %+v, %v", diff, err)
+	}
+}
+
+func TestEqualJSON(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{`{"a":1,"b":[1,2]}`, `{"b":[1,2.0],"a":1}`, true},
+		{`[1,2]`, `[2,1]`, false},
+		{``, ``, true},
+		{``, `null`, false},
+	} {
+		if equal, err := EqualJSON(test.a, test.b); err != nil || equal != test.equal {
+			t.Errorf("%s == %s: expected %t, got %t (%v)", test.a, test.b, test.equal, equal, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package metax
 import (
 	"encoding/json"
 	"errors"
+	"net/http"
 )
 
 var (
@@ -10,6 +11,26 @@ var (
 	ErrNotFound           = errors.New("not found")
 	ErrIdRequired         = errors.New("dataset without id and not allowed to create")
 	ErrInvalidId          = errors.New("invalid dataset id")
+
+	// ErrCircuitOpen is returned without calling the API while the circuit breaker considers Metax down.
+	ErrCircuitOpen = &ApiError{"metax is unavailable", nil, http.StatusServiceUnavailable}
+
+	// ErrProjectForbidden is returned when a file query involves a project the user is not a member of.
+	ErrProjectForbidden = &ApiError{"access denied: invalid project", nil, http.StatusForbidden}
+
+	// ErrDraftsNotSupported is returned for draft operations when the client doesn't use Metax API v2.
+	ErrDraftsNotSupported = &ApiError{"draft datasets require Metax API v2", nil, http.StatusNotImplemented}
+
+	// ErrVersioningNotSupported is returned for explicit versioning when the client doesn't use Metax API v2;
+	// API v1 only creates new versions implicitly when the files of a published dataset change.
+	ErrVersioningNotSupported = &ApiError{"creating new versions explicitly requires Metax API v2", nil, http.StatusNotImplemented}
+
+	// ErrNewVersionRequired is returned when storing a published dataset with other files than it has with API v2,
+	// which only changes the files of a published dataset in a new version created with CreateNewVersion.
+	ErrNewVersionRequired = &ApiError{"changing the files of a published dataset requires a new version", nil, http.StatusConflict}
+
+	// ErrAlreadyPublished is returned when trying to store a published dataset as draft.
+	ErrAlreadyPublished = &ApiError{"dataset has already been published", nil, http.StatusConflict}
 )
 
 // LinkingError is a custom error type that adds the missing field name.
@@ -43,6 +64,18 @@ func (e *LinkingError) IsNotMine() bool {
 	return e.field == ""
 }
 
+// CreatedError means a request failed after Metax created a new dataset for it. The caller should keep the Identifier
+// of the dataset, so that trying again updates it instead of creating another one; Draft tells if it's still a draft.
+type CreatedError struct {
+	Identifier string
+	Draft      bool
+	Err        error
+}
+
+func (e *CreatedError) Error() string {
+	return e.Err.Error()
+}
+
 type ApiError struct {
 	myError    string
 	metaxError json.RawMessage
@@ -0,0 +1,280 @@
+package metax
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CSCfi/qvain-api/pkg/models"
+)
+
+// File is a file record in the Metax files API.
+type File struct {
+	Identifier        string           `json:"identifier"`
+	FileName          string           `json:"file_name"`
+	FilePath          string           `json:"file_path"`
+	ProjectIdentifier string           `json:"project_identifier"`
+	ByteSize          int64            `json:"byte_size"`
+	FileFormat        string           `json:"file_format,omitempty"`
+	Checksum          *Checksum        `json:"checksum,omitempty"`
+	ParentDirectory   *DirectoryRef    `json:"parent_directory,omitempty"`
+	FileStorage       *json.RawMessage `json:"file_storage,omitempty"`
+	Removed           bool             `json:"removed,omitempty"`
+	DateCreated       *time.Time       `json:"date_created,omitempty"`
+	DateModified      *time.Time       `json:"date_modified,omitempty"`
+}
+
+// Checksum is the checksum of a file.
+type Checksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"value"`
+}
+
+// DirectoryRef refers to a directory from a file or subdirectory.
+type DirectoryRef struct {
+	Identifier string `json:"identifier"`
+}
+
+// Directory is a directory record in the Metax files API.
+// ByteSize and FileCount include the contents of subdirectories.
+type Directory struct {
+	Identifier        string        `json:"identifier"`
+	DirectoryName     string        `json:"directory_name"`
+	DirectoryPath     string        `json:"directory_path"`
+	ProjectIdentifier string        `json:"project_identifier"`
+	ByteSize          int64         `json:"byte_size"`
+	FileCount         int           `json:"file_count"`
+	ParentDirectory   *DirectoryRef `json:"parent_directory,omitempty"`
+	DateCreated       *time.Time    `json:"date_created,omitempty"`
+	DateModified      *time.Time    `json:"date_modified,omitempty"`
+}
+
+// FilesPage is a page of file records.
+type FilesPage struct {
+	Count    int     `json:"count"`
+	Next     string  `json:"next"`
+	Previous string  `json:"previous"`
+	Results  []*File `json:"results"`
+}
+
+// DirectoryContents holds the subdirectories and files directly within a directory.
+//
+// Count, Next and Previous are only set for paginated queries. Directory is the listed directory itself;
+// Metax only returns it for project root queries.
+type DirectoryContents struct {
+	Directory   *Directory
+	Count       int
+	Next        string
+	Previous    string
+	Directories []*Directory
+	Files       []*File
+}
+
+// directoryListing is the shape of the contents in a Metax directory response.
+type directoryListing struct {
+	Directories []*Directory `json:"directories"`
+	Files       []*File      `json:"files"`
+}
+
+// UnmarshalJSON decodes both plain and paginated directory responses.
+func (contents *DirectoryContents) UnmarshalJSON(data []byte) error {
+	var page struct {
+		directoryListing
+		Identifier string            `json:"identifier"`
+		Count      int               `json:"count"`
+		Next       string            `json:"next"`
+		Previous   string            `json:"previous"`
+		Results    *directoryListing `json:"results"`
+	}
+	if err := json.Unmarshal(data, &page); err != nil {
+		return err
+	}
+
+	*contents = DirectoryContents{
+		Count:       page.Count,
+		Next:        page.Next,
+		Previous:    page.Previous,
+		Directories: page.Directories,
+		Files:       page.Files,
+	}
+	if page.Results != nil {
+		contents.Directories = page.Results.Directories
+		contents.Files = page.Results.Files
+	}
+	if page.Identifier != "" {
+		contents.Directory = new(Directory)
+		if err := json.Unmarshal(data, contents.Directory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Summary returns the number of files and their total size in bytes, including the contents of subdirectories.
+func (contents *DirectoryContents) Summary() (files int, bytes int64) {
+	for _, dir := range contents.Directories {
+		files += dir.FileCount
+		bytes += dir.ByteSize
+	}
+	for _, file := range contents.Files {
+		files++
+		bytes += file.ByteSize
+	}
+	return
+}
+
+// FileOption is an option for file and directory queries.
+type FileOption func(*http.Request)
+
+// Paginate is a file option that requests a page of results starting at offset.
+func Paginate(offset, limit int) FileOption {
+	return func(req *http.Request) {
+		setQuery(req, "pagination", "true")
+		setQuery(req, "offset", strconv.Itoa(offset))
+		setQuery(req, "limit", strconv.Itoa(limit))
+	}
+}
+
+// InDataset is a file option that restricts directory queries to files belonging to the dataset with the given Metax identifier.
+func InDataset(identifier string) FileOption {
+	return func(req *http.Request) {
+		setQuery(req, "cr_identifier", identifier)
+	}
+}
+
+// setQuery sets a query parameter of a request.
+func setQuery(req *http.Request, key, value string) {
+	query := req.URL.Query()
+	query.Set(key, value)
+	req.URL.RawQuery = query.Encode()
+}
+
+// Files lists the files of a project. The user must be a member of the project.
+func (api *MetaxService) Files(ctx context.Context, user *models.User, project string, params ...FileOption) (*FilesPage, error) {
+	if !canAccessProject(user, project) {
+		return nil, ErrProjectForbidden
+	}
+
+	var page FilesPage
+	if err := api.getFilesApi(ctx, api.urlFiles+"?project_identifier="+url.QueryEscape(project), &page, params...); err != nil {
+		return nil, err
+	}
+	if err := checkProjects(user, nil, page.Results); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// File returns a single file. The user must be a member of the project the file belongs to.
+func (api *MetaxService) File(ctx context.Context, user *models.User, id string) (*File, error) {
+	if id == "" {
+		return nil, ErrInvalidId
+	}
+
+	var file File
+	if err := api.getFilesApi(ctx, api.urlFiles+url.PathEscape(id), &file); err != nil {
+		return nil, err
+	}
+	if err := checkProjects(user, nil, []*File{&file}); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// DirectoryFiles lists the subdirectories and files directly within a directory.
+// The user must be a member of the project the directory belongs to.
+func (api *MetaxService) DirectoryFiles(ctx context.Context, user *models.User, id string, params ...FileOption) (*DirectoryContents, error) {
+	if id == "" {
+		return nil, ErrInvalidId
+	}
+
+	var contents DirectoryContents
+	if err := api.getFilesApi(ctx, api.urlDirectories+url.PathEscape(id)+"/files", &contents, params...); err != nil {
+		return nil, err
+	}
+	if err := checkProjects(user, contents.Directories, contents.Files); err != nil {
+		return nil, err
+	}
+	return &contents, nil
+}
+
+// ProjectRoot returns the root directory of a project and its contents. The user must be a member of the project.
+func (api *MetaxService) ProjectRoot(ctx context.Context, user *models.User, project string, params ...FileOption) (*DirectoryContents, error) {
+	if !canAccessProject(user, project) {
+		return nil, ErrProjectForbidden
+	}
+
+	var contents DirectoryContents
+	if err := api.getFilesApi(ctx, api.urlDirectories+"root?project="+url.QueryEscape(project), &contents, params...); err != nil {
+		return nil, err
+	}
+	dirs := contents.Directories
+	if contents.Directory != nil {
+		dirs = append([]*Directory{contents.Directory}, dirs...)
+	}
+	if err := checkProjects(user, dirs, contents.Files); err != nil {
+		return nil, err
+	}
+	return &contents, nil
+}
+
+// getFilesApi makes a GET request to the files API and decodes the response into v.
+func (api *MetaxService) getFilesApi(ctx context.Context, endpoint string, v interface{}, params ...FileOption) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	api.writeApiHeaders(req)
+
+	for _, param := range params {
+		param(req)
+	}
+
+	res, err := api.do(ctx, req, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return &ApiError{"not found", nil, res.StatusCode}
+	case 403:
+		return &ApiError{"forbidden", nil, res.StatusCode}
+	default:
+		return &ApiError{"API returned error", nil, res.StatusCode}
+	}
+
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return ErrInvalidContentType
+	}
+
+	err = json.NewDecoder(res.Body).Decode(v)
+	api.drainBody(res.Body)
+	return err
+}
+
+// canAccessProject checks if the user is a member of the given project.
+func canAccessProject(user *models.User, project string) bool {
+	return user != nil && project != "" && user.HasProject(project)
+}
+
+// checkProjects makes sure all directories and files in a response belong to projects the user is a member of.
+func checkProjects(user *models.User, dirs []*Directory, files []*File) error {
+	for _, dir := range dirs {
+		if !canAccessProject(user, dir.ProjectIdentifier) {
+			return ErrProjectForbidden
+		}
+	}
+	for _, file := range files {
+		if !canAccessProject(user, file.ProjectIdentifier) {
+			return ErrProjectForbidden
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package metax
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CSCfi/qvain-api/pkg/models"
+)
+
+const (
+	testDirectoryFiles = `{"directories":[{"identifier":"dir2","directory_name":"sub","project_identifier":"project1","byte_size":300,"file_count":3}],
+		"files":[{"identifier":"file1","file_name":"a.txt","project_identifier":"project1","byte_size":100}]}`
+	testDirectoryFilesPaginated = `{"count":5,"next":"http://metax/rest/directories/dir1/files?offset=2","previous":null,
+		"results":{"directories":[],"files":[{"identifier":"file1","file_name":"a.txt","project_identifier":"project1","byte_size":100}]}}`
+	testProjectRoot = `{"identifier":"root1","directory_name":"/","directory_path":"/","project_identifier":"project1","byte_size":400,"file_count":4,
+		"directories":[{"identifier":"dir2","directory_name":"sub","project_identifier":"project1","byte_size":300,"file_count":3}],
+		"files":[{"identifier":"file1","file_name":"a.txt","project_identifier":"project1","byte_size":100}]}`
+	testOtherProjectFiles = `{"count":1,"results":[{"identifier":"file9","project_identifier":"project2"}]}`
+)
+
+func TestFiles(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/rest/directories/dir1/files" && r.URL.Query().Get("pagination") == "true":
+			w.Write([]byte(testDirectoryFilesPaginated))
+		case r.URL.Path == "/rest/directories/dir1/files":
+			w.Write([]byte(testDirectoryFiles))
+		case r.URL.Path == "/rest/directories/root":
+			w.Write([]byte(testProjectRoot))
+		case r.URL.Path == "/rest/files/":
+			w.Write([]byte(testOtherProjectFiles))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	api := newTestService(srv)
+	user := &models.User{Identity: "jdoe", Projects: []string{"project1"}}
+	ctx := context.Background()
+
+	contents, err := api.DirectoryFiles(ctx, user, "dir1", InDataset("cr1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents.Directories) != 1 || len(contents.Files) != 1 || contents.Directory != nil {
+		t.Errorf("unexpected directory contents: %+v", contents)
+	}
+	if files, bytes := contents.Summary(); files != 4 || bytes != 400 {
+		t.Errorf("expected summary of 4 files and 400 bytes, got %d files and %d bytes", files, bytes)
+	}
+	if query != "cr_identifier=cr1" {
+		t.Errorf("unexpected query: %s", query)
+	}
+
+	contents, err = api.DirectoryFiles(ctx, user, "dir1", Paginate(2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents.Count != 5 || contents.Next == "" || len(contents.Files) != 1 || contents.Files[0].Identifier != "file1" {
+		t.Errorf("unexpected paginated contents: %+v", contents)
+	}
+
+	contents, err = api.ProjectRoot(ctx, user, "project1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents.Directory == nil || contents.Directory.Identifier != "root1" || contents.Directory.FileCount != 4 {
+		t.Errorf("expected root directory, got %+v", contents.Directory)
+	}
+
+	if _, err := api.DirectoryFiles(ctx, user, "missing"); err == nil {
+		t.Error("expected error for missing directory")
+	} else if apiErr, ok := err.(*ApiError); !ok || apiErr.StatusCode() != http.StatusNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestFilesProjectAccess(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testOtherProjectFiles))
+	}))
+	defer srv.Close()
+
+	api := newTestService(srv)
+	ctx := context.Background()
+
+	// projects the user is not a member of are refused without calling the API
+	for _, user := range []*models.User{nil, {Identity: "jdoe"}, {Identity: "jdoe", Projects: []string{"project1"}}} {
+		if _, err := api.Files(ctx, user, "project2"); err != ErrProjectForbidden {
+			t.Errorf("expected %v, got %v", ErrProjectForbidden, err)
+		}
+		if _, err := api.ProjectRoot(ctx, user, "project2"); err != ErrProjectForbidden {
+			t.Errorf("expected %v, got %v", ErrProjectForbidden, err)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("expected no calls to the API, got %d", calls)
+	}
+
+	// responses with files from other projects are refused
+	if _, err := api.Files(ctx, &models.User{Identity: "jdoe", Projects: []string{"project1"}}, "project1"); err != ErrProjectForbidden {
+		t.Errorf("expected %v, got %v", ErrProjectForbidden, err)
+	}
+}
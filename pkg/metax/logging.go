@@ -0,0 +1,104 @@
+package metax
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// RequestIdHeader carries the id of each request to Metax, so log entries on both sides can be correlated.
+	RequestIdHeader = "X-Request-Id"
+
+	// maxLoggedBody limits how many bytes of a (redacted) body are logged at debug level.
+	maxLoggedBody = 2048
+
+	// redacted replaces sensitive values in logged bodies.
+	redacted = "[redacted]"
+)
+
+// redactedKeys are JSON object keys whose values are personal information or credentials and must not be logged.
+var redactedKeys = map[string]bool{
+	"name":                   true,
+	"email":                  true,
+	"telephone":              true,
+	"phone":                  true,
+	"user_created":           true,
+	"user_modified":          true,
+	"metadata_provider_user": true,
+	"metadata_owner_org":     true,
+	"access_granter":         true,
+	"owner_id":               true,
+	"creator_id":             true,
+	"password":               true,
+	"token":                  true,
+}
+
+// Logger returns the logger of the Metax client, so callers can log related events consistently.
+func (api *MetaxService) Logger() *zerolog.Logger {
+	return &api.logger
+}
+
+// setRequestId adds a new request id to a request, unless it already has one, and returns it.
+func setRequestId(req *http.Request) string {
+	if id := req.Header.Get(RequestIdHeader); id != "" {
+		return id
+	}
+	id := xid.New().String()
+	req.Header.Set(RequestIdHeader, id)
+	return id
+}
+
+// logBody logs a request or response body at debug level, with personal information redacted and the size limited.
+func (api *MetaxService) logBody(req *http.Request, dataset string, what string, body []byte) {
+	if len(body) < 1 {
+		return
+	}
+	if ev := api.logger.Debug(); ev.Enabled() {
+		ev.Str("request_id", req.Header.Get(RequestIdHeader)).
+			Str("dataset", dataset).
+			Int("size", len(body)).
+			Str("body", redactBody(body)).
+			Msg("metax " + what + " body")
+	}
+}
+
+// redactBody returns a JSON body with sensitive values replaced, truncated to maxLoggedBody bytes.
+// Bodies that are not valid JSON are not logged at all.
+func redactBody(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return "[not json]"
+	}
+
+	out, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return "[unserialisable]"
+	}
+	if len(out) > maxLoggedBody {
+		return string(out[:maxLoggedBody]) + "..."
+	}
+	return string(out)
+}
+
+// redactValue walks decoded JSON and replaces the values of sensitive keys.
+func redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for key, val := range t {
+			if redactedKeys[strings.ToLower(key)] {
+				t[key] = redacted
+				continue
+			}
+			t[key] = redactValue(val)
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redactValue(t[i])
+		}
+	}
+	return v
+}
@@ -0,0 +1,101 @@
+package metax
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/rs/zerolog"
+)
+
+func TestRedactBody(t *testing.T) {
+	var tests = []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "nested",
+			body:     `{"identifier":"abc","research_dataset":{"creator":[{"name":"John Doe","email":"jdoe@example.com","@type":"Person"}]}}`,
+			expected: `{"identifier":"abc","research_dataset":{"creator":[{"@type":"Person","email":"[redacted]","name":"[redacted]"}]}}`,
+		},
+		{
+			name:     "user fields",
+			body:     `{"metadata_provider_user":"jdoe","User_Created":"jdoe","title":"x"}`,
+			expected: `{"User_Created":"[redacted]","metadata_provider_user":"[redacted]","title":"x"}`,
+		},
+		{
+			name:     "not json",
+			body:     `name=John`,
+			expected: `[not json]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if redacted := redactBody([]byte(test.body)); redacted != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, redacted)
+			}
+		})
+	}
+
+	long := `["` + strings.Repeat("x", 2*maxLoggedBody) + `"]`
+	if redacted := redactBody([]byte(long)); len(redacted) != maxLoggedBody+3 {
+		t.Errorf("expected body truncated to %d bytes, got %d", maxLoggedBody+3, len(redacted))
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	var calls int32
+	var requestId string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId = r.Header.Get(RequestIdHeader)
+		flakyHandler(0, 0, &calls)(w, r)
+	}))
+	defer srv.Close()
+
+	for _, level := range []zerolog.Level{zerolog.InfoLevel, zerolog.DebugLevel} {
+		var buf bytes.Buffer
+		api := newTestService(srv, WithLogger(zerolog.New(&buf).Level(level)))
+
+		if _, err := api.Store(context.Background(), json.RawMessage(`{"identifier":"abc","research_dataset":{"creator":[{"name":"John Doe"}]}}`), &models.User{}); err != nil {
+			t.Fatal(err)
+		}
+		if requestId == "" {
+			t.Fatal("no request id header in request")
+		}
+		if strings.Contains(buf.String(), "John Doe") {
+			t.Errorf("%s: personal information in log: %s", level, buf.String())
+		}
+
+		var found bool
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var event map[string]interface{}
+			if err := dec.Decode(&event); err != nil {
+				t.Fatal(err)
+			}
+			if _, hasBody := event["body"]; hasBody && level != zerolog.DebugLevel {
+				t.Errorf("%s: body logged: %v", level, event)
+			}
+			if event["message"] != "metax request" {
+				continue
+			}
+			found = true
+			if event["request_id"] != requestId || event["dataset"] != "abc" || event["status"] != float64(200) {
+				t.Errorf("%s: unexpected request event: %v", level, event)
+			}
+			if _, ok := event["latency"]; !ok {
+				t.Errorf("%s: no latency in request event", level)
+			}
+		}
+		if found != (level == zerolog.DebugLevel) {
+			t.Errorf("%s: expected request event: %v, got: %v", level, level == zerolog.DebugLevel, found)
+		}
+	}
+}
@@ -0,0 +1,791 @@
+// Package metaxtest provides an in-memory fake of the Metax v1 dataset API for tests and local development.
+//
+// The fake implements the dataset endpoints used by Qvain – listing with filters, pagination and streaming, CRUD with soft deletion,
+// and new versions when files change – as well as the cumulative state, directory refresh and fix deprecated RPCs.
+// It doesn't check credentials or project membership.
+package metaxtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CSCfi/qvain-api/pkg/metax"
+)
+
+const (
+	// DefaultPageSize is the number of datasets in a paginated response if no limit is given.
+	DefaultPageSize = 10
+
+	// IdentifierPrefix is prepended to generated dataset identifiers.
+	IdentifierPrefix = "urn:nbn:fi:att:fake-"
+)
+
+// dataset is a Metax dataset as generic JSON object.
+type dataset map[string]interface{}
+
+// Server is a fake Metax API server.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	datasets map[string]dataset
+	order    []string
+	dirs     map[string][]string
+	linked   map[string]map[string]bool
+	missing  map[string][]string
+	seq      int
+
+	// Now returns the time used for creation and modification dates; it can be replaced before the server is used.
+	Now func() time.Time
+}
+
+// NewServer starts a fake Metax server; call Close() when done.
+func NewServer() *Server {
+	srv := &Server{
+		datasets: make(map[string]dataset),
+		dirs:     make(map[string][]string),
+		linked:   make(map[string]map[string]bool),
+		missing:  make(map[string][]string),
+		Now:      time.Now,
+	}
+	srv.Server = httptest.NewServer(srv)
+	return srv
+}
+
+// Host returns the host and port of the server, as expected by metax.NewMetaxService().
+func (srv *Server) Host() string {
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// Options returns the client options needed to talk to the fake server.
+func (srv *Server) Options() []metax.MetaxOption {
+	return []metax.MetaxOption{metax.DisableHttps}
+}
+
+// Client returns a Metax client for the fake server.
+func (srv *Server) Client(params ...metax.MetaxOption) *metax.MetaxService {
+	return metax.NewMetaxService(srv.Host(), append(srv.Options(), params...)...)
+}
+
+// Add stores a dataset as if it were created through the API and returns the stored dataset.
+// Datasets with an identifier keep it; this allows seeding the server with existing datasets.
+func (srv *Server) Add(blob []byte) (json.RawMessage, error) {
+	ds, err := decode(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return json.Marshal(srv.create(ds))
+}
+
+// Load adds the datasets in a JSON array, e.g. from a seed file.
+func (srv *Server) Load(r io.Reader) error {
+	var blobs []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&blobs); err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if _, err := srv.Add(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns a stored dataset, including removed ones, or nil if it doesn't exist.
+func (srv *Server) Get(id string) json.RawMessage {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	ds, ok := srv.datasets[id]
+	if !ok {
+		return nil
+	}
+	blob, _ := json.Marshal(ds)
+	return blob
+}
+
+// Len returns the number of stored datasets, including removed ones and old versions.
+func (srv *Server) Len() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.datasets)
+}
+
+// SetDirectory sets the files in a directory, used when refreshing directory contents.
+func (srv *Server) SetDirectory(dir string, files ...string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.dirs[dir] = files
+}
+
+// Deprecate marks a dataset deprecated as if the given files had been removed from IDA.
+func (srv *Server) Deprecate(id string, removedFiles ...string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	ds, ok := srv.datasets[id]
+	if !ok {
+		return fmt.Errorf("dataset %s not found", id)
+	}
+	now := srv.timestamp()
+	ds[metax.DeprecatedKey] = true
+	ds[metax.DateDeprecatedKey] = now
+	ds[metax.DateModifiedKey] = now
+	srv.missing[id] = append(srv.missing[id], removedFiles...)
+	return nil
+}
+
+// Files returns the identifiers of the files linked to a dataset, both listed ones and those added by refreshing directories.
+func (srv *Server) Files(id string) []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	ds, ok := srv.datasets[id]
+	if !ok {
+		return nil
+	}
+	files := make([]string, 0)
+	for file := range srv.linkedFiles(id, ds) {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// ServeHTTP routes API requests.
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == strings.TrimSuffix(metax.DatasetsEndpoint, "/"):
+		switch r.Method {
+		case http.MethodGet:
+			srv.list(w, r)
+		case http.MethodPost:
+			srv.post(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case strings.HasPrefix(path, metax.DatasetsEndpoint):
+		id := strings.TrimPrefix(path, metax.DatasetsEndpoint)
+		switch r.Method {
+		case http.MethodGet:
+			srv.get(w, r, id)
+		case http.MethodPut:
+			srv.put(w, r, id)
+		case http.MethodDelete:
+			srv.delete(w, r, id)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case path == metax.ChangeCumulativeStateEndpoint && r.Method == http.MethodPost:
+		srv.changeCumulativeState(w, r)
+	case path == metax.RefreshDirectoryContentEndpoint && r.Method == http.MethodPost:
+		srv.refreshDirectoryContent(w, r)
+	case path == metax.FixDeprecatedEndpoint && r.Method == http.MethodPost:
+		srv.fixDeprecated(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// list returns the datasets matching the query, either paginated or streamed as JSON array.
+func (srv *Server) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	removed := query.Get("removed") == "true"
+	owner := query.Get("owner_id")
+	user := query.Get("metadata_provider_user")
+	org := query.Get("metadata_provider_org")
+
+	var since time.Time
+	if header := r.Header.Get("If-Modified-Since"); header != "" {
+		var err error
+		if since, err = http.ParseTime(header); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid If-Modified-Since header")
+			return
+		}
+	}
+
+	results := make([]dataset, 0)
+	for _, id := range srv.order {
+		ds := srv.datasets[id]
+		if ds.flag("removed") != removed {
+			continue
+		}
+		if owner != "" && ds.editor("owner_id") != owner {
+			continue
+		}
+		if user != "" && ds.str("metadata_provider_user") != user {
+			continue
+		}
+		if org != "" && ds.str("metadata_provider_org") != org {
+			continue
+		}
+		if !since.IsZero() && !ds.modified().After(since) {
+			continue
+		}
+		results = append(results, ds)
+	}
+
+	if query.Get("stream") == "true" && query.Get("no_pagination") == "true" {
+		srv.stream(w, results)
+		return
+	}
+
+	limit, offset := DefaultPageSize, 0
+	if n, err := strconv.Atoi(query.Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if n, err := strconv.Atoi(query.Get("offset")); err == nil && n > 0 {
+		offset = n
+	}
+
+	page := struct {
+		Count    int       `json:"count"`
+		Next     *string   `json:"next"`
+		Previous *string   `json:"previous"`
+		Results  []dataset `json:"results"`
+	}{Count: len(results), Results: make([]dataset, 0)}
+
+	if offset < len(results) {
+		end := offset + limit
+		if end > len(results) {
+			end = len(results)
+		}
+		page.Results = results[offset:end]
+	}
+	if offset+limit < len(results) {
+		page.Next = pageUrl(srv.URL, r.URL, offset+limit, limit)
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		page.Previous = pageUrl(srv.URL, r.URL, prev, limit)
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// stream writes datasets as JSON array, flushing after each dataset.
+func (srv *Server) stream(w http.ResponseWriter, results []dataset) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Count", strconv.Itoa(len(results)))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	io.WriteString(w, "[")
+	for i, ds := range results {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		enc.Encode(ds)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	io.WriteString(w, "]")
+}
+
+// get returns a single dataset; removed datasets are only returned with the removed parameter.
+func (srv *Server) get(w http.ResponseWriter, r *http.Request, id string) {
+	ds, ok := srv.datasets[id]
+	if !ok || ds.flag("removed") != (r.URL.Query().Get("removed") == "true") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, ds)
+}
+
+// post creates a new dataset.
+func (srv *Server) post(w http.ResponseWriter, r *http.Request) {
+	ds, ok := readDataset(w, r)
+	if !ok {
+		return
+	}
+	delete(ds, "identifier")
+	writeJSON(w, http.StatusCreated, srv.create(ds))
+}
+
+// put updates a dataset; changing the files of a published, non-cumulative dataset creates a new version.
+func (srv *Server) put(w http.ResponseWriter, r *http.Request, id string) {
+	old, ok := srv.datasets[id]
+	if !ok || old.flag("removed") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	ds, ok := readDataset(w, r)
+	if !ok {
+		return
+	}
+
+	added, removed := diff(fileIds(old), fileIds(ds))
+	if len(added) == 0 && len(removed) == 0 {
+		writeJSON(w, http.StatusOK, srv.update(id, ds))
+		return
+	}
+	if _, hasNext := old["next_dataset_version"]; hasNext {
+		writeError(w, http.StatusBadRequest, "Changing files in old dataset versions is not permitted.")
+		return
+	}
+	if old.cumulativeState() == 1 && len(removed) == 0 {
+		writeJSON(w, http.StatusOK, srv.update(id, ds))
+		return
+	}
+
+	newDs := srv.newVersion(id, ds)
+	writeJSON(w, http.StatusOK, srv.withNewVersion(id, newDs))
+}
+
+// delete marks a dataset as removed.
+func (srv *Server) delete(w http.ResponseWriter, r *http.Request, id string) {
+	ds, ok := srv.datasets[id]
+	if !ok || ds.flag("removed") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	now := srv.timestamp()
+	ds["removed"] = true
+	ds[metax.DateRemovedKey] = now
+	ds[metax.DateModifiedKey] = now
+	srv.updateVersionSet(ds)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changeCumulativeState changes the cumulative state of a dataset.
+// Closing a cumulative dataset (1 → 2) is done in place; other changes create a new version if the dataset has files.
+// Non-cumulative datasets can't be closed.
+func (srv *Server) changeCumulativeState(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("identifier")
+	state, err := strconv.Atoi(r.URL.Query().Get("cumulative_state"))
+	if err != nil || state < 0 || state > 2 {
+		writeError(w, http.StatusBadRequest, "invalid cumulative_state")
+		return
+	}
+	ds, ok := srv.datasets[id]
+	if !ok || ds.flag("removed") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	current := ds.cumulativeState()
+	switch {
+	case state == current:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case current == 0 && state == 2:
+		writeError(w, http.StatusBadRequest, "can't close a non-cumulative dataset")
+		return
+	case current == 1 && state == 2, len(srv.linkedFiles(id, ds)) == 0:
+		ds["cumulative_state"] = state
+		if state == 2 {
+			ds["date_cumulation_ended"] = srv.timestamp()
+		}
+		ds[metax.DateModifiedKey] = srv.timestamp()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	content := ds.copy()
+	content["cumulative_state"] = state
+	newDs := srv.newVersion(id, content)
+	writeJSON(w, http.StatusOK, srv.withNewVersion(id, newDs))
+}
+
+// refreshDirectoryContent adds the files in a directory of the dataset that are not yet linked to it.
+// Cumulative datasets are updated in place, others get a new version with the files.
+func (srv *Server) refreshDirectoryContent(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("cr_identifier")
+	dir := r.URL.Query().Get("dir_identifier")
+	ds, ok := srv.datasets[id]
+	if !ok || ds.flag("removed") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !fileIds(ds)[dir] {
+		writeError(w, http.StatusBadRequest, "directory is not part of the dataset")
+		return
+	}
+
+	linked := srv.linkedFiles(id, ds)
+	var added []string
+	for _, file := range srv.dirs[dir] {
+		if !linked[file] {
+			added = append(added, file)
+		}
+	}
+	if len(added) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	target := id
+	var newDs dataset
+	if ds.cumulativeState() != 1 {
+		newDs = srv.newVersion(id, ds.copy())
+		target = newDs.str("identifier")
+		for file := range linked {
+			srv.link(target, file)
+		}
+	} else {
+		ds[metax.DateModifiedKey] = srv.timestamp()
+	}
+	for _, file := range added {
+		srv.link(target, file)
+	}
+
+	if newDs == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, srv.withNewVersion(id, newDs))
+}
+
+// fixDeprecated creates a new version of a deprecated dataset without the removed files.
+func (srv *Server) fixDeprecated(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("identifier")
+	ds, ok := srv.datasets[id]
+	if !ok || ds.flag("removed") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !ds.flag(metax.DeprecatedKey) {
+		writeError(w, http.StatusBadRequest, "Requested dataset is not deprecated")
+		return
+	}
+
+	missing := make(map[string]bool)
+	for _, file := range srv.missing[id] {
+		missing[file] = true
+	}
+
+	content := ds.copy()
+	rd := content.obj("research_dataset")
+	files := make([]interface{}, 0)
+	for _, file := range list(rd["files"]) {
+		if !missing[dataset(file).str("identifier")] {
+			files = append(files, file)
+		}
+	}
+	rd["files"] = files
+	content["research_dataset"] = rd
+	content[metax.DeprecatedKey] = false
+	delete(content, metax.DateDeprecatedKey)
+
+	newDs := srv.newVersion(id, content)
+	writeJSON(w, http.StatusOK, srv.withNewVersion(id, newDs))
+}
+
+// create stores a new dataset, generating its identifiers unless it already has one.
+func (srv *Server) create(ds dataset) dataset {
+	id := ds.str("identifier")
+	if id == "" {
+		id = srv.nextId()
+		ds["identifier"] = id
+	}
+	rd := ds.obj("research_dataset")
+	if _, ok := rd["preferred_identifier"]; !ok {
+		rd["preferred_identifier"] = id
+	}
+	rd["metadata_version_identifier"] = srv.nextId()
+	ds["research_dataset"] = rd
+
+	setDefault(ds, metax.DateCreatedKey, srv.timestamp())
+	setDefault(ds, "removed", false)
+	setDefault(ds, "deprecated", false)
+	setDefault(ds, "cumulative_state", 0)
+	setDefault(ds, "preservation_state", 0)
+	setDefault(ds, "state", "published")
+
+	if _, exists := srv.datasets[id]; !exists {
+		srv.order = append(srv.order, id)
+	}
+	srv.datasets[id] = ds
+	srv.updateVersionSet(ds)
+	return ds
+}
+
+// update replaces the content of a dataset, keeping the fields only Metax can set.
+func (srv *Server) update(id string, ds dataset) dataset {
+	old := srv.datasets[id]
+	for _, key := range []string{"identifier", "date_created", "removed", "deprecated", "cumulative_state", "preservation_state", "state",
+		"dataset_version_set", "next_dataset_version", "previous_dataset_version"} {
+		if value, ok := old[key]; ok {
+			ds[key] = value
+		} else {
+			delete(ds, key)
+		}
+	}
+	rd := ds.obj("research_dataset")
+	rd["preferred_identifier"] = old.obj("research_dataset")["preferred_identifier"]
+	rd["metadata_version_identifier"] = srv.nextId()
+	ds["research_dataset"] = rd
+	ds[metax.DateModifiedKey] = srv.timestamp()
+
+	srv.datasets[id] = ds
+	return ds
+}
+
+// newVersion creates a new version of a dataset with the given content and links the versions.
+func (srv *Server) newVersion(id string, content dataset) dataset {
+	old := srv.datasets[id]
+
+	ds := content.copy()
+	for _, key := range []string{"identifier", "date_created", "date_modified", "next_dataset_version", "new_version_created", "dataset_version_set"} {
+		delete(ds, key)
+	}
+	rd := ds.obj("research_dataset")
+	delete(rd, "preferred_identifier")
+	ds["research_dataset"] = rd
+	ds["previous_dataset_version"] = versionRef(old)
+	if _, ok := ds["cumulative_state"]; !ok {
+		ds["cumulative_state"] = old.cumulativeState()
+	}
+	srv.create(ds)
+
+	old["next_dataset_version"] = versionRef(ds)
+	old[metax.DateModifiedKey] = srv.timestamp()
+	srv.updateVersionSet(ds)
+	return ds
+}
+
+// withNewVersion returns a copy of a dataset with the new_version_created key, like Metax does when an update creates a new version.
+func (srv *Server) withNewVersion(id string, newDs dataset) dataset {
+	res := srv.datasets[id].copy()
+	ref := versionRef(newDs)
+	ref["version_type"] = "dataset"
+	res["new_version_created"] = ref
+	return res
+}
+
+// updateVersionSet sets the same dataset_version_set on all versions of a dataset.
+func (srv *Server) updateVersionSet(ds dataset) {
+	// find the first version
+	for {
+		prev, ok := ds["previous_dataset_version"].(map[string]interface{})
+		if !ok {
+			break
+		}
+		first, ok := srv.datasets[dataset(prev).str("identifier")]
+		if !ok {
+			break
+		}
+		ds = first
+	}
+
+	var versions []dataset
+	for ds != nil {
+		versions = append(versions, ds)
+		next, ok := ds["next_dataset_version"].(map[string]interface{})
+		if !ok {
+			break
+		}
+		ds = srv.datasets[dataset(next).str("identifier")]
+	}
+
+	// newest first, like Metax
+	set := make([]interface{}, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		ref := versionRef(versions[i])
+		ref["removed"] = versions[i].flag("removed")
+		ref["date_created"] = versions[i][metax.DateCreatedKey]
+		set = append(set, ref)
+	}
+	for _, version := range versions {
+		version["dataset_version_set"] = set
+	}
+}
+
+// linkedFiles returns the files and directories in the dataset and the files added by refreshing directories.
+func (srv *Server) linkedFiles(id string, ds dataset) map[string]bool {
+	files := make(map[string]bool)
+	for _, file := range list(ds.obj("research_dataset")["files"]) {
+		if id := dataset(file).str("identifier"); id != "" {
+			files[id] = true
+		}
+	}
+	for file := range srv.linked[id] {
+		files[file] = true
+	}
+	return files
+}
+
+// link adds a file to a dataset.
+func (srv *Server) link(id, file string) {
+	if srv.linked[id] == nil {
+		srv.linked[id] = make(map[string]bool)
+	}
+	srv.linked[id][file] = true
+}
+
+func (srv *Server) nextId() string {
+	srv.seq++
+	return IdentifierPrefix + strconv.Itoa(srv.seq)
+}
+
+func (srv *Server) timestamp() string {
+	return srv.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// readDataset decodes the request body, writing an error response if it's not a dataset.
+func readDataset(w http.ResponseWriter, r *http.Request) (dataset, bool) {
+	var ds dataset
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&ds); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return nil, false
+	}
+	if _, ok := ds["research_dataset"].(map[string]interface{}); !ok {
+		writeJSON(w, http.StatusBadRequest, map[string][]string{"research_dataset": {"This field is required."}})
+		return nil, false
+	}
+	return ds, true
+}
+
+func decode(blob []byte) (dataset, error) {
+	var ds dataset
+	dec := json.NewDecoder(strings.NewReader(string(blob)))
+	dec.UseNumber()
+	if err := dec.Decode(&ds); err != nil {
+		return nil, err
+	}
+	if _, ok := ds["research_dataset"].(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("dataset has no research_dataset")
+	}
+	return ds, nil
+}
+
+// fileIds returns the identifiers of the files and directories listed in the research dataset.
+func fileIds(ds dataset) map[string]bool {
+	ids := make(map[string]bool)
+	rd := ds.obj("research_dataset")
+	for _, key := range []string{"files", "directories"} {
+		for _, obj := range list(rd[key]) {
+			if id := dataset(obj).str("identifier"); id != "" {
+				ids[id] = true
+			}
+		}
+	}
+	return ids
+}
+
+func diff(old, new map[string]bool) (added, removed []string) {
+	for id := range new {
+		if !old[id] {
+			added = append(added, id)
+		}
+	}
+	for id := range old {
+		if !new[id] {
+			removed = append(removed, id)
+		}
+	}
+	return
+}
+
+// versionRef returns a reference to a dataset version as plain map, like decoded JSON.
+func versionRef(ds dataset) map[string]interface{} {
+	return map[string]interface{}{
+		"identifier":           ds["identifier"],
+		"preferred_identifier": ds.obj("research_dataset")["preferred_identifier"],
+	}
+}
+
+func list(v interface{}) []map[string]interface{} {
+	arr, _ := v.([]interface{})
+	objs := make([]map[string]interface{}, 0, len(arr))
+	for _, item := range arr {
+		if obj, ok := item.(map[string]interface{}); ok {
+			objs = append(objs, obj)
+		}
+	}
+	return objs
+}
+
+func setDefault(ds dataset, key string, value interface{}) {
+	if _, ok := ds[key]; !ok {
+		ds[key] = value
+	}
+}
+
+func (ds dataset) str(key string) string {
+	s, _ := ds[key].(string)
+	return s
+}
+
+func (ds dataset) flag(key string) bool {
+	b, _ := ds[key].(bool)
+	return b
+}
+
+func (ds dataset) obj(key string) map[string]interface{} {
+	obj, ok := ds[key].(map[string]interface{})
+	if !ok {
+		return make(map[string]interface{})
+	}
+	return obj
+}
+
+func (ds dataset) editor(key string) string {
+	return dataset(ds.obj("editor")).str(key)
+}
+
+func (ds dataset) cumulativeState() int {
+	switch state := ds["cumulative_state"].(type) {
+	case int:
+		return state
+	case json.Number:
+		n, _ := state.Int64()
+		return int(n)
+	case float64:
+		return int(state)
+	}
+	return 0
+}
+
+func (ds dataset) modified() time.Time {
+	blob, _ := json.Marshal(ds)
+	return metax.GetModificationDate(blob)
+}
+
+// copy makes a deep copy of a dataset.
+func (ds dataset) copy() dataset {
+	blob, _ := json.Marshal(ds)
+	cp, _ := decode(blob)
+	return cp
+}
+
+func pageUrl(base string, u *url.URL, offset, limit int) *string {
+	query := u.Query()
+	query.Set("offset", strconv.Itoa(offset))
+	query.Set("limit", strconv.Itoa(limit))
+	s := base + u.Path + "?" + query.Encode()
+	return &s
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string][]string{"detail": {msg}})
+}
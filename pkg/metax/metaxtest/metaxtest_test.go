@@ -0,0 +1,305 @@
+package metaxtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/CSCfi/qvain-api/pkg/metax"
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	testOwner   = "053bffbcc41edad4853bea91fc42ea18"
+	testDataset = `{"metadata_provider_user":"jdoe","editor":{"identifier":"qvain","owner_id":"` + testOwner + `"},
+		"research_dataset":{"title":{"en":"Test"},"files":[{"identifier":"file1"}],"directories":[{"identifier":"dir1"}]}}`
+)
+
+var testUser = &models.User{Identity: "jdoe"}
+
+func TestDatasets(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	api := srv.Client()
+	ctx := context.Background()
+
+	created, err := api.Store(ctx, json.RawMessage(testDataset), testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := metax.GetIdentifier(created)
+	if id == "" || metax.GetModificationDate(created).IsZero() {
+		t.Fatalf("created dataset lacks identifier or dates: %s", created)
+	}
+
+	// update without file changes
+	updated, _ := sjson.SetBytes(created, "research_dataset.title.en", "Updated")
+	res, err := api.Store(ctx, updated, testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metax.CreatedNewVersion(res) || gjson.GetBytes(res, "research_dataset.title.en").String() != "Updated" {
+		t.Errorf("unexpected update response: %s", res)
+	}
+
+	// another dataset by someone else
+	if _, err := srv.Add([]byte(`{"metadata_provider_user":"other","metadata_provider_org":"csc.fi","research_dataset":{"title":{"en":"Other"}}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// filters
+	for _, test := range []struct {
+		params   []metax.DatasetOption
+		expected int
+	}{
+		{params: nil, expected: 2},
+		{params: []metax.DatasetOption{metax.WithOwner(testOwner)}, expected: 1},
+		{params: []metax.DatasetOption{metax.WithUser("other")}, expected: 1},
+		{params: []metax.DatasetOption{metax.WithUser("nobody")}, expected: 0},
+		{params: []metax.DatasetOption{metax.WithOrganisation("csc.fi")}, expected: 1},
+		{params: []metax.DatasetOption{metax.Since(time.Now().Add(time.Hour))}, expected: 0},
+	} {
+		page, err := api.Datasets(ctx, test.params...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Count != test.expected || len(page.Results) != test.expected {
+			t.Errorf("expected %d datasets, got %d", test.expected, page.Count)
+		}
+	}
+
+	// removal
+	if err := api.Delete(ctx, created); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.GetId(ctx, id); err == nil {
+		t.Error("expected removed dataset not to be found")
+	}
+	removed, err := api.GetIdRemoved(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gjson.GetBytes(removed, "removed").Bool() {
+		t.Errorf("dataset not marked as removed: %s", removed)
+	}
+	page, err := api.Datasets(ctx, metax.WithRemoved())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Count != 1 {
+		t.Errorf("expected 1 removed dataset, got %d", page.Count)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	for i := 0; i < DefaultPageSize+5; i++ {
+		if _, err := srv.Add([]byte(testDataset)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api := srv.Client()
+	page, err := api.Datasets(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Count != DefaultPageSize+5 || len(page.Results) != DefaultPageSize || page.Next == "" || page.Previous != "" {
+		t.Errorf("unexpected first page: count %d, results %d, next %q, previous %q", page.Count, len(page.Results), page.Next, page.Previous)
+	}
+
+	count, records, errc, err := api.ReadStreamChannel(context.Background(), metax.WithOwner(testOwner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := 0
+Loop:
+	for {
+		select {
+		case _, more := <-records:
+			if !more {
+				break Loop
+			}
+			read++
+		case err := <-errc:
+			t.Fatal(err)
+		}
+	}
+	if count != DefaultPageSize+5 || read != count {
+		t.Errorf("expected %d streamed datasets, got count %d and %d records", DefaultPageSize+5, count, read)
+	}
+
+	read = 0
+	count, err = api.StreamDatasets(context.Background(), func(*metax.MetaxRawRecord) error {
+		read++
+		return nil
+	}, metax.WithOwner(testOwner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != DefaultPageSize+5 || read != count {
+		t.Errorf("expected %d streamed datasets, got count %d and %d records", DefaultPageSize+5, count, read)
+	}
+
+	// stop reading early
+	stop := errors.New("stop")
+	read = 0
+	_, err = api.StreamDatasets(context.Background(), func(*metax.MetaxRawRecord) error {
+		read++
+		if read == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || read != 3 {
+		t.Errorf("expected stream to stop after 3 datasets, got %d and error %v", read, err)
+	}
+}
+
+func TestNewVersion(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	api := srv.Client()
+	ctx := context.Background()
+
+	created, err := api.Store(ctx, json.RawMessage(testDataset), testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := metax.GetIdentifier(created)
+
+	// changing files creates a new version
+	changed, _ := sjson.SetRawBytes(created, "research_dataset.files", []byte(`[{"identifier":"file2"}]`))
+	res, err := api.Store(ctx, changed, testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newId := metax.MaybeNewVersionId(res)
+	if newId == "" || newId == id {
+		t.Fatalf("expected new version, got: %s", res)
+	}
+
+	newVersion, err := api.GetId(ctx, newId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gjson.GetBytes(newVersion, "previous_dataset_version.identifier").String() != id {
+		t.Errorf("new version not linked to previous: %s", newVersion)
+	}
+	if gjson.GetBytes(newVersion, "research_dataset.files.0.identifier").String() != "file2" {
+		t.Errorf("new version doesn't have the new files: %s", newVersion)
+	}
+	if n := gjson.GetBytes(newVersion, "dataset_version_set.#").Int(); n != 2 {
+		t.Errorf("expected 2 versions in version set, got %d", n)
+	}
+
+	// the old version keeps its files and can't be changed
+	old := srv.Get(id)
+	if gjson.GetBytes(old, "research_dataset.files.0.identifier").String() != "file1" {
+		t.Errorf("old version changed: %s", old)
+	}
+	if _, err := api.Store(ctx, changed, testUser); err == nil {
+		t.Error("expected error changing files of old version")
+	}
+}
+
+func TestRpc(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	api := srv.Client()
+	ctx := context.Background()
+
+	created, err := api.Store(ctx, json.RawMessage(testDataset), testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := metax.GetIdentifier(created)
+
+	// non-cumulative datasets can't be closed
+	if _, err := api.ChangeCumulativeState(ctx, id, "2"); err == nil {
+		t.Error("expected error closing non-cumulative dataset")
+	}
+
+	// making a dataset with files cumulative creates a new version
+	cumulativeId, err := api.ChangeCumulativeState(ctx, id, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cumulativeId == "" {
+		t.Fatal("expected new version")
+	}
+
+	// refreshing a cumulative dataset adds the files in place
+	srv.SetDirectory("dir1", "file1", "file3")
+	newId, err := api.RefreshDirectoryContent(ctx, cumulativeId, "dir1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newId != "" {
+		t.Errorf("expected no new version for cumulative dataset, got %s", newId)
+	}
+	if files := srv.Files(cumulativeId); !reflect.DeepEqual(files, []string{"file1", "file3"}) {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	// nothing new to add
+	if newId, err := api.RefreshDirectoryContent(ctx, cumulativeId, "dir1"); err != nil || newId != "" {
+		t.Errorf("expected no changes, got %q, %v", newId, err)
+	}
+
+	// closing is done in place
+	if newId, err := api.ChangeCumulativeState(ctx, cumulativeId, "2"); err != nil || newId != "" {
+		t.Errorf("expected dataset closed in place, got %q, %v", newId, err)
+	}
+
+	// unknown directories are rejected
+	if _, err := api.RefreshDirectoryContent(ctx, cumulativeId, "dir9"); err == nil {
+		t.Error("expected error for unknown directory")
+	}
+}
+
+func TestFixDeprecated(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	api := srv.Client()
+	ctx := context.Background()
+
+	created, err := api.Store(ctx, json.RawMessage(testDataset), testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := metax.GetIdentifier(created)
+
+	if _, err := api.FixDeprecated(ctx, id); err == nil {
+		t.Error("expected error fixing dataset that is not deprecated")
+	}
+
+	if err := srv.Deprecate(id, "file1"); err != nil {
+		t.Fatal(err)
+	}
+	if !metax.IsDeprecated(srv.Get(id)) {
+		t.Fatal("dataset not deprecated")
+	}
+
+	newId, err := api.FixDeprecated(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newVersion, err := api.GetId(ctx, newId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metax.IsDeprecated(newVersion) || gjson.GetBytes(newVersion, "research_dataset.files.#").Int() != 0 {
+		t.Errorf("new version still deprecated or has removed files: %s", newVersion)
+	}
+	if gjson.GetBytes(srv.Get(id), "next_dataset_version.identifier").String() != newId {
+		t.Error("deprecated version not linked to new version")
+	}
+}
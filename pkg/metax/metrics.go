@@ -0,0 +1,44 @@
+package metax
+
+import (
+	"expvar"
+	"sync"
+)
+
+var (
+	// request counters
+	requestsC        expvar.Int
+	retriesC         expvar.Int
+	failuresC        expvar.Int
+	breakerOpenedC   expvar.Int
+	breakerRejectedC expvar.Int
+
+	// current circuit breaker state per service
+	breakerStates   expvar.Map
+	breakerStatesMu sync.Mutex
+
+	// map container
+	metricsMetax = expvar.NewMap("metax")
+)
+
+func init() {
+	metricsMetax.Set("requests", &requestsC)
+	metricsMetax.Set("retries", &retriesC)
+	metricsMetax.Set("failures", &failuresC)
+	metricsMetax.Set("breaker_opened", &breakerOpenedC)
+	metricsMetax.Set("breaker_rejected", &breakerRejectedC)
+	metricsMetax.Set("breaker_state", &breakerStates)
+}
+
+// breakerStateVar returns the expvar holding the circuit breaker state of the service with the given key.
+func breakerStateVar(key string) *expvar.String {
+	breakerStatesMu.Lock()
+	defer breakerStatesMu.Unlock()
+
+	if v, ok := breakerStates.Get(key).(*expvar.String); ok {
+		return v
+	}
+	v := new(expvar.String)
+	breakerStates.Set(key, v)
+	return v
+}
@@ -0,0 +1,607 @@
+package metax
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// This file contains a typed model of Metax catalog records and their research_dataset.
+//
+// All object types keep fields that are not part of the model in their Extra map, so a record survives
+// a round trip through the model without losing data; only the order of keys in objects changes.
+// Numbers and booleans are pointers so zero values are kept. Other fields are omitted when empty; if the record
+// had an empty value such as null, "" or [] for them, Extra remembers it and it is written back unless the field is set.
+
+// LangString is a string in several languages, keyed by language code.
+type LangString map[string]string
+
+// CatalogRecord is a Metax catalog record.
+type CatalogRecord struct {
+	Id                     *int64           `json:"id,omitempty"`
+	Identifier             string           `json:"identifier,omitempty"`
+	DataCatalog            *CatalogRef      `json:"data_catalog,omitempty"`
+	MetadataOwnerOrg       string           `json:"metadata_owner_org,omitempty"`
+	MetadataProviderOrg    string           `json:"metadata_provider_org,omitempty"`
+	MetadataProviderUser   string           `json:"metadata_provider_user,omitempty"`
+	PreservationState      *int             `json:"preservation_state,omitempty"`
+	CumulativeState        *int             `json:"cumulative_state,omitempty"`
+	State                  string           `json:"state,omitempty"`
+	Removed                *bool            `json:"removed,omitempty"`
+	Deprecated             *bool            `json:"deprecated,omitempty"`
+	DateCreated            string           `json:"date_created,omitempty"`
+	DateModified           string           `json:"date_modified,omitempty"`
+	Editor                 *Editor          `json:"editor,omitempty"`
+	NextDatasetVersion     *VersionRef      `json:"next_dataset_version,omitempty"`
+	PreviousDatasetVersion *VersionRef      `json:"previous_dataset_version,omitempty"`
+	DatasetVersionSet      []*VersionRef    `json:"dataset_version_set,omitempty"`
+	ResearchDataset        *ResearchDataset `json:"research_dataset,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// CatalogRef refers to a data catalog. Metax accepts both the catalog identifier as string and an object;
+// the form found in the record is kept.
+type CatalogRef struct {
+	Id         *int64 `json:"id,omitempty"`
+	Identifier string `json:"identifier,omitempty"`
+
+	// IsString is set if the catalog was given as identifier string.
+	IsString bool                       `json:"-"`
+	Extra    map[string]json.RawMessage `json:"-"`
+}
+
+// VersionRef refers to another version of a dataset.
+type VersionRef struct {
+	Id                  *int64 `json:"id,omitempty"`
+	Identifier          string `json:"identifier,omitempty"`
+	PreferredIdentifier string `json:"preferred_identifier,omitempty"`
+	Removed             *bool  `json:"removed,omitempty"`
+	DateCreated         string `json:"date_created,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// ResearchDataset is the descriptive metadata of a dataset.
+type ResearchDataset struct {
+	Title                     LangString         `json:"title,omitempty"`
+	Description               LangString         `json:"description,omitempty"`
+	Keyword                   []string           `json:"keyword,omitempty"`
+	Theme                     []*Concept         `json:"theme,omitempty"`
+	FieldOfScience            []*Concept         `json:"field_of_science,omitempty"`
+	Language                  []*Language        `json:"language,omitempty"`
+	Issued                    string             `json:"issued,omitempty"`
+	Modified                  string             `json:"modified,omitempty"`
+	VersionNotes              []string           `json:"version_notes,omitempty"`
+	OtherIdentifier           []*OtherIdentifier `json:"other_identifier,omitempty"`
+	PreferredIdentifier       string             `json:"preferred_identifier,omitempty"`
+	MetadataVersionIdentifier string             `json:"metadata_version_identifier,omitempty"`
+
+	Creator      []*Actor `json:"creator,omitempty"`
+	Publisher    *Actor   `json:"publisher,omitempty"`
+	Curator      []*Actor `json:"curator,omitempty"`
+	RightsHolder []*Actor `json:"rights_holder,omitempty"`
+	Contributor  []*Actor `json:"contributor,omitempty"`
+
+	IsOutputOf     []*Project `json:"is_output_of,omitempty"`
+	Infrastructure []*Concept `json:"infrastructure,omitempty"`
+
+	AccessRights *AccessRights `json:"access_rights,omitempty"`
+
+	Files              []*DatasetFile      `json:"files,omitempty"`
+	Directories        []*DatasetDirectory `json:"directories,omitempty"`
+	RemoteResources    []*RemoteResource   `json:"remote_resources,omitempty"`
+	TotalFilesByteSize *int64              `json:"total_files_byte_size,omitempty"`
+	TotalIdaByteSize   *int64              `json:"total_ida_byte_size,omitempty"`
+
+	Temporal []*Temporal `json:"temporal,omitempty"`
+	Spatial  []*Spatial  `json:"spatial,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// Concept is a reference data entry.
+type Concept struct {
+	Identifier string     `json:"identifier,omitempty"`
+	PrefLabel  LangString `json:"pref_label,omitempty"`
+	Definition LangString `json:"definition,omitempty"`
+	InScheme   string     `json:"in_scheme,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// Language is a language reference; unlike other reference data it has a title instead of a pref_label.
+type Language struct {
+	Identifier string     `json:"identifier,omitempty"`
+	Title      LangString `json:"title,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// OtherIdentifier is an identifier of the dataset in another system.
+type OtherIdentifier struct {
+	Notation string   `json:"notation,omitempty"`
+	Type     *Concept `json:"type,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// Actor types.
+const (
+	ActorPerson       = "Person"
+	ActorOrganization = "Organization"
+)
+
+// Actor is a person or organisation related to the dataset.
+type Actor struct {
+	Type            string     `json:"@type,omitempty"`
+	Identifier      string     `json:"identifier,omitempty"`
+	Name            *ActorName `json:"name,omitempty"`
+	Email           string     `json:"email,omitempty"`
+	Telephone       []string   `json:"telephone,omitempty"`
+	MemberOf        *Actor     `json:"member_of,omitempty"`
+	IsPartOf        *Actor     `json:"is_part_of,omitempty"`
+	ContributorRole []*Concept `json:"contributor_role,omitempty"`
+	ContributorType []*Concept `json:"contributor_type,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// IsPerson returns true if the actor is a person.
+func (actor *Actor) IsPerson() bool {
+	return actor.Type == ActorPerson
+}
+
+// ActorName is the name of an actor: a plain string for persons, a LangString for organisations.
+type ActorName struct {
+	Name string
+	Lang LangString
+}
+
+// String returns the plain name, or the name in English, Finnish or any language, in that order.
+func (name *ActorName) String() string {
+	if name.Lang == nil {
+		return name.Name
+	}
+	for _, lang := range []string{"en", "fi", "und"} {
+		if s := name.Lang[lang]; s != "" {
+			return s
+		}
+	}
+	for _, s := range name.Lang {
+		return s
+	}
+	return ""
+}
+
+// MarshalJSON satisfies the json.Marshaler interface.
+func (name ActorName) MarshalJSON() ([]byte, error) {
+	if name.Lang != nil {
+		return json.Marshal(name.Lang)
+	}
+	return json.Marshal(name.Name)
+}
+
+// UnmarshalJSON satisfies the json.Unmarshaler interface.
+func (name *ActorName) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		return json.Unmarshal(data, &name.Lang)
+	}
+	return json.Unmarshal(data, &name.Name)
+}
+
+// Project is a project the dataset was produced in.
+type Project struct {
+	Identifier         string     `json:"identifier,omitempty"`
+	Name               LangString `json:"name,omitempty"`
+	SourceOrganization []*Actor   `json:"source_organization,omitempty"`
+	HasFundingAgency   []*Actor   `json:"has_funding_agency,omitempty"`
+	FunderType         *Concept   `json:"funder_type,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// AccessRights describe the conditions of access to the dataset.
+type AccessRights struct {
+	AccessType         *Concept   `json:"access_type,omitempty"`
+	RestrictionGrounds []*Concept `json:"restriction_grounds,omitempty"`
+	License            []*License `json:"license,omitempty"`
+	AvailableDate      string     `json:"available,omitempty"`
+	Description        LangString `json:"description,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+
+	// older records have a single restriction_grounds object instead of a list
+	singleRestrictionGrounds bool
+}
+
+// License is either a reference data license with identifier, or a custom license with only an url.
+type License struct {
+	Identifier  string     `json:"identifier,omitempty"`
+	Title       LangString `json:"title,omitempty"`
+	Description LangString `json:"description,omitempty"`
+	License     string     `json:"license,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// DatasetFile is a file in the dataset with its dataset-specific metadata.
+type DatasetFile struct {
+	Identifier  string   `json:"identifier,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	UseCategory *Concept `json:"use_category,omitempty"`
+	FileType    *Concept `json:"file_type,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// DatasetDirectory is a directory in the dataset with its dataset-specific metadata.
+type DatasetDirectory struct {
+	Identifier  string   `json:"identifier,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	UseCategory *Concept `json:"use_category,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// RemoteResource is a file that is not stored in IDA.
+type RemoteResource struct {
+	Identifier  string    `json:"identifier,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	AccessURL   *Document `json:"access_url,omitempty"`
+	DownloadURL *Document `json:"download_url,omitempty"`
+	UseCategory *Concept  `json:"use_category,omitempty"`
+	FileType    *Concept  `json:"file_type,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// Document is a link to a web page or file.
+type Document struct {
+	Identifier  string     `json:"identifier,omitempty"`
+	Title       LangString `json:"title,omitempty"`
+	Description LangString `json:"description,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// Temporal is a period of time the dataset covers.
+type Temporal struct {
+	StartDate string `json:"start_date,omitempty"`
+	EndDate   string `json:"end_date,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// Spatial is an area the dataset covers.
+type Spatial struct {
+	GeographicName   string   `json:"geographic_name,omitempty"`
+	FullAddress      string   `json:"full_address,omitempty"`
+	AltitudeInMeters *float64 `json:"alt,omitempty"`
+	AsWkt            []string `json:"as_wkt,omitempty"`
+	PlaceUri         *Concept `json:"place_uri,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// ParseDataset parses a Metax catalog record into the typed model.
+func ParseDataset(blob []byte) (*CatalogRecord, error) {
+	dataset := new(CatalogRecord)
+	if err := json.Unmarshal(blob, dataset); err != nil {
+		return nil, err
+	}
+	return dataset, nil
+}
+
+// Typed parses the dataset JSON into the typed model.
+func (dataset *MetaxDataset) Typed() (*CatalogRecord, error) {
+	return ParseDataset(dataset.Blob())
+}
+
+// knownKeys caches the JSON keys of the model types.
+var knownKeys sync.Map
+
+// jsonKeys returns the JSON object keys of a struct type's fields.
+func jsonKeys(t reflect.Type) map[string]bool {
+	if keys, ok := knownKeys.Load(t); ok {
+		return keys.(map[string]bool)
+	}
+
+	keys := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		keys[name] = true
+	}
+	knownKeys.Store(t, keys)
+	return keys
+}
+
+// unmarshalWithExtra decodes an object into v, a pointer to a struct without custom unmarshaler,
+// and puts the keys that are not struct fields in extra.
+func unmarshalWithExtra(data []byte, v interface{}, extra *map[string]json.RawMessage) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	known := jsonKeys(reflect.TypeOf(v).Elem())
+	for key, val := range all {
+		if known[key] && !isEmptyJSON(val) {
+			delete(all, key)
+		}
+	}
+
+	*extra = nil
+	if len(all) > 0 {
+		*extra = all
+	}
+	return nil
+}
+
+// isEmptyJSON checks if a JSON value is null, an empty string, an empty array or an empty object.
+func isEmptyJSON(val json.RawMessage) bool {
+	switch strings.TrimSpace(string(val)) {
+	case "null", `""`:
+		return true
+	}
+	var container []json.RawMessage
+	if err := json.Unmarshal(val, &container); err == nil {
+		return len(container) == 0
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(val, &object); err == nil {
+		return len(object) == 0
+	}
+	return false
+}
+
+// marshalWithExtra encodes v, a struct without custom marshaler, and adds the keys in extra to the object.
+func marshalWithExtra(v interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for key, val := range extra {
+		if _, exists := all[key]; !exists {
+			all[key] = val
+		}
+	}
+	return json.Marshal(all)
+}
+
+// The methods below route the model types through unmarshalWithExtra and marshalWithExtra;
+// the local plain types have the same fields but no methods, avoiding recursion.
+
+func (v *CatalogRecord) UnmarshalJSON(data []byte) error {
+	type plain CatalogRecord
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v CatalogRecord) MarshalJSON() ([]byte, error) {
+	type plain CatalogRecord
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *CatalogRef) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*v = CatalogRef{IsString: true}
+		return json.Unmarshal(data, &v.Identifier)
+	}
+	type plain CatalogRef
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v CatalogRef) MarshalJSON() ([]byte, error) {
+	if v.IsString {
+		return json.Marshal(v.Identifier)
+	}
+	type plain CatalogRef
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *VersionRef) UnmarshalJSON(data []byte) error {
+	type plain VersionRef
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v VersionRef) MarshalJSON() ([]byte, error) {
+	type plain VersionRef
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *ResearchDataset) UnmarshalJSON(data []byte) error {
+	type plain ResearchDataset
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v ResearchDataset) MarshalJSON() ([]byte, error) {
+	type plain ResearchDataset
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *Concept) UnmarshalJSON(data []byte) error {
+	type plain Concept
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v Concept) MarshalJSON() ([]byte, error) {
+	type plain Concept
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *Language) UnmarshalJSON(data []byte) error {
+	type plain Language
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v Language) MarshalJSON() ([]byte, error) {
+	type plain Language
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *OtherIdentifier) UnmarshalJSON(data []byte) error {
+	type plain OtherIdentifier
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v OtherIdentifier) MarshalJSON() ([]byte, error) {
+	type plain OtherIdentifier
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *Actor) UnmarshalJSON(data []byte) error {
+	type plain Actor
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v Actor) MarshalJSON() ([]byte, error) {
+	type plain Actor
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *Project) UnmarshalJSON(data []byte) error {
+	type plain Project
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v Project) MarshalJSON() ([]byte, error) {
+	type plain Project
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *AccessRights) UnmarshalJSON(data []byte) error {
+	type plain AccessRights
+	var single struct {
+		RestrictionGrounds json.RawMessage `json:"restriction_grounds"`
+	}
+	if err := json.Unmarshal(data, &single); err != nil {
+		return err
+	}
+	if len(single.RestrictionGrounds) == 0 || single.RestrictionGrounds[0] != '{' {
+		return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	all["restriction_grounds"] = json.RawMessage("[" + string(single.RestrictionGrounds) + "]")
+	if data, err := json.Marshal(all); err != nil {
+		return err
+	} else if err := unmarshalWithExtra(data, (*plain)(v), &v.Extra); err != nil {
+		return err
+	}
+	v.singleRestrictionGrounds = true
+	return nil
+}
+
+func (v AccessRights) MarshalJSON() ([]byte, error) {
+	type plain AccessRights
+	if !v.singleRestrictionGrounds || len(v.RestrictionGrounds) != 1 {
+		return marshalWithExtra(plain(v), v.Extra)
+	}
+
+	grounds := v.RestrictionGrounds[0]
+	v.RestrictionGrounds = nil
+	data, err := marshalWithExtra(plain(v), v.Extra)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	if all["restriction_grounds"], err = json.Marshal(grounds); err != nil {
+		return nil, err
+	}
+	return json.Marshal(all)
+}
+
+func (v *License) UnmarshalJSON(data []byte) error {
+	type plain License
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v License) MarshalJSON() ([]byte, error) {
+	type plain License
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *DatasetFile) UnmarshalJSON(data []byte) error {
+	type plain DatasetFile
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v DatasetFile) MarshalJSON() ([]byte, error) {
+	type plain DatasetFile
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *DatasetDirectory) UnmarshalJSON(data []byte) error {
+	type plain DatasetDirectory
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v DatasetDirectory) MarshalJSON() ([]byte, error) {
+	type plain DatasetDirectory
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *RemoteResource) UnmarshalJSON(data []byte) error {
+	type plain RemoteResource
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v RemoteResource) MarshalJSON() ([]byte, error) {
+	type plain RemoteResource
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *Document) UnmarshalJSON(data []byte) error {
+	type plain Document
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v Document) MarshalJSON() ([]byte, error) {
+	type plain Document
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *Temporal) UnmarshalJSON(data []byte) error {
+	type plain Temporal
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v Temporal) MarshalJSON() ([]byte, error) {
+	type plain Temporal
+	return marshalWithExtra(plain(v), v.Extra)
+}
+
+func (v *Spatial) UnmarshalJSON(data []byte) error {
+	type plain Spatial
+	return unmarshalWithExtra(data, (*plain)(v), &v.Extra)
+}
+
+func (v Spatial) MarshalJSON() ([]byte, error) {
+	type plain Spatial
+	return marshalWithExtra(plain(v), v.Extra)
+}
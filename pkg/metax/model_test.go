@@ -0,0 +1,110 @@
+package metax
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testModelDataset has fields that are not in the model, empty values and both forms of polymorphic fields.
+const testModelDataset = `{
+	"identifier": "abc",
+	"data_catalog": "urn:nbn:fi:att:data-catalog-ida",
+	"preservation_state": 0,
+	"removed": false,
+	"state": "",
+	"next_dataset_version": null,
+	"unknown_top_level": {"nested": [1, 2, 3]},
+	"research_dataset": {
+		"title": {"en": "Title"},
+		"keyword": [],
+		"creator": [
+			{"@type": "Person", "name": "Jane Doe", "orcid": "0000", "member_of": {"@type": "Organization", "name": {"fi": "Yliopisto", "en": "University"}}}
+		],
+		"access_rights": {
+			"access_type": {"identifier": "open", "pref_label": {"en": "Open"}, "extra_field": true},
+			"license": [{"license": "http://example.com/license"}]
+		},
+		"temporal": [{"start_date": "2019-01-01T00:00:00Z", "end_date": "2019-12-31T00:00:00Z"}],
+		"spatial": [{"geographic_name": "Espoo", "alt": 0, "as_wkt": ["POINT(24 60)"]}],
+		"provenance": [{"title": {"en": "Collected"}}],
+		"total_files_byte_size": 0
+	}
+}`
+
+// normalise decodes JSON into generic values for comparison.
+func normalise(t *testing.T, data []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestModelRoundTrip(t *testing.T) {
+	blobs := map[string][]byte{
+		"hand-crafted": []byte(testModelDataset),
+		"published":    readTestFile(t, "published.json"),
+		"unpublished":  readTestFile(t, "unpublished.json"),
+	}
+
+	for name, blob := range blobs {
+		t.Run(name, func(t *testing.T) {
+			dataset, err := ParseDataset(blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := json.Marshal(dataset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, got := normalise(t, blob), normalise(t, out); !reflect.DeepEqual(expected, got) {
+				t.Errorf("round trip changed the dataset:\nexpected: %s\ngot: %s", blob, out)
+			}
+		})
+	}
+}
+
+func TestModelFields(t *testing.T) {
+	dataset, err := ParseDataset([]byte(testModelDataset))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !dataset.DataCatalog.IsString || dataset.DataCatalog.Identifier != "urn:nbn:fi:att:data-catalog-ida" {
+		t.Errorf("wrong data catalog: %+v", dataset.DataCatalog)
+	}
+	if dataset.PreservationState == nil || *dataset.PreservationState != 0 {
+		t.Error("preservation state not parsed")
+	}
+	if _, ok := dataset.Extra["unknown_top_level"]; !ok {
+		t.Error("unknown field not kept in extra")
+	}
+
+	rd := dataset.ResearchDataset
+	creator := rd.Creator[0]
+	if !creator.IsPerson() || creator.Name.String() != "Jane Doe" || creator.MemberOf.Name.String() != "University" {
+		t.Errorf("wrong creator: %+v", creator)
+	}
+	if rd.AccessRights.AccessType.Identifier != "open" || rd.AccessRights.License[0].License != "http://example.com/license" {
+		t.Errorf("wrong access rights: %+v", rd.AccessRights)
+	}
+	if rd.Spatial[0].GeographicName != "Espoo" || rd.Temporal[0].EndDate != "2019-12-31T00:00:00Z" {
+		t.Error("coverage not parsed")
+	}
+
+	// changed fields are written instead of remembered empty values
+	rd.Keyword = []string{"new"}
+	dataset.NextDatasetVersion = &VersionRef{Identifier: "def"}
+	out, err := json.Marshal(dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := ParseDataset(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed.ResearchDataset.Keyword) != 1 || changed.NextDatasetVersion == nil || changed.NextDatasetVersion.Identifier != "def" {
+		t.Errorf("changes not written: %s", out)
+	}
+}
@@ -0,0 +1,115 @@
+package metax
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Refdata resolves reference data URIs, e.g. from a local cache of the Metax reference data.
+type Refdata interface {
+	// Lookup returns the label of a reference data entry of the given type and whether the URI exists.
+	// An error means the reference data is not available and the URI can't be checked.
+	Lookup(typ, uri string) (label map[string]string, found bool, err error)
+}
+
+// refdataField describes a research_dataset field holding reference data identifiers.
+type refdataField struct {
+	// path to the reference object, or to an array of them
+	path  string
+	typ   string
+	label string
+}
+
+// refdataFields are the reference data fields checked on save.
+var refdataFields = []refdataField{
+	{path: "research_dataset.language", typ: "language", label: "title"},
+	{path: "research_dataset.field_of_science", typ: "field_of_science", label: "pref_label"},
+	{path: "research_dataset.access_rights.license", typ: "license", label: "title"},
+	{path: "research_dataset.access_rights.access_type", typ: "access_type", label: "pref_label"},
+}
+
+// RefdataError lists reference data identifiers that don't exist, keyed by their path in the dataset.
+type RefdataError struct {
+	Invalid map[string]string
+}
+
+// Error satisfies the Error interface.
+func (e *RefdataError) Error() string {
+	paths := make([]string, 0, len(e.Invalid))
+	for path := range e.Invalid {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return "unknown reference data: " + strings.Join(paths, ", ")
+}
+
+// Payload returns the invalid paths and identifiers as JSON object.
+func (e *RefdataError) Payload() json.RawMessage {
+	payload, _ := json.Marshal(e.Invalid)
+	return payload
+}
+
+// ValidateRefdata checks that the reference data identifiers in the research dataset exist.
+// If fill is true, missing labels are filled in from the reference data.
+// Fields with reference data types that are not available are not checked.
+func (dataset *MetaxDataset) ValidateRefdata(refdata Refdata, fill bool) error {
+	blob := dataset.Blob()
+	invalid := make(map[string]string)
+	filled := false
+
+	for _, field := range refdataFields {
+		value := gjson.GetBytes(blob, field.path)
+		if !value.Exists() {
+			continue
+		}
+
+		var objects []gjson.Result
+		var paths []string
+		if value.IsArray() {
+			for i, obj := range value.Array() {
+				objects = append(objects, obj)
+				paths = append(paths, field.path+"."+strconv.Itoa(i))
+			}
+		} else {
+			objects = append(objects, value)
+			paths = append(paths, field.path)
+		}
+
+		for i, obj := range objects {
+			uri := obj.Get("identifier").String()
+			if uri == "" {
+				// e.g. custom licenses only have an url
+				continue
+			}
+
+			label, found, err := refdata.Lookup(field.typ, uri)
+			if err != nil {
+				break
+			}
+			if !found {
+				invalid[paths[i]+".identifier"] = uri
+				continue
+			}
+
+			if fill && !obj.Get(field.label).Exists() && len(label) > 0 {
+				if blob, err = sjson.SetBytes(blob, paths[i]+"."+field.label, label); err != nil {
+					return err
+				}
+				filled = true
+			}
+		}
+	}
+
+	if len(invalid) > 0 {
+		return &RefdataError{Invalid: invalid}
+	}
+	if filled {
+		return dataset.SetData(dataset.Family(), dataset.Schema(), blob)
+	}
+	return nil
+}
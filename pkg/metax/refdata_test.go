@@ -0,0 +1,106 @@
+package metax
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/CSCfi/qvain-api/pkg/models"
+	"github.com/tidwall/gjson"
+	"github.com/wvh/uuid"
+)
+
+// fakeRefdata has reference data for some types; other types are not available.
+type fakeRefdata map[string]map[string]map[string]string
+
+func (refdata fakeRefdata) Lookup(typ, uri string) (map[string]string, bool, error) {
+	items, ok := refdata[typ]
+	if !ok {
+		return nil, false, errors.New("not loaded")
+	}
+	label, found := items[uri]
+	return label, found, nil
+}
+
+func TestValidateRefdata(t *testing.T) {
+	refdata := fakeRefdata{
+		"language": {
+			"http://lexvo.org/id/iso639-3/fin": {"en": "Finnish", "fi": "suomi"},
+		},
+		"access_type": {
+			"http://uri.suomi.fi/codelist/fairdata/access_type/code/open": {"en": "Open", "fi": "Avoin"},
+		},
+	}
+
+	var tests = []struct {
+		name    string
+		blob    string
+		fill    bool
+		invalid map[string]string
+		labels  map[string]string
+	}{
+		{
+			name: "valid",
+			blob: `{"research_dataset":{"language":[{"identifier":"http://lexvo.org/id/iso639-3/fin"}],
+				"access_rights":{"access_type":{"identifier":"http://uri.suomi.fi/codelist/fairdata/access_type/code/open","pref_label":{"en":"mine"}}}}}`,
+		},
+		{
+			name: "invalid",
+			blob: `{"research_dataset":{"language":[{"identifier":"http://lexvo.org/id/iso639-3/fin"},{"identifier":"http://lexvo.org/id/iso639-3/xxx"}],
+				"access_rights":{"access_type":{"identifier":"open"}}}}`,
+			invalid: map[string]string{
+				"research_dataset.language.1.identifier":                "http://lexvo.org/id/iso639-3/xxx",
+				"research_dataset.access_rights.access_type.identifier": "open",
+			},
+		},
+		{
+			name: "unavailable types are not checked",
+			blob: `{"research_dataset":{"field_of_science":[{"identifier":"nonsense"}],"access_rights":{"license":[{"license":"http://example.com/license"}]}}}`,
+		},
+		{
+			name: "fill labels",
+			blob: `{"research_dataset":{"language":[{"identifier":"http://lexvo.org/id/iso639-3/fin"}],
+				"access_rights":{"access_type":{"identifier":"http://uri.suomi.fi/codelist/fairdata/access_type/code/open","pref_label":{"en":"mine"}}}}}`,
+			fill: true,
+			labels: map[string]string{
+				"research_dataset.language.0.title.fi":                     "suomi",
+				"research_dataset.access_rights.access_type.pref_label.en": "mine",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ds, err := models.NewDataset(uuid.MustNewUUID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ds.SetData(MetaxDatasetFamily, "metax-ida", []byte(test.blob))
+			dataset := &MetaxDataset{ds}
+
+			err = dataset.ValidateRefdata(refdata, test.fill)
+			if test.invalid == nil {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			} else {
+				refdataErr, ok := err.(*RefdataError)
+				if !ok {
+					t.Fatalf("expected RefdataError, got %v", err)
+				}
+				if !reflect.DeepEqual(refdataErr.Invalid, test.invalid) {
+					t.Errorf("expected invalid paths %v, got %v", test.invalid, refdataErr.Invalid)
+				}
+			}
+
+			for path, expected := range test.labels {
+				if label := gjson.GetBytes(dataset.Blob(), path).String(); label != expected {
+					t.Errorf("%s: expected %q, got %q", path, expected, label)
+				}
+			}
+			if !test.fill && gjson.GetBytes(dataset.Blob(), "research_dataset.language.0.title").Exists() {
+				t.Error("label filled in without fill option")
+			}
+		})
+	}
+}
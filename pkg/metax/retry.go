@@ -0,0 +1,153 @@
+package metax
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultMaxAttempts is the default number of tries for idempotent requests.
+	DefaultMaxAttempts = 3
+
+	// DefaultMinBackoff is the wait before the first retry; it doubles for each following retry.
+	DefaultMinBackoff = 200 * time.Millisecond
+
+	// DefaultMaxBackoff caps the wait between retries.
+	DefaultMaxBackoff = 2 * time.Second
+)
+
+// retryPolicy configures retries for idempotent requests.
+type retryPolicy struct {
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+// backoff returns the wait before the given retry (starting at 1), with exponential growth and jitter.
+func (policy retryPolicy) backoff(retry int) time.Duration {
+	wait := policy.minBackoff << uint(retry-1)
+	if wait > policy.maxBackoff || wait <= 0 {
+		wait = policy.maxBackoff
+	}
+	// full jitter in the upper half to avoid synchronised retries
+	half := int64(wait / 2)
+	if half > 0 {
+		wait = time.Duration(half + rand.Int63n(half))
+	}
+	return wait
+}
+
+// isIdempotent returns true for request methods that are safe to retry.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// isRetryable returns true for server side errors worth retrying.
+func isRetryable(status int) bool {
+	return status >= 500
+}
+
+// do sends a request with the given context, retrying idempotent requests on network errors and 5xx responses.
+// It fails fast with ErrCircuitOpen if the circuit breaker is open.
+//
+// Each call gets a request id and is logged with the dataset identifier, if any, the final status and the latency.
+func (api *MetaxService) do(ctx context.Context, req *http.Request, dataset string) (*http.Response, error) {
+	return api.doWith(ctx, api.client, req, dataset)
+}
+
+// doWith is do with the given http client.
+func (api *MetaxService) doWith(ctx context.Context, client *http.Client, req *http.Request, dataset string) (res *http.Response, err error) {
+	reqId := setRequestId(req)
+	start := time.Now()
+	attempt := 1
+	defer func() {
+		var ev *zerolog.Event
+		switch {
+		case err != nil:
+			ev = api.logger.Warn().Err(err)
+		case res.StatusCode >= 500:
+			ev = api.logger.Warn()
+		default:
+			ev = api.logger.Debug()
+		}
+		if res != nil {
+			ev = ev.Int("status", res.StatusCode)
+		}
+		ev.Str("request_id", reqId).
+			Str("method", req.Method).
+			Str("path", req.URL.Path).
+			Str("dataset", dataset).
+			Int("attempts", attempt).
+			Dur("latency", time.Since(start)).
+			Msg("metax request")
+	}()
+
+	if err := api.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	attempts := 1
+	if isIdempotent(req.Method) && api.retry.maxAttempts > 1 {
+		attempts = api.retry.maxAttempts
+	}
+
+	req = req.WithContext(ctx)
+
+	for ; ; attempt++ {
+		requestsC.Add(1)
+		res, err = client.Do(req)
+
+		failed := err != nil || isRetryable(res.StatusCode)
+		if !failed {
+			api.breaker.Success()
+			return res, nil
+		}
+		failuresC.Add(1)
+
+		// don't retry if the caller gave up or we're out of attempts
+		if ctx.Err() != nil || attempt >= attempts {
+			break
+		}
+		if req.Body != nil {
+			if req.GetBody == nil {
+				break
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				break
+			}
+			req.Body = body
+		}
+		if res != nil {
+			api.drainBody(res.Body)
+			res.Body.Close()
+		}
+
+		wait := api.retry.backoff(attempt)
+		api.logger.Debug().Str("request_id", reqId).Str("dataset", dataset).Dur("wait", wait).Int("attempt", attempt+1).Msg("metax request retry")
+		retriesC.Add(1)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			api.breaker.Cancel()
+			return nil, ctx.Err()
+		}
+	}
+
+	// a cancelled request says nothing about the health of the API, but must resolve a trial request
+	if ctx.Err() == nil {
+		api.breaker.Failure()
+	} else {
+		api.breaker.Cancel()
+	}
+	return res, err
+}
@@ -0,0 +1,243 @@
+package metax
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CSCfi/qvain-api/pkg/models"
+)
+
+// newTestService returns a Metax client for a test server with fast retries.
+func newTestService(srv *httptest.Server, params ...MetaxOption) *MetaxService {
+	params = append([]MetaxOption{DisableHttps, WithRetry(3, time.Millisecond, 5*time.Millisecond)}, params...)
+	return NewMetaxService(strings.TrimPrefix(srv.URL, "http://"), params...)
+}
+
+// flakyHandler fails the first n requests with the given status, then returns a dataset.
+func flakyHandler(n int32, status int, calls *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt32(calls, 1)
+		if r.Body != nil {
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Method == http.MethodPut && len(body) == 0 {
+				http.Error(w, "empty body", http.StatusBadRequest)
+				return
+			}
+		}
+		if call <= n {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"identifier":"abc"}`))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var tests = []struct {
+		name     string
+		failures int32
+		status   int
+		call     func(*MetaxService) error
+		calls    int32
+		wantErr  bool
+	}{
+		{
+			name:     "get recovers",
+			failures: 2,
+			status:   http.StatusServiceUnavailable,
+			call: func(api *MetaxService) error {
+				_, err := api.GetId(context.Background(), "abc")
+				return err
+			},
+			calls: 3,
+		},
+		{
+			name:     "get gives up",
+			failures: 5,
+			status:   http.StatusBadGateway,
+			call: func(api *MetaxService) error {
+				_, err := api.GetId(context.Background(), "abc")
+				return err
+			},
+			calls:   3,
+			wantErr: true,
+		},
+		{
+			name:     "no retry on client error",
+			failures: 5,
+			status:   http.StatusNotFound,
+			call: func(api *MetaxService) error {
+				_, err := api.GetId(context.Background(), "abc")
+				return err
+			},
+			calls:   1,
+			wantErr: true,
+		},
+		{
+			name:     "put resends body",
+			failures: 1,
+			status:   http.StatusInternalServerError,
+			call: func(api *MetaxService) error {
+				_, err := api.Store(context.Background(), json.RawMessage(`{"identifier":"abc"}`), &models.User{})
+				return err
+			},
+			calls: 2,
+		},
+		{
+			name:     "no retry for post",
+			failures: 1,
+			status:   http.StatusInternalServerError,
+			call: func(api *MetaxService) error {
+				_, err := api.Store(context.Background(), json.RawMessage(`{"title":"new"}`), &models.User{})
+				return err
+			},
+			calls:   1,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int32
+			srv := httptest.NewServer(flakyHandler(test.failures, test.status, &calls))
+			defer srv.Close()
+
+			err := test.call(newTestService(srv))
+			if (err != nil) != test.wantErr {
+				t.Errorf("expected error: %v, got: %v", test.wantErr, err)
+			}
+			if calls != test.calls {
+				t.Errorf("expected %d calls, got %d", test.calls, calls)
+			}
+		})
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(flakyHandler(100, http.StatusServiceUnavailable, &calls))
+	defer srv.Close()
+
+	api := newTestService(srv, WithRetry(100, time.Second, time.Second), WithCircuitBreaker(1, time.Minute))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := api.GetId(ctx, "abc"); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("retry did not stop when the context expired")
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+	// giving up during the backoff is the caller's decision, not an API failure
+	if api.breaker.State() != breakerClosed {
+		t.Errorf("expected breaker to stay closed, got %s", api.breaker.State())
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(flakyHandler(4, http.StatusInternalServerError, &calls))
+	defer srv.Close()
+
+	api := newTestService(srv, WithRetry(1, 0, 0), WithCircuitBreaker(2, time.Minute))
+	now := time.Now()
+	api.breaker.now = func() time.Time { return now }
+
+	get := func() error {
+		_, err := api.GetId(context.Background(), "abc")
+		return err
+	}
+
+	// two failures open the breaker
+	get()
+	get()
+	if api.breaker.State() != breakerOpen {
+		t.Fatalf("expected breaker to be open, got %s", api.breaker.State())
+	}
+	if state := breakerStateVar(api.metricsKey()).Value(); state != "open" {
+		t.Errorf("expected expvar state open, got %s", state)
+	}
+
+	// fail fast without calling the API
+	if err := get(); err != ErrCircuitOpen {
+		t.Errorf("expected %v, got %v", ErrCircuitOpen, err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+
+	// after the cooldown a failed trial request opens the breaker again
+	now = now.Add(2 * time.Minute)
+	get()
+	if api.breaker.State() != breakerOpen {
+		t.Fatalf("expected breaker to be open after failed trial, got %s", api.breaker.State())
+	}
+
+	// a cancelled trial request doesn't leave the breaker half-open
+	now = now.Add(2 * time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	api.GetId(ctx, "abc")
+	if api.breaker.State() != breakerOpen {
+		t.Fatalf("expected breaker to be open after cancelled trial, got %s", api.breaker.State())
+	}
+
+	// ... and a successful one closes it
+	atomic.StoreInt32(&calls, 4)
+	if err := get(); err != nil {
+		t.Errorf("expected trial request to succeed, got %v", err)
+	}
+	if api.breaker.State() != breakerClosed {
+		t.Errorf("expected breaker to be closed, got %s", api.breaker.State())
+	}
+}
+
+func TestCircuitBreakerMetrics(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(flakyHandler(100, http.StatusInternalServerError, &calls))
+	defer srv.Close()
+
+	failing := newTestService(srv, WithName("failing"), WithRetry(1, 0, 0), WithCircuitBreaker(1, time.Minute))
+	idle := newTestService(srv, WithName("idle"), WithRetry(1, 0, 0), WithCircuitBreaker(1, time.Minute))
+
+	failing.GetId(context.Background(), "abc")
+
+	if state := breakerStateVar(failing.metricsKey()).Value(); state != "open" {
+		t.Errorf("expected state of failing client to be open, got %s", state)
+	}
+	if state := breakerStateVar(idle.metricsKey()).Value(); state != "closed" {
+		t.Errorf("expected state of idle client to be closed, got %s", state)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 5, minBackoff: 100 * time.Millisecond, maxBackoff: 300 * time.Millisecond}
+
+	var tests = []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 150 * time.Millisecond, 300 * time.Millisecond},
+		{10, 150 * time.Millisecond, 300 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if wait := policy.backoff(test.retry); wait < test.min || wait > test.max {
+			t.Errorf("retry %d: expected backoff in [%v, %v], got %v", test.retry, test.min, test.max, wait)
+		}
+	}
+}
@@ -36,8 +36,17 @@ var (
 
 	// DateRemovedKey is the key for the Metax dataset removal timestamp.
 	DateRemovedKey = "date_removed"
+
+	// DeprecatedKey is the key for the flag set by Metax when files of the dataset have been removed.
+	DeprecatedKey = "deprecated"
+
+	// StateKey is the key for the Metax API v2 dataset state, either "draft" or "published".
+	StateKey = "state"
 )
 
+// StateDraft is the state of Metax API v2 draft datasets.
+const StateDraft = "draft"
+
 func GetIdentifier(blob []byte) string {
 	if len(blob) < 1 {
 		return ""
@@ -68,7 +77,26 @@ func IsPublished(blob []byte) bool {
 		return false
 	}
 
-	return gjson.GetBytes(blob, IdentifierKey).Exists()
+	results := gjson.GetManyBytes(blob, IdentifierKey, StateKey)
+	return results[0].Exists() && results[1].String() != StateDraft
+}
+
+// IsDeprecated returns a boolean indicating whether Metax has marked the dataset deprecated.
+func IsDeprecated(blob []byte) bool {
+	if len(blob) < 1 {
+		return false
+	}
+
+	return gjson.GetBytes(blob, DeprecatedKey).Bool()
+}
+
+// IsDraft returns a boolean indicating whether the dataset is a Metax draft; drafts have an identifier but are not published.
+func IsDraft(blob []byte) bool {
+	if len(blob) < 1 {
+		return false
+	}
+
+	return gjson.GetBytes(blob, StateKey).String() == StateDraft
 }
 
 // CreatedNewVersion returns a boolean indicating whether the new version created key exists.
@@ -111,6 +111,28 @@ func TestGetIdentifier(t *testing.T) {
 	}
 }
 
+func TestIsDraft(t *testing.T) {
+	tests := []struct {
+		blob      string
+		draft     bool
+		published bool
+	}{
+		{blob: `{}`, draft: false, published: false},
+		{blob: `{"identifier":"cr1"}`, draft: false, published: true},
+		{blob: `{"identifier":"cr1","state":"published"}`, draft: false, published: true},
+		{blob: `{"identifier":"cr1","state":"draft"}`, draft: true, published: false},
+	}
+
+	for _, test := range tests {
+		if IsDraft([]byte(test.blob)) != test.draft {
+			t.Errorf("IsDraft(%s): expected %v", test.blob, test.draft)
+		}
+		if IsPublished([]byte(test.blob)) != test.published {
+			t.Errorf("IsPublished(%s): expected %v", test.blob, test.published)
+		}
+	}
+}
+
 func TestEditor(t *testing.T) {
 	tests := []struct {
 		fn            string
@@ -0,0 +1,19 @@
+-- Seed data for Qvain development databases
+--
+-- Apply with `qvain-cli migrate seed` after the schema migrations.
+-- Don't use this in production.
+
+-- Predefined users for testing purposes.
+--
+-- It is safe both to include or exclude this;
+-- it just makes sure certain users will have a specific UID.
+--
+-- On conflict, one can also choose to merge JSON keys:
+--   ON CONFLICT (uid) DO UPDATE SET extids = identities.extids || excluded.extids;
+INSERT INTO identities(uid, extids) VALUES
+    ('053bffbcc41edad4853bea91fc42ea18', '{"fairdata":"2c3683230a580e286c5f5c4b4263f3b80e35f6d1@fairdataid"}'), -- wvh
+    ('053d18ecb29e752cb7a35cd77b34f5fd', '{}'), -- epk
+    ('05593961536b76fa825281ccaedd4d4f', '{}'), -- am
+    ('055ea4dade5ab2145954f56d4b51cef0', '{}'), -- hk
+    ('055ea531a6cac569425bed94459266ee', '{}') -- jml
+ON CONFLICT DO NOTHING;